@@ -0,0 +1,198 @@
+package bricks
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// ErrorCode declares an error code and how the errors coded with it (using ErrorWithCode) behave and are carried
+// over the wire. Standard codes (ErrCode* constants) are registered by default and domain packages can register their
+// custom ones using RegisterErrorCode.
+type ErrorCode struct {
+	Code       int
+	Name       string // snake_case identifier, e.g. "insufficient_funds"
+	Parent     int    // Code of the category which a custom code belongs to, e.g. ErrCodeFailedPrecondition
+	HttpStatus int    // Defaults to the parent's
+	GrpcCode   int    // Defaults to the parent's. Standard codes are equal to their gRPC counterparts.
+	Retryable  bool   // Custom codes belonging to a retryable parent are retryable regardless
+
+	sentinel error // Standard error of the code, e.g. ErrNotFound for ErrCodeNotFound
+}
+
+// Codes below ErrCodeCustomMin are reserved for the toolbox. Those of them declared here are registered by the
+// toolbox modules (e.g. handywares) and the others are rejected by RegisterErrorCode, so custom codes of apps start
+// from ErrCodeCustomMin and don't collide with them.
+const (
+	ErrCodeIdempotencyKeyInUse = 409 // Registered by handywares
+	ErrCodeLimitExceeded       = 429 // Registered by handywares
+	ErrCodeTimedOut            = 504 // Registered by handywares
+
+	ErrCodeCustomMin = 1000
+)
+
+var errorCodes = struct {
+	l sync.RWMutex
+
+	cc    map[int]ErrorCode
+	names map[string]int
+}{
+	cc:    make(map[int]ErrorCode),
+	names: make(map[string]int),
+}
+
+func init() {
+	for _, std := range []struct {
+		code     int
+		name     string
+		status   int
+		sentinel error
+	}{
+		{ErrCodeCanceled, "canceled", http.StatusInternalServerError, ErrCanceled},
+		{ErrCodeUnknown, "unknown", http.StatusInternalServerError, ErrUnknown},
+		{ErrCodeInvalidArgument, "invalid_argument", http.StatusBadRequest, ErrInvalidArgument},
+		{ErrCodeDeadlineExceeded, "deadline_exceeded", http.StatusInternalServerError, ErrDeadlineExceeded},
+		{ErrCodeNotFound, "not_found", http.StatusNotFound, ErrNotFound},
+		{ErrCodeAlreadyExists, "already_exists", http.StatusConflict, ErrAlreadyExists},
+		{ErrCodePermissionDenied, "permission_denied", http.StatusForbidden, ErrPermissionDenied},
+		{ErrCodeResourceExhausted, "resource_exhausted", http.StatusInternalServerError, ErrResourceExhausted},
+		{ErrCodeFailedPrecondition, "failed_precondition", http.StatusPreconditionFailed, ErrFailedPrecondition},
+		{ErrCodeAborted, "aborted", http.StatusInternalServerError, ErrAborted},
+		{ErrCodeOutOfRange, "out_of_range", http.StatusRequestedRangeNotSatisfiable, ErrOutOfRange},
+		{ErrCodeUnimplemented, "unimplemented", http.StatusNotImplemented, ErrUnimplemented},
+		{ErrCodeInternal, "internal", http.StatusInternalServerError, ErrInternal},
+		{ErrCodeUnavailable, "unavailable", http.StatusServiceUnavailable, ErrUnavailable},
+		{ErrCodeDataLoss, "data_loss", http.StatusInternalServerError, ErrDataLoss},
+		{ErrCodeUnauthenticated, "unauthenticated", http.StatusUnauthorized, ErrUnauthenticated},
+	} {
+		errorCodes.cc[std.code] = ErrorCode{
+			Code:       std.code,
+			Name:       std.name,
+			HttpStatus: std.status,
+			GrpcCode:   std.code,
+			Retryable:  errors.Is(std.sentinel, ErrRetryable),
+			sentinel:   std.sentinel,
+		}
+		errorCodes.names[std.name] = std.code
+	}
+}
+
+// RegisterErrorCode registers a custom error code (see ErrCodeCustomMin) under its parent. Errors coded with it using
+// ErrorWithCode match (errors.Is) the standard error of the closest standard ancestor (e.g. ErrFailedPrecondition)
+// and its classifiers (ErrCustomerSide/ErrSupplierSide), and also ErrRetryable if the code is retryable.
+func RegisterErrorCode(ec ErrorCode) error {
+	if ec.Code <= 0 || len(ec.Name) == 0 {
+		return errors.Join(ErrInvalidArgument, errors.New("error code must be positive and named"))
+	}
+
+	switch {
+	case ec.Code >= ErrCodeCustomMin:
+	case ec.Code == ErrCodeIdempotencyKeyInUse, ec.Code == ErrCodeLimitExceeded, ec.Code == ErrCodeTimedOut:
+	default:
+		return errors.Join(ErrInvalidArgument, fmt.Errorf("error code `%d` is reserved", ec.Code))
+	}
+
+	errorCodes.l.Lock()
+	defer errorCodes.l.Unlock()
+
+	if _, ok := errorCodes.cc[ec.Code]; ok {
+		return errors.Join(fmt.Errorf("error code `%d` has been already registered", ec.Code), ErrAlreadyExists)
+	}
+
+	if _, ok := errorCodes.names[ec.Name]; ok {
+		return errors.Join(fmt.Errorf("error code `%s` has been already registered", ec.Name), ErrAlreadyExists)
+	}
+
+	parent, ok := errorCodes.cc[ec.Parent]
+	if !ok {
+		return errors.Join(fmt.Errorf("parent error code `%d` not found", ec.Parent), ErrInvalidArgument)
+	}
+
+	if ec.HttpStatus == 0 {
+		ec.HttpStatus = parent.HttpStatus
+	}
+	if ec.GrpcCode == 0 {
+		ec.GrpcCode = parent.GrpcCode
+	}
+	ec.Retryable = ec.Retryable || parent.Retryable
+	ec.sentinel = nil
+
+	errorCodes.cc[ec.Code] = ec
+	errorCodes.names[ec.Name] = ec.Code
+
+	return nil
+}
+
+// MustRegisterErrorCode registers the error code using RegisterErrorCode and returns its Code. It panics on failure
+// which makes it suitable to declare custom codes as package variables.
+func MustRegisterErrorCode(ec ErrorCode) int {
+	if err := RegisterErrorCode(ec); err != nil {
+		panic(err)
+	}
+
+	return ec.Code
+}
+
+// LookupErrorCode returns the registered error code
+func LookupErrorCode(code int) (ErrorCode, bool) {
+	errorCodes.l.RLock()
+	defer errorCodes.l.RUnlock()
+
+	ec, ok := errorCodes.cc[code]
+
+	return ec, ok
+}
+
+// LookupErrorCodeByName returns the registered error code which has the name
+func LookupErrorCodeByName(name string) (ErrorCode, bool) {
+	errorCodes.l.RLock()
+	code, ok := errorCodes.names[name]
+	errorCodes.l.RUnlock()
+	if !ok {
+		return ErrorCode{}, false
+	}
+
+	return LookupErrorCode(code)
+}
+
+// ErrorCodeOf returns the registered error code of the first Coded error in the err tree
+func ErrorCodeOf(err error) (ErrorCode, bool) {
+	var coded Coded
+	if !errors.As(err, &coded) {
+		return ErrorCode{}, false
+	}
+
+	return LookupErrorCode(coded.Code())
+}
+
+// ErrorCodes returns all the registered error codes ordered by code
+func ErrorCodes() []ErrorCode {
+	errorCodes.l.RLock()
+	defer errorCodes.l.RUnlock()
+
+	return slices.SortedFunc(maps.Values(errorCodes.cc), func(a, b ErrorCode) int {
+		return a.Code - b.Code
+	})
+}
+
+// is reports whether errors coded with a custom code match the target
+func (ec ErrorCode) is(target error) bool {
+	if ec.Parent == 0 {
+		return false
+	}
+
+	if target == ErrRetryable {
+		return ec.Retryable
+	}
+
+	for p, ok := LookupErrorCode(ec.Parent); ok; p, ok = LookupErrorCode(p.Parent) {
+		if p.sentinel != nil {
+			return target == p.sentinel || errors.Is(p.sentinel, target)
+		}
+	}
+
+	return false
+}
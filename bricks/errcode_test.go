@@ -0,0 +1,87 @@
+package bricks_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/bricks"
+)
+
+var (
+	errCodeInsufficientFunds = bricks.MustRegisterErrorCode(bricks.ErrorCode{
+		Code:       1001,
+		Name:       "insufficient_funds",
+		Parent:     bricks.ErrCodeFailedPrecondition,
+		HttpStatus: http.StatusPaymentRequired,
+	})
+	errCodeLedgerLocked = bricks.MustRegisterErrorCode(bricks.ErrorCode{
+		Code:      1002,
+		Name:      "ledger_locked",
+		Parent:    errCodeInsufficientFunds,
+		Retryable: true,
+	})
+
+	errInsufficientFunds = bricks.ErrorWithCode(errCodeInsufficientFunds, errors.New("insufficient funds"))
+)
+
+func TestRegisterErrorCode(t *testing.T) {
+	ec, ok := bricks.LookupErrorCode(bricks.ErrCodeUnavailable)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, ec.HttpStatus)
+	assert.True(t, ec.Retryable)
+
+	// Standard codes without a dedicated status are responded by 500 as they were before the registry
+	for _, code := range []int{
+		bricks.ErrCodeCanceled, bricks.ErrCodeDeadlineExceeded, bricks.ErrCodeResourceExhausted, bricks.ErrCodeAborted,
+	} {
+		ec, ok = bricks.LookupErrorCode(code)
+		require.True(t, ok)
+		assert.Equal(t, http.StatusInternalServerError, ec.HttpStatus, ec.Name)
+	}
+
+	ec, ok = bricks.LookupErrorCodeByName("insufficient_funds")
+	require.True(t, ok)
+	assert.Equal(t, http.StatusPaymentRequired, ec.HttpStatus)
+	assert.Equal(t, bricks.ErrCodeFailedPrecondition, ec.GrpcCode)
+	assert.False(t, ec.Retryable)
+
+	ec, ok = bricks.ErrorCodeOf(errors.Join(errors.New("ledger #1"),
+		bricks.ErrorWithCode(errCodeLedgerLocked, errors.New("ledger is locked"))))
+	require.True(t, ok)
+	assert.Equal(t, "ledger_locked", ec.Name)
+	assert.Equal(t, http.StatusPaymentRequired, ec.HttpStatus)
+
+	err := bricks.RegisterErrorCode(bricks.ErrorCode{Code: 1001, Name: "another", Parent: bricks.ErrCodeInternal})
+	require.ErrorIs(t, err, bricks.ErrAlreadyExists)
+	err = bricks.RegisterErrorCode(bricks.ErrorCode{Code: 1003, Name: "insufficient_funds", Parent: 1})
+	require.ErrorIs(t, err, bricks.ErrAlreadyExists)
+	err = bricks.RegisterErrorCode(bricks.ErrorCode{Code: 1003, Name: "orphan", Parent: 999})
+	require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+	err = bricks.RegisterErrorCode(bricks.ErrorCode{Code: 1003, Name: "root"})
+	require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+	err = bricks.RegisterErrorCode(bricks.ErrorCode{Code: 17, Name: "reserved", Parent: bricks.ErrCodeInternal})
+	require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+
+	assert.Len(t, bricks.ErrorCodes(), 18)
+}
+
+func TestErrorWithCustomCode(t *testing.T) {
+	err := errors.Join(errors.New("charging wallet"), errInsufficientFunds)
+	assert.ErrorIs(t, err, errInsufficientFunds)
+	assert.ErrorIs(t, err, bricks.ErrFailedPrecondition)
+	assert.ErrorIs(t, err, bricks.ErrCustomerSide)
+	assert.NotErrorIs(t, err, bricks.ErrSupplierSide)
+	assert.NotErrorIs(t, err, bricks.ErrRetryable)
+	assert.NotErrorIs(t, err, bricks.ErrNotFound)
+
+	err = bricks.ErrorWithCode(errCodeLedgerLocked, errors.New("ledger is locked"))
+	assert.ErrorIs(t, err, bricks.ErrFailedPrecondition)
+	assert.ErrorIs(t, err, bricks.ErrRetryable)
+	assert.NotErrorIs(t, err, errInsufficientFunds)
+
+	assert.NotErrorIs(t, bricks.ErrNotFound, bricks.ErrRetryable)
+}
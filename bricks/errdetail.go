@@ -0,0 +1,122 @@
+package bricks
+
+import (
+	"iter"
+	"time"
+)
+
+// ErrorDetail is a structured, machine-readable detail attachable to errors using ErrorWithDetails.
+// The details are modeled after google.rpc error details to be carried across the wire losslessly.
+type ErrorDetail interface {
+	errorDetail()
+}
+
+// BadRequest describes violations in a client request, e.g. validation failures of fields.
+type BadRequest struct {
+	FieldViolations []FieldViolation
+}
+
+type FieldViolation struct {
+	Field       string // Path to the field, e.g. "items[2].quantity"
+	Description string
+}
+
+// RetryInfo tells the client when it can retry a failed request.
+type RetryInfo struct {
+	RetryDelay time.Duration
+}
+
+// ErrorInfo describes the cause of the error with structured details.
+type ErrorInfo struct {
+	Reason   string // UPPER_SNAKE_CASE identifier of the proximate cause, unique within Domain
+	Domain   string // Logical grouping to which Reason belongs, e.g. service name
+	Metadata map[string]string
+}
+
+// LocalizedMessage is an error message which is safe to return to the user in the Locale.
+type LocalizedMessage struct {
+	Locale  string // BCP 47 locale tag, e.g. "en-US"
+	Message string
+}
+
+func (BadRequest) errorDetail()       {}
+func (RetryInfo) errorDetail()        {}
+func (ErrorInfo) errorDetail()        {}
+func (LocalizedMessage) errorDetail() {}
+
+type detailedError struct {
+	error
+	details []ErrorDetail
+}
+
+// ErrorWithDetails attaches details to the err. The result still matches err using errors.Is and errors.As.
+func ErrorWithDetails(err error, details ...ErrorDetail) error {
+	if err == nil || len(details) == 0 {
+		return err
+	}
+
+	return detailedError{
+		error:   err,
+		details: details,
+	}
+}
+
+func (de detailedError) Unwrap() error {
+	return de.error
+}
+
+// ErrorDetails collects details of the err and all the errors wrapped by it in depth-first order.
+func ErrorDetails(err error) []ErrorDetail {
+	var dd []ErrorDetail
+	for e := range ErrorTree(err) {
+		if de, ok := e.(detailedError); ok {
+			dd = append(dd, de.details...)
+		}
+	}
+
+	return dd
+}
+
+// ErrorDetailOf returns the first detail of type D attached to the err or the errors wrapped by it.
+func ErrorDetailOf[D ErrorDetail](err error) (D, bool) {
+	for _, detail := range ErrorDetails(err) {
+		if d, ok := detail.(D); ok {
+			return d, true
+		}
+	}
+
+	var d D
+
+	return d, false
+}
+
+// ErrorTree iterates over err and all the errors wrapped by it in depth-first order
+func ErrorTree(err error) iter.Seq[error] {
+	return func(yield func(error) bool) {
+		walkErrorTree(err, yield)
+	}
+}
+
+func walkErrorTree(err error, yield func(error) bool) bool {
+	if err == nil {
+		return true
+	}
+
+	if !yield(err) {
+		return false
+	}
+
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return walkErrorTree(e.Unwrap(), yield)
+
+	case interface{ Unwrap() []error }:
+		for _, child := range e.Unwrap() {
+			if !walkErrorTree(child, yield) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
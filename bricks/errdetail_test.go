@@ -0,0 +1,42 @@
+package bricks_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/bricks"
+)
+
+func TestErrorWithDetails(t *testing.T) {
+	assert.NoError(t, bricks.ErrorWithDetails(nil, bricks.RetryInfo{RetryDelay: time.Second}))
+	assert.Equal(t, bricks.ErrNotFound, bricks.ErrorWithDetails(bricks.ErrNotFound))
+	assert.Empty(t, bricks.ErrorDetails(bricks.ErrNotFound))
+
+	br := bricks.BadRequest{FieldViolations: []bricks.FieldViolation{{Field: "name", Description: "is empty"}}}
+	ri := bricks.RetryInfo{RetryDelay: 3 * time.Second}
+	ei := bricks.ErrorInfo{Reason: "STOCK_DEPLETED", Domain: "ordering", Metadata: map[string]string{"sku": "s1"}}
+
+	err := errors.Join(
+		bricks.ErrorWithDetails(bricks.ErrInvalidArgument, br),
+		bricks.ErrorWithDetails(errors.New("inner"), ri, ei),
+	)
+	require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+	require.ErrorIs(t, err, bricks.ErrCustomerSide)
+
+	var coded bricks.Coded
+	require.ErrorAs(t, err, &coded)
+	assert.Equal(t, bricks.ErrCodeInvalidArgument, coded.Code())
+
+	assert.Equal(t, []bricks.ErrorDetail{br, ri, ei}, bricks.ErrorDetails(err))
+
+	v, ok := bricks.ErrorDetailOf[bricks.RetryInfo](err)
+	assert.True(t, ok)
+	assert.Equal(t, ri, v)
+
+	_, ok = bricks.ErrorDetailOf[bricks.LocalizedMessage](err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,135 @@
+package bricks
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff computes the delay before the retry'th retry (starting from 1) given the delay before the previous one
+type Backoff func(retry int, previous time.Duration) time.Duration
+
+// ConstantBackoff waits the same delay before every retry
+func ConstantBackoff(delay time.Duration) Backoff {
+	return func(_ int, _ time.Duration) time.Duration {
+		return delay
+	}
+}
+
+// ExponentialBackoff doubles the delay before every retry starting from base and capped by limit
+func ExponentialBackoff(base, limit time.Duration) Backoff {
+	return func(retry int, _ time.Duration) time.Duration {
+		if retry < 1 {
+			return base
+		}
+
+		if retry > 62 {
+			return limit
+		}
+
+		delay := base << (retry - 1)
+		if delay <= 0 || delay > limit {
+			return limit
+		}
+
+		return delay
+	}
+}
+
+// DecorrelatedJitterBackoff picks the delay randomly between base and three times the previous delay, capped by
+// limit. Randomness spreads retries of concurrent callers to avoid them hitting the recovering service all at once.
+func DecorrelatedJitterBackoff(base, limit time.Duration) Backoff {
+	return func(_ int, previous time.Duration) time.Duration {
+		upper := max(previous*3, base)
+		if upper <= base {
+			return min(base, limit)
+		}
+
+		return min(base+rand.N(upper-base), limit)
+	}
+}
+
+// Defaults of RetryPolicy, so the zero policy is bounded
+const (
+	DefaultRetryMaxAttempts = 3
+	DefaultRetryBaseDelay   = 100 * time.Millisecond
+	DefaultRetryMaxDelay    = 5 * time.Second
+)
+
+// RetryPolicy tells Retry when and how often to retry. MaxAttempts defaults to DefaultRetryMaxAttempts if neither it
+// nor MaxElapsed is set, so retries never go on unbounded.
+type RetryPolicy struct {
+	Backoff     Backoff              // Defaults to ExponentialBackoff(DefaultRetryBaseDelay, DefaultRetryMaxDelay)
+	MaxAttempts int                  // Maximum number of attempts including the first one. Zero means unlimited.
+	MaxElapsed  time.Duration        // Budget of all the attempts and delays in between. Zero means unlimited.
+	Retryable   func(err error) bool // Defaults to matching ErrRetryable
+}
+
+// Retry calls fn until it succeeds, fails with a non-retryable error or the policy budget runs out. The delay before
+// each retry is the longer of the policy backoff and the RetryInfo attached to the error. The last error is returned
+// as is, joined with the ctx error if ctx gets done in the meantime.
+func Retry(ctx context.Context, policy RetryPolicy, fn func(ctx context.Context) error) error {
+	if policy.MaxAttempts <= 0 && policy.MaxElapsed <= 0 {
+		policy.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if policy.Backoff == nil {
+		policy.Backoff = ExponentialBackoff(DefaultRetryBaseDelay, DefaultRetryMaxDelay)
+	}
+
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = func(err error) bool {
+			return errors.Is(err, ErrRetryable)
+		}
+	}
+
+	var (
+		start = time.Now()
+		delay time.Duration
+	)
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !retryable(err) {
+			return err
+		}
+
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		delay = policy.Backoff(attempt, delay)
+		if ri, ok := ErrorDetailOf[RetryInfo](err); ok {
+			delay = max(delay, ri.RetryDelay)
+		}
+
+		if policy.MaxElapsed > 0 && time.Since(start)+delay > policy.MaxElapsed {
+			return err
+		}
+
+		if werr := retryWait(ctx, delay); werr != nil {
+			return errors.Join(err, werr)
+		}
+	}
+}
+
+func retryWait(ctx context.Context, delay time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+
+	case <-timer.C:
+		return nil
+	}
+}
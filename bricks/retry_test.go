@@ -0,0 +1,128 @@
+package bricks_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/bricks"
+)
+
+func TestBackoffs(t *testing.T) {
+	exp := bricks.ExponentialBackoff(10*time.Millisecond, time.Second)
+	assert.Equal(t, 10*time.Millisecond, exp(1, 0))
+	assert.Equal(t, 40*time.Millisecond, exp(3, 0))
+	assert.Equal(t, time.Second, exp(10, 0))
+	assert.Equal(t, time.Second, exp(100, 0))
+
+	assert.Equal(t, time.Second, bricks.ConstantBackoff(time.Second)(5, 0))
+
+	djb := bricks.DecorrelatedJitterBackoff(10*time.Millisecond, 100*time.Millisecond)
+	var delay time.Duration
+	for retry := 1; retry <= 20; retry++ {
+		delay = djb(retry, delay)
+		assert.GreaterOrEqual(t, delay, 10*time.Millisecond)
+		assert.LessOrEqual(t, delay, 100*time.Millisecond)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+
+	attempts := 0
+	err := bricks.Retry(ctx, bricks.RetryPolicy{MaxAttempts: 5}, func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return bricks.ErrUnavailable
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = bricks.Retry(ctx, bricks.RetryPolicy{MaxAttempts: 5}, func(ctx context.Context) error {
+		attempts++
+
+		return bricks.ErrNotFound
+	})
+	require.ErrorIs(t, err, bricks.ErrNotFound)
+	assert.Equal(t, 1, attempts)
+
+	attempts = 0
+	err = bricks.Retry(ctx, bricks.RetryPolicy{MaxAttempts: 3}, func(ctx context.Context) error {
+		attempts++
+
+		return bricks.ErrUnavailable
+	})
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = bricks.Retry(ctx, bricks.RetryPolicy{
+		Backoff:    bricks.ConstantBackoff(20 * time.Millisecond),
+		MaxElapsed: 50 * time.Millisecond,
+	}, func(ctx context.Context) error {
+		attempts++
+
+		return bricks.ErrUnavailable
+	})
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = bricks.Retry(ctx, bricks.RetryPolicy{
+		MaxAttempts: 2,
+		Retryable: func(err error) bool {
+			return errors.Is(err, bricks.ErrNotFound)
+		},
+	}, func(ctx context.Context) error {
+		attempts++
+
+		return bricks.ErrNotFound
+	})
+	require.ErrorIs(t, err, bricks.ErrNotFound)
+	assert.Equal(t, 2, attempts)
+
+	// The zero policy is bounded rather than busy-looping forever
+	attempts = 0
+	start := time.Now()
+	err = bricks.Retry(ctx, bricks.RetryPolicy{}, func(ctx context.Context) error {
+		attempts++
+
+		return bricks.ErrUnavailable
+	})
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	assert.Equal(t, bricks.DefaultRetryMaxAttempts, attempts)
+	assert.GreaterOrEqual(t, time.Since(start), bricks.DefaultRetryBaseDelay)
+}
+
+func TestRetryHonorsRetryInfoAndContext(t *testing.T) {
+	attempts := 0
+	start := time.Now()
+	err := bricks.Retry(context.Background(), bricks.RetryPolicy{MaxAttempts: 2}, func(ctx context.Context) error {
+		attempts++
+
+		return bricks.ErrorWithDetails(bricks.ErrResourceExhausted, bricks.RetryInfo{RetryDelay: 30 * time.Millisecond})
+	})
+	require.ErrorIs(t, err, bricks.ErrResourceExhausted)
+	assert.Equal(t, 2, attempts)
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	err = bricks.Retry(ctx,
+		bricks.RetryPolicy{Backoff: bricks.ConstantBackoff(10 * time.Millisecond), MaxElapsed: time.Second},
+		func(ctx context.Context) error {
+			return bricks.ErrUnavailable
+		},
+	)
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
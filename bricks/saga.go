@@ -0,0 +1,327 @@
+package bricks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSagaCompensated is what sagas failed and compensated successfully end with
+	ErrSagaCompensated = errors.Join(ErrAborted, errors.New("saga compensated"))
+	// ErrSagaFailed is what sagas end with if their compensation fails by a non-retryable error
+	ErrSagaFailed = errors.Join(ErrAborted, errors.New("saga compensation failed"))
+	// ErrSagaConflict is what SagaStore.Save fails with if the record is saved by another run of the saga meanwhile
+	ErrSagaConflict = errors.Join(ErrAborted, errors.New("saga is saved concurrently"))
+)
+
+type SagaStatus string
+
+const (
+	SagaRunning      SagaStatus = "running"
+	SagaCompensating SagaStatus = "compensating"
+	SagaCompleted    SagaStatus = "completed"
+	SagaCompensated  SagaStatus = "compensated"
+	SagaFailed       SagaStatus = "failed" // Compensation failed by a non-retryable error and needs intervention
+)
+
+// Finished tells whether the saga with the status has nothing left to run
+func (ss SagaStatus) Finished() bool {
+	return ss == SagaCompleted || ss == SagaCompensated || ss == SagaFailed
+}
+
+// SagaRecord is the persisted progress of a saga instance
+type SagaRecord struct {
+	Id        string     `json:"id"`
+	Saga      string     `json:"saga"`
+	Status    SagaStatus `json:"status"`
+	Step      int        `json:"step"`            // Index of the step to run next or, on compensation, the one after it
+	State     []byte     `json:"state"`           // Json of the state shared by the steps
+	Error     string     `json:"error,omitempty"` // The error which failed the saga
+	Version   int        `json:"version"`         // Incremented by each save to detect concurrent runs
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// SagaStore persists progress of sagas. Create is expected to fail by ErrAlreadyExists if the id is taken and Load by
+// ErrNotFound if it's missing. Save replaces the record only if the stored one is still of the expected version and
+// fails by ErrSagaConflict otherwise, so concurrent runs of a saga instance (e.g. a redelivered task along with the
+// one resumed on startup) can't overwrite the progress of each other.
+type SagaStore interface {
+	Create(ctx context.Context, rec SagaRecord) error
+	Save(ctx context.Context, rec SagaRecord, expectedVersion int) error
+	Load(ctx context.Context, id string) (SagaRecord, error)
+	Unfinished(ctx context.Context, saga string) ([]SagaRecord, error)
+}
+
+// SagaStep is a step of a saga. Action is run in order of the steps and Compensation (if any) undoes it in the
+// reverse order once a following step fails by a non-retryable error. Both may be run more than once (e.g. when the
+// process crashes before their progress is saved) so they're expected to be idempotent.
+//
+// The cause passed to Compensation is rebuilt out of the persisted message of the failure (by errors.New) since the
+// compensation may run in another process, so errors.Is and errors.As don't match the original error on it.
+type SagaStep[T any] struct {
+	Name         string
+	Action       func(ctx context.Context, state *T) error
+	Compensation func(ctx context.Context, state *T, cause error) error
+}
+
+// Saga orchestrates its steps over the state of type T and persists their progress in a SagaStore, so it can be
+// resumed after crashes. Runs failed by retryable errors are left as they are to be run again later, e.g. by Retry,
+// Resume or the task queue driving the saga. The action of the failing step isn't compensated, except by the
+// Compensator attached to its error (see CompensatorAsError).
+type Saga[T any] struct {
+	name  string
+	store SagaStore
+	steps []SagaStep[T]
+}
+
+func NewSaga[T any](name string, store SagaStore, steps ...SagaStep[T]) *Saga[T] {
+	if len(name) == 0 || store == nil || len(steps) == 0 {
+		panic(errors.Join(ErrInvalidArgument, errors.New("empty saga name, store or steps")))
+	}
+
+	for k, step := range steps {
+		if step.Action == nil {
+			panic(errors.Join(ErrInvalidArgument, fmt.Errorf("saga step #%d (%s) has no action", k, step.Name)))
+		}
+	}
+
+	return &Saga[T]{
+		name:  name,
+		store: store,
+		steps: steps,
+	}
+}
+
+func (s *Saga[T]) Name() string {
+	return s.name
+}
+
+// Begin persists a new instance of the saga with the initial state without running it
+func (s *Saga[T]) Begin(ctx context.Context, id string, state T) error {
+	bb, err := json.Marshal(state)
+	if err != nil {
+		return errors.Join(ErrInvalidArgument, err)
+	}
+
+	return s.store.Create(ctx, SagaRecord{
+		Id:        id,
+		Saga:      s.name,
+		Status:    SagaRunning,
+		State:     bb,
+		Version:   1,
+		UpdatedAt: time.Now().UTC(),
+	})
+}
+
+// Start begins a new instance of the saga and runs it in-process
+func (s *Saga[T]) Start(ctx context.Context, id string, state T) (T, error) {
+	if err := s.Begin(ctx, id, state); err != nil {
+		return state, err
+	}
+
+	return s.Run(ctx, id)
+}
+
+// Run advances the saga instance as far as possible and returns its latest state. It returns nil once the saga
+// completes, ErrSagaCompensated (joined with the message of the cause) once it's compensated, the step error if it's
+// retryable and ErrSagaConflict if another run of the instance gets ahead of it.
+func (s *Saga[T]) Run(ctx context.Context, id string) (T, error) {
+	var state T
+
+	rec, err := s.store.Load(ctx, id)
+	if err != nil {
+		return state, err
+	}
+
+	if rec.Saga != s.name {
+		return state, errors.Join(ErrFailedPrecondition, fmt.Errorf("saga %s belongs to %s", id, rec.Saga))
+	}
+
+	if err = json.Unmarshal(rec.State, &state); err != nil {
+		return state, errors.Join(ErrDataLoss, err)
+	}
+
+	if rec.Status == SagaRunning {
+		if err = s.forward(ctx, &rec, &state); err != nil {
+			return state, err
+		}
+	}
+
+	if rec.Status == SagaCompensating {
+		if err = s.backward(ctx, &rec, &state); err != nil {
+			return state, err
+		}
+	}
+
+	switch rec.Status {
+	case SagaCompensated:
+		return state, errors.Join(ErrSagaCompensated, errors.New(rec.Error))
+
+	case SagaFailed:
+		return state, errors.Join(ErrSagaFailed, errors.New(rec.Error))
+
+	default:
+		return state, nil
+	}
+}
+
+func (s *Saga[T]) forward(ctx context.Context, rec *SagaRecord, state *T) error {
+	for rec.Step < len(s.steps) {
+		step := s.steps[rec.Step]
+		if err := step.Action(ctx, state); err != nil {
+			if errors.Is(err, ErrRetryable) {
+				return err
+			}
+
+			var c Compensator
+			if errors.As(err, &c) {
+				err = errors.Join(err, c.Compensate(ctx, err))
+			}
+
+			rec.Status = SagaCompensating
+			rec.Error = fmt.Sprintf("%s: %s", step.Name, err)
+
+			return s.save(ctx, rec, state)
+		}
+
+		rec.Step++
+		if err := s.save(ctx, rec, state); err != nil {
+			return err
+		}
+	}
+
+	rec.Status = SagaCompleted
+
+	return s.save(ctx, rec, state)
+}
+
+func (s *Saga[T]) backward(ctx context.Context, rec *SagaRecord, state *T) error {
+	cause := errors.New(rec.Error)
+	for rec.Step > 0 {
+		step := s.steps[rec.Step-1]
+		if step.Compensation != nil {
+			if err := step.Compensation(ctx, state, cause); err != nil {
+				if errors.Is(err, ErrRetryable) {
+					return err
+				}
+
+				rec.Status = SagaFailed
+				rec.Error = fmt.Sprintf("%s; compensating %s: %s", rec.Error, step.Name, err)
+
+				return s.save(ctx, rec, state)
+			}
+		}
+
+		rec.Step--
+		if err := s.save(ctx, rec, state); err != nil {
+			return err
+		}
+	}
+
+	rec.Status = SagaCompensated
+
+	return s.save(ctx, rec, state)
+}
+
+func (s *Saga[T]) save(ctx context.Context, rec *SagaRecord, state *T) error {
+	bb, err := json.Marshal(state)
+	if err != nil {
+		return errors.Join(ErrInvalidArgument, err)
+	}
+
+	rec.State = bb
+	rec.UpdatedAt = time.Now().UTC()
+	rec.Version++
+
+	return s.store.Save(ctx, *rec, rec.Version-1)
+}
+
+// Resume runs all the unfinished instances of the saga, e.g. on startup after a crash. It returns errors of the runs
+// other than ErrSagaCompensated.
+func (s *Saga[T]) Resume(ctx context.Context) error {
+	records, err := s.store.Unfinished(ctx, s.name)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, rec := range records {
+		if _, err = s.Run(ctx, rec.Id); err != nil && !errors.Is(err, ErrSagaCompensated) {
+			errs = append(errs, fmt.Errorf("saga %s: %w", rec.Id, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// MemorySagaStore is an in-memory SagaStore for single-process deployments and tests
+type MemorySagaStore struct {
+	l sync.RWMutex
+
+	records map[string]SagaRecord
+}
+
+func NewMemorySagaStore() *MemorySagaStore {
+	return &MemorySagaStore{
+		records: make(map[string]SagaRecord),
+	}
+}
+
+func (ms *MemorySagaStore) Create(_ context.Context, rec SagaRecord) error {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+
+	if _, ok := ms.records[rec.Id]; ok {
+		return errors.Join(ErrAlreadyExists, fmt.Errorf("saga %s exists", rec.Id))
+	}
+
+	ms.records[rec.Id] = rec
+
+	return nil
+}
+
+func (ms *MemorySagaStore) Save(_ context.Context, rec SagaRecord, expectedVersion int) error {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+
+	if stored, ok := ms.records[rec.Id]; !ok || stored.Version != expectedVersion {
+		return errors.Join(ErrSagaConflict, fmt.Errorf("saga %s isn't of version %d", rec.Id, expectedVersion))
+	}
+
+	ms.records[rec.Id] = rec
+
+	return nil
+}
+
+func (ms *MemorySagaStore) Load(_ context.Context, id string) (SagaRecord, error) {
+	ms.l.RLock()
+	defer ms.l.RUnlock()
+
+	rec, ok := ms.records[id]
+	if !ok {
+		return SagaRecord{}, ErrNotFound
+	}
+
+	return rec, nil
+}
+
+func (ms *MemorySagaStore) Unfinished(_ context.Context, saga string) ([]SagaRecord, error) {
+	ms.l.RLock()
+	defer ms.l.RUnlock()
+
+	records := slices.Collect(maps.Values(ms.records))
+	records = slices.DeleteFunc(records, func(rec SagaRecord) bool {
+		return rec.Saga != saga || rec.Status.Finished()
+	})
+	slices.SortFunc(records, func(a, b SagaRecord) int {
+		return a.UpdatedAt.Compare(b.UpdatedAt)
+	})
+
+	return records, nil
+}
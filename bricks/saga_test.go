@@ -0,0 +1,211 @@
+package bricks_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/bricks"
+)
+
+type orderSaga struct {
+	Reserved bool   `json:"reserved"`
+	Charged  bool   `json:"charged"`
+	Shipment string `json:"shipment"`
+}
+
+func newOrderSaga(store bricks.SagaStore, ship func(state *orderSaga) error) (*bricks.Saga[orderSaga], *[]string) {
+	var journal []string
+
+	return bricks.NewSaga("order", store,
+		bricks.SagaStep[orderSaga]{
+			Name: "reserve",
+			Action: func(ctx context.Context, state *orderSaga) error {
+				journal = append(journal, "reserve")
+				state.Reserved = true
+
+				return nil
+			},
+			Compensation: func(ctx context.Context, state *orderSaga, cause error) error {
+				journal = append(journal, "release")
+				state.Reserved = false
+
+				return nil
+			},
+		},
+		bricks.SagaStep[orderSaga]{
+			Name: "charge",
+			Action: func(ctx context.Context, state *orderSaga) error {
+				journal = append(journal, "charge")
+				state.Charged = true
+
+				return nil
+			},
+			Compensation: func(ctx context.Context, state *orderSaga, cause error) error {
+				journal = append(journal, "refund")
+				state.Charged = false
+
+				return nil
+			},
+		},
+		bricks.SagaStep[orderSaga]{
+			Name: "ship",
+			Action: func(ctx context.Context, state *orderSaga) error {
+				journal = append(journal, "ship")
+
+				return ship(state)
+			},
+		},
+	), &journal
+}
+
+func TestSagaCompletes(t *testing.T) {
+	ctx := context.Background()
+	store := bricks.NewMemorySagaStore()
+
+	saga, journal := newOrderSaga(store, func(state *orderSaga) error {
+		state.Shipment = "s1"
+
+		return nil
+	})
+
+	state, err := saga.Start(ctx, "o1", orderSaga{})
+	require.NoError(t, err)
+	assert.Equal(t, orderSaga{Reserved: true, Charged: true, Shipment: "s1"}, state)
+	assert.Equal(t, []string{"reserve", "charge", "ship"}, *journal)
+
+	rec, err := store.Load(ctx, "o1")
+	require.NoError(t, err)
+	assert.Equal(t, bricks.SagaCompleted, rec.Status)
+
+	_, err = saga.Start(ctx, "o1", orderSaga{})
+	require.ErrorIs(t, err, bricks.ErrAlreadyExists)
+}
+
+func TestSagaCompensates(t *testing.T) {
+	ctx := context.Background()
+
+	var compensated bool
+	saga, journal := newOrderSaga(bricks.NewMemorySagaStore(), func(state *orderSaga) error {
+		return bricks.CompensatorAsError(bricks.CompensatorFunc(func(ctx context.Context, err error) error {
+			compensated = true
+
+			return nil
+		}), bricks.ErrFailedPrecondition)
+	})
+
+	state, err := saga.Start(ctx, "o1", orderSaga{})
+	require.ErrorIs(t, err, bricks.ErrSagaCompensated)
+	require.NotErrorIs(t, err, bricks.ErrRetryable)
+	assert.Equal(t, orderSaga{}, state)
+	assert.Equal(t, []string{"reserve", "charge", "ship", "refund", "release"}, *journal)
+	assert.True(t, compensated)
+}
+
+func TestSagaResumes(t *testing.T) {
+	ctx := context.Background()
+	store := bricks.NewMemorySagaStore()
+
+	down := true
+	saga, journal := newOrderSaga(store, func(state *orderSaga) error {
+		if down {
+			return bricks.ErrUnavailable
+		}
+
+		state.Shipment = "s1"
+
+		return nil
+	})
+
+	_, err := saga.Start(ctx, "o1", orderSaga{})
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+
+	rec, err := store.Load(ctx, "o1")
+	require.NoError(t, err)
+	assert.Equal(t, bricks.SagaRunning, rec.Status)
+	assert.Equal(t, 2, rec.Step)
+
+	// a fresh instance of the saga (e.g. after restart) picks up where it's left
+	down = false
+	resumed, resumedJournal := newOrderSaga(store, func(state *orderSaga) error {
+		state.Shipment = "s2"
+
+		return nil
+	})
+	require.NoError(t, resumed.Resume(ctx))
+	assert.Equal(t, []string{"reserve", "charge", "ship"}, *journal)
+	assert.Equal(t, []string{"ship"}, *resumedJournal)
+
+	state, err := resumed.Run(ctx, "o1")
+	require.NoError(t, err)
+	assert.Equal(t, orderSaga{Reserved: true, Charged: true, Shipment: "s2"}, state)
+
+	unfinished, err := store.Unfinished(ctx, "order")
+	require.NoError(t, err)
+	assert.Empty(t, unfinished)
+}
+
+func TestSagaFailsOnCompensationFailure(t *testing.T) {
+	ctx := context.Background()
+
+	saga := bricks.NewSaga("transfer", bricks.NewMemorySagaStore(),
+		bricks.SagaStep[int]{
+			Name: "debit",
+			Action: func(ctx context.Context, state *int) error {
+				return nil
+			},
+			Compensation: func(ctx context.Context, state *int, cause error) error {
+				return errors.New("account closed")
+			},
+		},
+		bricks.SagaStep[int]{
+			Name: "credit",
+			Action: func(ctx context.Context, state *int) error {
+				return bricks.ErrNotFound
+			},
+		},
+	)
+
+	_, err := saga.Start(ctx, "t1", 100)
+	require.ErrorIs(t, err, bricks.ErrSagaFailed)
+	assert.ErrorContains(t, err, "compensating debit: account closed")
+}
+
+func TestSagaConflicts(t *testing.T) {
+	ctx := context.Background()
+	store := bricks.NewMemorySagaStore()
+
+	var (
+		saga  *bricks.Saga[int]
+		raced bool
+	)
+	saga = bricks.NewSaga("counter", store,
+		bricks.SagaStep[int]{
+			Name: "increment",
+			Action: func(ctx context.Context, state *int) error {
+				*state++
+
+				// another run of the instance (e.g. a redelivered task) gets ahead meanwhile
+				if !raced {
+					raced = true
+					_, err := saga.Run(ctx, "c1")
+					require.NoError(t, err)
+				}
+
+				return nil
+			},
+		},
+	)
+
+	_, err := saga.Start(ctx, "c1", 0)
+	require.ErrorIs(t, err, bricks.ErrSagaConflict)
+	require.ErrorIs(t, err, bricks.ErrAborted)
+
+	rec, err := store.Load(ctx, "c1")
+	require.NoError(t, err)
+	assert.Equal(t, bricks.SagaCompleted, rec.Status)
+	assert.JSONEq(t, "1", string(rec.State), "progress of the run ahead is kept")
+}
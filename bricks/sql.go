@@ -0,0 +1,11 @@
+package bricks
+
+import "strconv"
+
+// SqlPlaceholder formats the nth (1-based) bind parameter of sql statements
+type SqlPlaceholder func(n int) string
+
+var (
+	QuestionSqlPlaceholder SqlPlaceholder = func(int) string { return "?" }                     // mysql, sqlite
+	DollarSqlPlaceholder   SqlPlaceholder = func(n int) string { return "$" + strconv.Itoa(n) } // postgres
+)
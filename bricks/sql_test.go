@@ -0,0 +1,14 @@
+package bricks_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/janstoon/toolbox/bricks"
+)
+
+func TestSqlPlaceholder(t *testing.T) {
+	assert.Equal(t, "?", bricks.QuestionSqlPlaceholder(2))
+	assert.Equal(t, "$2", bricks.DollarSqlPlaceholder(2))
+}
@@ -90,6 +90,7 @@ type Coded interface {
 	Code() int
 }
 
+// ErrorWithCode codes the err. Errors coded with a custom code (see RegisterErrorCode) also match its category.
 func ErrorWithCode(code int, err error) error {
 	return codedError{
 		error: err,
@@ -110,6 +111,12 @@ func (ce codedError) Unwrap() error {
 	return ce.error
 }
 
+func (ce codedError) Is(target error) bool {
+	ec, ok := LookupErrorCode(ce.code)
+
+	return ok && ec.is(target)
+}
+
 func ParseError(err, unknown error) error {
 	if err == nil {
 		return nil
@@ -1,15 +1,21 @@
 package handywares
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
-	"fmt"
-	"runtime/debug"
 	"strings"
 
 	"github.com/hibiken/asynq"
 	"github.com/janstoon/toolbox/bricks"
 	"github.com/janstoon/toolbox/tricks"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -35,18 +41,21 @@ func AsynqErrorDecoratorMiddleware(options ...ErrorDecoratorAsynqMiddlewareOpt)
 	}
 }
 
-type PanicRecoverAsynqMiddlewareOpt = tricks.MutableOption[any]
+type PanicRecoverAsynqMiddlewareOpt = PanicRecoverOpt
 
+// AsynqPanicRecoverMiddleware converts panics to errors of bricks.ErrInternal. If it's configured to be
+// non-retryable using PanicRecoverRetryable the error skips asynq retries as well.
 func AsynqPanicRecoverMiddleware(options ...PanicRecoverAsynqMiddlewareOpt) tricks.Middleware[asynq.Handler] {
+	pr := newPanicRecoverer(options...)
+
 	return func(next asynq.Handler) asynq.Handler {
-		return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) (err error) {
 			defer func() {
 				if r := recover(); r != nil {
-					span := trace.SpanFromContext(ctx)
-					span.AddEvent("panic recovered", trace.WithAttributes(
-						oaPanicValue.String(fmt.Sprintf("%+v", r)),
-						oaDebugStack.String(string(debug.Stack())),
-					))
+					err = pr.recovered(ctx, r)
+					if !errors.Is(err, bricks.ErrRetryable) {
+						err = errors.Join(asynq.SkipRetry, err)
+					}
 				}
 			}()
 
@@ -82,9 +91,11 @@ func AsynqCompensatorMiddleware(options ...CompensatorAsynqMiddlewareOpt) tricks
 }
 
 type OtelAmw struct {
-	tracer trace.Tracer
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
 
-	namePrefix string
+	namePrefix   string
+	linkProducer bool
 }
 
 type OpenTelemetryAsynqMiddlewareOpt = tricks.Option[OtelAmw]
@@ -97,27 +108,158 @@ func OtelAsynqSpanNamePrefix(prefix string) OpenTelemetryAsynqMiddlewareOpt {
 	})
 }
 
+// OtelAsynqPropagator sets the propagator used to inject trace context into enqueued tasks and extract it from
+// the processing ones. It defaults to otel.GetTextMapPropagator.
+func OtelAsynqPropagator(propagator propagation.TextMapPropagator) OpenTelemetryAsynqMiddlewareOpt {
+	return tricks.ImmutableOption[OtelAmw](func(amw OtelAmw) OtelAmw {
+		amw.propagator = propagator
+
+		return amw
+	})
+}
+
+// OtelAsynqProducerLink makes the processing span a new root which links to the enqueuing span instead of being its
+// child.
+func OtelAsynqProducerLink(link bool) OpenTelemetryAsynqMiddlewareOpt {
+	return tricks.ImmutableOption[OtelAmw](func(amw OtelAmw) OtelAmw {
+		amw.linkProducer = link
+
+		return amw
+	})
+}
+
+// AsynqOpenTelemetryMiddleware starts a consumer span for each task. The span becomes child of the span the task was
+// created in (or links to it with OtelAsynqProducerLink) if the task carries its trace context (see OtelAsynqHeaders),
+// so all attempts of a retried task share the same trace. The task is passed on as it is.
 func AsynqOpenTelemetryMiddleware(
 	tracer trace.Tracer, options ...OpenTelemetryAsynqMiddlewareOpt,
 ) tricks.Middleware[asynq.Handler] {
+	return newOtelAmw(tracer, options...).builder
+}
+
+// AsynqOpenTelemetryEnqueuerMiddleware starts a producer span for each enqueued task. Tasks enqueued by
+// OtelAsynqEnqueue are rebuilt to carry trace context of the span. The others are enqueued as they are, since
+// rebuilding them would drop the options bound to them (e.g. asynq.Queue), so the trace context should be put in
+// the task headers on creation (see NewAsynqTask and OtelAsynqHeaders).
+func AsynqOpenTelemetryEnqueuerMiddleware(
+	tracer trace.Tracer, options ...OpenTelemetryAsynqMiddlewareOpt,
+) tricks.Middleware[AsynqEnqueuer] {
+	return newOtelAmw(tracer, options...).enqueuerBuilder
+}
+
+func newOtelAmw(tracer trace.Tracer, options ...OpenTelemetryAsynqMiddlewareOpt) *OtelAmw {
 	amw := &OtelAmw{
-		tracer: tracer,
+		tracer:     tracer,
+		propagator: otel.GetTextMapPropagator(),
 	}
-	amw = tricks.ApplyOptions(amw, options...)
 
-	return amw.builder
+	return tricks.ApplyOptions(amw, options...)
 }
 
 func (amw OtelAmw) builder(next asynq.Handler) asynq.Handler {
 	return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		ctx, headers := withAsynqHeaders(ctx, task)
+
+		attrs := []attribute.KeyValue{
+			semconv.MessagingSystemKey.String(asynqMessagingSystem),
+			semconv.MessagingOperationTypeDeliver,
+		}
+		if queue, ok := asynq.GetQueueName(ctx); ok {
+			attrs = append(attrs, semconv.MessagingDestinationName(queue))
+		}
+		if id, ok := asynq.GetTaskID(ctx); ok {
+			attrs = append(attrs, semconv.MessagingMessageID(id))
+		}
+		if retried, ok := asynq.GetRetryCount(ctx); ok {
+			attrs = append(attrs, oaAsynqRetryCount.Int(retried))
+		}
+		if maxRetry, ok := asynq.GetMaxRetry(ctx); ok {
+			attrs = append(attrs, oaAsynqRetryMax.Int(maxRetry))
+		}
+
+		oo := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attrs...)}
+		producer := amw.propagator.Extract(ctx, propagation.MapCarrier(headers))
+		if amw.linkProducer {
+			oo = append(oo, trace.WithNewRoot(), trace.WithLinks(trace.LinkFromContext(producer)))
+		} else {
+			ctx = producer
+		}
+
 		var span trace.Span
-		ctx, span = amw.tracer.Start(ctx, amw.spanName(task.Type()), trace.WithSpanKind(trace.SpanKindConsumer))
+		ctx, span = amw.tracer.Start(ctx, amw.spanName(task.Type()), oo...)
 		defer span.End()
 
-		return next.ProcessTask(ctx, task)
+		err := next.ProcessTask(ctx, task)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		return err
 	})
 }
 
+func (amw OtelAmw) enqueuerBuilder(next AsynqEnqueuer) AsynqEnqueuer {
+	return AsynqEnqueuerFunc(
+		func(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+			ctx, span := amw.tracer.Start(ctx, amw.spanName(task.Type()),
+				trace.WithSpanKind(trace.SpanKindProducer),
+				trace.WithAttributes(
+					semconv.MessagingSystemKey.String(asynqMessagingSystem),
+					semconv.MessagingOperationTypePublish,
+				),
+			)
+			defer span.End()
+
+			if e, ok := ctx.Value(asynqEnqueueCtxKey{}).(asynqEnqueue); ok && e.task == task {
+				headers := make(map[string]string)
+				amw.propagator.Inject(ctx, propagation.MapCarrier(headers))
+				task = NewAsynqTask(e.typ, e.payload, headers)
+			}
+
+			info, err := next.EnqueueContext(ctx, task, opts...)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+
+				return info, err
+			}
+
+			span.SetAttributes(semconv.MessagingDestinationName(info.Queue), semconv.MessagingMessageID(info.ID))
+
+			return info, nil
+		},
+	)
+}
+
+// OtelAsynqHeaders returns trace context of ctx as headers of tasks to be created by NewAsynqTask
+func OtelAsynqHeaders(ctx context.Context, options ...OpenTelemetryAsynqMiddlewareOpt) map[string]string {
+	headers := make(map[string]string)
+	newOtelAmw(nil, options...).propagator.Inject(ctx, propagation.MapCarrier(headers))
+
+	return headers
+}
+
+type asynqEnqueueCtxKey struct{}
+
+type asynqEnqueue struct {
+	typ     string
+	payload []byte
+	task    *asynq.Task
+}
+
+// OtelAsynqEnqueue enqueues a task of the type and payload created by NewAsynqTask. If the enqueuer is wrapped by
+// AsynqOpenTelemetryEnqueuerMiddleware the task carries trace context of its producer span, otherwise the one of ctx.
+// The options are passed on to the enqueuer rather than bound to the task, so it can be rebuilt.
+func OtelAsynqEnqueue(
+	ctx context.Context, enqueuer AsynqEnqueuer, typ string, payload []byte, opts ...asynq.Option,
+) (*asynq.TaskInfo, error) {
+	task := NewAsynqTask(typ, payload, OtelAsynqHeaders(ctx))
+	ctx = context.WithValue(ctx, asynqEnqueueCtxKey{}, asynqEnqueue{typ: typ, payload: payload, task: task})
+
+	return enqueuer.EnqueueContext(ctx, task, opts...)
+}
+
 func (amw OtelAmw) spanName(opId string) string {
 	sb := strings.Builder{}
 	if len(strings.TrimSpace(amw.namePrefix)) > 0 {
@@ -129,3 +271,114 @@ func (amw OtelAmw) spanName(opId string) string {
 
 	return sb.String()
 }
+
+const asynqMessagingSystem = "asynq"
+
+// AsynqEnqueuer is the client-side counterpart of asynq.Handler which puts tasks on the queue. *asynq.Client
+// implements it and wrapping it with AsynqEnqueuerMiddlewareStack makes client-side middlewares possible.
+type AsynqEnqueuer interface {
+	EnqueueContext(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error)
+}
+
+type AsynqEnqueuerFunc func(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error)
+
+func (fn AsynqEnqueuerFunc) EnqueueContext(
+	ctx context.Context, task *asynq.Task, opts ...asynq.Option,
+) (*asynq.TaskInfo, error) {
+	return fn(ctx, task, opts...)
+}
+
+type AsynqEnqueuerMiddlewareStack = tricks.MiddlewareStack[AsynqEnqueuer]
+
+// asynqHeadersMagic prefixes payload of the tasks which carry headers along with their original payload.
+// The layout is: magic | uvarint(len(headers)) | json(headers) | payload
+var asynqHeadersMagic = []byte("\x00jst:headers\x00")
+
+// NewAsynqTask creates a task which carries the headers (e.g. trace context by OtelAsynqHeaders) in its payload, since
+// asynq tasks have no metadata of their own. The options are bound to the task as asynq.NewTask does.
+//
+// The payload of the task is framed along with the headers, so its handlers must read it by AsynqTaskPayload (or
+// AsynqTaskHeaders) rather than task.Payload(). Handlers which don't, see the framed payload.
+func NewAsynqTask(typ string, payload []byte, headers map[string]string, opts ...asynq.Option) *asynq.Task {
+	if len(headers) == 0 {
+		return asynq.NewTask(typ, payload, opts...)
+	}
+
+	hh, err := json.Marshal(headers)
+	if err != nil {
+		return asynq.NewTask(typ, payload, opts...)
+	}
+
+	framed := make([]byte, 0, len(asynqHeadersMagic)+binary.MaxVarintLen64+len(hh)+len(payload))
+	framed = append(framed, asynqHeadersMagic...)
+	framed = binary.AppendUvarint(framed, uint64(len(hh)))
+	framed = append(framed, hh...)
+	framed = append(framed, payload...)
+
+	return asynq.NewTask(typ, framed, opts...)
+}
+
+// AsynqTaskHeaders separates headers put by NewAsynqTask from payload of the task. It returns empty headers and the
+// payload as it is if the task carries no headers.
+func AsynqTaskHeaders(task *asynq.Task) (map[string]string, []byte) {
+	headers := make(map[string]string)
+	if task == nil {
+		return headers, nil
+	}
+
+	if !bytes.HasPrefix(task.Payload(), asynqHeadersMagic) {
+		return headers, task.Payload()
+	}
+
+	rest := task.Payload()[len(asynqHeadersMagic):]
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < size {
+		return headers, task.Payload()
+	}
+
+	if err := json.Unmarshal(rest[n:n+int(size)], &headers); err != nil {
+		return make(map[string]string), task.Payload()
+	}
+
+	return headers, rest[n+int(size):]
+}
+
+// AsynqTaskPayload returns payload of the task without the headers put by NewAsynqTask. Handlers should read the
+// payload by it, so the task (along with its asynq.ResultWriter) is passed on by the middlewares as it is.
+func AsynqTaskPayload(ctx context.Context, task *asynq.Task) []byte {
+	_, payload := asynqContextHeaders(ctx, task)
+
+	return payload
+}
+
+type asynqHeadersCtxKey struct{}
+
+type asynqTaskHeaders struct {
+	task    *asynq.Task
+	headers map[string]string
+	payload []byte
+}
+
+// withAsynqHeaders puts headers of the task in the context once, so the middlewares share them rather than parsing
+// the payload over and over
+func withAsynqHeaders(ctx context.Context, task *asynq.Task) (context.Context, map[string]string) {
+	if th, ok := ctx.Value(asynqHeadersCtxKey{}).(asynqTaskHeaders); ok && th.task == task {
+		return ctx, th.headers
+	}
+
+	headers, payload := AsynqTaskHeaders(task)
+
+	return context.WithValue(ctx, asynqHeadersCtxKey{}, asynqTaskHeaders{
+		task:    task,
+		headers: headers,
+		payload: payload,
+	}), headers
+}
+
+func asynqContextHeaders(ctx context.Context, task *asynq.Task) (map[string]string, []byte) {
+	if th, ok := ctx.Value(asynqHeadersCtxKey{}).(asynqTaskHeaders); ok && th.task == task {
+		return th.headers, th.payload
+	}
+
+	return AsynqTaskHeaders(task)
+}
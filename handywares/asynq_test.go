@@ -0,0 +1,139 @@
+package handywares_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+func TestAsynqTaskHeaders(t *testing.T) {
+	task := asynq.NewTask("email:send", []byte(`{"to":"someone"}`))
+
+	hh, payload := handywares.AsynqTaskHeaders(task)
+	assert.Empty(t, hh)
+	assert.Equal(t, task.Payload(), payload)
+
+	wrapped := handywares.NewAsynqTask("email:send", task.Payload(), map[string]string{"k1": "v1"})
+	assert.Equal(t, "email:send", wrapped.Type())
+	assert.NotEqual(t, task.Payload(), wrapped.Payload())
+
+	hh, payload = handywares.AsynqTaskHeaders(wrapped)
+	assert.Equal(t, map[string]string{"k1": "v1"}, hh)
+	assert.Equal(t, task.Payload(), payload)
+	assert.Equal(t, task.Payload(), handywares.AsynqTaskPayload(context.Background(), wrapped))
+}
+
+func TestAsynqTracePropagation(t *testing.T) {
+	tracer := noop.NewTracerProvider().Tracer("")
+	propagator := propagation.TraceContext{}
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01, 0x02, 0x03},
+		SpanID:     trace.SpanID{0x04, 0x05, 0x06},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	var enqueued *asynq.Task
+	var enqueuers handywares.AsynqEnqueuerMiddlewareStack
+	enqueuer := enqueuers.
+		Push(handywares.AsynqOpenTelemetryEnqueuerMiddleware(tracer, handywares.OtelAsynqPropagator(propagator)))(
+		handywares.AsynqEnqueuerFunc(
+			func(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+				enqueued = task
+
+				return client.EnqueueContext(ctx, task, opts...)
+			},
+		),
+	)
+
+	task := handywares.NewAsynqTask("email:send", []byte("payload"),
+		handywares.OtelAsynqHeaders(ctx, handywares.OtelAsynqPropagator(propagator)), asynq.Queue("critical"))
+	info, err := enqueuer.EnqueueContext(ctx, task)
+	require.NoError(t, err)
+	assert.Equal(t, "critical", info.Queue)
+	require.Same(t, task, enqueued)
+
+	hh, _ := handywares.AsynqTaskHeaders(enqueued)
+	assert.Contains(t, hh, "traceparent")
+
+	var handlers handywares.AsynqMiddlewareStack
+	handler := handlers.
+		Push(handywares.AsynqOpenTelemetryMiddleware(tracer, handywares.OtelAsynqPropagator(propagator)))(
+		asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+			assert.Equal(t, sc.TraceID(), trace.SpanContextFromContext(ctx).TraceID())
+			assert.Equal(t, []byte("payload"), handywares.AsynqTaskPayload(ctx, task))
+			assert.Same(t, enqueued, task)
+
+			return nil
+		}),
+	)
+
+	require.NoError(t, handler.ProcessTask(context.Background(), enqueued))
+}
+
+// producerTracer starts spans with the span id
+type producerTracer struct {
+	noop.Tracer
+
+	spanId trace.SpanID
+}
+
+func (pt producerTracer) Start(
+	ctx context.Context, _ string, _ ...trace.SpanStartOption,
+) (context.Context, trace.Span) {
+	sc := trace.SpanContextFromContext(ctx).WithSpanID(pt.spanId)
+	ctx = trace.ContextWithSpanContext(ctx, sc)
+
+	return ctx, trace.SpanFromContext(ctx)
+}
+
+func TestOtelAsynqEnqueue(t *testing.T) {
+	propagator := propagation.TraceContext{}
+	tracer := producerTracer{spanId: trace.SpanID{0x07, 0x08, 0x09}}
+
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01, 0x02, 0x03},
+		SpanID:     trace.SpanID{0x04, 0x05, 0x06},
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	var enqueued *asynq.Task
+	var enqueuers handywares.AsynqEnqueuerMiddlewareStack
+	enqueuer := enqueuers.
+		Push(handywares.AsynqOpenTelemetryEnqueuerMiddleware(tracer, handywares.OtelAsynqPropagator(propagator)))(
+		handywares.AsynqEnqueuerFunc(
+			func(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+				enqueued = task
+
+				return client.EnqueueContext(ctx, task, opts...)
+			},
+		),
+	)
+
+	info, err := handywares.OtelAsynqEnqueue(ctx, enqueuer, "email:send", []byte("payload"), asynq.Queue("critical"))
+	require.NoError(t, err)
+	assert.Equal(t, "critical", info.Queue)
+	assert.Equal(t, "email:send", enqueued.Type())
+
+	hh, payload := handywares.AsynqTaskHeaders(enqueued)
+	assert.Equal(t, []byte("payload"), payload)
+	producer := propagator.Extract(context.Background(), propagation.MapCarrier(hh))
+	assert.Equal(t, trace.TraceID{0x01, 0x02, 0x03}, trace.SpanContextFromContext(producer).TraceID())
+	assert.Equal(t, tracer.spanId, trace.SpanContextFromContext(producer).SpanID())
+}
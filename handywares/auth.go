@@ -0,0 +1,374 @@
+package handywares
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+var ErrCredentialsMissing = errors.New("credentials missing")
+
+type AuthMethod string
+
+const (
+	AuthMethodJwt    AuthMethod = "jwt"
+	AuthMethodApiKey AuthMethod = "api_key"
+	AuthMethodMtls   AuthMethod = "mtls"
+)
+
+// Principal is the authenticated caller
+type Principal struct {
+	Subject    string
+	Method     AuthMethod
+	Roles      []string
+	Attributes map[string]any // e.g. claims of jwt
+}
+
+type principalCtxKey struct{}
+
+func ContextWithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalCtxKey{}, p)
+}
+
+// PrincipalFromContext returns the principal put in ctx by authentication middlewares
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalCtxKey{}).(Principal)
+
+	return p, ok
+}
+
+// Credentials are what callers present to get authenticated. Transports extract them from requests and messages.
+type Credentials struct {
+	Bearer           string              // Token of bearer authorization
+	ApiKey           string              // Value of the api key header
+	PeerCertificates []*x509.Certificate // Verified certificate chain of the client leaf first
+}
+
+// Authenticator resolves the principal who has presented the credentials. It fails with ErrCredentialsMissing if
+// the credentials it authenticates aren't presented at all, with bricks.ErrUnauthenticated if they're invalid and
+// with other errors (e.g. bricks.ErrUnavailable) if it can't decide.
+type Authenticator interface {
+	Authenticate(ctx context.Context, cred Credentials) (Principal, error)
+}
+
+type AuthenticatorFunc func(ctx context.Context, cred Credentials) (Principal, error)
+
+func (fn AuthenticatorFunc) Authenticate(ctx context.Context, cred Credentials) (Principal, error) {
+	return fn(ctx, cred)
+}
+
+func credentialsMissing() error {
+	return errors.Join(bricks.ErrUnauthenticated, ErrCredentialsMissing)
+}
+
+// ChainAuthenticators authenticates callers using the first authenticator whose credentials are presented
+func ChainAuthenticators(aa ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, cred Credentials) (Principal, error) {
+		for _, a := range aa {
+			p, err := a.Authenticate(ctx, cred)
+			if errors.Is(err, ErrCredentialsMissing) {
+				continue
+			}
+
+			return p, err
+		}
+
+		return Principal{}, credentialsMissing()
+	})
+}
+
+// ApiKeyAuthenticator authenticates callers by api keys. Keys are kept hashed (sha256) so it can be fed by hashes
+// stored elsewhere without having the keys at all.
+type ApiKeyAuthenticator struct {
+	principals map[string]Principal
+}
+
+// NewApiKeyAuthenticator creates an authenticator of the static api keys mapped to their principals
+func NewApiKeyAuthenticator(keys map[string]Principal) *ApiKeyAuthenticator {
+	hashes := make(map[string]Principal, len(keys))
+	for key, p := range keys {
+		hashes[HashApiKey(key)] = p
+	}
+
+	return NewHashedApiKeyAuthenticator(hashes)
+}
+
+// NewHashedApiKeyAuthenticator creates an authenticator of the api keys whose hashes (see HashApiKey) are mapped to
+// their principals.
+func NewHashedApiKeyAuthenticator(hashes map[string]Principal) *ApiKeyAuthenticator {
+	principals := make(map[string]Principal, len(hashes))
+	for hash, p := range hashes {
+		p.Method = AuthMethodApiKey
+		principals[strings.ToLower(hash)] = p
+	}
+
+	return &ApiKeyAuthenticator{
+		principals: principals,
+	}
+}
+
+// HashApiKey returns hex-encoded sha256 hash of the api key
+func HashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (aka ApiKeyAuthenticator) Authenticate(_ context.Context, cred Credentials) (Principal, error) {
+	if len(cred.ApiKey) == 0 {
+		return Principal{}, credentialsMissing()
+	}
+
+	p, ok := aka.principals[HashApiKey(cred.ApiKey)]
+	if !ok {
+		return Principal{}, errors.Join(bricks.ErrUnauthenticated, errors.New("invalid api key"))
+	}
+
+	return p, nil
+}
+
+// MtlsAuthenticator authenticates callers by their client certificate verified by the tls handshake
+type MtlsAuthenticator struct {
+	resolver func(cert *x509.Certificate) (Principal, error)
+}
+
+// NewMtlsAuthenticator creates an authenticator resolving principals of client certificates using resolver. It
+// defaults to the one taking subject common name as principal subject and subject organizational units as its roles.
+func NewMtlsAuthenticator(resolver func(cert *x509.Certificate) (Principal, error)) *MtlsAuthenticator {
+	if resolver == nil {
+		resolver = func(cert *x509.Certificate) (Principal, error) {
+			return Principal{
+				Subject: cert.Subject.CommonName,
+				Roles:   cert.Subject.OrganizationalUnit,
+			}, nil
+		}
+	}
+
+	return &MtlsAuthenticator{
+		resolver: resolver,
+	}
+}
+
+func (ma MtlsAuthenticator) Authenticate(_ context.Context, cred Credentials) (Principal, error) {
+	if len(cred.PeerCertificates) == 0 {
+		return Principal{}, credentialsMissing()
+	}
+
+	p, err := ma.resolver(cred.PeerCertificates[0])
+	if err != nil {
+		return Principal{}, errors.Join(bricks.ErrUnauthenticated, err)
+	}
+	p.Method = AuthMethodMtls
+
+	return p, nil
+}
+
+// Authentication is the common configuration of authentication middlewares of all stacks
+type Authentication struct {
+	authenticator Authenticator
+	optional      bool
+	apiKeyHeader  string
+}
+
+type AuthenticationOpt = tricks.Option[Authentication]
+
+// AuthenticationOptional lets callers without any credentials through anonymously, i.e. without principal in context.
+// Callers presenting invalid credentials are rejected anyway.
+func AuthenticationOptional(optional bool) AuthenticationOpt {
+	return tricks.ImmutableOption[Authentication](func(a Authentication) Authentication {
+		a.optional = optional
+
+		return a
+	})
+}
+
+// AuthenticationApiKeyHeader sets name of the header (or metadata key) carrying api key. It defaults to X-Api-Key.
+func AuthenticationApiKeyHeader(name string) AuthenticationOpt {
+	return tricks.ImmutableOption[Authentication](func(a Authentication) Authentication {
+		a.apiKeyHeader = name
+
+		return a
+	})
+}
+
+func newAuthentication(authenticator Authenticator, options ...AuthenticationOpt) *Authentication {
+	if authenticator == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty authenticator")))
+	}
+
+	a := &Authentication{
+		authenticator: authenticator,
+		apiKeyHeader:  "X-Api-Key",
+	}
+
+	return tricks.ApplyOptions(a, options...)
+}
+
+// authenticate puts the principal of cred in ctx
+func (a Authentication) authenticate(ctx context.Context, cred Credentials) (context.Context, error) {
+	p, err := a.authenticator.Authenticate(ctx, cred)
+	if err != nil {
+		if a.optional && errors.Is(err, ErrCredentialsMissing) {
+			return ctx, nil
+		}
+
+		return ctx, err
+	}
+
+	return ContextWithPrincipal(ctx, p), nil
+}
+
+func bearerToken(authorization string) string {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
+
+// HttpAuthenticationMiddleware authenticates requests by bearer token, api key header and client certificate and
+// puts the principal in request context. Failures are written as problem details of bricks.ErrUnauthenticated (401).
+func HttpAuthenticationMiddleware(
+	authenticator Authenticator, options ...AuthenticationOpt,
+) tricks.Middleware[http.Handler] {
+	a := newAuthentication(authenticator, options...)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			cred := Credentials{
+				Bearer: bearerToken(req.Header.Get("Authorization")),
+				ApiKey: req.Header.Get(a.apiKeyHeader),
+			}
+			if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+				cred.PeerCertificates = req.TLS.VerifiedChains[0]
+			}
+
+			ctx, err := a.authenticate(req.Context(), cred)
+			if err != nil {
+				if errors.Is(err, bricks.ErrUnauthenticated) {
+					rw.Header().Set("WWW-Authenticate", "Bearer")
+				}
+				HttpWriteError(rw, req, err)
+
+				return
+			}
+
+			next.ServeHTTP(rw, req.WithContext(ctx))
+		})
+	}
+}
+
+func grpcCredentials(ctx context.Context, apiKeyHeader string) Credentials {
+	var cred Credentials
+	if vv := metadata.ValueFromIncomingContext(ctx, "authorization"); len(vv) > 0 {
+		cred.Bearer = bearerToken(vv[0])
+	}
+	if vv := metadata.ValueFromIncomingContext(ctx, strings.ToLower(apiKeyHeader)); len(vv) > 0 {
+		cred.ApiKey = vv[0]
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+			cred.PeerCertificates = tlsInfo.State.VerifiedChains[0]
+		}
+	}
+
+	return cred
+}
+
+// GrpcAuthenticationMiddleware authenticates calls by bearer token of authorization metadata, api key metadata and
+// client certificate and puts the principal in context. Push it after (inner than)
+// GrpcUnaryServerErrorMapperMiddleware to have failures converted to UNAUTHENTICATED status.
+func GrpcAuthenticationMiddleware(
+	authenticator Authenticator, options ...AuthenticationOpt,
+) tricks.Middleware[grpc.UnaryServerInterceptor] {
+	a := newAuthentication(authenticator, options...)
+
+	return func(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+		return func(
+			ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+		) (any, error) {
+			ctx, err := a.authenticate(ctx, grpcCredentials(ctx, a.apiKeyHeader))
+			if err != nil {
+				return nil, err
+			}
+
+			return next(ctx, req, info, handler)
+		}
+	}
+}
+
+// GrpcStreamAuthenticationMiddleware is the stream counterpart of GrpcAuthenticationMiddleware
+func GrpcStreamAuthenticationMiddleware(
+	authenticator Authenticator, options ...AuthenticationOpt,
+) tricks.Middleware[grpc.StreamServerInterceptor] {
+	a := newAuthentication(authenticator, options...)
+
+	return func(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+		return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := a.authenticate(ss.Context(), grpcCredentials(ss.Context(), a.apiKeyHeader))
+			if err != nil {
+				return err
+			}
+
+			return next(srv, GrpcServerStreamWithContext(ctx, ss), info, handler)
+		}
+	}
+}
+
+// NatsAuthenticationMiddleware authenticates messages by bearer token of Authorization header and api key header and
+// puts the principal in context.
+func NatsAuthenticationMiddleware(
+	authenticator Authenticator, options ...AuthenticationOpt,
+) tricks.Middleware[NatsMsgHandler] {
+	a := newAuthentication(authenticator, options...)
+
+	return func(next NatsMsgHandler) NatsMsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			ctx, err := a.authenticate(ctx, Credentials{
+				Bearer: bearerToken(msg.Header.Get("Authorization")),
+				ApiKey: msg.Header.Get(a.apiKeyHeader),
+			})
+			if err != nil {
+				return err
+			}
+
+			return next(ctx, msg)
+		}
+	}
+}
+
+// MsgAuthenticationMiddleware authenticates messages by credentials extracted from them and puts the principal in
+// context.
+func MsgAuthenticationMiddleware[M any](
+	authenticator Authenticator, extractor func(msg M) Credentials, options ...AuthenticationOpt,
+) tricks.Middleware[MsgHandler[M]] {
+	if extractor == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty credentials extractor")))
+	}
+
+	a := newAuthentication(authenticator, options...)
+
+	return func(next MsgHandler[M]) MsgHandler[M] {
+		return func(ctx context.Context, msg M) error {
+			ctx, err := a.authenticate(ctx, extractor(msg))
+			if err != nil {
+				return err
+			}
+
+			return next(ctx, msg)
+		}
+	}
+}
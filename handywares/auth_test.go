@@ -0,0 +1,292 @@
+package handywares_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+func TestApiKeyAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	aka := handywares.NewApiKeyAuthenticator(map[string]handywares.Principal{
+		"s3cr3t": {Subject: "svc-a", Roles: []string{"reader"}},
+	})
+
+	p, err := aka.Authenticate(ctx, handywares.Credentials{ApiKey: "s3cr3t"})
+	require.NoError(t, err)
+	assert.Equal(t, "svc-a", p.Subject)
+	assert.Equal(t, handywares.AuthMethodApiKey, p.Method)
+	assert.Equal(t, []string{"reader"}, p.Roles)
+
+	_, err = aka.Authenticate(ctx, handywares.Credentials{ApiKey: "guess"})
+	require.ErrorIs(t, err, bricks.ErrUnauthenticated)
+	require.NotErrorIs(t, err, handywares.ErrCredentialsMissing)
+
+	_, err = aka.Authenticate(ctx, handywares.Credentials{})
+	require.ErrorIs(t, err, handywares.ErrCredentialsMissing)
+}
+
+func TestChainAuthenticators(t *testing.T) {
+	ctx := context.Background()
+	a := handywares.ChainAuthenticators(
+		handywares.NewMtlsAuthenticator(nil),
+		handywares.NewApiKeyAuthenticator(map[string]handywares.Principal{"k": {Subject: "svc-a"}}),
+	)
+
+	p, err := a.Authenticate(ctx, handywares.Credentials{ApiKey: "k"})
+	require.NoError(t, err)
+	assert.Equal(t, handywares.AuthMethodApiKey, p.Method)
+
+	p, err = a.Authenticate(ctx, handywares.Credentials{
+		ApiKey: "k",
+		PeerCertificates: []*x509.Certificate{{
+			Subject: pkix.Name{CommonName: "svc-b", OrganizationalUnit: []string{"writer"}},
+		}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "svc-b", p.Subject)
+	assert.Equal(t, handywares.AuthMethodMtls, p.Method)
+	assert.Equal(t, []string{"writer"}, p.Roles)
+
+	_, err = a.Authenticate(ctx, handywares.Credentials{})
+	require.ErrorIs(t, err, bricks.ErrUnauthenticated)
+	require.ErrorIs(t, err, handywares.ErrCredentialsMissing)
+}
+
+type jwtIssuer struct {
+	signer jose.Signer
+	jwks   jose.JSONWebKeySet
+	hits   atomic.Int32
+	server *httptest.Server
+}
+
+func newJwtIssuer(t *testing.T) *jwtIssuer {
+	t.Helper()
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.ES256,
+		Key:       jose.JSONWebKey{Key: pk, KeyID: "k1"},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	require.NoError(t, err)
+
+	iss := &jwtIssuer{
+		signer: signer,
+		jwks: jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: pk.Public(), KeyID: "k1", Algorithm: string(jose.ES256), Use: "sig"},
+		}},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":   iss.server.URL,
+			"jwks_uri": iss.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, req *http.Request) {
+		iss.hits.Add(1)
+		_ = json.NewEncoder(rw).Encode(iss.jwks)
+	})
+	iss.server = httptest.NewServer(mux)
+	t.Cleanup(iss.server.Close)
+
+	return iss
+}
+
+func (iss *jwtIssuer) token(t *testing.T, claims jwt.Claims, extra map[string]any) string {
+	t.Helper()
+
+	token, err := jwt.Signed(iss.signer).Claims(claims).Claims(extra).Serialize()
+	require.NoError(t, err)
+
+	return token
+}
+
+func TestJwtAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	iss := newJwtIssuer(t)
+
+	keys, err := handywares.DiscoverOidcJwks(ctx, iss.server.URL)
+	require.NoError(t, err)
+	a := handywares.NewJwtAuthenticator(keys, handywares.JwtIssuer(iss.server.URL), handywares.JwtAudience("api"))
+
+	now := time.Now()
+	p, err := a.Authenticate(ctx, handywares.Credentials{
+		Bearer: iss.token(t, jwt.Claims{
+			Issuer:   iss.server.URL,
+			Subject:  "user-1",
+			Audience: jwt.Audience{"api"},
+			Expiry:   jwt.NewNumericDate(now.Add(time.Minute)),
+		}, map[string]any{"roles": []string{"admin", "reader"}}),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", p.Subject)
+	assert.Equal(t, handywares.AuthMethodJwt, p.Method)
+	assert.Equal(t, []string{"admin", "reader"}, p.Roles)
+	assert.Equal(t, "user-1", p.Attributes["sub"])
+
+	_, err = a.Authenticate(ctx, handywares.Credentials{
+		Bearer: iss.token(t, jwt.Claims{
+			Issuer:   iss.server.URL,
+			Subject:  "user-1",
+			Audience: jwt.Audience{"api"},
+			Expiry:   jwt.NewNumericDate(now.Add(-time.Hour)),
+		}, nil),
+	})
+	require.ErrorIs(t, err, bricks.ErrUnauthenticated)
+	require.ErrorIs(t, err, jwt.ErrExpired)
+
+	_, err = a.Authenticate(ctx, handywares.Credentials{
+		Bearer: iss.token(t, jwt.Claims{
+			Issuer:   iss.server.URL,
+			Subject:  "user-1",
+			Audience: jwt.Audience{"other"},
+			Expiry:   jwt.NewNumericDate(now.Add(time.Minute)),
+		}, nil),
+	})
+	require.ErrorIs(t, err, jwt.ErrInvalidAudience)
+
+	expiryless := iss.token(t, jwt.Claims{Issuer: iss.server.URL, Subject: "user-1", Audience: jwt.Audience{"api"}}, nil)
+	_, err = a.Authenticate(ctx, handywares.Credentials{Bearer: expiryless})
+	require.ErrorIs(t, err, bricks.ErrUnauthenticated)
+	require.ErrorIs(t, err, handywares.ErrJwtExpiryMissing)
+
+	p, err = handywares.NewJwtAuthenticator(keys, handywares.JwtAudience("api"), handywares.JwtAllowNoExpiry()).
+		Authenticate(ctx, handywares.Credentials{Bearer: expiryless})
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", p.Subject)
+
+	assert.Panics(t, func() {
+		handywares.NewJwtAuthenticator(keys)
+	})
+
+	_, err = a.Authenticate(ctx, handywares.Credentials{Bearer: "not.a.jwt"})
+	require.ErrorIs(t, err, bricks.ErrUnauthenticated)
+
+	assert.EqualValues(t, 1, iss.hits.Load())
+}
+
+func TestJwksCacheUnknownKeyId(t *testing.T) {
+	ctx := context.Background()
+	iss := newJwtIssuer(t)
+	keys := handywares.NewJwksCache(iss.server.URL+"/jwks", handywares.JwksMinRefreshInterval(time.Hour))
+
+	_, err := keys.JwtKey(ctx, "k1")
+	require.NoError(t, err)
+
+	_, err = keys.JwtKey(ctx, "k2")
+	require.ErrorIs(t, err, bricks.ErrUnauthenticated)
+	assert.EqualValues(t, 1, iss.hits.Load(), "refresh on unknown key id is rate limited")
+
+	_, err = handywares.NewJwksCache(iss.server.URL+"/missing").JwtKey(ctx, "k1")
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+}
+
+func TestJwksCacheConcurrentRefresh(t *testing.T) {
+	ctx := context.Background()
+	iss := newJwtIssuer(t)
+	keys := handywares.NewJwksCache(iss.server.URL+"/jwks", handywares.JwksMinRefreshInterval(time.Hour))
+
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := keys.JwtKey(ctx, "k1")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 1, iss.hits.Load(), "concurrent refreshes are coalesced")
+}
+
+func TestHttpAuthenticationMiddleware(t *testing.T) {
+	var mws handywares.HttpMiddlewareStack
+	handler := mws.Push(handywares.HttpAuthenticationMiddleware(
+		handywares.NewApiKeyAuthenticator(map[string]handywares.Principal{"k": {Subject: "svc-a"}}),
+		handywares.AuthenticationOptional(true),
+	))(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p, _ := handywares.PrincipalFromContext(req.Context())
+		_, _ = rw.Write([]byte(p.Subject))
+	}))
+
+	serve := func(apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if len(apiKey) > 0 {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := serve("k")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "svc-a", rec.Body.String())
+
+	rec = serve("")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	rec = serve("guess")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, handywares.HttpProblemContentType, rec.Header().Get("Content-Type"))
+}
+
+func TestGrpcAuthenticationMiddleware(t *testing.T) {
+	ctx := context.Background()
+	iss := newJwtIssuer(t)
+
+	var mws handywares.GrpcUnaryServerMiddlewareStack
+	interceptor := mws.
+		Push(handywares.GrpcUnaryServerErrorMapperMiddleware(handywares.BricksToGrpcErrorMapper)).
+		Push(handywares.GrpcAuthenticationMiddleware(
+			handywares.NewJwtAuthenticator(handywares.NewJwksCache(iss.server.URL+"/jwks"), handywares.JwtAnyAudience()),
+		))(handywares.GrpcUnaryServerInvokeHandlerInterceptor)
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		p, _ := handywares.PrincipalFromContext(ctx)
+
+		return p.Subject, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/svc/Method"}
+
+	token := iss.token(t, jwt.Claims{Subject: "user-1", Expiry: jwt.NewNumericDate(time.Now().Add(time.Minute))}, nil)
+	rsp, err := interceptor(
+		metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token)), nil, info, handler,
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", rsp)
+
+	_, err = interceptor(ctx, nil, info, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
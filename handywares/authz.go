@@ -0,0 +1,510 @@
+package handywares
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"google.golang.org/grpc"
+)
+
+// Authorizer decides whether the principal in ctx (if any) is permitted to perform the operation on the resource
+// described by its attributes. It fails with bricks.ErrPermissionDenied if not.
+type Authorizer interface {
+	Authorize(ctx context.Context, operation string, resource map[string]any) error
+}
+
+type AuthorizerFunc func(ctx context.Context, operation string, resource map[string]any) error
+
+func (fn AuthorizerFunc) Authorize(ctx context.Context, operation string, resource map[string]any) error {
+	return fn(ctx, operation, resource)
+}
+
+type AuthorizationEffect string
+
+const (
+	AuthorizationAllow AuthorizationEffect = "allow"
+	AuthorizationDeny  AuthorizationEffect = "deny"
+)
+
+// AuthorizationPolicy is a set of RBAC/ABAC rules. An operation is permitted if at least one allow rule and no deny
+// rule match it. Keys are lower-cased snake_case and role names are case-insensitive to survive settings sources which
+// lower-case map keys, e.g. viper behind kareless.Settings. An example in yaml:
+//
+//	roles:
+//	  admin: [editor]
+//	rules:
+//	  - name: editors-edit-own-documents
+//	    operations: [updateDocument, /docs.v1.Documents/*]
+//	    roles: [editor]
+//	    conditions:
+//	      - attribute: resource.owner
+//	        operator: eq
+//	        value_of: principal.subject
+//	  - name: no-deletes-on-archive
+//	    effect: deny
+//	    operations: [deleteDocument]
+//	    conditions:
+//	      - attribute: resource.archived
+//	        value: true
+type AuthorizationPolicy struct {
+	Roles map[string][]string `json:"roles"` // Role to the roles it inherits permissions of
+	Rules []AuthorizationRule `json:"rules"`
+}
+
+// AuthorizationRule matches a request if all of its non-empty constraints hold
+type AuthorizationRule struct {
+	Name       string                   `json:"name"`
+	Effect     AuthorizationEffect      `json:"effect"`     // Defaults to allow
+	Operations []string                 `json:"operations"` // Operation ids or grpc full methods. Globs of path.Match.
+	Anonymous  bool                     `json:"anonymous"`  // Matches callers without principal too
+	Subjects   []string                 `json:"subjects"`   // Principal subject is any of them
+	Roles      []string                 `json:"roles"`      // Principal has any of them directly or by inheritance
+	Conditions []AuthorizationCondition `json:"conditions"` // All of them hold
+}
+
+// AuthorizationCondition compares an attribute with either a literal value or another attribute. Attributes are
+// referenced by dot-separated paths rooted at operation, principal (subject, method, roles and attributes) or
+// resource, e.g. principal.attributes.tenant or resource.owner.
+type AuthorizationCondition struct {
+	Attribute string                `json:"attribute"`
+	Operator  AuthorizationOperator `json:"operator"` // Defaults to eq
+	Value     any                   `json:"value"`
+	ValueOf   string                `json:"value_of"`
+}
+
+type AuthorizationOperator string
+
+const (
+	AuthorizationOperatorEq       AuthorizationOperator = "eq"
+	AuthorizationOperatorNe       AuthorizationOperator = "ne"
+	AuthorizationOperatorIn       AuthorizationOperator = "in"     // Attribute is an element of the value
+	AuthorizationOperatorNotIn    AuthorizationOperator = "not_in" // Attribute isn't an element of the value
+	AuthorizationOperatorContains AuthorizationOperator = "contains"
+	AuthorizationOperatorExists   AuthorizationOperator = "exists"
+)
+
+// SettingsUnmarshaler is a settings storage, i.e. *kareless.Settings
+type SettingsUnmarshaler interface {
+	UnmarshalJson(key string, valPtr any) error
+}
+
+// LoadAuthorizationPolicy reads the policy under key of the settings storage, e.g. a yaml file of
+// std.LocalEarlyLoadedSettingSource fed to kareless.
+func LoadAuthorizationPolicy(ss SettingsUnmarshaler, key string) (AuthorizationPolicy, error) {
+	var policy AuthorizationPolicy
+	if err := ss.UnmarshalJson(key, &policy); err != nil {
+		return AuthorizationPolicy{}, errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	return policy, nil
+}
+
+// AuthorizationDecision is the outcome of evaluating a policy and the rule leading to it, if any
+type AuthorizationDecision struct {
+	Allowed bool
+	Rule    string
+}
+
+// PolicyAuthorizer is the Authorizer evaluating an AuthorizationPolicy
+type PolicyAuthorizer struct {
+	inherits map[string][]string
+	rules    []AuthorizationRule
+}
+
+// NewPolicyAuthorizer validates the policy and creates an authorizer of it. The policy is copied, so it can be reused.
+func NewPolicyAuthorizer(policy AuthorizationPolicy) (*PolicyAuthorizer, error) {
+	inherits := make(map[string][]string, len(policy.Roles))
+	for role, parents := range policy.Roles {
+		role = strings.ToLower(role)
+		inherits[role] = append(inherits[role], lowerRoles(parents)...)
+	}
+
+	rules := make([]AuthorizationRule, len(policy.Rules))
+	for k, rule := range policy.Rules {
+		rule.Roles = lowerRoles(rule.Roles)
+		rule.Conditions = slices.Clone(rule.Conditions)
+
+		if len(rule.Name) == 0 {
+			rule.Name = fmt.Sprintf("#%d", k)
+		}
+
+		if len(rule.Effect) == 0 {
+			rule.Effect = AuthorizationAllow
+		} else if rule.Effect != AuthorizationAllow && rule.Effect != AuthorizationDeny {
+			return nil, errors.Join(bricks.ErrInvalidArgument,
+				fmt.Errorf("rule `%s`: unknown effect `%s`", rule.Name, rule.Effect))
+		}
+
+		for _, op := range rule.Operations {
+			if _, err := path.Match(op, ""); err != nil {
+				return nil, errors.Join(bricks.ErrInvalidArgument, fmt.Errorf("rule `%s`: %w", rule.Name, err))
+			}
+		}
+
+		for j, cond := range rule.Conditions {
+			switch cond.Operator {
+			case "":
+				rule.Conditions[j].Operator = AuthorizationOperatorEq
+
+			case AuthorizationOperatorEq, AuthorizationOperatorNe, AuthorizationOperatorIn,
+				AuthorizationOperatorNotIn, AuthorizationOperatorContains, AuthorizationOperatorExists:
+
+			default:
+				return nil, errors.Join(bricks.ErrInvalidArgument,
+					fmt.Errorf("rule `%s`: unknown operator `%s`", rule.Name, cond.Operator))
+			}
+		}
+
+		rules[k] = rule
+	}
+
+	return &PolicyAuthorizer{
+		inherits: inherits,
+		rules:    rules,
+	}, nil
+}
+
+func lowerRoles(roles []string) []string {
+	if roles == nil {
+		return nil
+	}
+
+	lowered := make([]string, len(roles))
+	for k, role := range roles {
+		lowered[k] = strings.ToLower(role)
+	}
+
+	return lowered
+}
+
+// MustNewPolicyAuthorizer is like NewPolicyAuthorizer but panics on invalid policies
+func MustNewPolicyAuthorizer(policy AuthorizationPolicy) *PolicyAuthorizer {
+	pa, err := NewPolicyAuthorizer(policy)
+	if err != nil {
+		panic(err)
+	}
+
+	return pa
+}
+
+func (pa PolicyAuthorizer) Authorize(ctx context.Context, operation string, resource map[string]any) error {
+	var principal *Principal
+	if p, ok := PrincipalFromContext(ctx); ok {
+		principal = &p
+	}
+
+	d := pa.Decide(principal, operation, resource)
+	if d.Allowed {
+		return nil
+	}
+
+	if len(d.Rule) > 0 {
+		return errors.Join(bricks.ErrPermissionDenied,
+			fmt.Errorf("operation `%s` denied by rule `%s`", operation, d.Rule))
+	}
+
+	return errors.Join(bricks.ErrPermissionDenied, fmt.Errorf("no rule allows operation `%s`", operation))
+}
+
+// Decide evaluates the policy for the principal (nil if anonymous). Deny rules take precedence over allow ones.
+func (pa PolicyAuthorizer) Decide(
+	principal *Principal, operation string, resource map[string]any,
+) AuthorizationDecision {
+	var (
+		d     AuthorizationDecision
+		roles map[string]struct{}
+	)
+	if principal != nil {
+		roles = pa.expandRoles(principal.Roles)
+	}
+
+	attrs := authorizationAttributes{
+		operation: operation,
+		principal: principal,
+		resource:  resource,
+	}
+	for _, rule := range pa.rules {
+		if !pa.matches(rule, attrs, roles) {
+			continue
+		}
+
+		if rule.Effect == AuthorizationDeny {
+			return AuthorizationDecision{Allowed: false, Rule: rule.Name}
+		}
+
+		if !d.Allowed {
+			d = AuthorizationDecision{Allowed: true, Rule: rule.Name}
+		}
+	}
+
+	return d
+}
+
+func (pa PolicyAuthorizer) expandRoles(direct []string) map[string]struct{} {
+	roles := make(map[string]struct{}, len(direct))
+	queue := lowerRoles(direct)
+	for len(queue) > 0 {
+		role := queue[0]
+		queue = queue[1:]
+		if _, seen := roles[role]; seen {
+			continue
+		}
+
+		roles[role] = struct{}{}
+		queue = append(queue, pa.inherits[role]...)
+	}
+
+	return roles
+}
+
+func (pa PolicyAuthorizer) matches(
+	rule AuthorizationRule, attrs authorizationAttributes, roles map[string]struct{},
+) bool {
+	if len(rule.Operations) > 0 && !slices.ContainsFunc(rule.Operations, func(pattern string) bool {
+		matched, _ := path.Match(pattern, attrs.operation)
+
+		return matched
+	}) {
+		return false
+	}
+
+	if attrs.principal == nil {
+		if !rule.Anonymous || len(rule.Subjects) > 0 || len(rule.Roles) > 0 {
+			return false
+		}
+	} else {
+		if len(rule.Subjects) > 0 && tricks.SliceIndexOf(attrs.principal.Subject, rule.Subjects) < 0 {
+			return false
+		}
+
+		if len(rule.Roles) > 0 && !slices.ContainsFunc(rule.Roles, func(role string) bool {
+			_, ok := roles[role]
+
+			return ok
+		}) {
+			return false
+		}
+	}
+
+	for _, cond := range rule.Conditions {
+		if !cond.holds(attrs) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type authorizationAttributes struct {
+	operation string
+	principal *Principal
+	resource  map[string]any
+}
+
+// lookup resolves the dot-separated attribute path
+func (aa authorizationAttributes) lookup(ref string) (any, bool) {
+	root, rest, _ := strings.Cut(ref, ".")
+	switch root {
+	case "operation":
+		return aa.operation, len(rest) == 0
+
+	case "resource":
+		return lookupAttribute(aa.resource, rest)
+
+	case "principal":
+		if aa.principal == nil {
+			return nil, false
+		}
+
+		field, rest, _ := strings.Cut(rest, ".")
+		switch field {
+		case "subject":
+			return aa.principal.Subject, len(rest) == 0
+
+		case "method":
+			return string(aa.principal.Method), len(rest) == 0
+
+		case "roles":
+			return aa.principal.Roles, len(rest) == 0
+
+		case "attributes":
+			return lookupAttribute(aa.principal.Attributes, rest)
+		}
+	}
+
+	return nil, false
+}
+
+func lookupAttribute(attrs map[string]any, ref string) (any, bool) {
+	name, rest, nested := strings.Cut(ref, ".")
+	v, ok := attrs[name]
+	if !ok || !nested {
+		return v, ok
+	}
+
+	child, ok := v.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+
+	return lookupAttribute(child, rest)
+}
+
+func (cond AuthorizationCondition) holds(attrs authorizationAttributes) bool {
+	v, found := attrs.lookup(cond.Attribute)
+	if cond.Operator == AuthorizationOperatorExists {
+		return found
+	}
+
+	if !found {
+		return cond.Operator == AuthorizationOperatorNe || cond.Operator == AuthorizationOperatorNotIn
+	}
+
+	expected := cond.Value
+	if len(cond.ValueOf) > 0 {
+		if expected, found = attrs.lookup(cond.ValueOf); !found {
+			return false
+		}
+	}
+
+	switch cond.Operator {
+	case AuthorizationOperatorNe:
+		return !authorizationEqual(v, expected)
+
+	case AuthorizationOperatorIn:
+		return authorizationContains(expected, v)
+
+	case AuthorizationOperatorNotIn:
+		return !authorizationContains(expected, v)
+
+	case AuthorizationOperatorContains:
+		return authorizationContains(v, expected)
+
+	default:
+		return authorizationEqual(v, expected)
+	}
+}
+
+// authorizationEqual compares values loosely to tolerate number and string types differing between settings sources
+// and request attributes, e.g. int vs. float64.
+func authorizationEqual(a, b any) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func authorizationContains(collection, element any) bool {
+	switch c := collection.(type) {
+	case []any:
+		return slices.ContainsFunc(c, func(v any) bool {
+			return authorizationEqual(v, element)
+		})
+
+	case []string:
+		return tricks.SliceIndexOf(fmt.Sprint(element), c) >= 0
+
+	case string:
+		return strings.Contains(c, fmt.Sprint(element))
+
+	default:
+		return false
+	}
+}
+
+// HttpAuthorizationResourceExtractor extracts attributes of the resource requested on the route
+type HttpAuthorizationResourceExtractor func(req *http.Request, route *middleware.MatchedRoute) map[string]any
+
+// HttpPathParamsAuthorizationResource takes path parameters of the route as the resource attributes
+func HttpPathParamsAuthorizationResource(_ *http.Request, route *middleware.MatchedRoute) map[string]any {
+	attrs := make(map[string]any, len(route.Params))
+	for _, param := range route.Params {
+		attrs[param.Name] = param.Value
+	}
+
+	return attrs
+}
+
+// HttpAuthorizationMiddleware authorizes requests to the operation id of the matched openapi route. Requests not
+// matching any route are let through to be rejected by the router. It defaults to HttpPathParamsAuthorizationResource
+// if resource extractor is nil. Push it after (inner than) HttpAuthenticationMiddleware.
+func HttpAuthorizationMiddleware(
+	authorizer Authorizer, mctx *middleware.Context, resource HttpAuthorizationResourceExtractor,
+) tricks.Middleware[http.Handler] {
+	if authorizer == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty authorizer")))
+	}
+
+	if resource == nil {
+		resource = HttpPathParamsAuthorizationResource
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			route, matched := mctx.LookupRoute(req)
+			if !matched {
+				next.ServeHTTP(rw, req)
+
+				return
+			}
+
+			if err := authorizer.Authorize(req.Context(), route.Operation.ID, resource(req, route)); err != nil {
+				HttpWriteError(rw, req, err)
+
+				return
+			}
+
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// GrpcAuthorizationResourceExtractor extracts attributes of the resource requested by the call
+type GrpcAuthorizationResourceExtractor func(ctx context.Context, req any) map[string]any
+
+// GrpcAuthorizationMiddleware authorizes calls to their full method, e.g. /package.Service/Method. Resource extractor
+// is optional. Push it after (inner than) GrpcAuthenticationMiddleware.
+func GrpcAuthorizationMiddleware(
+	authorizer Authorizer, resource GrpcAuthorizationResourceExtractor,
+) tricks.Middleware[grpc.UnaryServerInterceptor] {
+	if authorizer == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty authorizer")))
+	}
+
+	return func(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			var attrs map[string]any
+			if resource != nil {
+				attrs = resource(ctx, req)
+			}
+
+			if err := authorizer.Authorize(ctx, info.FullMethod, attrs); err != nil {
+				return nil, err
+			}
+
+			return next(ctx, req, info, handler)
+		}
+	}
+}
+
+// GrpcStreamAuthorizationMiddleware authorizes streams to their full method
+func GrpcStreamAuthorizationMiddleware(authorizer Authorizer) tricks.Middleware[grpc.StreamServerInterceptor] {
+	if authorizer == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty authorizer")))
+	}
+
+	return func(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+		return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorizer.Authorize(ss.Context(), info.FullMethod, nil); err != nil {
+				return err
+			}
+
+			return next(srv, ss, info, handler)
+		}
+	}
+}
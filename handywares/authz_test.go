@@ -0,0 +1,254 @@
+package handywares_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-openapi/loads"
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/go-openapi/runtime/middleware/untyped"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/janstoon/toolbox/handywares"
+	"github.com/janstoon/toolbox/handywares/authztest"
+)
+
+const authzPolicy = `
+roles:
+  admin: [editor]
+  editor: [viewer]
+rules:
+  - name: viewers-read
+    operations: [getDocument, /docs.v1.Documents/Get*]
+    roles: [viewer]
+  - name: public-read
+    operations: [getDocument]
+    anonymous: true
+    conditions:
+      - attribute: resource.visibility
+        value: public
+  - name: editors-update-own
+    operations: [updateDocument]
+    roles: [editor]
+    conditions:
+      - attribute: resource.owner
+        value_of: principal.subject
+  - name: admins-update-tenant
+    operations: [updateDocument]
+    roles: [admin]
+    conditions:
+      - attribute: resource.tenant
+        operator: in
+        value_of: principal.attributes.tenants
+  - name: archive-is-readonly
+    effect: deny
+    operations: [updateDocument]
+    conditions:
+      - attribute: resource.archived
+        value: true
+`
+
+func TestPolicyAuthorizer(t *testing.T) {
+	pa := authztest.PolicyFromYaml(t, authzPolicy)
+
+	viewer := &handywares.Principal{Subject: "v", Roles: []string{"viewer"}}
+	editor := &handywares.Principal{Subject: "e", Roles: []string{"editor"}}
+	admin := &handywares.Principal{
+		Subject:    "a",
+		Roles:      []string{"admin"},
+		Attributes: map[string]any{"tenants": []any{"t1", "t2"}},
+	}
+
+	authztest.AssertDecisions(t, pa,
+		authztest.Case{Name: "viewer reads", Principal: viewer, Operation: "getDocument", Allowed: true},
+		authztest.Case{
+			Name: "viewer calls grpc", Principal: viewer, Operation: "/docs.v1.Documents/GetDocument", Allowed: true,
+		},
+		authztest.Case{Name: "viewer updates", Principal: viewer, Operation: "updateDocument"},
+		authztest.Case{Name: "anonymous reads private", Operation: "getDocument"},
+		authztest.Case{
+			Name: "anonymous reads public", Operation: "getDocument",
+			Resource: map[string]any{"visibility": "public"}, Allowed: true,
+		},
+		authztest.Case{
+			Name: "editor updates own", Principal: editor, Operation: "updateDocument",
+			Resource: map[string]any{"owner": "e"}, Allowed: true,
+		},
+		authztest.Case{
+			Name: "editor updates others", Principal: editor, Operation: "updateDocument",
+			Resource: map[string]any{"owner": "x"},
+		},
+		authztest.Case{
+			Name: "admin updates in tenant", Principal: admin, Operation: "updateDocument",
+			Resource: map[string]any{"owner": "x", "tenant": "t2"}, Allowed: true,
+		},
+		authztest.Case{
+			Name: "admin updates out of tenant", Principal: admin, Operation: "updateDocument",
+			Resource: map[string]any{"owner": "x", "tenant": "t3"},
+		},
+		authztest.Case{
+			Name: "editor updates own archived", Principal: editor, Operation: "updateDocument",
+			Resource: map[string]any{"owner": "e", "archived": true},
+		},
+	)
+
+	d := pa.Decide(editor, "updateDocument", map[string]any{"owner": "e", "archived": true})
+	assert.Equal(t, handywares.AuthorizationDecision{Allowed: false, Rule: "archive-is-readonly"}, d)
+
+	err := pa.Authorize(context.Background(), "deleteDocument", nil)
+	require.ErrorIs(t, err, bricks.ErrPermissionDenied)
+}
+
+// jsonSettings mimics kareless.Settings which lower-cases map keys (by viper)
+type jsonSettings map[string]any
+
+func (ss jsonSettings) UnmarshalJson(key string, valPtr any) error {
+	bb, err := json.Marshal(lowerKeys(ss[key]))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(bb, valPtr)
+}
+
+func lowerKeys(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		lowered := make(map[string]any, len(v))
+		for k, child := range v {
+			lowered[strings.ToLower(k)] = lowerKeys(child)
+		}
+
+		return lowered
+
+	case []any:
+		lowered := make([]any, len(v))
+		for k, child := range v {
+			lowered[k] = lowerKeys(child)
+		}
+
+		return lowered
+
+	default:
+		return v
+	}
+}
+
+func TestLoadAuthorizationPolicy(t *testing.T) {
+	policy, err := handywares.LoadAuthorizationPolicy(jsonSettings{
+		"authz": map[string]any{
+			"rules": []any{
+				map[string]any{"name": "r1", "operations": []any{"op"}, "effect": "permit"},
+			},
+		},
+	}, "authz")
+	require.NoError(t, err)
+	require.Len(t, policy.Rules, 1)
+	assert.Equal(t, []string{"op"}, policy.Rules[0].Operations)
+
+	_, err = handywares.NewPolicyAuthorizer(policy)
+	require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+
+	policy, err = handywares.LoadAuthorizationPolicy(jsonSettings{
+		"authz": map[string]any{
+			"roles": map[string]any{"SuperAdmin": []any{"Editor"}},
+			"rules": []any{
+				map[string]any{
+					"operations": []any{"updateDocument"},
+					"roles":      []any{"Editor"},
+					"conditions": []any{map[string]any{"attribute": "resource.owner", "value_of": "principal.subject"}},
+				},
+			},
+		},
+	}, "authz")
+	require.NoError(t, err)
+
+	pa, err := handywares.NewPolicyAuthorizer(policy)
+	require.NoError(t, err)
+	assert.Empty(t, policy.Rules[0].Conditions[0].Operator, "policy isn't mutated")
+	assert.True(t, pa.Decide(&handywares.Principal{Subject: "s", Roles: []string{"SuperAdmin"}},
+		"updateDocument", map[string]any{"owner": "s"}).Allowed, "role names are case-insensitive")
+}
+
+const authzSpec = `{
+  "swagger": "2.0",
+  "info": {"title": "docs", "version": "1"},
+  "paths": {
+    "/documents/{id}": {
+      "get": {
+        "operationId": "getDocument",
+        "parameters": [{"name": "id", "in": "path", "required": true, "type": "string"}],
+        "responses": {"200": {"description": "ok"}}
+      }
+    }
+  }
+}`
+
+func TestHttpAuthorizationMiddleware(t *testing.T) {
+	doc, err := loads.Analyzed(json.RawMessage(authzSpec), "")
+	require.NoError(t, err)
+	api := untyped.NewAPI(doc)
+	api.RegisterOperation(http.MethodGet, "/documents/{id}", runtime.OperationHandlerFunc(func(any) (any, error) {
+		return nil, nil
+	}))
+	mctx := middleware.NewContext(doc, api, nil)
+	_ = middleware.NewRouter(mctx, nil) // builds the router
+
+	pa := handywares.MustNewPolicyAuthorizer(handywares.AuthorizationPolicy{
+		Rules: []handywares.AuthorizationRule{{
+			Operations: []string{"getDocument"},
+			Anonymous:  true,
+			Conditions: []handywares.AuthorizationCondition{{Attribute: "resource.id", Value: "d1"}},
+		}},
+	})
+
+	var mws handywares.HttpMiddlewareStack
+	handler := mws.Push(handywares.HttpAuthorizationMiddleware(pa, mctx, nil))(
+		http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusNoContent)
+		}),
+	)
+
+	serve := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve("/documents/d1"))
+	assert.Equal(t, http.StatusForbidden, serve("/documents/d2"))
+	assert.Equal(t, http.StatusNoContent, serve("/unknown"))
+}
+
+func TestGrpcAuthorizationMiddleware(t *testing.T) {
+	pa := handywares.MustNewPolicyAuthorizer(handywares.AuthorizationPolicy{
+		Rules: []handywares.AuthorizationRule{{Operations: []string{"/svc/Public"}, Anonymous: true}},
+	})
+
+	var mws handywares.GrpcUnaryServerMiddlewareStack
+	interceptor := mws.
+		Push(handywares.GrpcUnaryServerErrorMapperMiddleware(handywares.BricksToGrpcErrorMapper)).
+		Push(handywares.GrpcAuthorizationMiddleware(pa, nil))(handywares.GrpcUnaryServerInvokeHandlerInterceptor)
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		return "ok", nil
+	}
+
+	rsp, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Public"}, handler)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", rsp)
+
+	_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Private"}, handler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,82 @@
+// Package authztest helps asserting decisions of authorization policies and authorizers in tests
+package authztest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"gopkg.in/yaml.v3"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+// Case is an authorization request along with its expected decision
+type Case struct {
+	Name      string
+	Principal *handywares.Principal // Nil for anonymous callers
+	Operation string
+	Resource  map[string]any
+	Allowed   bool
+}
+
+// PolicyFromYaml parses the yaml document of handywares.AuthorizationPolicy the way it's loaded from settings and
+// creates its authorizer. It fails the test if the policy is invalid.
+func PolicyFromYaml(tb testing.TB, doc string) *handywares.PolicyAuthorizer {
+	tb.Helper()
+
+	var raw any
+	if err := yaml.Unmarshal([]byte(doc), &raw); err != nil {
+		tb.Fatalf("invalid policy yaml: %v", err)
+	}
+
+	bb, err := json.Marshal(raw)
+	if err != nil {
+		tb.Fatalf("invalid policy yaml: %v", err)
+	}
+
+	var policy handywares.AuthorizationPolicy
+	if err = json.Unmarshal(bb, &policy); err != nil {
+		tb.Fatalf("invalid policy: %v", err)
+	}
+
+	pa, err := handywares.NewPolicyAuthorizer(policy)
+	if err != nil {
+		tb.Fatalf("invalid policy: %v", err)
+	}
+
+	return pa
+}
+
+// AssertDecisions runs the cases against the authorizer and reports the ones decided unexpectedly. It returns true if
+// all the decisions are as expected.
+func AssertDecisions(tb testing.TB, authorizer handywares.Authorizer, cases ...Case) bool {
+	tb.Helper()
+
+	ok := true
+	for _, c := range cases {
+		ctx := context.Background()
+		if c.Principal != nil {
+			ctx = handywares.ContextWithPrincipal(ctx, *c.Principal)
+		}
+
+		err := authorizer.Authorize(ctx, c.Operation, c.Resource)
+		switch {
+		case err != nil && !errors.Is(err, bricks.ErrPermissionDenied):
+			tb.Errorf("%s: authorization failed: %v", c.Name, err)
+			ok = false
+
+		case c.Allowed && err != nil:
+			tb.Errorf("%s: expected to be allowed but denied: %v", c.Name, err)
+			ok = false
+
+		case !c.Allowed && err == nil:
+			tb.Errorf("%s: expected to be denied but allowed", c.Name)
+			ok = false
+		}
+	}
+
+	return ok
+}
@@ -0,0 +1,380 @@
+package handywares
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+
+	case CircuitOpen:
+		return "open"
+
+	case CircuitHalfOpen:
+		return "half-open"
+
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker stops calling a failing downstream for a while to let it recover. The circuit opens once the ratio
+// of failures over the rolling window reaches the threshold and calls fail fast with bricks.ErrUnavailable. After the
+// open timeout a few probe calls are let through (half-open) which close the circuit if they all succeed or open it
+// again otherwise.
+type CircuitBreaker struct {
+	CircuitBreakerPolicy
+
+	name         string
+	transitions  metric.Int64Counter
+	rejections   metric.Int64Counter
+	registration metric.Registration
+
+	l          sync.Mutex
+	state      CircuitState
+	generation uint64
+	openedAt   time.Time
+	probes     int
+	successes  int
+	ring       []circuitBucket
+}
+
+// CircuitBreakerPolicy is the configuration of CircuitBreaker
+type CircuitBreakerPolicy struct {
+	failureRatio   float64
+	minRequests    int
+	window         time.Duration
+	buckets        int
+	openTimeout    time.Duration
+	halfOpenProbes int
+	failure        func(err error) bool
+	meter          metric.Meter
+}
+
+type circuitBucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+type CircuitBreakerOpt = tricks.Option[CircuitBreakerPolicy]
+
+// CircuitBreakerFailureRatio sets the ratio of failures (0, 1] over the window which opens the circuit. It defaults
+// to 0.5.
+func CircuitBreakerFailureRatio(ratio float64) CircuitBreakerOpt {
+	return tricks.ImmutableOption[CircuitBreakerPolicy](func(cbp CircuitBreakerPolicy) CircuitBreakerPolicy {
+		cbp.failureRatio = ratio
+
+		return cbp
+	})
+}
+
+// CircuitBreakerMinRequests sets the minimum number of calls in the window to evaluate the failure ratio. It defaults
+// to 10.
+func CircuitBreakerMinRequests(n int) CircuitBreakerOpt {
+	return tricks.ImmutableOption[CircuitBreakerPolicy](func(cbp CircuitBreakerPolicy) CircuitBreakerPolicy {
+		cbp.minRequests = n
+
+		return cbp
+	})
+}
+
+// CircuitBreakerWindow sets the rolling window which is divided to buckets sliding one by one. It defaults to 10
+// buckets of a second.
+func CircuitBreakerWindow(window time.Duration, buckets int) CircuitBreakerOpt {
+	return tricks.ImmutableOption[CircuitBreakerPolicy](func(cbp CircuitBreakerPolicy) CircuitBreakerPolicy {
+		cbp.window = window
+		cbp.buckets = buckets
+
+		return cbp
+	})
+}
+
+// CircuitBreakerOpenTimeout sets how long the circuit stays open before going half-open. It defaults to 30 seconds.
+func CircuitBreakerOpenTimeout(timeout time.Duration) CircuitBreakerOpt {
+	return tricks.ImmutableOption[CircuitBreakerPolicy](func(cbp CircuitBreakerPolicy) CircuitBreakerPolicy {
+		cbp.openTimeout = timeout
+
+		return cbp
+	})
+}
+
+// CircuitBreakerHalfOpenProbes sets the number of calls let through in half-open state. It defaults to 1.
+func CircuitBreakerHalfOpenProbes(n int) CircuitBreakerOpt {
+	return tricks.ImmutableOption[CircuitBreakerPolicy](func(cbp CircuitBreakerPolicy) CircuitBreakerPolicy {
+		cbp.halfOpenProbes = n
+
+		return cbp
+	})
+}
+
+// CircuitBreakerFailureClassifier sets the classifier of errors counted as failures. It defaults to matching
+// bricks.ErrSupplierSide since the other errors don't indicate that downstream is in trouble.
+func CircuitBreakerFailureClassifier(classifier func(err error) bool) CircuitBreakerOpt {
+	return tricks.ImmutableOption[CircuitBreakerPolicy](func(cbp CircuitBreakerPolicy) CircuitBreakerPolicy {
+		cbp.failure = classifier
+
+		return cbp
+	})
+}
+
+// CircuitBreakerMeter sets the meter of state metrics. It defaults to the one of otel.GetMeterProvider.
+func CircuitBreakerMeter(meter metric.Meter) CircuitBreakerOpt {
+	return tricks.ImmutableOption[CircuitBreakerPolicy](func(cbp CircuitBreakerPolicy) CircuitBreakerPolicy {
+		cbp.meter = meter
+
+		return cbp
+	})
+}
+
+// NewCircuitBreaker creates a circuit breaker which is meant to be shared by all the calls to the same downstream,
+// identified by name in metrics and events.
+func NewCircuitBreaker(name string, options ...CircuitBreakerOpt) *CircuitBreaker {
+	cbp := &CircuitBreakerPolicy{
+		failureRatio:   0.5,
+		minRequests:    10,
+		window:         10 * time.Second,
+		buckets:        10,
+		openTimeout:    30 * time.Second,
+		halfOpenProbes: 1,
+		failure: func(err error) bool {
+			return errors.Is(err, bricks.ErrSupplierSide)
+		},
+		meter: otel.GetMeterProvider().Meter(instrumentationName),
+	}
+	cbp = tricks.ApplyOptions(cbp, options...)
+	if cbp.failureRatio <= 0 || cbp.failureRatio > 1 || cbp.window <= 0 || cbp.buckets <= 0 || cbp.halfOpenProbes <= 0 {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("invalid circuit breaker configuration")))
+	}
+
+	cb := &CircuitBreaker{
+		CircuitBreakerPolicy: *cbp,
+		name:                 name,
+		ring:                 make([]circuitBucket, cbp.buckets),
+	}
+
+	cb.transitions, _ = cb.meter.Int64Counter(string(oaCircuitBreaker+".transitions"),
+		metric.WithDescription("Number of circuit breaker state changes"))
+	cb.rejections, _ = cb.meter.Int64Counter(string(oaCircuitBreaker+".rejections"),
+		metric.WithDescription("Number of calls rejected by open circuit breakers"))
+	if gauge, err := cb.meter.Int64ObservableGauge(string(oaCircuitBreaker+".state"),
+		metric.WithDescription("State of the circuit breaker: 0 (closed), 1 (open) or 2 (half-open)"),
+	); err == nil {
+		cb.registration, _ = cb.meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+			o.ObserveInt64(gauge, int64(cb.State()), metric.WithAttributes(oaCircuitBreakerName.String(cb.name)))
+
+			return nil
+		}, gauge)
+	}
+
+	return cb
+}
+
+// Close stops reporting state of the circuit breaker to the meter. Breakers created on the fly (e.g. per tenant)
+// should be closed once they're dropped.
+func (cb *CircuitBreaker) Close() error {
+	if cb.registration == nil {
+		return nil
+	}
+
+	return cb.registration.Unregister()
+}
+
+// State returns the current state of the circuit
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+
+	return cb.currentState(context.Background(), time.Now())
+}
+
+// Do calls fn if the circuit lets it through and records its result. A panic of fn is recorded as a failure and
+// re-panicked.
+func (cb *CircuitBreaker) Do(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	generation, err := cb.allow(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			cb.record(ctx, generation, errors.Join(bricks.ErrInternal, fmt.Errorf("panic: %v", r)))
+
+			panic(r)
+		}
+
+		cb.record(ctx, generation, err)
+	}()
+
+	return fn(ctx)
+}
+
+func (cb *CircuitBreaker) allow(ctx context.Context) (uint64, error) {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+
+	now := time.Now()
+	switch cb.currentState(ctx, now) {
+	case CircuitOpen:
+		cb.rejections.Add(ctx, 1, metric.WithAttributes(oaCircuitBreakerName.String(cb.name)))
+
+		return 0, bricks.ErrorWithDetails(errors.Join(bricks.ErrUnavailable, ErrCircuitOpen),
+			bricks.RetryInfo{RetryDelay: cb.openedAt.Add(cb.openTimeout).Sub(now)})
+
+	case CircuitHalfOpen:
+		if cb.probes >= cb.halfOpenProbes {
+			cb.rejections.Add(ctx, 1, metric.WithAttributes(oaCircuitBreakerName.String(cb.name)))
+
+			return 0, errors.Join(bricks.ErrUnavailable, ErrCircuitOpen)
+		}
+
+		cb.probes++
+	}
+
+	return cb.generation, nil
+}
+
+func (cb *CircuitBreaker) record(ctx context.Context, generation uint64, err error) {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+
+	now := time.Now()
+	state := cb.currentState(ctx, now)
+	if generation != cb.generation {
+		return
+	}
+
+	failed := err != nil && cb.failure(err)
+	switch state {
+	case CircuitClosed:
+		bucket := cb.bucket(now)
+		bucket.total++
+		if failed {
+			bucket.failures++
+		}
+
+		var total, failures int
+		for _, b := range cb.ring {
+			if now.Sub(b.start) < cb.window {
+				total += b.total
+				failures += b.failures
+			}
+		}
+
+		if total >= cb.minRequests && float64(failures) >= cb.failureRatio*float64(total) {
+			cb.transit(ctx, CircuitOpen, now)
+		}
+
+	case CircuitHalfOpen:
+		if failed {
+			cb.transit(ctx, CircuitOpen, now)
+
+			return
+		}
+
+		cb.successes++
+		if cb.successes >= cb.halfOpenProbes {
+			cb.transit(ctx, CircuitClosed, now)
+		}
+	}
+}
+
+// currentState moves the open circuit to half-open once the open timeout elapses
+func (cb *CircuitBreaker) currentState(ctx context.Context, now time.Time) CircuitState {
+	if cb.state == CircuitOpen && now.Sub(cb.openedAt) >= cb.openTimeout {
+		cb.transit(ctx, CircuitHalfOpen, now)
+	}
+
+	return cb.state
+}
+
+func (cb *CircuitBreaker) bucket(now time.Time) *circuitBucket {
+	span := cb.window / time.Duration(cb.buckets)
+	start := now.Truncate(span)
+	bucket := &cb.ring[int(start.UnixNano()/int64(span))%cb.buckets]
+	if !bucket.start.Equal(start) {
+		*bucket = circuitBucket{start: start}
+	}
+
+	return bucket
+}
+
+func (cb *CircuitBreaker) transit(ctx context.Context, to CircuitState, now time.Time) {
+	from := cb.state
+	cb.state = to
+	cb.generation++
+	cb.probes = 0
+	cb.successes = 0
+	if to == CircuitOpen {
+		cb.openedAt = now
+	}
+	if to == CircuitClosed {
+		clear(cb.ring)
+	}
+
+	attrs := []attribute.KeyValue{
+		oaCircuitBreakerName.String(cb.name),
+		oaCircuitBreakerStateFrom.String(from.String()),
+		oaCircuitBreakerStateTo.String(to.String()),
+	}
+	cb.transitions.Add(ctx, 1, metric.WithAttributes(attrs...))
+	trace.SpanFromContext(ctx).AddEvent("circuit breaker state changed", trace.WithAttributes(attrs...))
+}
+
+// HttpCircuitBreakerTripperware guards round trips by the circuit breaker. Push it before (outer than)
+// HttpErrorMapperTripperware to have error statuses mapped to bricks errors.
+func HttpCircuitBreakerTripperware(cb *CircuitBreaker) tricks.Middleware[http.RoundTripper] {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return HttpRoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			var rsp *http.Response
+			err := cb.Do(req.Context(), func(_ context.Context) error {
+				var err error
+				rsp, err = next.RoundTrip(req)
+
+				return err
+			})
+
+			return rsp, err
+		})
+	}
+}
+
+// GrpcUnaryClientCircuitBreakerMiddleware guards calls by the circuit breaker. Push it before (outer than)
+// GrpcUnaryClientErrorMapperMiddleware to have status errors mapped to bricks errors.
+func GrpcUnaryClientCircuitBreakerMiddleware(cb *CircuitBreaker) tricks.Middleware[grpc.UnaryClientInterceptor] {
+	return func(next grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+		return func(
+			ctx context.Context, method string, req, reply any,
+			cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption,
+		) error {
+			return cb.Do(ctx, func(ctx context.Context) error {
+				return next(ctx, method, req, reply, cc, invoker, opts...)
+			})
+		}
+	}
+}
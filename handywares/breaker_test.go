@@ -0,0 +1,119 @@
+package handywares_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := handywares.NewCircuitBreaker("downstream",
+		handywares.CircuitBreakerMinRequests(4),
+		handywares.CircuitBreakerFailureRatio(0.5),
+		handywares.CircuitBreakerOpenTimeout(50*time.Millisecond),
+	)
+	ctx := context.Background()
+
+	fail := func(err error) func(context.Context) error {
+		return func(context.Context) error {
+			return err
+		}
+	}
+
+	for range 3 {
+		require.ErrorIs(t, cb.Do(ctx, fail(bricks.ErrNotFound)), bricks.ErrNotFound)
+	}
+	require.ErrorIs(t, cb.Do(ctx, fail(bricks.ErrUnavailable)), bricks.ErrUnavailable)
+	assert.Equal(t, handywares.CircuitClosed, cb.State(), "customer-side errors don't count")
+
+	for range 4 {
+		_ = cb.Do(ctx, fail(bricks.ErrInternal))
+	}
+	assert.Equal(t, handywares.CircuitOpen, cb.State())
+
+	called := false
+	err := cb.Do(ctx, func(context.Context) error {
+		called = true
+
+		return nil
+	})
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	require.ErrorIs(t, err, handywares.ErrCircuitOpen)
+	assert.False(t, called)
+	ri, ok := bricks.ErrorDetailOf[bricks.RetryInfo](err)
+	assert.True(t, ok)
+	assert.LessOrEqual(t, ri.RetryDelay, 50*time.Millisecond)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, handywares.CircuitHalfOpen, cb.State())
+	require.ErrorIs(t, cb.Do(ctx, fail(bricks.ErrUnavailable)), bricks.ErrUnavailable)
+	assert.Equal(t, handywares.CircuitOpen, cb.State())
+
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, cb.Do(ctx, fail(nil)))
+	assert.Equal(t, handywares.CircuitClosed, cb.State())
+}
+
+func TestCircuitBreakerPanic(t *testing.T) {
+	cb := handywares.NewCircuitBreaker("panicky",
+		handywares.CircuitBreakerMinRequests(1),
+		handywares.CircuitBreakerOpenTimeout(10*time.Millisecond),
+	)
+	t.Cleanup(func() {
+		assert.NoError(t, cb.Close())
+	})
+	ctx := context.Background()
+
+	panicky := func(context.Context) error {
+		panic("boom")
+	}
+
+	assert.PanicsWithValue(t, "boom", func() { _ = cb.Do(ctx, panicky) })
+	assert.Equal(t, handywares.CircuitOpen, cb.State(), "panics count as failures")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.PanicsWithValue(t, "boom", func() { _ = cb.Do(ctx, panicky) })
+	assert.Equal(t, handywares.CircuitOpen, cb.State(), "a panicking probe reopens the circuit")
+
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, cb.Do(ctx, func(context.Context) error { return nil }))
+	assert.Equal(t, handywares.CircuitClosed, cb.State())
+}
+
+func TestGrpcUnaryClientCircuitBreakerMiddleware(t *testing.T) {
+	cb := handywares.NewCircuitBreaker("grpc", handywares.CircuitBreakerMinRequests(2))
+
+	var mws handywares.GrpcUnaryClientMiddlewareStack
+	interceptor := mws.
+		Push(handywares.GrpcUnaryClientCircuitBreakerMiddleware(cb)).
+		Push(handywares.GrpcUnaryClientErrorMapperMiddleware(handywares.GrpcToBricksErrorMapper))(
+		handywares.GrpcUnaryClientInvokerInterceptor,
+	)
+
+	invocations := 0
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn,
+		opts ...grpc.CallOption,
+	) error {
+		invocations++
+
+		return status.Error(codes.Unavailable, "down")
+	}
+
+	for range 3 {
+		_ = interceptor(context.Background(), "/svc/Method", nil, nil, nil, invoker)
+	}
+	assert.Equal(t, 2, invocations)
+
+	err := interceptor(context.Background(), "/svc/Method", nil, nil, nil, invoker)
+	assert.True(t, errors.Is(err, handywares.ErrCircuitOpen))
+}
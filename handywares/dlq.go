@@ -0,0 +1,354 @@
+package handywares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// DeadLetterTaskType is type of asynq tasks carrying dead letters
+const DeadLetterTaskType = "dead_letter"
+
+// DeadLetter is a terminally failed message routed to a dead-letter queue along with the reason of its failure. It's
+// encoded as json on the wire.
+type DeadLetter struct {
+	Source    string              `json:"source"`         // Subject or queue the message was consumed from
+	Type      string              `json:"type,omitempty"` // Task type of asynq tasks
+	Payload   []byte              `json:"payload"`
+	Headers   map[string][]string `json:"headers,omitempty"`
+	Errors    []string            `json:"errors"` // Error chain, the outermost first
+	ErrorCode int                 `json:"error_code"`
+	ErrorName string              `json:"error_name,omitempty"`
+	Retried   int                 `json:"retried"`
+	Trace     map[string]string   `json:"trace,omitempty"` // Context of the span the message failed in
+	FailedAt  time.Time           `json:"failed_at"`
+}
+
+// ParseDeadLetter decodes a dead letter out of the data published by dead letter publishers
+func ParseDeadLetter(data []byte) (DeadLetter, error) {
+	var dl DeadLetter
+	if err := json.Unmarshal(data, &dl); err != nil {
+		return DeadLetter{}, errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	return dl, nil
+}
+
+// DeadLetterPublisher routes the dead letter to a dead-letter queue
+type DeadLetterPublisher func(ctx context.Context, dl DeadLetter) error
+
+// NatsDeadLetterPublisher publishes dead letters to the subject by nc and waits for the server to process them (until
+// ctx is done), so the failed message isn't acknowledged before its dead letter leaves the process. Subjects captured
+// by a JetStream stream may be published by a JetStream context instead to wait for the stream acknowledgement.
+func NatsDeadLetterPublisher(nc *nats.Conn, subject string) DeadLetterPublisher {
+	return func(ctx context.Context, dl DeadLetter) error {
+		data, err := json.Marshal(dl)
+		if err != nil {
+			return errors.Join(bricks.ErrInvalidArgument, err)
+		}
+
+		if err = nc.Publish(subject, data); err != nil {
+			return errors.Join(bricks.ErrUnavailable, err)
+		}
+
+		return natsFlush(ctx, nc)
+	}
+}
+
+// natsFlush waits for the server to process the messages published by nc until ctx is done, or the default timeout
+// of nats if ctx has no deadline
+func natsFlush(ctx context.Context, nc *nats.Conn) error {
+	var err error
+	if _, ok := ctx.Deadline(); ok {
+		err = nc.FlushWithContext(ctx)
+	} else {
+		err = nc.Flush()
+	}
+
+	if err != nil {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	return nil
+}
+
+// AsynqDeadLetterPublisher enqueues dead letters as tasks of DeadLetterTaskType to the queue
+func AsynqDeadLetterPublisher(enqueuer AsynqEnqueuer, queue string) DeadLetterPublisher {
+	return func(ctx context.Context, dl DeadLetter) error {
+		data, err := json.Marshal(dl)
+		if err != nil {
+			return errors.Join(bricks.ErrInvalidArgument, err)
+		}
+
+		_, err = enqueuer.EnqueueContext(ctx, asynq.NewTask(DeadLetterTaskType, data), asynq.Queue(queue),
+			asynq.MaxRetry(0))
+
+		return err
+	}
+}
+
+// DeadLetterPolicy is the common configuration of dead letter middlewares of all stacks
+type DeadLetterPolicy struct {
+	propagator propagation.TextMapPropagator
+}
+
+type DeadLetterOpt = tricks.Option[DeadLetterPolicy]
+
+// DeadLetterPropagator sets the propagator of trace context of dead letters. It defaults to the global one.
+func DeadLetterPropagator(propagator propagation.TextMapPropagator) DeadLetterOpt {
+	return tricks.ImmutableOption[DeadLetterPolicy](func(dlp DeadLetterPolicy) DeadLetterPolicy {
+		dlp.propagator = propagator
+
+		return dlp
+	})
+}
+
+func newDeadLetterPolicy(options ...DeadLetterOpt) *DeadLetterPolicy {
+	dlp := &DeadLetterPolicy{
+		propagator: otel.GetTextMapPropagator(),
+	}
+
+	return tricks.ApplyOptions(dlp, options...)
+}
+
+// letter fills in the failure of dl caused by err
+func (dlp DeadLetterPolicy) letter(ctx context.Context, dl DeadLetter, err error) DeadLetter {
+	dl.Errors = errorChain(err)
+	if ec, ok := bricks.ErrorCodeOf(err); ok {
+		dl.ErrorCode = ec.Code
+		dl.ErrorName = ec.Name
+	}
+
+	dl.Trace = make(map[string]string)
+	dlp.propagator.Inject(ctx, propagation.MapCarrier(dl.Trace))
+	dl.FailedAt = time.Now().UTC()
+
+	return dl
+}
+
+// deadLetterHeaders converts single-value headers (e.g. of asynq tasks) to headers of dead letters
+func deadLetterHeaders(headers map[string]string) map[string][]string {
+	if headers == nil {
+		return nil
+	}
+
+	dh := make(map[string][]string, len(headers))
+	for k, v := range headers {
+		dh[k] = []string{v}
+	}
+
+	return dh
+}
+
+// route publishes the dead letter of the message failed by err. The message is considered handled once it's routed to
+// the dead-letter queue, otherwise both errors are returned.
+func (dlp DeadLetterPolicy) route(
+	ctx context.Context, publisher DeadLetterPublisher, dl DeadLetter, err error,
+) error {
+	if perr := publisher(ctx, dlp.letter(ctx, dl, err)); perr != nil {
+		return errors.Join(err, perr)
+	}
+
+	return nil
+}
+
+// errorChain flattens joined errors of the err tree to their messages. Wrapped errors are represented by messages of
+// their wrappers.
+func errorChain(err error) []string {
+	if err == nil {
+		return nil
+	}
+
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var chain []string
+		for _, child := range joined.Unwrap() {
+			chain = append(chain, errorChain(child)...)
+		}
+
+		return chain
+	}
+
+	return []string{err.Error()}
+}
+
+// MsgDeadLetterMiddleware routes messages failed by non-retryable errors to a dead-letter queue by the publisher. The
+// extractor returns the message as a DeadLetter with its source, payload, headers and retry count. Push it before
+// (outer than) MsgCompensatorMiddleware to dead-letter messages after they're compensated.
+func MsgDeadLetterMiddleware[M any](
+	publisher DeadLetterPublisher, extractor func(msg M) DeadLetter, options ...DeadLetterOpt,
+) tricks.Middleware[MsgHandler[M]] {
+	if publisher == nil || extractor == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty dead letter publisher or message extractor")))
+	}
+
+	dlp := newDeadLetterPolicy(options...)
+
+	return func(next MsgHandler[M]) MsgHandler[M] {
+		return func(ctx context.Context, msg M) error {
+			err := next(ctx, msg)
+			if err == nil || errors.Is(err, bricks.ErrRetryable) {
+				return err
+			}
+
+			return dlp.route(ctx, publisher, extractor(msg), err)
+		}
+	}
+}
+
+// NatsDeadLetterMiddleware is the nats counterpart of MsgDeadLetterMiddleware. Retry count of JetStream messages is
+// taken from their delivery count.
+func NatsDeadLetterMiddleware(
+	publisher DeadLetterPublisher, options ...DeadLetterOpt,
+) tricks.Middleware[NatsMsgHandler] {
+	if publisher == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty dead letter publisher")))
+	}
+
+	dlp := newDeadLetterPolicy(options...)
+
+	return func(next NatsMsgHandler) NatsMsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			err := next(ctx, msg)
+			if err == nil || errors.Is(err, bricks.ErrRetryable) {
+				return err
+			}
+
+			dl := DeadLetter{
+				Source:  msg.Subject,
+				Payload: msg.Data,
+				Headers: make(map[string][]string, len(msg.Header)),
+			}
+			for k, vv := range msg.Header {
+				dl.Headers[k] = slices.Clone(vv)
+			}
+			if meta, merr := msg.Metadata(); merr == nil && meta.NumDelivered > 0 {
+				dl.Retried = int(meta.NumDelivered - 1)
+			}
+
+			return dlp.route(ctx, publisher, dl, err)
+		}
+	}
+}
+
+// AsynqDeadLetterMiddleware routes tasks to a dead-letter queue by the publisher once they run out of retries or fail
+// by non-retryable errors. Push it before (outer than) AsynqCompensatorMiddleware to dead-letter tasks after they're
+// compensated.
+func AsynqDeadLetterMiddleware(
+	publisher DeadLetterPublisher, options ...DeadLetterOpt,
+) tricks.Middleware[asynq.Handler] {
+	if publisher == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty dead letter publisher")))
+	}
+
+	dlp := newDeadLetterPolicy(options...)
+
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+			err := next.ProcessTask(ctx, task)
+			if err == nil {
+				return nil
+			}
+
+			retries, _ := asynq.GetRetryCount(ctx)
+			maxRetry, _ := asynq.GetMaxRetry(ctx)
+			if retries < maxRetry && errors.Is(err, bricks.ErrRetryable) {
+				return err
+			}
+
+			headers, payload := asynqContextHeaders(ctx, task)
+			queue, _ := asynq.GetQueueName(ctx)
+
+			return dlp.route(ctx, publisher, DeadLetter{
+				Source:  queue,
+				Type:    task.Type(),
+				Payload: payload,
+				Headers: deadLetterHeaders(headers),
+				Retried: retries,
+			}, err)
+		})
+	}
+}
+
+// DeadLetterReplayer re-injects the message of a dead letter into its source
+type DeadLetterReplayer func(ctx context.Context, dl DeadLetter) error
+
+// NatsDeadLetterReplayer publishes payload of dead letters to their source subject along with their headers by nc
+// and waits for the server to process them like NatsDeadLetterPublisher. Nats-Msg-Id is rewritten to a replay id of
+// the dead letter (the original one suffixed by the time it failed), so jetstream doesn't drop the replay as a
+// duplicate of the original message but does drop the repeated replays of the same dead letter.
+func NatsDeadLetterReplayer(nc *nats.Conn) DeadLetterReplayer {
+	return func(ctx context.Context, dl DeadLetter) error {
+		msg := nats.NewMsg(dl.Source)
+		msg.Data = dl.Payload
+		for k, vv := range dl.Headers {
+			msg.Header[k] = slices.Clone(vv)
+		}
+		if id := msg.Header.Get(nats.MsgIdHdr); len(id) > 0 {
+			msg.Header.Set(nats.MsgIdHdr, fmt.Sprintf("%s:replay:%d", id, dl.FailedAt.UnixNano()))
+		}
+
+		if err := nc.PublishMsg(msg); err != nil {
+			return errors.Join(bricks.ErrUnavailable, err)
+		}
+
+		return natsFlush(ctx, nc)
+	}
+}
+
+// AsynqDeadLetterReplayer enqueues tasks of dead letters to their source queue along with their headers
+func AsynqDeadLetterReplayer(enqueuer AsynqEnqueuer) DeadLetterReplayer {
+	return func(ctx context.Context, dl DeadLetter) error {
+		var oo []asynq.Option
+		if len(dl.Source) > 0 {
+			oo = append(oo, asynq.Queue(dl.Source))
+		}
+
+		headers := make(map[string]string, len(dl.Headers))
+		for k, vv := range dl.Headers {
+			if len(vv) > 0 {
+				headers[k] = vv[0]
+			}
+		}
+
+		_, err := enqueuer.EnqueueContext(ctx, NewAsynqTask(dl.Type, dl.Payload, headers), oo...)
+
+		return err
+	}
+}
+
+// NatsDeadLetterReplayHandler replays dead letters published by NatsDeadLetterPublisher. Subscribe it to the
+// dead-letter subject (or bind it to a JetStream consumer of it) to re-inject the failed messages, e.g. once the
+// cause of their failure is fixed.
+func NatsDeadLetterReplayHandler(replayer DeadLetterReplayer) NatsMsgHandler {
+	return func(ctx context.Context, msg *nats.Msg) error {
+		dl, err := ParseDeadLetter(msg.Data)
+		if err != nil {
+			return err
+		}
+
+		return replayer(ctx, dl)
+	}
+}
+
+// AsynqDeadLetterReplayHandler is the asynq counterpart of NatsDeadLetterReplayHandler. Run it for DeadLetterTaskType
+// on the dead-letter queue.
+func AsynqDeadLetterReplayHandler(replayer DeadLetterReplayer) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		dl, err := ParseDeadLetter(task.Payload())
+		if err != nil {
+			return errors.Join(asynq.SkipRetry, err)
+		}
+
+		return replayer(ctx, dl)
+	})
+}
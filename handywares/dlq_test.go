@@ -0,0 +1,145 @@
+package handywares_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+func TestMsgDeadLetterMiddleware(t *testing.T) {
+	var (
+		mws     handywares.MsgMiddlewareStack[bricks.MessageEnvelope]
+		letters []handywares.DeadLetter
+	)
+	handler := mws.Push(handywares.MsgDeadLetterMiddleware(
+		func(ctx context.Context, dl handywares.DeadLetter) error {
+			letters = append(letters, dl)
+
+			return nil
+		},
+		func(msg bricks.MessageEnvelope) handywares.DeadLetter {
+			return handywares.DeadLetter{Source: "orders", Payload: msg.Note, Retried: int(msg.Retried)}
+		},
+		handywares.DeadLetterPropagator(propagation.TraceContext{}),
+	))(func(ctx context.Context, msg bricks.MessageEnvelope) error {
+		if msg.Id == "retry" {
+			return bricks.ErrUnavailable
+		}
+
+		return errors.Join(fmt.Errorf("order %s: %w", msg.Id, bricks.ErrInvalidArgument), errors.New("compensated"))
+	})
+
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01},
+		SpanID:     trace.SpanID{0x02},
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	require.ErrorIs(t, handler(ctx, bricks.MessageEnvelope{Id: "retry"}), bricks.ErrUnavailable)
+	assert.Empty(t, letters)
+
+	require.NoError(t, handler(ctx, bricks.MessageEnvelope{Id: "o1", Retried: 2, Note: []byte("note")}))
+	require.Len(t, letters, 1)
+
+	dl := letters[0]
+	assert.Equal(t, "orders", dl.Source)
+	assert.Equal(t, []byte("note"), dl.Payload)
+	assert.Equal(t, 2, dl.Retried)
+	assert.Equal(t, []string{"order o1: " + bricks.ErrInvalidArgument.Error(), "compensated"}, dl.Errors)
+	assert.Equal(t, bricks.ErrCodeInvalidArgument, dl.ErrorCode)
+	assert.Equal(t, "invalid_argument", dl.ErrorName)
+	assert.Equal(t, "00-01000000000000000000000000000000-0200000000000000-01", dl.Trace["traceparent"])
+	assert.WithinDuration(t, time.Now(), dl.FailedAt, time.Second)
+}
+
+func TestNatsDeadLetterReplay(t *testing.T) {
+	nc := runNats(t)
+
+	dlq, err := nc.SubscribeSync("orders.dlq")
+	require.NoError(t, err)
+	orders, err := nc.SubscribeSync("orders.created")
+	require.NoError(t, err)
+
+	var mws handywares.NatsMiddlewareStack
+	handler := mws.Push(handywares.NatsDeadLetterMiddleware(handywares.NatsDeadLetterPublisher(nc, "orders.dlq")))(
+		func(ctx context.Context, msg *nats.Msg) error {
+			return bricks.ErrFailedPrecondition
+		},
+	)
+
+	msg := nats.NewMsg("orders.created")
+	msg.Data = []byte(`{"id":1}`)
+	msg.Header.Set("X-Request-ID", "req-1")
+	msg.Header.Set(nats.MsgIdHdr, "m1")
+	msg.Header.Add("Baggage", "a=1")
+	msg.Header.Add("Baggage", "b=2")
+	require.NoError(t, handler(context.Background(), msg))
+
+	letter, err := dlq.NextMsg(time.Second)
+	require.NoError(t, err)
+
+	dl, err := handywares.ParseDeadLetter(letter.Data)
+	require.NoError(t, err)
+	assert.Equal(t, "orders.created", dl.Source)
+	assert.Equal(t, bricks.ErrCodeFailedPrecondition, dl.ErrorCode)
+
+	require.NoError(t, handywares.NatsDeadLetterReplayHandler(handywares.NatsDeadLetterReplayer(nc))(
+		context.Background(), letter,
+	))
+
+	replayed, err := orders.NextMsg(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Data, replayed.Data)
+	assert.Equal(t, "req-1", replayed.Header.Get("X-Request-ID"))
+	assert.Equal(t, []string{"a=1", "b=2"}, replayed.Header.Values("Baggage"))
+	assert.Equal(t, fmt.Sprintf("m1:replay:%d", dl.FailedAt.UnixNano()), replayed.Header.Get(nats.MsgIdHdr))
+
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	cancel()
+	err = handywares.NatsDeadLetterPublisher(nc, "orders.dlq")(expired, handywares.DeadLetter{})
+	require.ErrorIs(t, err, bricks.ErrUnavailable, "waiting for the server honors ctx")
+}
+
+func TestAsynqDeadLetterMiddleware(t *testing.T) {
+	var enqueued []*asynq.Task
+	enqueuer := handywares.AsynqEnqueuerFunc(
+		func(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+			enqueued = append(enqueued, task)
+
+			return &asynq.TaskInfo{}, nil
+		},
+	)
+
+	var mws handywares.AsynqMiddlewareStack
+	handler := mws.Push(handywares.AsynqDeadLetterMiddleware(handywares.AsynqDeadLetterPublisher(enqueuer, "dlq")))(
+		asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+			return errors.Join(bricks.ErrUnavailable, bricks.ErrRetryable)
+		}),
+	)
+
+	task := handywares.NewAsynqTask("email:send", []byte("payload"), map[string]string{"k": "v"})
+	require.NoError(t, handler.ProcessTask(context.Background(), task))
+	require.Len(t, enqueued, 1)
+	assert.Equal(t, handywares.DeadLetterTaskType, enqueued[0].Type())
+
+	require.NoError(t, handywares.AsynqDeadLetterReplayHandler(handywares.AsynqDeadLetterReplayer(enqueuer)).
+		ProcessTask(context.Background(), enqueued[0]))
+	require.Len(t, enqueued, 2)
+
+	headers, payload := handywares.AsynqTaskHeaders(enqueued[1])
+	assert.Equal(t, "email:send", enqueued[1].Type())
+	assert.Equal(t, []byte("payload"), payload)
+	assert.Equal(t, map[string]string{"k": "v"}, headers)
+}
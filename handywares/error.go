@@ -1,15 +1,27 @@
 package handywares
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/janstoon/toolbox/bricks"
 	"github.com/janstoon/toolbox/tricks"
 	"github.com/redis/go-redis/v9"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 var httpStatusToBricksErr = map[int]error{
@@ -43,35 +55,79 @@ func HttpStatusToBricksError(code int, err error) error {
 	return errors.Join(ferr, fmt.Errorf("http status (%d): %s", code, http.StatusText(code)))
 }
 
+// HttpToBricksErrorMapper maps the response status to bricks error. It also restores bricks.ErrorDetail(s) from
+// Retry-After header and problem details body (RFC 9457) written by HttpProblemWriter.
 func HttpToBricksErrorMapper(rsp *http.Response, err error) (*http.Response, error) {
-	return rsp, HttpStatusToBricksError(tricks.PtrVal(rsp).StatusCode, err)
+	berr := HttpStatusToBricksError(tricks.PtrVal(rsp).StatusCode, err)
+	if berr == nil {
+		return rsp, nil
+	}
+
+	return rsp, bricks.ErrorWithDetails(berr, httpResponseErrorDetails(rsp)...)
+}
+
+func httpResponseErrorDetails(rsp *http.Response) []bricks.ErrorDetail {
+	if rsp == nil {
+		return nil
+	}
+
+	var dd []bricks.ErrorDetail
+	if mt, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type")); mt == HttpProblemContentType && rsp.Body != nil {
+		bb, err := io.ReadAll(rsp.Body)
+		_ = rsp.Body.Close()
+		rsp.Body = io.NopCloser(bytes.NewReader(bb))
+
+		var problem HttpProblem
+		if err == nil && json.Unmarshal(bb, &problem) == nil {
+			dd = httpProblemErrorDetails(problem)
+		}
+	}
+
+	if !tricks.SliceAny(dd, tricks.MatcherFunc[bricks.ErrorDetail](func(d bricks.ErrorDetail) bool {
+		_, ok := d.(bricks.RetryInfo)
+
+		return ok
+	})) {
+		if delay, ok := httpParseRetryAfter(rsp.Header.Get("Retry-After")); ok {
+			dd = append(dd, bricks.RetryInfo{RetryDelay: delay})
+		}
+	}
+
+	return dd
+}
+
+func httpParseRetryAfter(v string) (time.Duration, bool) {
+	if len(v) == 0 {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(v); err == nil {
+		return max(time.Until(at), 0), true
+	}
+
+	return 0, false
 }
 
-var bricksErrCodeToHttpStatus = map[int]int{
-	bricks.ErrCodeInvalidArgument:    http.StatusBadRequest,
-	bricks.ErrCodeUnauthenticated:    http.StatusUnauthorized,
-	bricks.ErrCodePermissionDenied:   http.StatusForbidden,
-	bricks.ErrCodeNotFound:           http.StatusNotFound,
-	bricks.ErrCodeAlreadyExists:      http.StatusConflict,
-	bricks.ErrCodeFailedPrecondition: http.StatusPreconditionFailed,
-	bricks.ErrCodeOutOfRange:         http.StatusRequestedRangeNotSatisfiable,
-
-	bricks.ErrCodeUnimplemented: http.StatusNotImplemented,
-	bricks.ErrCodeUnavailable:   http.StatusServiceUnavailable,
+func httpFormatRetryAfter(delay time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(delay.Seconds())))
 }
 
+// BricksErrorToHttpStatusMapper maps err to the http status of its error code, consulting the bricks error code
+// registry so custom codes are mapped as they're registered. Uncoded errors are mapped to 500.
 func BricksErrorToHttpStatusMapper(err error) int {
-	code := http.StatusInternalServerError
-	var coded bricks.Coded
-	if errors.As(err, &coded) {
-		if v, ok := bricksErrCodeToHttpStatus[coded.Code()]; ok {
-			code = v
-		}
+	if ec, ok := bricks.ErrorCodeOf(err); ok && ec.HttpStatus > 0 {
+		return ec.HttpStatus
 	}
 
-	return code
+	return http.StatusInternalServerError
 }
 
+// BricksToGrpcErrorMapper converts err to grpc status of its error code, consulting the bricks error code registry so
+// custom codes are converted as they're registered. Attached bricks.ErrorDetail(s) are carried as status details.
 func BricksToGrpcErrorMapper(err error) error {
 	if err == nil {
 		return nil
@@ -79,11 +135,22 @@ func BricksToGrpcErrorMapper(err error) error {
 
 	code := codes.Unknown
 	var coded bricks.Coded
-	if errors.As(err, &coded) {
+	if ec, ok := bricks.ErrorCodeOf(err); ok {
+		code = codes.Code(ec.GrpcCode)
+	} else if errors.As(err, &coded) {
 		code = codes.Code(coded.Code())
 	}
 
-	return status.Error(code, err.Error())
+	st := status.New(code, err.Error())
+	if dd := bricks.ErrorDetails(err); len(dd) > 0 {
+		if detailed, derr := st.WithDetails(tricks.SliceMap[[]bricks.ErrorDetail, []protoadapt.MessageV1](
+			dd, bricksErrorDetailToProto,
+		)...); derr == nil {
+			st = detailed
+		}
+	}
+
+	return st.Err()
 }
 
 var grpcCodeToBricksErr = map[codes.Code]error{
@@ -116,7 +183,16 @@ func GrpcToBricksErrorMapper(err error) error {
 		berr = v
 	}
 
-	return errors.Join(berr, err)
+	var dd []bricks.ErrorDetail
+	if st, ok := status.FromError(err); ok {
+		for _, detail := range st.Details() {
+			if d, ok := protoToBricksErrorDetail(detail); ok {
+				dd = append(dd, d)
+			}
+		}
+	}
+
+	return bricks.ErrorWithDetails(errors.Join(berr, err), dd...)
 }
 
 func RedisToBricksError(err error) error {
@@ -137,3 +213,118 @@ func RedisToBricksError(err error) error {
 
 	return errW
 }
+
+func bricksErrorDetailToProto(detail bricks.ErrorDetail) protoadapt.MessageV1 {
+	switch d := detail.(type) {
+	case bricks.BadRequest:
+		return &errdetails.BadRequest{
+			FieldViolations: tricks.SliceMap[[]bricks.FieldViolation, []*errdetails.BadRequest_FieldViolation](
+				d.FieldViolations,
+				func(src bricks.FieldViolation) *errdetails.BadRequest_FieldViolation {
+					return &errdetails.BadRequest_FieldViolation{
+						Field:       src.Field,
+						Description: src.Description,
+					}
+				},
+			),
+		}
+
+	case bricks.RetryInfo:
+		return &errdetails.RetryInfo{RetryDelay: durationpb.New(d.RetryDelay)}
+
+	case bricks.ErrorInfo:
+		return &errdetails.ErrorInfo{Reason: d.Reason, Domain: d.Domain, Metadata: d.Metadata}
+
+	case bricks.LocalizedMessage:
+		return &errdetails.LocalizedMessage{Locale: d.Locale, Message: d.Message}
+	}
+
+	return nil
+}
+
+func protoToBricksErrorDetail(detail any) (bricks.ErrorDetail, bool) {
+	switch d := detail.(type) {
+	case *errdetails.BadRequest:
+		return bricks.BadRequest{
+			FieldViolations: tricks.SliceMap[[]*errdetails.BadRequest_FieldViolation, []bricks.FieldViolation](
+				d.GetFieldViolations(),
+				func(src *errdetails.BadRequest_FieldViolation) bricks.FieldViolation {
+					return bricks.FieldViolation{
+						Field:       src.GetField(),
+						Description: src.GetDescription(),
+					}
+				},
+			),
+		}, true
+
+	case *errdetails.RetryInfo:
+		return bricks.RetryInfo{RetryDelay: d.GetRetryDelay().AsDuration()}, true
+
+	case *errdetails.ErrorInfo:
+		return bricks.ErrorInfo{Reason: d.GetReason(), Domain: d.GetDomain(), Metadata: d.GetMetadata()}, true
+
+	case *errdetails.LocalizedMessage:
+		return bricks.LocalizedMessage{Locale: d.GetLocale(), Message: d.GetMessage()}, true
+	}
+
+	return nil, false
+}
+
+// httpProblemDetailsMember is the problem details extension member which carries bricks.ErrorDetail(s) in the
+// json representation of google.rpc.Status details.
+const httpProblemDetailsMember = "details"
+
+func bricksErrorDetailsToHttpProblemExtension(dd []bricks.ErrorDetail) []json.RawMessage {
+	ext := make([]json.RawMessage, 0, len(dd))
+	for _, detail := range dd {
+		msg := bricksErrorDetailToProto(detail)
+		if msg == nil {
+			continue
+		}
+
+		packed, err := anypb.New(protoadapt.MessageV2Of(msg))
+		if err != nil {
+			continue
+		}
+
+		bb, err := protojson.Marshal(packed)
+		if err != nil {
+			continue
+		}
+
+		ext = append(ext, bb)
+	}
+
+	return ext
+}
+
+func httpProblemErrorDetails(problem HttpProblem) []bricks.ErrorDetail {
+	raw, ok := problem.Extensions[httpProblemDetailsMember].(json.RawMessage)
+	if !ok {
+		return nil
+	}
+
+	var rr []json.RawMessage
+	if err := json.Unmarshal(raw, &rr); err != nil {
+		return nil
+	}
+
+	var dd []bricks.ErrorDetail
+	for _, r := range rr {
+		var packed anypb.Any
+		if err := protojson.Unmarshal(r, &packed); err != nil {
+			continue
+		}
+
+		msg, err := packed.UnmarshalNew()
+		if err != nil {
+			continue
+		}
+
+		if d, ok := protoToBricksErrorDetail(msg); ok {
+			dd = append(dd, d)
+		}
+	}
+
+	return dd
+}
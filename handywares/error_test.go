@@ -0,0 +1,115 @@
+package handywares_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+var (
+	testBadRequest = bricks.BadRequest{FieldViolations: []bricks.FieldViolation{
+		{Field: "items[0].quantity", Description: "must be positive"},
+	}}
+	testRetryInfo = bricks.RetryInfo{RetryDelay: 2 * time.Second}
+	testErrorInfo = bricks.ErrorInfo{
+		Reason: "STOCK_DEPLETED", Domain: "ordering", Metadata: map[string]string{"sku": "s1"},
+	}
+	testLocalizedMessage = bricks.LocalizedMessage{Locale: "en-US", Message: "Out of stock"}
+)
+
+func TestGrpcErrorDetailsRoundTrip(t *testing.T) {
+	err := bricks.ErrorWithDetails(bricks.ErrInvalidArgument,
+		testBadRequest, testRetryInfo, testErrorInfo, testLocalizedMessage)
+
+	gerr := handywares.BricksToGrpcErrorMapper(err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(gerr))
+	assert.Len(t, status.Convert(gerr).Details(), 4)
+
+	berr := handywares.GrpcToBricksErrorMapper(gerr)
+	require.ErrorIs(t, berr, bricks.ErrInvalidArgument)
+	assert.Equal(t, []bricks.ErrorDetail{testBadRequest, testRetryInfo, testErrorInfo, testLocalizedMessage},
+		bricks.ErrorDetails(berr))
+}
+
+func TestHttpErrorDetailsRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(handywares.HttpErrorHandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+		if req.URL.Path == "/unavailable" {
+			return bricks.ErrorWithDetails(
+				errors.Join(bricks.ErrUnavailable, errors.New("db is down")), testRetryInfo, testErrorInfo)
+		}
+
+		return bricks.ErrorWithDetails(bricks.ErrInvalidArgument, testBadRequest, testLocalizedMessage)
+	}))
+	defer srv.Close()
+
+	var tws handywares.HttpTripperwareStack
+	client := http.Client{
+		Transport: tws.Push(handywares.HttpErrorMapperTripperware(handywares.HttpToBricksErrorMapper))(
+			http.DefaultTransport),
+	}
+
+	do := func(path string) error {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+path, nil)
+		require.NoError(t, err)
+
+		rsp, err := client.Do(req)
+		if rsp != nil {
+			_ = rsp.Body.Close()
+		}
+
+		return err
+	}
+
+	err := do("/invalid")
+	require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+	assert.Equal(t, []bricks.ErrorDetail{testBadRequest, testLocalizedMessage}, bricks.ErrorDetails(err))
+
+	err = do("/unavailable")
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	assert.Equal(t, []bricks.ErrorDetail{testRetryInfo, testErrorInfo}, bricks.ErrorDetails(err))
+}
+
+func TestHttpRetryAfterErrorDetail(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Retry-After", "7")
+	rec.WriteHeader(http.StatusTooManyRequests)
+
+	_, err := handywares.HttpToBricksErrorMapper(rec.Result(), nil)
+	require.ErrorIs(t, err, bricks.ErrResourceExhausted)
+
+	ri, ok := bricks.ErrorDetailOf[bricks.RetryInfo](err)
+	assert.True(t, ok)
+	assert.Equal(t, 7*time.Second, ri.RetryDelay)
+}
+
+var errCodeQuotaDepleted = bricks.MustRegisterErrorCode(bricks.ErrorCode{
+	Code:       2001,
+	Name:       "quota_depleted",
+	Parent:     bricks.ErrCodeFailedPrecondition,
+	HttpStatus: http.StatusPaymentRequired,
+	GrpcCode:   int(codes.ResourceExhausted),
+})
+
+func TestCustomErrorCodeMapping(t *testing.T) {
+	err := bricks.ErrorWithCode(errCodeQuotaDepleted, errors.New("monthly quota depleted"))
+
+	assert.Equal(t, http.StatusPaymentRequired, handywares.BricksErrorToHttpStatusMapper(err))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(handywares.BricksToGrpcErrorMapper(err)))
+
+	assert.Equal(t, http.StatusInternalServerError,
+		handywares.BricksErrorToHttpStatusMapper(bricks.ErrResourceExhausted))
+	assert.Equal(t, http.StatusTooManyRequests, handywares.BricksErrorToHttpStatusMapper(handywares.ErrLimitExceeded))
+	assert.Equal(t, http.StatusInternalServerError, handywares.BricksErrorToHttpStatusMapper(errors.New("uncoded")))
+	assert.Equal(t, codes.Unknown, status.Code(handywares.BricksToGrpcErrorMapper(errors.New("uncoded"))))
+}
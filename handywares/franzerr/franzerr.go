@@ -0,0 +1,25 @@
+// Package franzerr extracts kafka error codes of twmb/franz-go errors for handywares.KafkaErrorMapper
+package franzerr
+
+import (
+	"errors"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+// KafkaCodeOf returns code of the franz-go error in the err tree
+func KafkaCodeOf(err error) (int, bool) {
+	var kerrr *kerr.Error
+	if errors.As(err, &kerrr) && kerrr != nil {
+		return int(kerrr.Code), true
+	}
+
+	return 0, false
+}
+
+// KafkaCodeExtractor makes the mapper extract codes of franz-go errors by KafkaCodeOf
+func KafkaCodeExtractor() handywares.KafkaErrorMapperOpt {
+	return handywares.KafkaCodeExtractor(KafkaCodeOf)
+}
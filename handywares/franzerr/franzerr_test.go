@@ -0,0 +1,23 @@
+package franzerr_test
+
+import (
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kerr"
+
+	"github.com/janstoon/toolbox/handywares"
+	"github.com/janstoon/toolbox/handywares/franzerr"
+)
+
+func TestKafkaCodeExtractor(t *testing.T) {
+	mapper := handywares.NewKafkaErrorMapper(franzerr.KafkaCodeExtractor())
+
+	assert.ErrorIs(t, mapper.Map(kerr.RebalanceInProgress), bricks.ErrAborted)
+	assert.ErrorIs(t, mapper.Map(kerr.TopicAuthorizationFailed), bricks.ErrPermissionDenied)
+	assert.NotPanics(t, func() {
+		var nilErr *kerr.Error
+		_ = mapper.Map(nilErr)
+	})
+}
@@ -3,34 +3,35 @@ package handywares
 import (
 	"context"
 	"errors"
-	"fmt"
-	"runtime/debug"
+	"io"
+	"log"
 	"strings"
 
 	"github.com/janstoon/toolbox/bricks"
 	"github.com/janstoon/toolbox/tricks"
 	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type GrpcUnaryServerMiddlewareStack = tricks.MiddlewareStack[grpc.UnaryServerInterceptor]
 
-type PanicRecoverGrpcMiddlewareOpt = tricks.MutableOption[any]
+type PanicRecoverGrpcMiddlewareOpt = PanicRecoverOpt
 
+// GrpcPanicRecoverMiddleware converts panics to status of bricks.ErrInternal
 func GrpcPanicRecoverMiddleware(
 	options ...PanicRecoverGrpcMiddlewareOpt,
 ) tricks.Middleware[grpc.UnaryServerInterceptor] {
+	pr := newGrpcPanicRecoverer(options...)
+
 	return func(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
 		return func(
 			ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
 		) (resp any, err error) {
 			defer func() {
 				if r := recover(); r != nil {
-					span := trace.SpanFromContext(ctx)
-					span.AddEvent("panic recovered", trace.WithAttributes(
-						oaPanicValue.String(fmt.Sprintf("%+v", r)),
-						oaDebugStack.String(string(debug.Stack())),
-					))
+					err = grpcPanicStatus(pr.recovered(ctx, r))
 				}
 			}()
 
@@ -58,12 +59,21 @@ func OtelGrpcSpanNamePrefix(prefix string) OpenTelemetryGrpcMiddlewareOpt {
 func GrpcOpenTelemetryMiddleware(
 	tracer trace.Tracer, options ...OpenTelemetryGrpcMiddlewareOpt,
 ) tricks.Middleware[grpc.UnaryServerInterceptor] {
+	return newOtelGmw(tracer, options...).builder
+}
+
+func GrpcStreamOpenTelemetryMiddleware(
+	tracer trace.Tracer, options ...OpenTelemetryGrpcMiddlewareOpt,
+) tricks.Middleware[grpc.StreamServerInterceptor] {
+	return newOtelGmw(tracer, options...).streamBuilder
+}
+
+func newOtelGmw(tracer trace.Tracer, options ...OpenTelemetryGrpcMiddlewareOpt) *OtelGmw {
 	gmw := &OtelGmw{
 		tracer: tracer,
 	}
-	gmw = tricks.ApplyOptions(gmw, options...)
 
-	return gmw.builder
+	return tricks.ApplyOptions(gmw, options...)
 }
 
 func (gmw OtelGmw) builder(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
@@ -76,6 +86,16 @@ func (gmw OtelGmw) builder(next grpc.UnaryServerInterceptor) grpc.UnaryServerInt
 	}
 }
 
+func (gmw OtelGmw) streamBuilder(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := gmw.tracer.Start(ss.Context(), gmw.spanName(info.FullMethod),
+			trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		return next(srv, GrpcServerStreamWithContext(ctx, ss), info, handler)
+	}
+}
+
 func (gmw OtelGmw) spanName(opId string) string {
 	sb := strings.Builder{}
 	if len(strings.TrimSpace(gmw.namePrefix)) > 0 {
@@ -133,3 +153,194 @@ func GrpcUnaryClientErrorMapperMiddleware(mapper func(error) error) tricks.Middl
 		}
 	}
 }
+
+// GrpcUnaryClientRetryMiddleware retries calls failed with retryable errors according to the policy. Push it before
+// (outer than) GrpcUnaryClientErrorMapperMiddleware to have status errors mapped to bricks errors.
+func GrpcUnaryClientRetryMiddleware(policy bricks.RetryPolicy) tricks.Middleware[grpc.UnaryClientInterceptor] {
+	return func(next grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+		return func(
+			ctx context.Context, method string, req, reply any,
+			cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption,
+		) error {
+			return bricks.Retry(ctx, policy, func(ctx context.Context) error {
+				return next(ctx, method, req, reply, cc, invoker, opts...)
+			})
+		}
+	}
+}
+
+type GrpcStreamServerMiddlewareStack = tricks.MiddlewareStack[grpc.StreamServerInterceptor]
+
+// GrpcStreamPanicRecoverMiddleware converts panics to status of bricks.ErrInternal
+func GrpcStreamPanicRecoverMiddleware(
+	options ...PanicRecoverGrpcMiddlewareOpt,
+) tricks.Middleware[grpc.StreamServerInterceptor] {
+	pr := newGrpcPanicRecoverer(options...)
+
+	return func(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+		return func(
+			srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+		) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = grpcPanicStatus(pr.recovered(ss.Context(), r))
+				}
+			}()
+
+			return next(srv, ss, info, handler)
+		}
+	}
+}
+
+// newGrpcPanicRecoverer makes a PanicRecoverer which logs the errors made of recovered panics unless the options
+// set another PanicRecoverErrorHandler
+func newGrpcPanicRecoverer(options ...PanicRecoverOpt) *PanicRecoverer {
+	return newPanicRecoverer(append([]PanicRecoverOpt{PanicRecoverErrorHandler(logGrpcPanic)}, options...)...)
+}
+
+func logGrpcPanic(_ context.Context, err error) {
+	log.Printf("GRPC|%s\n", err)
+}
+
+// grpcPanicStatus maps the error made of a recovered panic to status. The message of the status is generic if the
+// error carries the PanicError (e.g. by the default transformer), so the panic value isn't leaked to clients, but
+// its code and details are kept.
+func grpcPanicStatus(err error) error {
+	st := status.Convert(BricksToGrpcErrorMapper(err))
+	if !errors.As(err, new(PanicError)) {
+		return st.Err()
+	}
+
+	sp := st.Proto()
+	sp.Message = st.Code().String()
+
+	return status.ErrorProto(sp)
+}
+
+func GrpcStreamServerInvokeHandlerInterceptor(
+	srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler,
+) error {
+	return handler(srv, ss)
+}
+
+func GrpcStreamServerErrorMapperMiddleware(
+	mapper func(error) error,
+) tricks.Middleware[grpc.StreamServerInterceptor] {
+	if mapper == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty error mapper")))
+	}
+
+	return func(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+		return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return mapper(next(srv, ss, info, handler))
+		}
+	}
+}
+
+type ctxServerStream struct {
+	grpc.ServerStream
+
+	ctx context.Context
+}
+
+func (ss ctxServerStream) Context() context.Context {
+	return ss.ctx
+}
+
+// GrpcServerStreamWithContext wraps the grpc.ServerStream to replace its context with ctx
+// which is the way stream middlewares pass context values (e.g. span) to the next ones
+func GrpcServerStreamWithContext(ctx context.Context, ss grpc.ServerStream) grpc.ServerStream {
+	return ctxServerStream{
+		ServerStream: ss,
+		ctx:          ctx,
+	}
+}
+
+type GrpcStreamClientMiddlewareStack = tricks.MiddlewareStack[grpc.StreamClientInterceptor]
+
+func GrpcStreamClientStreamerInterceptor(
+	ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+	streamer grpc.Streamer, opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// GrpcStreamClientErrorMapperMiddleware maps errors of opening the stream as well as errors of the stream operations
+// except io.EOF which indicates end of the stream.
+func GrpcStreamClientErrorMapperMiddleware(
+	mapper func(error) error,
+) tricks.Middleware[grpc.StreamClientInterceptor] {
+	if mapper == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty error mapper")))
+	}
+
+	return func(next grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+		return func(
+			ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+			streamer grpc.Streamer, opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			cs, err := next(ctx, desc, cc, method, streamer, opts...)
+			if err != nil {
+				return cs, mapper(err)
+			}
+
+			return errMapperClientStream{
+				ClientStream: cs,
+				mapper:       mapper,
+			}, nil
+		}
+	}
+}
+
+// GrpcStreamClientRetryMiddleware retries opening streams failed with retryable errors according to the policy.
+// Failures of the opened stream aren't retried since messages may have been already exchanged.
+func GrpcStreamClientRetryMiddleware(policy bricks.RetryPolicy) tricks.Middleware[grpc.StreamClientInterceptor] {
+	return func(next grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+		return func(
+			ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+			streamer grpc.Streamer, opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			var cs grpc.ClientStream
+			err := bricks.Retry(ctx, policy, func(ctx context.Context) error {
+				var err error
+				cs, err = next(ctx, desc, cc, method, streamer, opts...)
+
+				return err
+			})
+
+			return cs, err
+		}
+	}
+}
+
+type errMapperClientStream struct {
+	grpc.ClientStream
+
+	mapper func(error) error
+}
+
+func (cs errMapperClientStream) Header() (metadata.MD, error) {
+	md, err := cs.ClientStream.Header()
+
+	return md, cs.mapErr(err)
+}
+
+func (cs errMapperClientStream) CloseSend() error {
+	return cs.mapErr(cs.ClientStream.CloseSend())
+}
+
+func (cs errMapperClientStream) SendMsg(m any) error {
+	return cs.mapErr(cs.ClientStream.SendMsg(m))
+}
+
+func (cs errMapperClientStream) RecvMsg(m any) error {
+	return cs.mapErr(cs.ClientStream.RecvMsg(m))
+}
+
+func (cs errMapperClientStream) mapErr(err error) error {
+	if err == nil || errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return cs.mapper(err)
+}
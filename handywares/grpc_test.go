@@ -0,0 +1,171 @@
+package handywares_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+type fakeServerStream struct {
+	grpc.ServerStream
+}
+
+func (fakeServerStream) Context() context.Context {
+	return context.Background()
+}
+
+type fakeClientStream struct {
+	grpc.ClientStream
+
+	recvErr error
+}
+
+func (cs fakeClientStream) RecvMsg(_ any) error {
+	return cs.recvErr
+}
+
+func TestGrpcPanicRecoverMiddleware(t *testing.T) {
+	var mws handywares.GrpcUnaryServerMiddlewareStack
+	interceptor := mws.Push(handywares.GrpcPanicRecoverMiddleware())(handywares.GrpcUnaryServerInvokeHandlerInterceptor)
+
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Method"},
+		func(ctx context.Context, req any) (any, error) {
+			panic("unary panic")
+		},
+	)
+	require.Error(t, err)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.NotContains(t, status.Convert(err).Message(), "unary panic")
+
+	var handled []error
+	interceptor = mws.Push(handywares.GrpcPanicRecoverMiddleware(
+		handywares.PanicRecoverErrorHandler(func(ctx context.Context, err error) {
+			handled = append(handled, err)
+		}),
+		handywares.PanicRecoverErrorTransformer(func(pe handywares.PanicError) error {
+			return bricks.ErrorWithDetails(bricks.ErrUnavailable, bricks.RetryInfo{RetryDelay: time.Second})
+		}),
+	))(handywares.GrpcUnaryServerInvokeHandlerInterceptor)
+
+	_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Method"},
+		func(ctx context.Context, req any) (any, error) {
+			panic("unary panic")
+		},
+	)
+	require.Len(t, handled, 1)
+	assert.ErrorIs(t, handled[0], bricks.ErrUnavailable)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	ri, ok := bricks.ErrorDetailOf[bricks.RetryInfo](handywares.GrpcToBricksErrorMapper(err))
+	require.True(t, ok)
+	assert.Equal(t, time.Second, ri.RetryDelay)
+}
+
+func TestGrpcStreamServerMiddlewareStack(t *testing.T) {
+	var mws handywares.GrpcStreamServerMiddlewareStack
+	interceptor := mws.
+		Push(handywares.GrpcStreamPanicRecoverMiddleware()).
+		Push(handywares.GrpcStreamServerErrorMapperMiddleware(handywares.BricksToGrpcErrorMapper))(
+		handywares.GrpcStreamServerInvokeHandlerInterceptor,
+	)
+	info := &grpc.StreamServerInfo{FullMethod: "/svc/Stream"}
+
+	err := interceptor(nil, fakeServerStream{}, info, func(srv any, stream grpc.ServerStream) error {
+		panic("stream panic")
+	})
+	require.Error(t, err)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.NotContains(t, status.Convert(err).Message(), "stream panic")
+
+	err = interceptor(nil, fakeServerStream{}, info, func(srv any, stream grpc.ServerStream) error {
+		return bricks.ErrNotFound
+	})
+	require.Error(t, err)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	require.NoError(t, interceptor(nil, fakeServerStream{}, info, func(srv any, stream grpc.ServerStream) error {
+		return nil
+	}))
+}
+
+func TestGrpcServerStreamWithContext(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+
+	ss := handywares.GrpcServerStreamWithContext(ctx, fakeServerStream{})
+	assert.Equal(t, "value", ss.Context().Value(ctxKey{}))
+}
+
+func TestGrpcStreamClientErrorMapperMiddleware(t *testing.T) {
+	var mws handywares.GrpcStreamClientMiddlewareStack
+	interceptor := mws.Push(handywares.GrpcStreamClientErrorMapperMiddleware(handywares.GrpcToBricksErrorMapper))(
+		handywares.GrpcStreamClientStreamerInterceptor,
+	)
+
+	streamer := func(recvErr error) grpc.Streamer {
+		return func(
+			ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			return fakeClientStream{recvErr: recvErr}, nil
+		}
+	}
+
+	cs, err := interceptor(context.Background(), &grpc.StreamDesc{}, nil, "/svc/Stream",
+		streamer(status.Error(codes.Unavailable, "down")))
+	require.NoError(t, err)
+	err = cs.RecvMsg(nil)
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+
+	cs, err = interceptor(context.Background(), &grpc.StreamDesc{}, nil, "/svc/Stream", streamer(io.EOF))
+	require.NoError(t, err)
+	assert.Equal(t, io.EOF, cs.RecvMsg(nil))
+
+	_, err = interceptor(context.Background(), &grpc.StreamDesc{}, nil, "/svc/Stream",
+		func(
+			ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			return nil, status.Error(codes.PermissionDenied, "nope")
+		},
+	)
+	require.ErrorIs(t, err, bricks.ErrPermissionDenied)
+}
+
+func TestGrpcUnaryClientRetryMiddleware(t *testing.T) {
+	var mws handywares.GrpcUnaryClientMiddlewareStack
+	interceptor := mws.
+		Push(handywares.GrpcUnaryClientRetryMiddleware(bricks.RetryPolicy{MaxAttempts: 3})).
+		Push(handywares.GrpcUnaryClientErrorMapperMiddleware(handywares.GrpcToBricksErrorMapper))(
+		handywares.GrpcUnaryClientInvokerInterceptor,
+	)
+
+	attempts := 0
+	err := interceptor(context.Background(), "/svc/Method", nil, nil, nil,
+		func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			attempts++
+
+			return status.Error(codes.Unavailable, "down")
+		},
+	)
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = interceptor(context.Background(), "/svc/Method", nil, nil, nil,
+		func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			attempts++
+
+			return status.Error(codes.InvalidArgument, "bad")
+		},
+	)
+	require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+	assert.Equal(t, 1, attempts)
+}
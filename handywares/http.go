@@ -1,12 +1,12 @@
 package handywares
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"runtime/debug"
 	"strings"
 
 	"github.com/go-openapi/runtime/middleware"
@@ -21,21 +21,22 @@ import (
 
 type HttpMiddlewareStack = tricks.MiddlewareStack[http.Handler]
 
-type PanicRecoverHttpMiddlewareOpt = tricks.MutableOption[any]
+type PanicRecoverHttpMiddlewareOpt = PanicRecoverOpt
 
+// HttpPanicRecoverMiddleware converts panics to bricks.ErrInternal and responds with its problem details using
+// HttpWriteError. http.ErrAbortHandler is re-panicked to let http.Server abort the response.
 func HttpPanicRecoverMiddleware(options ...PanicRecoverHttpMiddlewareOpt) tricks.Middleware[http.Handler] {
+	pr := newPanicRecoverer(options...)
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 			defer func() {
 				if r := recover(); r != nil {
-					span := trace.SpanFromContext(req.Context())
-					span.AddEvent("panic recovered", trace.WithAttributes(
-						oaPanicValue.String(fmt.Sprintf("%+v", r)),
-						oaDebugStack.String(string(debug.Stack())),
-					))
-
-					// todo: translate to proper http status
-					rw.WriteHeader(http.StatusInternalServerError)
+					if r == http.ErrAbortHandler {
+						panic(r)
+					}
+
+					HttpWriteError(rw, req, pr.recovered(req.Context(), r))
 				}
 			}()
 
@@ -46,13 +47,39 @@ func HttpPanicRecoverMiddleware(options ...PanicRecoverHttpMiddlewareOpt) tricks
 
 type BlindLoggerHttpMiddlewareOpt = tricks.MutableOption[any]
 
+type httpBlindLogger struct {
+	requestId bool
+}
+
+// BlindLoggerRequestId makes HttpBlindLoggerMiddleware log request id of the context (see HttpRequestIdMiddleware)
+// too, as in HTTP|<request id>|<remote address>/... Log parsers should be updated before opting in.
+func BlindLoggerRequestId() BlindLoggerHttpMiddlewareOpt {
+	return func(s *any) {
+		if bl, ok := (*s).(*httpBlindLogger); ok {
+			bl.requestId = true
+		}
+	}
+}
+
 func HttpBlindLoggerMiddleware(
 	mctx *middleware.Context, options ...BlindLoggerHttpMiddlewareOpt,
 ) tricks.Middleware[http.Handler] {
+	bl := &httpBlindLogger{}
+	var cfg any = bl
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			prefix := "HTTP|"
+			if rid, _ := RequestIdFromContext(req.Context()); bl.requestId {
+				prefix += rid + "|"
+			}
+
 			log.Printf(
-				"HTTP|%s/%s %s [%s] %s %s %s\n",
+				"%s%s/%s %s [%s] %s %s %s\n",
+				prefix,
 				req.RemoteAddr,
 				req.Referer(),
 				req.UserAgent(),
@@ -233,6 +260,9 @@ func HttpBlindLoggerTripperware(options ...BlindLoggerHttpTripperwareOpt) tricks
 		return HttpRoundTripperFunc(func(req *http.Request) (*http.Response, error) {
 			span := trace.SpanFromContext(req.Context())
 			attrs := make([]attribute.KeyValue, 0)
+			if rid, ok := RequestIdFromContext(req.Context()); ok {
+				attrs = append(attrs, oaRequestId.String(rid))
+			}
 			defer func() {
 				span.AddEvent("http request", trace.WithAttributes(attrs...))
 			}()
@@ -266,6 +296,67 @@ func HttpErrorMapperTripperware(
 	}
 }
 
+// HttpRetryTripperware retries round trips failed with retryable errors according to the policy. Push it before (outer
+// than) HttpErrorMapperTripperware to have error statuses mapped to bricks errors. Only requests of idempotent methods
+// or carrying Idempotency-Key header are retried, given their body (if any) can be rewound by GetBody.
+func HttpRetryTripperware(policy bricks.RetryPolicy) tricks.Middleware[http.RoundTripper] {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return HttpRoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if !httpRetriable(req) {
+				return next.RoundTrip(req)
+			}
+
+			var (
+				rsp      *http.Response
+				attempts int
+			)
+			err := bricks.Retry(req.Context(), policy, func(ctx context.Context) error {
+				attempts++
+
+				attempt := req
+				if rsp != nil && rsp.Body != nil {
+					_, _ = io.Copy(io.Discard, rsp.Body)
+					_ = rsp.Body.Close()
+				}
+				if attempts > 1 {
+					// The body of the previous attempt is consumed, even if it failed without a response
+					attempt = req.Clone(ctx)
+					if req.GetBody != nil {
+						body, err := req.GetBody()
+						if err != nil {
+							return err
+						}
+
+						attempt.Body = body
+					}
+				}
+
+				var err error
+				rsp, err = next.RoundTrip(attempt)
+
+				return err
+			})
+
+			return rsp, err
+		})
+	}
+}
+
+// httpRetriable tells whether resending the request is safe
+func httpRetriable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+
+	default:
+		return len(req.Header.Get("Idempotency-Key")) > 0
+	}
+}
+
 type HttpRoundTripperFunc func(*http.Request) (*http.Response, error)
 
 func (fn HttpRoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -2,11 +2,14 @@ package handywares_test
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/janstoon/toolbox/bricks"
 	"github.com/janstoon/toolbox/tricks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -77,5 +80,90 @@ func TestHttpMiddlewarePanicRecover(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotEmpty(t, rsp)
 	assert.Equal(t, http.StatusInternalServerError, tricks.PtrVal(rsp).StatusCode)
+	assert.Equal(t, "application/problem+json", rsp.Header.Get("Content-Type"))
+	bb, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"about:blank","title":"Internal Server Error","status":500,"instance":"/"}`, string(bb))
 	require.NoError(t, rsp.Body.Close())
 }
+
+func TestHttpRetryTripperware(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+		bb, _ := io.ReadAll(req.Body)
+		assert.Equal(t, "payload", string(bb))
+
+		if attempts < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var tws handywares.HttpTripperwareStack
+	client := http.Client{
+		Transport: tws.
+			Push(handywares.HttpRetryTripperware(bricks.RetryPolicy{MaxAttempts: 3})).
+			Push(handywares.HttpErrorMapperTripperware(handywares.HttpToBricksErrorMapper))(http.DefaultTransport),
+	}
+
+	// Non-idempotent requests aren't retried
+	_, err := client.Post(srv.URL, "text/plain", strings.NewReader("payload"))
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	assert.Equal(t, 1, attempts)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Set("Idempotency-Key", "k1")
+
+	rsp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, 3, attempts)
+
+	// Bodies which can't be rewound aren't resent
+	attempts = 0
+	req, err = http.NewRequest(http.MethodPut, srv.URL, io.NopCloser(strings.NewReader("payload")))
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestHttpRetryTripperwareTransportError(t *testing.T) {
+	var bodies []string
+	transport := handywares.HttpRoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		bb, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(bb))
+
+		if len(bodies) == 1 {
+			return nil, errors.Join(bricks.ErrUnavailable, errors.New("connection reset"))
+		}
+
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+
+	var tws handywares.HttpTripperwareStack
+	client := http.Client{
+		Transport: tws.Push(handywares.HttpRetryTripperware(bricks.RetryPolicy{MaxAttempts: 3}))(transport),
+	}
+
+	rsp, err := client.Post("http://example.com", "text/plain", strings.NewReader("payload"))
+	require.Error(t, err)
+	assert.Nil(t, rsp)
+	assert.Equal(t, []string{"payload"}, bodies)
+
+	bodies = nil
+	req, err := http.NewRequest(http.MethodPut, "http://example.com", strings.NewReader("payload"))
+	require.NoError(t, err)
+	rsp, err = client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, []string{"payload", "payload"}, bodies)
+}
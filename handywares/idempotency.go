@@ -0,0 +1,510 @@
+package handywares
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrCodeIdempotencyKeyInUse is the custom error code of ErrIdempotencyKeyInUse which is responded by 409 over http
+var ErrCodeIdempotencyKeyInUse = bricks.MustRegisterErrorCode(bricks.ErrorCode{
+	Code:       bricks.ErrCodeIdempotencyKeyInUse,
+	Name:       "idempotency_key_in_use",
+	Parent:     bricks.ErrCodeAborted,
+	HttpStatus: http.StatusConflict,
+	Retryable:  true,
+})
+
+var (
+	// ErrIdempotencyKeyInUse matches bricks.ErrAborted and bricks.ErrRetryable
+	ErrIdempotencyKeyInUse = bricks.ErrorWithCode(ErrCodeIdempotencyKeyInUse,
+		errors.New("idempotency key is in use by an in-flight request"))
+	ErrIdempotencyKeyConflict = errors.New("idempotency key is reused with a different payload")
+)
+
+// IdempotencyRecord is the outcome of the first processing of an idempotency key
+type IdempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"` // Hash of the payload processed by the key
+	Completed   bool   `json:"completed"`   // False while the first processing is in flight
+	Response    []byte `json:"response"`    // Response to replay, if any
+}
+
+// IdempotencyStore keeps records of idempotency keys until they expire
+type IdempotencyStore interface {
+	// Reserve atomically records the key as in flight unless it's recorded already. It returns the existing record and
+	// false if the key isn't reserved.
+	Reserve(ctx context.Context, key, fingerprint string, ttl time.Duration) (IdempotencyRecord, bool, error)
+
+	// Complete replaces the in-flight record of the key by the completed one
+	Complete(ctx context.Context, key string, record IdempotencyRecord, ttl time.Duration) error
+
+	// Release removes the record of key to let it be processed again
+	Release(ctx context.Context, key string) error
+}
+
+type memoryIdempotencyRecord struct {
+	IdempotencyRecord
+	expiresAt time.Time
+}
+
+type memoryIdempotencyStore struct {
+	l       sync.Mutex
+	records map[string]memoryIdempotencyRecord
+	purged  time.Time
+}
+
+// NewMemoryIdempotencyStore creates an in-process IdempotencyStore. It deduplicates within a single replica only.
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{
+		records: make(map[string]memoryIdempotencyRecord),
+	}
+}
+
+func (mis *memoryIdempotencyStore) Reserve(
+	_ context.Context, key, fingerprint string, ttl time.Duration,
+) (IdempotencyRecord, bool, error) {
+	mis.l.Lock()
+	defer mis.l.Unlock()
+
+	now := time.Now()
+	mis.purge(now)
+
+	if rec, ok := mis.records[key]; ok && now.Before(rec.expiresAt) {
+		return rec.IdempotencyRecord, false, nil
+	}
+
+	mis.records[key] = memoryIdempotencyRecord{
+		IdempotencyRecord: IdempotencyRecord{Fingerprint: fingerprint},
+		expiresAt:         now.Add(ttl),
+	}
+
+	return IdempotencyRecord{}, true, nil
+}
+
+func (mis *memoryIdempotencyStore) Complete(
+	_ context.Context, key string, record IdempotencyRecord, ttl time.Duration,
+) error {
+	mis.l.Lock()
+	defer mis.l.Unlock()
+
+	mis.records[key] = memoryIdempotencyRecord{
+		IdempotencyRecord: record,
+		expiresAt:         time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+func (mis *memoryIdempotencyStore) Release(_ context.Context, key string) error {
+	mis.l.Lock()
+	defer mis.l.Unlock()
+
+	delete(mis.records, key)
+
+	return nil
+}
+
+// purge drops expired records once in a while
+func (mis *memoryIdempotencyStore) purge(now time.Time) {
+	if now.Sub(mis.purged) < time.Minute {
+		return
+	}
+
+	for key, rec := range mis.records {
+		if !now.Before(rec.expiresAt) {
+			delete(mis.records, key)
+		}
+	}
+	mis.purged = now
+}
+
+type redisIdempotencyStore struct {
+	client redis.Cmdable
+	prefix string
+}
+
+// NewRedisIdempotencyStore creates an IdempotencyStore keeping records in redis under the prefixed keys. It's shared
+// by all replicas.
+func NewRedisIdempotencyStore(client redis.Cmdable, prefix string) IdempotencyStore {
+	if client == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty redis client")))
+	}
+
+	return redisIdempotencyStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (ris redisIdempotencyStore) Reserve(
+	ctx context.Context, key, fingerprint string, ttl time.Duration,
+) (IdempotencyRecord, bool, error) {
+	bb, err := json.Marshal(IdempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return IdempotencyRecord{}, false, errors.Join(bricks.ErrInternal, err)
+	}
+
+	// The record may expire between the failed reservation and reading it, so try again
+	for range 3 {
+		reserved, err := ris.client.SetNX(ctx, ris.prefix+key, bb, ttl).Result()
+		if err != nil {
+			return IdempotencyRecord{}, false, errors.Join(bricks.ErrUnavailable, err)
+		}
+
+		if reserved {
+			return IdempotencyRecord{}, true, nil
+		}
+
+		raw, err := ris.client.Get(ctx, ris.prefix+key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			return IdempotencyRecord{}, false, errors.Join(bricks.ErrUnavailable, err)
+		}
+
+		var rec IdempotencyRecord
+		if err = json.Unmarshal(raw, &rec); err != nil {
+			return IdempotencyRecord{}, false, errors.Join(bricks.ErrDataLoss, err)
+		}
+
+		return rec, false, nil
+	}
+
+	return IdempotencyRecord{}, false, errors.Join(ErrIdempotencyKeyInUse,
+		fmt.Errorf("reserving idempotency key `%s` contended", key))
+}
+
+func (ris redisIdempotencyStore) Complete(
+	ctx context.Context, key string, record IdempotencyRecord, ttl time.Duration,
+) error {
+	bb, err := json.Marshal(record)
+	if err != nil {
+		return errors.Join(bricks.ErrInternal, err)
+	}
+
+	if err = ris.client.Set(ctx, ris.prefix+key, bb, ttl).Err(); err != nil {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	return nil
+}
+
+func (ris redisIdempotencyStore) Release(ctx context.Context, key string) error {
+	if err := ris.client.Del(ctx, ris.prefix+key).Err(); err != nil {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	return nil
+}
+
+// Idempotency is the common configuration of idempotency middlewares of all stacks
+type Idempotency struct {
+	store   IdempotencyStore
+	ttl     time.Duration
+	lockTtl time.Duration
+	header  string
+}
+
+type IdempotencyOpt = tricks.Option[Idempotency]
+
+// IdempotencyTtl sets how long outcomes are kept to be replayed. It defaults to a day.
+func IdempotencyTtl(ttl time.Duration) IdempotencyOpt {
+	return tricks.ImmutableOption[Idempotency](func(i Idempotency) Idempotency {
+		i.ttl = ttl
+
+		return i
+	})
+}
+
+// IdempotencyLockTtl sets how long a key is reserved by an in-flight processing which may have crashed. It defaults
+// to a minute.
+func IdempotencyLockTtl(ttl time.Duration) IdempotencyOpt {
+	return tricks.ImmutableOption[Idempotency](func(i Idempotency) Idempotency {
+		i.lockTtl = ttl
+
+		return i
+	})
+}
+
+// IdempotencyHeader sets name of the header carrying idempotency key. It defaults to Idempotency-Key for http and
+// Nats-Msg-Id for nats.
+func IdempotencyHeader(name string) IdempotencyOpt {
+	return tricks.ImmutableOption[Idempotency](func(i Idempotency) Idempotency {
+		i.header = name
+
+		return i
+	})
+}
+
+func newIdempotency(store IdempotencyStore, header string, options ...IdempotencyOpt) *Idempotency {
+	if store == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty idempotency store")))
+	}
+
+	i := &Idempotency{
+		store:   store,
+		ttl:     24 * time.Hour,
+		lockTtl: time.Minute,
+		header:  header,
+	}
+
+	return tricks.ApplyOptions(i, options...)
+}
+
+func idempotencyFingerprint(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		_, _ = h.Write([]byte(strconv.Itoa(len(part))))
+		_, _ = h.Write(part)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// scope prefixes the key by the principal in ctx, if any, so callers can't collide with or replay outcomes of each
+// other
+func (i Idempotency) scope(ctx context.Context, key string) string {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return key
+	}
+
+	return idempotencyFingerprint([]byte(p.Method), []byte(p.Subject)) + ":" + key
+}
+
+// reserve reserves the key for processing the payload of fingerprint. It returns the completed record if the key has
+// been processed already.
+func (i Idempotency) reserve(ctx context.Context, key, fingerprint string) (*IdempotencyRecord, error) {
+	rec, reserved, err := i.store.Reserve(ctx, key, fingerprint, i.lockTtl)
+	if err != nil {
+		return nil, err
+	}
+
+	if reserved {
+		return nil, nil
+	}
+
+	if rec.Fingerprint != fingerprint {
+		return nil, errors.Join(bricks.ErrAlreadyExists, ErrIdempotencyKeyConflict)
+	}
+
+	if !rec.Completed {
+		return nil, bricks.ErrorWithDetails(
+			ErrIdempotencyKeyInUse,
+			bricks.RetryInfo{RetryDelay: time.Second},
+		)
+	}
+
+	return &rec, nil
+}
+
+// process runs fn once per key unless it fails
+func (i Idempotency) process(ctx context.Context, key, fingerprint string, fn func(ctx context.Context) error) error {
+	rec, err := i.reserve(ctx, key, fingerprint)
+	if err != nil || rec != nil {
+		return err
+	}
+
+	if err = fn(ctx); err != nil {
+		return errors.Join(err, i.store.Release(context.WithoutCancel(ctx), key))
+	}
+
+	return i.store.Complete(context.WithoutCancel(ctx), key, IdempotencyRecord{
+		Fingerprint: fingerprint,
+		Completed:   true,
+	}, i.ttl)
+}
+
+type httpIdempotentResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+type httpIdempotencyRecorder struct {
+	http.ResponseWriter
+
+	status int
+	body   bytes.Buffer
+}
+
+func (r *httpIdempotencyRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *httpIdempotencyRecorder) Write(bb []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(bb)
+
+	return r.ResponseWriter.Write(bb)
+}
+
+// HttpIdempotencyMiddleware processes requests carrying Idempotency-Key header at most once and replays the stored
+// response to retries, marked by Idempotent-Replayed header. Reusing a key with a different method, url or body is
+// rejected by bricks.ErrAlreadyExists (409) and retrying a key while it's in flight by ErrIdempotencyKeyInUse (409).
+// Requests without the key pass through. Only successful (2xx) and deterministic client error (4xx) responses are
+// stored. The key is released on the others (e.g. 5xx, 408, 409 and 429), so retries are processed again.
+//
+// Keys are scoped to the authenticated principal, if any. Push it after (inner than) HttpAuthenticationMiddleware.
+func HttpIdempotencyMiddleware(store IdempotencyStore, options ...IdempotencyOpt) tricks.Middleware[http.Handler] {
+	i := newIdempotency(store, "Idempotency-Key", options...)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			key := req.Header.Get(i.header)
+			if len(key) == 0 {
+				next.ServeHTTP(rw, req)
+
+				return
+			}
+
+			var body []byte
+			if req.Body != nil {
+				var err error
+				if body, err = io.ReadAll(req.Body); err != nil {
+					HttpWriteError(rw, req, errors.Join(bricks.ErrInvalidArgument, err))
+
+					return
+				}
+				req.Body = io.NopCloser(bytes.NewReader(body))
+			}
+
+			ctx := req.Context()
+			key = i.scope(ctx, key)
+			fingerprint := idempotencyFingerprint(
+				[]byte(req.Method), []byte(req.URL.Path), []byte(req.URL.RawQuery), body,
+			)
+			rec, err := i.reserve(ctx, key, fingerprint)
+			if err != nil {
+				HttpWriteError(rw, req, err)
+
+				return
+			}
+
+			if rec != nil {
+				httpReplayIdempotentResponse(rw, req, rec.Response)
+
+				return
+			}
+
+			recorder := &httpIdempotencyRecorder{ResponseWriter: rw}
+			next.ServeHTTP(recorder, req)
+
+			ctx = context.WithoutCancel(ctx)
+			if !httpIdempotentStatus(recorder.status) {
+				_ = i.store.Release(ctx, key)
+
+				return
+			}
+
+			bb, _ := json.Marshal(httpIdempotentResponse{
+				Status: recorder.status,
+				Header: rw.Header().Clone(),
+				Body:   recorder.body.Bytes(),
+			})
+			_ = i.store.Complete(ctx, key, IdempotencyRecord{
+				Fingerprint: fingerprint,
+				Completed:   true,
+				Response:    bb,
+			}, i.ttl)
+		})
+	}
+}
+
+// httpIdempotentStatus tells whether responses of the status are final, i.e. retrying the request won't change them
+func httpIdempotentStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusLocked, http.StatusTooEarly,
+		http.StatusTooManyRequests:
+		return false
+
+	default:
+		return status >= http.StatusOK && status < http.StatusMultipleChoices ||
+			status >= http.StatusBadRequest && status < http.StatusInternalServerError
+	}
+}
+
+func httpReplayIdempotentResponse(rw http.ResponseWriter, req *http.Request, raw []byte) {
+	var rsp httpIdempotentResponse
+	if err := json.Unmarshal(raw, &rsp); err != nil {
+		HttpWriteError(rw, req, errors.Join(bricks.ErrDataLoss, err))
+
+		return
+	}
+
+	for name, values := range rsp.Header {
+		rw.Header()[name] = values
+	}
+	rw.Header().Set("Idempotent-Replayed", "true")
+	if rsp.Status == 0 {
+		rsp.Status = http.StatusOK
+	}
+	rw.WriteHeader(rsp.Status)
+	_, _ = rw.Write(rsp.Body)
+}
+
+// NatsIdempotencyMiddleware processes messages at most once per message id of Nats-Msg-Id header. Redeliveries of
+// processed messages are acknowledged without processing and redeliveries of in-flight ones fail with
+// bricks.ErrRetryable. Reusing an id with a different subject or payload fails with bricks.ErrAlreadyExists. Messages
+// without id pass through.
+func NatsIdempotencyMiddleware(store IdempotencyStore, options ...IdempotencyOpt) tricks.Middleware[NatsMsgHandler] {
+	i := newIdempotency(store, nats.MsgIdHdr, options...)
+
+	return func(next NatsMsgHandler) NatsMsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			key := msg.Header.Get(i.header)
+			if len(key) == 0 {
+				return next(ctx, msg)
+			}
+
+			return i.process(ctx, key, idempotencyFingerprint([]byte(msg.Subject), msg.Data), func(ctx context.Context) error {
+				return next(ctx, msg)
+			})
+		}
+	}
+}
+
+// MsgIdempotencyMiddleware is the generic counterpart of NatsIdempotencyMiddleware. The extractor returns id of the
+// message (e.g. bricks.MessageEnvelope.Id) along with its payload to fingerprint.
+func MsgIdempotencyMiddleware[M any](
+	store IdempotencyStore, extractor func(msg M) (id string, payload []byte), options ...IdempotencyOpt,
+) tricks.Middleware[MsgHandler[M]] {
+	if extractor == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty message id extractor")))
+	}
+
+	i := newIdempotency(store, "", options...)
+
+	return func(next MsgHandler[M]) MsgHandler[M] {
+		return func(ctx context.Context, msg M) error {
+			key, payload := extractor(msg)
+			if len(key) == 0 {
+				return next(ctx, msg)
+			}
+
+			return i.process(ctx, key, idempotencyFingerprint(payload), func(ctx context.Context) error {
+				return next(ctx, msg)
+			})
+		}
+	}
+}
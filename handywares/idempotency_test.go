@@ -0,0 +1,172 @@
+package handywares_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+func TestHttpIdempotencyMiddleware(t *testing.T) {
+	var (
+		mws   handywares.HttpMiddlewareStack
+		calls int
+	)
+	handler := mws.Push(handywares.HttpIdempotencyMiddleware(handywares.NewMemoryIdempotencyStore()))(
+		http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			calls++
+			if req.URL.Path == "/fail" && calls == 1 {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+
+				return
+			}
+
+			if req.URL.Path == "/busy" && calls == 1 {
+				rw.WriteHeader(http.StatusTooManyRequests)
+
+				return
+			}
+
+			rw.Header().Set("Location", "/orders/1")
+			rw.WriteHeader(http.StatusCreated)
+			_, _ = rw.Write([]byte("created"))
+		}),
+	)
+
+	var principal *handywares.Principal
+	serve := func(key, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if principal != nil {
+			req = req.WithContext(handywares.ContextWithPrincipal(req.Context(), *principal))
+		}
+		if len(key) > 0 {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := serve("k1", "/orders", `{"qty":1}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+
+	rec = serve("k1", "/orders", `{"qty":1}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "created", rec.Body.String())
+	assert.Equal(t, "/orders/1", rec.Header().Get("Location"))
+	assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 1, calls)
+
+	rec = serve("k1", "/orders", `{"qty":2}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, 1, calls)
+
+	serve("", "/orders", `{"qty":1}`)
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	assert.Equal(t, http.StatusServiceUnavailable, serve("k2", "/fail", "").Code)
+	assert.Equal(t, http.StatusCreated, serve("k2", "/fail", "").Code)
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	assert.Equal(t, http.StatusTooManyRequests, serve("k3", "/busy", "").Code)
+	assert.Equal(t, http.StatusCreated, serve("k3", "/busy", "").Code)
+	assert.Equal(t, 2, calls, "transient client errors aren't stored")
+
+	assert.Equal(t, http.StatusConflict, serve("k1", "/orders?dry_run=true", `{"qty":1}`).Code,
+		"query is a part of the fingerprint")
+
+	calls = 0
+	principal = &handywares.Principal{Subject: "u1", Method: handywares.AuthMethodJwt}
+	assert.Empty(t, serve("k1", "/orders", `{"qty":1}`).Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "true", serve("k1", "/orders", `{"qty":1}`).Header().Get("Idempotent-Replayed"))
+	principal = &handywares.Principal{Subject: "u2", Method: handywares.AuthMethodJwt}
+	assert.Empty(t, serve("k1", "/orders", `{"qty":1}`).Header().Get("Idempotent-Replayed"),
+		"keys are scoped to the principal")
+	assert.Equal(t, 2, calls)
+}
+
+func TestNatsIdempotencyMiddleware(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() {
+		_ = client.Close()
+	}()
+
+	var (
+		mws     handywares.NatsMiddlewareStack
+		calls   int
+		handler handywares.NatsMsgHandler
+	)
+	handler = mws.Push(handywares.NatsIdempotencyMiddleware(handywares.NewRedisIdempotencyStore(client, "idem:")))(
+		func(ctx context.Context, msg *nats.Msg) error {
+			calls++
+			if string(msg.Data) == "reenter" {
+				err := handler(ctx, msg)
+				require.ErrorIs(t, err, handywares.ErrIdempotencyKeyInUse)
+				require.ErrorIs(t, err, bricks.ErrRetryable)
+			}
+
+			return nil
+		},
+	)
+
+	msg := func(id, data string) *nats.Msg {
+		m := nats.NewMsg("orders.created")
+		m.Data = []byte(data)
+		m.Header.Set(nats.MsgIdHdr, id)
+
+		return m
+	}
+
+	require.NoError(t, handler(ctx, msg("m1", "reenter")))
+	require.NoError(t, handler(ctx, msg("m1", "reenter")))
+	assert.Equal(t, 1, calls)
+	assert.True(t, mr.Exists("idem:m1"))
+
+	err := handler(ctx, msg("m1", "other"))
+	require.ErrorIs(t, err, bricks.ErrAlreadyExists)
+	require.ErrorIs(t, err, handywares.ErrIdempotencyKeyConflict)
+}
+
+func TestMsgIdempotencyMiddleware(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		mws   handywares.MsgMiddlewareStack[bricks.MessageEnvelope]
+		calls int
+	)
+	handler := mws.Push(handywares.MsgIdempotencyMiddleware(
+		handywares.NewMemoryIdempotencyStore(),
+		func(msg bricks.MessageEnvelope) (string, []byte) {
+			return msg.Id, msg.Note
+		},
+	))(func(ctx context.Context, msg bricks.MessageEnvelope) error {
+		calls++
+		if calls == 1 {
+			return bricks.ErrUnavailable
+		}
+
+		return nil
+	})
+
+	envelope := bricks.MessageEnvelope{Id: "e1", Note: []byte("note")}
+	require.ErrorIs(t, handler(ctx, envelope), bricks.ErrUnavailable)
+	require.NoError(t, handler(ctx, envelope))
+	require.NoError(t, handler(ctx, envelope))
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,162 @@
+package handywares
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/nats-io/nats.go"
+)
+
+type sqlTxCtxKey struct{}
+
+// ContextWithSqlTx puts tx in ctx to be picked by handlers running within it
+func ContextWithSqlTx(ctx context.Context, tx *sql.Tx) context.Context {
+	return context.WithValue(ctx, sqlTxCtxKey{}, tx)
+}
+
+// SqlTxFromContext returns the transaction put in ctx, e.g. by inbox middlewares
+func SqlTxFromContext(ctx context.Context) (*sql.Tx, bool) {
+	tx, ok := ctx.Value(sqlTxCtxKey{}).(*sql.Tx)
+
+	return tx, ok
+}
+
+// Inbox records ids of consumed messages in a sql table to drop redeliveries. The table is expected to be like:
+//
+//	CREATE TABLE inbox (
+//	  id          VARCHAR(255) PRIMARY KEY,
+//	  received_at TIMESTAMP NOT NULL
+//	);
+type Inbox struct {
+	table       string
+	placeholder bricks.SqlPlaceholder
+	txOptions   *sql.TxOptions
+	errMapper   *SqlErrorMapper
+}
+
+type InboxOpt = tricks.Option[Inbox]
+
+// InboxTable sets name of the inbox table. It defaults to inbox.
+func InboxTable(name string) InboxOpt {
+	return tricks.ImmutableOption[Inbox](func(ib Inbox) Inbox {
+		ib.table = name
+
+		return ib
+	})
+}
+
+// InboxSqlPlaceholder sets the bind parameter style of the database. It defaults to bricks.QuestionSqlPlaceholder.
+func InboxSqlPlaceholder(placeholder bricks.SqlPlaceholder) InboxOpt {
+	return tricks.ImmutableOption[Inbox](func(ib Inbox) Inbox {
+		ib.placeholder = placeholder
+
+		return ib
+	})
+}
+
+// InboxTxOptions sets options of transactions the messages are handled within
+func InboxTxOptions(options *sql.TxOptions) InboxOpt {
+	return tricks.ImmutableOption[Inbox](func(ib Inbox) Inbox {
+		ib.txOptions = options
+
+		return ib
+	})
+}
+
+// InboxSqlErrorMapper sets the mapper of database errors. Inserting a duplicate id is expected to be mapped to
+// bricks.ErrAlreadyExists, so drivers whose errors don't report their SQLSTATE need a mapper with their extractor
+// (see SqlStateExtractor). It defaults to the one used by SqlToBricksError.
+func InboxSqlErrorMapper(mapper *SqlErrorMapper) InboxOpt {
+	return tricks.ImmutableOption[Inbox](func(ib Inbox) Inbox {
+		ib.errMapper = mapper
+
+		return ib
+	})
+}
+
+func newInbox(options ...InboxOpt) *Inbox {
+	ib := &Inbox{
+		table:       "inbox",
+		placeholder: bricks.QuestionSqlPlaceholder,
+		errMapper:   defaultSqlErrorMapper,
+	}
+
+	return tricks.ApplyOptions(ib, options...)
+}
+
+// handle runs next within a transaction recording id of the message. Duplicates are dropped silently.
+func (ib Inbox) handle(ctx context.Context, db *sql.DB, id string, next func(ctx context.Context) error) error {
+	if len(id) == 0 {
+		return next(ctx)
+	}
+
+	tx, err := db.BeginTx(ctx, ib.txOptions)
+	if err != nil {
+		return ib.errMapper.Map(err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %s (id, received_at) VALUES (%s, %s)", ib.table, ib.placeholder(1), ib.placeholder(2)),
+		id, time.Now().UTC(),
+	)
+	if err = ib.errMapper.Map(err); err != nil {
+		if errors.Is(err, bricks.ErrAlreadyExists) {
+			return nil
+		}
+
+		return err
+	}
+
+	if err = next(ContextWithSqlTx(ctx, tx)); err != nil {
+		return err
+	}
+
+	return ib.errMapper.Map(tx.Commit())
+}
+
+// MsgInboxMiddleware drops messages whose id (returned by extractor) is recorded in the inbox table of db already.
+// Others are handled within a transaction (available by SqlTxFromContext) recording their id, which commits if the
+// handler succeeds. Handlers writing their side effects (e.g. including outbox messages) by the transaction get
+// processed exactly once. Messages without id are handled without transaction.
+func MsgInboxMiddleware[M any](
+	db *sql.DB, extractor func(msg M) string, options ...InboxOpt,
+) tricks.Middleware[MsgHandler[M]] {
+	if db == nil || extractor == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty inbox database or message id extractor")))
+	}
+
+	ib := newInbox(options...)
+
+	return func(next MsgHandler[M]) MsgHandler[M] {
+		return func(ctx context.Context, msg M) error {
+			return ib.handle(ctx, db, extractor(msg), func(ctx context.Context) error {
+				return next(ctx, msg)
+			})
+		}
+	}
+}
+
+// NatsInboxMiddleware is the nats counterpart of MsgInboxMiddleware. Messages are identified by Nats-Msg-Id header.
+func NatsInboxMiddleware(db *sql.DB, options ...InboxOpt) tricks.Middleware[NatsMsgHandler] {
+	if db == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty inbox database")))
+	}
+
+	ib := newInbox(options...)
+
+	return func(next NatsMsgHandler) NatsMsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			return ib.handle(ctx, db, msg.Header.Get(nats.MsgIdHdr), func(ctx context.Context) error {
+				return next(ctx, msg)
+			})
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package handywares_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/handywares"
+	"github.com/janstoon/toolbox/handywares/sqliteerr"
+)
+
+var inboxSqliteErrorMapper = handywares.InboxSqlErrorMapper(handywares.NewSqlErrorMapper(sqliteerr.SqlStateExtractor()))
+
+func openInboxDb(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "inbox.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("CREATE TABLE inbox (id VARCHAR(255) PRIMARY KEY, received_at TIMESTAMP NOT NULL)")
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE effects (note TEXT NOT NULL)")
+	require.NoError(t, err)
+
+	return db
+}
+
+func TestMsgInboxMiddleware(t *testing.T) {
+	ctx := context.Background()
+	db := openInboxDb(t)
+
+	var (
+		mws   handywares.MsgMiddlewareStack[bricks.MessageEnvelope]
+		calls int
+	)
+	handler := mws.Push(handywares.MsgInboxMiddleware(db, func(msg bricks.MessageEnvelope) string {
+		return msg.Id
+	}, inboxSqliteErrorMapper))(func(ctx context.Context, msg bricks.MessageEnvelope) error {
+		calls++
+
+		tx, ok := handywares.SqlTxFromContext(ctx)
+		require.True(t, ok)
+		_, err := tx.ExecContext(ctx, "INSERT INTO effects (note) VALUES (?)", string(msg.Note))
+		require.NoError(t, err)
+
+		if calls == 1 {
+			return bricks.ErrUnavailable
+		}
+
+		return nil
+	})
+
+	envelope := bricks.MessageEnvelope{Id: "e1", Note: []byte("note")}
+	require.ErrorIs(t, handler(ctx, envelope), bricks.ErrUnavailable)
+	require.NoError(t, handler(ctx, envelope))
+	require.NoError(t, handler(ctx, envelope))
+	assert.Equal(t, 2, calls)
+
+	var effects int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM effects").Scan(&effects))
+	assert.Equal(t, 1, effects)
+}
+
+func TestNatsInboxMiddleware(t *testing.T) {
+	ctx := context.Background()
+	db := openInboxDb(t)
+
+	var (
+		mws   handywares.NatsMiddlewareStack
+		calls int
+	)
+	handler := mws.Push(handywares.NatsInboxMiddleware(db, inboxSqliteErrorMapper))(
+		func(ctx context.Context, msg *nats.Msg) error {
+			calls++
+
+			return nil
+		},
+	)
+
+	msg := nats.NewMsg("orders.created")
+	msg.Header.Set(nats.MsgIdHdr, "m1")
+	require.NoError(t, handler(ctx, msg))
+	require.NoError(t, handler(ctx, msg))
+	require.NoError(t, handler(ctx, nats.NewMsg("orders.created")))
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,391 @@
+package handywares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrJwtExpiryMissing is returned for tokens without expiration time (exp) unless JwtAllowNoExpiry is set
+var ErrJwtExpiryMissing = errors.New("jwt without expiration time")
+
+// JwtKeyResolver resolves the key verifying signature of jwt signed by the key id (kid)
+type JwtKeyResolver interface {
+	JwtKey(ctx context.Context, kid string) (any, error)
+}
+
+type JwtKeyResolverFunc func(ctx context.Context, kid string) (any, error)
+
+func (fn JwtKeyResolverFunc) JwtKey(ctx context.Context, kid string) (any, error) {
+	return fn(ctx, kid)
+}
+
+// JwksCache is a JwtKeyResolver of a remote json web key set (jwks). It caches the keys for a while and refreshes them
+// sooner if it encounters an unknown key id, e.g. once the issuer rotates its keys, but not more often than a minimum
+// interval. Stale keys are kept in use while the jwks is unreachable. Concurrent refreshes are coalesced into a single
+// fetch which doesn't block lookups of the cached keys.
+type JwksCache struct {
+	JwksCachePolicy
+
+	url     string
+	fetches singleflight.Group
+
+	l           sync.Mutex
+	keys        jose.JSONWebKeySet
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// JwksCachePolicy is the configuration of JwksCache
+type JwksCachePolicy struct {
+	client             *http.Client
+	ttl                time.Duration
+	minRefreshInterval time.Duration
+}
+
+type JwksCacheOpt = tricks.Option[JwksCachePolicy]
+
+// JwksHttpClient sets the http client fetching jwks. It defaults to http.DefaultClient.
+func JwksHttpClient(client *http.Client) JwksCacheOpt {
+	return tricks.ImmutableOption[JwksCachePolicy](func(jcp JwksCachePolicy) JwksCachePolicy {
+		jcp.client = client
+
+		return jcp
+	})
+}
+
+// JwksTtl sets how long the keys are cached. It defaults to an hour.
+func JwksTtl(ttl time.Duration) JwksCacheOpt {
+	return tricks.ImmutableOption[JwksCachePolicy](func(jcp JwksCachePolicy) JwksCachePolicy {
+		jcp.ttl = ttl
+
+		return jcp
+	})
+}
+
+// JwksMinRefreshInterval sets the minimum interval between fetches of the jwks. It defaults to a minute.
+func JwksMinRefreshInterval(interval time.Duration) JwksCacheOpt {
+	return tricks.ImmutableOption[JwksCachePolicy](func(jcp JwksCachePolicy) JwksCachePolicy {
+		jcp.minRefreshInterval = interval
+
+		return jcp
+	})
+}
+
+func newJwksCachePolicy(options ...JwksCacheOpt) *JwksCachePolicy {
+	jcp := &JwksCachePolicy{
+		client:             http.DefaultClient,
+		ttl:                time.Hour,
+		minRefreshInterval: time.Minute,
+	}
+
+	return tricks.ApplyOptions(jcp, options...)
+}
+
+// NewJwksCache creates a cache of jwks served at url. Keys are fetched lazily.
+func NewJwksCache(url string, options ...JwksCacheOpt) *JwksCache {
+	return &JwksCache{
+		JwksCachePolicy: *newJwksCachePolicy(options...),
+		url:             url,
+	}
+}
+
+// DiscoverOidcJwks creates a JwksCache of the OpenID Connect issuer using its discovery document
+func DiscoverOidcJwks(ctx context.Context, issuer string, options ...JwksCacheOpt) (*JwksCache, error) {
+	jcp := newJwksCachePolicy(options...)
+
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JwksUri string `json:"jwks_uri"`
+	}
+	err := httpGetJson(ctx, jcp.client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	if discovery.Issuer != issuer || len(discovery.JwksUri) == 0 {
+		return nil, errors.Join(bricks.ErrFailedPrecondition,
+			fmt.Errorf("invalid discovery document of oidc issuer `%s`", issuer))
+	}
+
+	return &JwksCache{
+		JwksCachePolicy: *jcp,
+		url:             discovery.JwksUri,
+	}, nil
+}
+
+func (jc *JwksCache) JwtKey(ctx context.Context, kid string) (any, error) {
+	jc.l.Lock()
+	now := time.Now()
+	key, found := jc.key(kid)
+	fresh := (found && now.Sub(jc.fetchedAt) < jc.ttl) || now.Sub(jc.attemptedAt) < jc.minRefreshInterval
+	jc.l.Unlock()
+
+	if !fresh {
+		_, err, _ := jc.fetches.Do(jc.url, func() (any, error) {
+			return nil, jc.fetch(ctx)
+		})
+
+		jc.l.Lock()
+		key, found = jc.key(kid)
+		jc.l.Unlock()
+
+		if !found && err != nil {
+			return nil, err
+		}
+	}
+
+	if !found {
+		return nil, errors.Join(bricks.ErrUnauthenticated, fmt.Errorf("unknown jwt key id `%s`", kid))
+	}
+
+	return key.Key, nil
+}
+
+// fetch replaces the keys by the ones served at the url unless they've been just fetched by a former flight. The keys
+// are kept if the jwks is unreachable.
+func (jc *JwksCache) fetch(ctx context.Context) error {
+	jc.l.Lock()
+	attemptedAt := time.Now()
+	throttled := attemptedAt.Sub(jc.attemptedAt) < jc.minRefreshInterval
+	jc.l.Unlock()
+	if throttled {
+		return nil
+	}
+
+	var keys jose.JSONWebKeySet
+	err := httpGetJson(ctx, jc.client, jc.url, &keys)
+
+	jc.l.Lock()
+	defer jc.l.Unlock()
+
+	jc.attemptedAt = attemptedAt
+	if err != nil {
+		return err
+	}
+
+	jc.keys = keys
+	jc.fetchedAt = attemptedAt
+
+	return nil
+}
+
+// key looks up the key by its id. Tokens without key id are verified by the only key of the set if there is one.
+func (jc *JwksCache) key(kid string) (jose.JSONWebKey, bool) {
+	if len(kid) == 0 && len(jc.keys.Keys) == 1 {
+		return jc.keys.Keys[0], true
+	}
+
+	if kk := jc.keys.Key(kid); len(kk) > 0 {
+		return kk[0], true
+	}
+
+	return jose.JSONWebKey{}, false
+}
+
+func httpGetJson(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.Join(bricks.ErrInvalidArgument, err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+
+	if rsp.StatusCode != http.StatusOK {
+		return errors.Join(bricks.ErrUnavailable, fmt.Errorf("GET %s: %s", url, rsp.Status))
+	}
+
+	if err = json.NewDecoder(rsp.Body).Decode(v); err != nil {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	return nil
+}
+
+// JwtAuthenticator authenticates callers by bearer json web tokens (jwt) signed by the keys of JwtKeyResolver
+type JwtAuthenticator struct {
+	keys       JwtKeyResolver
+	algorithms []jose.SignatureAlgorithm
+	issuer     string
+	audience   []string
+	leeway     time.Duration
+	rolesClaim string
+	expiryless bool
+	anyAud     bool
+}
+
+type JwtAuthenticatorOpt = tricks.Option[JwtAuthenticator]
+
+// JwtIssuer sets the expected issuer (iss) of tokens
+func JwtIssuer(issuer string) JwtAuthenticatorOpt {
+	return tricks.ImmutableOption[JwtAuthenticator](func(ja JwtAuthenticator) JwtAuthenticator {
+		ja.issuer = issuer
+
+		return ja
+	})
+}
+
+// JwtAudience sets the expected audience (aud) of tokens. Tokens intended for any of them are accepted. It's required
+// unless JwtAnyAudience is set, so tokens issued for other services aren't accepted.
+func JwtAudience(audience ...string) JwtAuthenticatorOpt {
+	return tricks.ImmutableOption[JwtAuthenticator](func(ja JwtAuthenticator) JwtAuthenticator {
+		ja.audience = audience
+
+		return ja
+	})
+}
+
+// JwtAlgorithms sets the accepted signature algorithms. It defaults to the asymmetric ones.
+func JwtAlgorithms(algorithms ...jose.SignatureAlgorithm) JwtAuthenticatorOpt {
+	return tricks.ImmutableOption[JwtAuthenticator](func(ja JwtAuthenticator) JwtAuthenticator {
+		ja.algorithms = algorithms
+
+		return ja
+	})
+}
+
+// JwtLeeway sets the tolerated clock skew validating time claims. It defaults to a minute.
+func JwtLeeway(leeway time.Duration) JwtAuthenticatorOpt {
+	return tricks.ImmutableOption[JwtAuthenticator](func(ja JwtAuthenticator) JwtAuthenticator {
+		ja.leeway = leeway
+
+		return ja
+	})
+}
+
+// JwtRolesClaim sets the claim holding roles of the principal either as an array or a space-separated string. It
+// defaults to "roles".
+func JwtRolesClaim(claim string) JwtAuthenticatorOpt {
+	return tricks.ImmutableOption[JwtAuthenticator](func(ja JwtAuthenticator) JwtAuthenticator {
+		ja.rolesClaim = claim
+
+		return ja
+	})
+}
+
+// JwtAllowNoExpiry lets tokens without expiration time (exp) in, which are rejected by default since they're valid
+// forever once leaked.
+func JwtAllowNoExpiry() JwtAuthenticatorOpt {
+	return tricks.ImmutableOption[JwtAuthenticator](func(ja JwtAuthenticator) JwtAuthenticator {
+		ja.expiryless = true
+
+		return ja
+	})
+}
+
+// JwtAnyAudience lets tokens of any audience (aud) in, e.g. if the issuer is dedicated to the service. It's the
+// explicit opt-out of JwtAudience.
+func JwtAnyAudience() JwtAuthenticatorOpt {
+	return tricks.ImmutableOption[JwtAuthenticator](func(ja JwtAuthenticator) JwtAuthenticator {
+		ja.anyAud = true
+
+		return ja
+	})
+}
+
+// NewJwtAuthenticator makes a JwtAuthenticator of the keys. It panics if neither JwtAudience nor JwtAnyAudience is
+// set.
+func NewJwtAuthenticator(keys JwtKeyResolver, options ...JwtAuthenticatorOpt) *JwtAuthenticator {
+	if keys == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty jwt key resolver")))
+	}
+
+	ja := &JwtAuthenticator{
+		keys: keys,
+		algorithms: []jose.SignatureAlgorithm{
+			jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512,
+			jose.ES256, jose.ES384, jose.ES512, jose.EdDSA,
+		},
+		leeway:     jwt.DefaultLeeway,
+		rolesClaim: "roles",
+	}
+
+	ja = tricks.ApplyOptions(ja, options...)
+	if len(ja.audience) == 0 && !ja.anyAud {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty jwt audience")))
+	}
+
+	return ja
+}
+
+func (ja JwtAuthenticator) Authenticate(ctx context.Context, cred Credentials) (Principal, error) {
+	if len(cred.Bearer) == 0 {
+		return Principal{}, credentialsMissing()
+	}
+
+	token, err := jwt.ParseSigned(cred.Bearer, ja.algorithms)
+	if err != nil {
+		return Principal{}, errors.Join(bricks.ErrUnauthenticated, err)
+	}
+
+	key, err := ja.keys.JwtKey(ctx, token.Headers[0].KeyID)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	var (
+		claims jwt.Claims
+		all    map[string]any
+	)
+	if err = token.Claims(key, &claims, &all); err != nil {
+		return Principal{}, errors.Join(bricks.ErrUnauthenticated, err)
+	}
+
+	if claims.Expiry == nil && !ja.expiryless {
+		return Principal{}, errors.Join(bricks.ErrUnauthenticated, ErrJwtExpiryMissing)
+	}
+
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      ja.issuer,
+		AnyAudience: ja.audience,
+		Time:        time.Now(),
+	}, ja.leeway)
+	if err != nil {
+		return Principal{}, errors.Join(bricks.ErrUnauthenticated, err)
+	}
+
+	return Principal{
+		Subject:    claims.Subject,
+		Method:     AuthMethodJwt,
+		Roles:      jwtRoles(all[ja.rolesClaim]),
+		Attributes: all,
+	}, nil
+}
+
+func jwtRoles(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+
+	case []any:
+		roles := make([]string, 0, len(v))
+		for _, role := range v {
+			if s, ok := role.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+
+		return roles
+
+	default:
+		return nil
+	}
+}
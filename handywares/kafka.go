@@ -0,0 +1,118 @@
+package handywares
+
+import (
+	"errors"
+	"maps"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+)
+
+// kafkaCodeToBricksErr maps kafka protocol error codes and librdkafka local (negative) error codes to bricks errors
+var kafkaCodeToBricksErr = map[int]error{
+	-1: bricks.ErrInternal,           // UNKNOWN_SERVER_ERROR
+	1:  bricks.ErrOutOfRange,         // OFFSET_OUT_OF_RANGE
+	2:  bricks.ErrDataLoss,           // CORRUPT_MESSAGE
+	3:  bricks.ErrNotFound,           // UNKNOWN_TOPIC_OR_PARTITION
+	5:  bricks.ErrUnavailable,        // LEADER_NOT_AVAILABLE
+	6:  bricks.ErrUnavailable,        // NOT_LEADER_OR_FOLLOWER
+	7:  bricks.ErrDeadlineExceeded,   // REQUEST_TIMED_OUT
+	8:  bricks.ErrUnavailable,        // BROKER_NOT_AVAILABLE
+	10: bricks.ErrInvalidArgument,    // MESSAGE_TOO_LARGE
+	14: bricks.ErrUnavailable,        // COORDINATOR_LOAD_IN_PROGRESS
+	15: bricks.ErrUnavailable,        // COORDINATOR_NOT_AVAILABLE
+	16: bricks.ErrUnavailable,        // NOT_COORDINATOR
+	17: bricks.ErrInvalidArgument,    // INVALID_TOPIC_EXCEPTION
+	18: bricks.ErrInvalidArgument,    // RECORD_LIST_TOO_LARGE
+	19: bricks.ErrUnavailable,        // NOT_ENOUGH_REPLICAS
+	20: bricks.ErrUnavailable,        // NOT_ENOUGH_REPLICAS_AFTER_APPEND
+	22: errTxRollback,                // ILLEGAL_GENERATION
+	25: errTxRollback,                // UNKNOWN_MEMBER_ID
+	27: errTxRollback,                // REBALANCE_IN_PROGRESS
+	29: bricks.ErrPermissionDenied,   // TOPIC_AUTHORIZATION_FAILED
+	30: bricks.ErrPermissionDenied,   // GROUP_AUTHORIZATION_FAILED
+	31: bricks.ErrPermissionDenied,   // CLUSTER_AUTHORIZATION_FAILED
+	35: bricks.ErrUnimplemented,      // UNSUPPORTED_VERSION
+	36: bricks.ErrAlreadyExists,      // TOPIC_ALREADY_EXISTS
+	42: bricks.ErrInvalidArgument,    // INVALID_REQUEST
+	47: bricks.ErrFailedPrecondition, // INVALID_PRODUCER_EPOCH
+	48: bricks.ErrFailedPrecondition, // INVALID_TXN_STATE
+	53: bricks.ErrPermissionDenied,   // TRANSACTIONAL_ID_AUTHORIZATION_FAILED
+	58: bricks.ErrUnauthenticated,    // SASL_AUTHENTICATION_FAILED
+	87: bricks.ErrInvalidArgument,    // INVALID_RECORD
+	89: bricks.ErrResourceExhausted,  // THROTTLING_QUOTA_EXCEEDED
+
+	-195: bricks.ErrUnavailable,      // _TRANSPORT
+	-187: bricks.ErrUnavailable,      // _ALL_BROKERS_DOWN
+	-185: bricks.ErrDeadlineExceeded, // _TIMED_OUT
+}
+
+// KafkaErrorMapper maps errors of kafka clients to bricks errors by their kafka error code, extracted by the
+// extractors of KafkaCodeExtractor. Unmapped errors which report themselves retriable (or temporary) are mapped to
+// bricks.ErrUnavailable.
+type KafkaErrorMapper struct {
+	codes      map[int]error
+	extractors []func(err error) (int, bool)
+}
+
+type KafkaErrorMapperOpt = tricks.Option[KafkaErrorMapper]
+
+// KafkaCodeToBricksError maps the kafka error code to berr. It overrides the default mapping of the code if there is
+// one.
+func KafkaCodeToBricksError(code int, berr error) KafkaErrorMapperOpt {
+	return tricks.ImmutableOption[KafkaErrorMapper](func(m KafkaErrorMapper) KafkaErrorMapper {
+		m.codes[code] = berr
+
+		return m
+	})
+}
+
+// KafkaCodeExtractor adds an extractor of kafka error code from client errors. Extractors of kafka-go and franz-go
+// errors are provided by kafkagoerr and franzerr subpackages, so the clients are linked only if they are used. Errors
+// of confluent-kafka-go can be supported by an extractor returning Code() of its kafka.Error.
+func KafkaCodeExtractor(extractor func(err error) (int, bool)) KafkaErrorMapperOpt {
+	return tricks.ImmutableOption[KafkaErrorMapper](func(m KafkaErrorMapper) KafkaErrorMapper {
+		m.extractors = append(m.extractors, extractor)
+
+		return m
+	})
+}
+
+func NewKafkaErrorMapper(options ...KafkaErrorMapperOpt) *KafkaErrorMapper {
+	m := &KafkaErrorMapper{
+		codes: maps.Clone(kafkaCodeToBricksErr),
+	}
+
+	return tricks.ApplyOptions(m, options...)
+}
+
+func (m KafkaErrorMapper) Map(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	for _, extract := range m.extractors {
+		if code, ok := extract(err); ok {
+			if berr, ok := m.codes[code]; ok {
+				return errors.Join(berr, err)
+			}
+		}
+	}
+
+	var (
+		rerr interface{ IsRetriable() bool }
+		terr interface{ Temporary() bool }
+	)
+	if (errors.As(err, &rerr) && rerr.IsRetriable()) || (errors.As(err, &terr) && terr.Temporary()) {
+		return bricks.ParseError(err, bricks.ErrUnavailable)
+	}
+
+	return bricks.ParseError(err, bricks.ErrUnknown)
+}
+
+var defaultKafkaErrorMapper = NewKafkaErrorMapper()
+
+// KafkaToBricksError maps err using the default KafkaErrorMapper
+func KafkaToBricksError(err error) error {
+	return defaultKafkaErrorMapper.Map(err)
+}
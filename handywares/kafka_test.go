@@ -0,0 +1,53 @@
+package handywares_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+// confluentError is shaped like confluent-kafka-go errors
+type confluentError struct {
+	code      int16
+	retriable bool
+}
+
+func (e confluentError) Error() string {
+	return "confluent error"
+}
+
+func (e confluentError) Code() int16 {
+	return e.code
+}
+
+func (e confluentError) IsRetriable() bool {
+	return e.retriable
+}
+
+func TestKafkaToBricksError(t *testing.T) {
+	assert.NoError(t, handywares.KafkaToBricksError(nil))
+
+	// Errors aren't taken for kafka errors by their shape, but retriable ones are mapped to bricks.ErrUnavailable
+	assert.ErrorIs(t, handywares.KafkaToBricksError(confluentError{code: 7}), bricks.ErrUnknown)
+	assert.ErrorIs(t, handywares.KafkaToBricksError(confluentError{code: 27, retriable: true}), bricks.ErrUnavailable)
+	assert.ErrorIs(t, handywares.KafkaToBricksError(bricks.ErrorWithCode(3, errors.New("coded"))), bricks.ErrUnknown)
+
+	mapper := handywares.NewKafkaErrorMapper(
+		handywares.KafkaCodeToBricksError(1001, bricks.ErrAborted),
+		handywares.KafkaCodeExtractor(func(err error) (int, bool) {
+			var cerr confluentError
+			if errors.As(err, &cerr) {
+				return int(cerr.Code()), true
+			}
+
+			return 0, false
+		}),
+	)
+	assert.ErrorIs(t, mapper.Map(confluentError{code: 1001}), bricks.ErrAborted)
+	assert.ErrorIs(t, mapper.Map(confluentError{code: 7}), bricks.ErrDeadlineExceeded)
+	assert.ErrorIs(t, mapper.Map(confluentError{code: 3}), bricks.ErrNotFound)
+}
@@ -0,0 +1,25 @@
+// Package kafkagoerr extracts kafka error codes of segmentio/kafka-go errors for handywares.KafkaErrorMapper
+package kafkagoerr
+
+import (
+	"errors"
+
+	kafkago "github.com/segmentio/kafka-go"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+// KafkaCodeOf returns code of the kafka-go error in the err tree
+func KafkaCodeOf(err error) (int, bool) {
+	var kgerr kafkago.Error
+	if errors.As(err, &kgerr) {
+		return int(kgerr), true
+	}
+
+	return 0, false
+}
+
+// KafkaCodeExtractor makes the mapper extract codes of kafka-go errors by KafkaCodeOf
+func KafkaCodeExtractor() handywares.KafkaErrorMapperOpt {
+	return handywares.KafkaCodeExtractor(KafkaCodeOf)
+}
@@ -0,0 +1,22 @@
+package kafkagoerr_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/janstoon/toolbox/handywares"
+	"github.com/janstoon/toolbox/handywares/kafkagoerr"
+)
+
+func TestKafkaCodeExtractor(t *testing.T) {
+	mapper := handywares.NewKafkaErrorMapper(kafkagoerr.KafkaCodeExtractor())
+
+	assert.ErrorIs(t, mapper.Map(kafkago.UnknownTopicOrPartition), bricks.ErrNotFound)
+	assert.ErrorIs(t, mapper.Map(fmt.Errorf("produce: %w", kafkago.TopicAuthorizationFailed)),
+		bricks.ErrPermissionDenied)
+	assert.ErrorIs(t, mapper.Map(kafkago.Error(1001)), bricks.ErrUnknown)
+}
@@ -0,0 +1,460 @@
+package handywares
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// ErrCodeLimitExceeded is the custom error code of ErrLimitExceeded which is responded by 429 over http
+var ErrCodeLimitExceeded = bricks.MustRegisterErrorCode(bricks.ErrorCode{
+	Code:       bricks.ErrCodeLimitExceeded,
+	Name:       "limit_exceeded",
+	Parent:     bricks.ErrCodeResourceExhausted,
+	HttpStatus: http.StatusTooManyRequests,
+})
+
+// ErrLimitExceeded is what calls not admitted by limiters fail by. It matches bricks.ErrResourceExhausted.
+var ErrLimitExceeded = bricks.ErrorWithCode(ErrCodeLimitExceeded, errors.New("limit exceeded"))
+
+// Limiter admits calls identified by key, e.g. client ip. Calls which aren't admitted must fail by ErrLimitExceeded,
+// along with bricks.RetryInfo if it's known when the key is admitted again, to be responded by 429 as bare
+// bricks.ErrResourceExhausted is responded by 500. Admitted calls must call release once they're done.
+type Limiter interface {
+	Acquire(ctx context.Context, key string) (release func(), err error)
+}
+
+func limitExceeded(retryAfter time.Duration) error {
+	err := ErrLimitExceeded
+	if retryAfter <= 0 {
+		return err
+	}
+
+	return bricks.ErrorWithDetails(err, bricks.RetryInfo{RetryDelay: retryAfter})
+}
+
+func noRelease() {}
+
+// TokenBucketLimiter admits bursts of calls up to the bucket size, refilled at a steady rate
+type TokenBucketLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	l         sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// NewTokenBucketLimiter creates a limiter admitting limit calls per period for each key in the long run and bursts of
+// up to burst calls.
+func NewTokenBucketLimiter(limit int, period time.Duration, burst int) *TokenBucketLimiter {
+	if limit <= 0 || period <= 0 || burst <= 0 {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("invalid token bucket limiter configuration")))
+	}
+
+	return &TokenBucketLimiter{
+		rate:    float64(limit) / period.Seconds(),
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (tbl *TokenBucketLimiter) Acquire(_ context.Context, key string) (func(), error) {
+	tbl.l.Lock()
+	defer tbl.l.Unlock()
+
+	now := time.Now()
+	tbl.sweep(now)
+
+	b, ok := tbl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: tbl.burst, at: now}
+		tbl.buckets[key] = b
+	}
+
+	b.tokens = min(tbl.burst, b.tokens+now.Sub(b.at).Seconds()*tbl.rate)
+	b.at = now
+	if b.tokens < 1 {
+		return nil, limitExceeded(time.Duration((1 - b.tokens) / tbl.rate * float64(time.Second)))
+	}
+
+	b.tokens--
+
+	return noRelease, nil
+}
+
+// sweep forgets the buckets which are full by now since they're the same as new ones
+func (tbl *TokenBucketLimiter) sweep(now time.Time) {
+	refill := time.Duration(tbl.burst / tbl.rate * float64(time.Second))
+	if now.Sub(tbl.lastSweep) < refill {
+		return
+	}
+
+	for key, b := range tbl.buckets {
+		if now.Sub(b.at) >= refill {
+			delete(tbl.buckets, key)
+		}
+	}
+	tbl.lastSweep = now
+}
+
+// SlidingWindowLimiter admits up to limit calls in any window of time for each key. It approximates the calls of the
+// sliding window by weighting the calls of the previous fixed window.
+type SlidingWindowLimiter struct {
+	limit  int
+	window time.Duration
+
+	l       sync.Mutex
+	windows map[string]*slidingWindow
+}
+
+type slidingWindow struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+func NewSlidingWindowLimiter(limit int, window time.Duration) *SlidingWindowLimiter {
+	if limit <= 0 || window <= 0 {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("invalid sliding window limiter configuration")))
+	}
+
+	return &SlidingWindowLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*slidingWindow),
+	}
+}
+
+func (swl *SlidingWindowLimiter) Acquire(_ context.Context, key string) (func(), error) {
+	swl.l.Lock()
+	defer swl.l.Unlock()
+
+	now := time.Now()
+	start := now.Truncate(swl.window)
+	w, ok := swl.windows[key]
+	if !ok {
+		w = &slidingWindow{start: start}
+		swl.windows[key] = w
+	}
+
+	if !w.start.Equal(start) {
+		if start.Sub(w.start) == swl.window {
+			w.previous = w.current
+		} else {
+			w.previous = 0
+		}
+		w.current = 0
+		w.start = start
+
+		swl.sweep(start)
+	}
+
+	elapsed := float64(now.Sub(start)) / float64(swl.window)
+	if float64(w.previous)*(1-elapsed)+float64(w.current)+1 <= float64(swl.limit) {
+		w.current++
+
+		return noRelease, nil
+	}
+
+	// Calls of the previous window fade out as time goes by until the next one starts
+	retryAfter := start.Add(swl.window).Sub(now)
+	if w.current+1 <= swl.limit && w.previous > 0 {
+		fade := 1 - float64(swl.limit-w.current-1)/float64(w.previous)
+		retryAfter = time.Duration(math.Ceil((fade - elapsed) * float64(swl.window)))
+	}
+
+	return nil, limitExceeded(retryAfter)
+}
+
+// sweep forgets the windows which have been idle for longer than a window
+func (swl *SlidingWindowLimiter) sweep(start time.Time) {
+	for key, w := range swl.windows {
+		if start.Sub(w.start) > swl.window {
+			delete(swl.windows, key)
+		}
+	}
+}
+
+// redisSlidingWindowScript logs admitted calls in a sorted set scored by their time (in microseconds) and returns zero
+// if the call is admitted or microseconds until the oldest call slides out of the window otherwise.
+var redisSlidingWindowScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[3])
+	redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+
+	return 0
+end
+
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+
+return math.max(tonumber(oldest[2]) + window - now, 1)
+`)
+
+// RedisLimiter is a distributed SlidingWindowLimiter which shares the windows among all the instances of the service
+// through redis. It logs calls precisely rather than approximating them.
+type RedisLimiter struct {
+	client redis.Scripter
+	prefix string
+	limit  int
+	window time.Duration
+}
+
+// NewRedisLimiter creates a redis-backed limiter storing the window of each key under prefix+key
+func NewRedisLimiter(client redis.Scripter, prefix string, limit int, window time.Duration) *RedisLimiter {
+	if client == nil || limit <= 0 || window < time.Millisecond {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("invalid redis limiter configuration")))
+	}
+
+	return &RedisLimiter{
+		client: client,
+		prefix: prefix,
+		limit:  limit,
+		window: window,
+	}
+}
+
+func (rl RedisLimiter) Acquire(ctx context.Context, key string) (func(), error) {
+	wait, err := redisSlidingWindowScript.Run(ctx, rl.client, []string{rl.prefix + key},
+		rl.window.Microseconds(), rl.limit, fmt.Sprintf("%d:%x", time.Now().UnixNano(), rand.Uint64()),
+	).Int64()
+	if err != nil {
+		return nil, RedisToBricksError(err)
+	}
+
+	if wait > 0 {
+		return nil, limitExceeded(time.Duration(wait) * time.Microsecond)
+	}
+
+	return noRelease, nil
+}
+
+// ConcurrencyLimiter admits up to limit in-flight calls for each key
+type ConcurrencyLimiter struct {
+	limit int
+
+	l        sync.Mutex
+	inflight map[string]int
+}
+
+func NewConcurrencyLimiter(limit int) *ConcurrencyLimiter {
+	if limit <= 0 {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("invalid concurrency limiter configuration")))
+	}
+
+	return &ConcurrencyLimiter{
+		limit:    limit,
+		inflight: make(map[string]int),
+	}
+}
+
+func (cl *ConcurrencyLimiter) Acquire(_ context.Context, key string) (func(), error) {
+	cl.l.Lock()
+	defer cl.l.Unlock()
+
+	if cl.inflight[key] >= cl.limit {
+		return nil, limitExceeded(0)
+	}
+	cl.inflight[key]++
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			cl.l.Lock()
+			defer cl.l.Unlock()
+
+			cl.inflight[key]--
+			if cl.inflight[key] <= 0 {
+				delete(cl.inflight, key)
+			}
+		})
+	}, nil
+}
+
+type HttpLimitKeyExtractor func(req *http.Request) string
+
+// HttpClientIpLimitKey keys requests by the ip of the remote address. Services behind reverse proxies should rather
+// use HttpHeaderLimitKey with the header which the proxy puts client ip in, e.g. X-Real-IP.
+func HttpClientIpLimitKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// HttpHeaderLimitKey keys requests by value of the header. Requests without the header share the same (empty) key.
+func HttpHeaderLimitKey(name string) HttpLimitKeyExtractor {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+// HttpLimiterMiddleware rejects requests not admitted by the limiter with problem details of
+// ErrLimitExceeded (429) and Retry-After header.
+func HttpLimiterMiddleware(limiter Limiter, key HttpLimitKeyExtractor) tricks.Middleware[http.Handler] {
+	if limiter == nil || key == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty limiter or key extractor")))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			release, err := limiter.Acquire(req.Context(), key(req))
+			if err != nil {
+				HttpWriteError(rw, req, err)
+
+				return
+			}
+			defer release()
+
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+type GrpcLimitKeyExtractor func(ctx context.Context, info *grpc.UnaryServerInfo) string
+
+// GrpcPeerLimitKey keys calls by the ip of the peer
+func GrpcPeerLimitKey(ctx context.Context, _ *grpc.UnaryServerInfo) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+// GrpcMetadataLimitKey keys calls by the first value of the incoming metadata key
+func GrpcMetadataLimitKey(name string) GrpcLimitKeyExtractor {
+	return func(ctx context.Context, _ *grpc.UnaryServerInfo) string {
+		if vv := metadata.ValueFromIncomingContext(ctx, name); len(vv) > 0 {
+			return vv[0]
+		}
+
+		return ""
+	}
+}
+
+// GrpcLimiterMiddleware rejects calls not admitted by the limiter with bricks.ErrResourceExhausted. Push it after
+// (inner than) GrpcUnaryServerErrorMapperMiddleware to have it converted to RESOURCE_EXHAUSTED status.
+func GrpcLimiterMiddleware(limiter Limiter, key GrpcLimitKeyExtractor) tricks.Middleware[grpc.UnaryServerInterceptor] {
+	if limiter == nil || key == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty limiter or key extractor")))
+	}
+
+	return func(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+		return func(
+			ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+		) (any, error) {
+			release, err := limiter.Acquire(ctx, key(ctx, info))
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+
+			return next(ctx, req, info, handler)
+		}
+	}
+}
+
+// NatsSubjectLimitKey keys messages by their subject
+func NatsSubjectLimitKey(msg *nats.Msg) string {
+	return msg.Subject
+}
+
+// NatsLimiterMiddleware fails handling of messages not admitted by the limiter with bricks.ErrResourceExhausted which
+// is retryable.
+func NatsLimiterMiddleware(limiter Limiter, key func(msg *nats.Msg) string) tricks.Middleware[NatsMsgHandler] {
+	if limiter == nil || key == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty limiter or key extractor")))
+	}
+
+	return func(next NatsMsgHandler) NatsMsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			release, err := limiter.Acquire(ctx, key(msg))
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			return next(ctx, msg)
+		}
+	}
+}
+
+// AsynqTaskTypeLimitKey keys tasks by their type
+func AsynqTaskTypeLimitKey(_ context.Context, task *asynq.Task) string {
+	return task.Type()
+}
+
+// AsynqLimiterMiddleware fails processing of tasks not admitted by the limiter with bricks.ErrResourceExhausted which
+// is retryable. Set asynq.Config.RetryDelayFunc to AsynqRetryDelayFunc to retry them once they're admitted and
+// asynq.Config.IsFailure to exclude ErrLimitExceeded from failures.
+func AsynqLimiterMiddleware(
+	limiter Limiter, key func(ctx context.Context, task *asynq.Task) string,
+) tricks.Middleware[asynq.Handler] {
+	if limiter == nil || key == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty limiter or key extractor")))
+	}
+
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+			release, err := limiter.Acquire(ctx, key(ctx, task))
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			return next.ProcessTask(ctx, task)
+		})
+	}
+}
+
+// AsynqRetryDelayFunc delays retries of tasks failed with bricks.RetryInfo as much as it says and falls back to
+// fallback (asynq.DefaultRetryDelayFunc if nil) for the others.
+func AsynqRetryDelayFunc(fallback asynq.RetryDelayFunc) asynq.RetryDelayFunc {
+	if fallback == nil {
+		fallback = asynq.DefaultRetryDelayFunc
+	}
+
+	return func(n int, err error, task *asynq.Task) time.Duration {
+		if ri, ok := bricks.ErrorDetailOf[bricks.RetryInfo](err); ok {
+			return ri.RetryDelay
+		}
+
+		return fallback(n, err, task)
+	}
+}
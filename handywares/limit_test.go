@@ -0,0 +1,161 @@
+package handywares_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+func assertLimitExceeded(t *testing.T, err error) {
+	t.Helper()
+
+	require.ErrorIs(t, err, bricks.ErrResourceExhausted)
+	require.ErrorIs(t, err, handywares.ErrLimitExceeded)
+	require.ErrorIs(t, err, bricks.ErrRetryable)
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter := handywares.NewTokenBucketLimiter(10, 100*time.Millisecond, 2)
+
+	for range 2 {
+		_, err := limiter.Acquire(ctx, "k1")
+		require.NoError(t, err)
+	}
+
+	_, err := limiter.Acquire(ctx, "k1")
+	assertLimitExceeded(t, err)
+	ri, ok := bricks.ErrorDetailOf[bricks.RetryInfo](err)
+	require.True(t, ok)
+	assert.LessOrEqual(t, ri.RetryDelay, 10*time.Millisecond)
+
+	_, err = limiter.Acquire(ctx, "k2")
+	require.NoError(t, err)
+
+	time.Sleep(ri.RetryDelay)
+	_, err = limiter.Acquire(ctx, "k1")
+	require.NoError(t, err)
+}
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter := handywares.NewSlidingWindowLimiter(3, time.Hour)
+
+	for range 3 {
+		_, err := limiter.Acquire(ctx, "k1")
+		require.NoError(t, err)
+	}
+
+	_, err := limiter.Acquire(ctx, "k1")
+	assertLimitExceeded(t, err)
+	ri, ok := bricks.ErrorDetailOf[bricks.RetryInfo](err)
+	require.True(t, ok)
+	assert.LessOrEqual(t, ri.RetryDelay, time.Hour)
+
+	_, err = limiter.Acquire(ctx, "k2")
+	require.NoError(t, err)
+}
+
+func TestRedisLimiter(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() {
+		_ = client.Close()
+	}()
+
+	limiter := handywares.NewRedisLimiter(client, "limit:", 2, time.Minute)
+	for range 2 {
+		_, err := limiter.Acquire(ctx, "k1")
+		require.NoError(t, err)
+	}
+
+	_, err := limiter.Acquire(ctx, "k1")
+	assertLimitExceeded(t, err)
+	ri, ok := bricks.ErrorDetailOf[bricks.RetryInfo](err)
+	require.True(t, ok)
+	assert.Greater(t, ri.RetryDelay, time.Duration(0))
+	assert.LessOrEqual(t, ri.RetryDelay, time.Minute)
+	assert.True(t, mr.Exists("limit:k1"))
+
+	_, err = limiter.Acquire(ctx, "k2")
+	require.NoError(t, err)
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter := handywares.NewConcurrencyLimiter(1)
+
+	release, err := limiter.Acquire(ctx, "k1")
+	require.NoError(t, err)
+
+	_, err = limiter.Acquire(ctx, "k1")
+	assertLimitExceeded(t, err)
+
+	release()
+	release()
+	release, err = limiter.Acquire(ctx, "k1")
+	require.NoError(t, err)
+	release()
+}
+
+func TestHttpLimiterMiddleware(t *testing.T) {
+	var mws handywares.HttpMiddlewareStack
+	handler := mws.Push(handywares.HttpLimiterMiddleware(
+		handywares.NewSlidingWindowLimiter(1, time.Hour), handywares.HttpHeaderLimitKey("X-Api-Key"),
+	))(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	serve := func(apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve("a").Code)
+	assert.Equal(t, http.StatusNoContent, serve("b").Code)
+
+	rec := serve("a")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	assert.Equal(t, handywares.HttpProblemContentType, rec.Header().Get("Content-Type"))
+}
+
+func TestGrpcLimiterMiddleware(t *testing.T) {
+	var mws handywares.GrpcUnaryServerMiddlewareStack
+	interceptor := mws.
+		Push(handywares.GrpcUnaryServerErrorMapperMiddleware(handywares.BricksToGrpcErrorMapper)).
+		Push(handywares.GrpcLimiterMiddleware(
+			handywares.NewTokenBucketLimiter(1, time.Hour, 1), handywares.GrpcMetadataLimitKey("tenant"),
+		))(handywares.GrpcUnaryServerInvokeHandlerInterceptor)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("tenant", "t1"))
+	handler := func(ctx context.Context, req any) (any, error) {
+		return "ok", nil
+	}
+
+	rsp, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Method"}, handler)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", rsp)
+
+	_, err = interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Method"}, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
@@ -3,8 +3,6 @@ package handywares
 import (
 	"context"
 	"errors"
-	"fmt"
-	"runtime/debug"
 	"strings"
 
 	"github.com/janstoon/toolbox/bricks"
@@ -22,18 +20,16 @@ func (stk MsgMiddlewareStack[M]) Push(mw tricks.Middleware[MsgHandler[M]]) MsgMi
 	return MsgMiddlewareStack[M](tricks.MiddlewareStack[MsgHandler[M]](stk).Push(mw))
 }
 
-type PanicRecoverMsgMiddlewareOpt = tricks.MutableOption[any]
+type PanicRecoverMsgMiddlewareOpt = PanicRecoverOpt
 
 func MsgPanicRecoverMiddleware[M any](options ...PanicRecoverMsgMiddlewareOpt) tricks.Middleware[MsgHandler[M]] {
+	pr := newPanicRecoverer(options...)
+
 	return func(next MsgHandler[M]) MsgHandler[M] {
-		return func(ctx context.Context, msg M) error {
+		return func(ctx context.Context, msg M) (err error) {
 			defer func() {
 				if r := recover(); r != nil {
-					span := trace.SpanFromContext(ctx)
-					span.AddEvent("panic recovered", trace.WithAttributes(
-						oaPanicValue.String(fmt.Sprintf("%+v", r)),
-						oaDebugStack.String(string(debug.Stack())),
-					))
+					err = pr.recovered(ctx, r)
 				}
 			}()
 
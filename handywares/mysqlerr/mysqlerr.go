@@ -0,0 +1,44 @@
+// Package mysqlerr extracts SQLSTATE codes of go-sql-driver/mysql errors for handywares.SqlErrorMapper
+package mysqlerr
+
+import (
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+// errNumToSqlState translates mysql error numbers to precise SQLSTATE codes
+var errNumToSqlState = map[uint16]string{
+	1048: "23502", // ER_BAD_NULL_ERROR
+	1062: "23505", // ER_DUP_ENTRY
+	1205: "55P03", // ER_LOCK_WAIT_TIMEOUT
+	1213: "40P01", // ER_LOCK_DEADLOCK
+	1216: "23503", // ER_NO_REFERENCED_ROW
+	1217: "23503", // ER_ROW_IS_REFERENCED
+	1451: "23503", // ER_ROW_IS_REFERENCED_2
+	1452: "23503", // ER_NO_REFERENCED_ROW_2
+	1586: "23505", // ER_DUP_ENTRY_WITH_KEY_NAME
+	3819: "23514", // ER_CHECK_CONSTRAINT_VIOLATED
+}
+
+// SqlStateOf returns SQLSTATE code of the mysql error in the err tree. Error numbers of the integrity constraint
+// violations and lock failures are translated to precise codes, since mysql reports vague ones for them.
+func SqlStateOf(err error) (string, bool) {
+	var merr *mysql.MySQLError
+	if !errors.As(err, &merr) || merr == nil {
+		return "", false
+	}
+
+	if state, ok := errNumToSqlState[merr.Number]; ok {
+		return state, true
+	}
+
+	return string(merr.SQLState[:]), true
+}
+
+// SqlStateExtractor makes the mapper extract SQLSTATE codes of mysql errors by SqlStateOf
+func SqlStateExtractor() handywares.SqlErrorMapperOpt {
+	return handywares.SqlStateExtractor(SqlStateOf)
+}
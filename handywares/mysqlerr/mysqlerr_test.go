@@ -0,0 +1,34 @@
+package mysqlerr_test
+
+import (
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/janstoon/toolbox/handywares"
+	"github.com/janstoon/toolbox/handywares/mysqlerr"
+)
+
+func TestSqlStateExtractor(t *testing.T) {
+	mapper := handywares.NewSqlErrorMapper(mysqlerr.SqlStateExtractor())
+
+	for _, tc := range []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"duplicate", &mysql.MySQLError{Number: 1062, SQLState: [5]byte([]byte("23000"))}, bricks.ErrAlreadyExists},
+		{"deadlock", &mysql.MySQLError{Number: 1213, SQLState: [5]byte([]byte("40001"))}, bricks.ErrRetryable},
+		{"native state", &mysql.MySQLError{Number: 1146, SQLState: [5]byte([]byte("42S02"))}, bricks.ErrUnknown},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := mapper.Map(tc.err)
+			assert.ErrorIs(t, err, tc.expected)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+
+	assert.ErrorIs(t, handywares.SqlToBricksError(&mysql.MySQLError{Number: 1062}), bricks.ErrUnknown)
+}
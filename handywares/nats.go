@@ -3,8 +3,6 @@ package handywares
 import (
 	"context"
 	"errors"
-	"fmt"
-	"runtime/debug"
 	"strings"
 
 	"github.com/janstoon/toolbox/bricks"
@@ -17,18 +15,16 @@ type NatsMsgHandler func(ctx context.Context, msg *nats.Msg) error
 
 type NatsMiddlewareStack = tricks.MiddlewareStack[NatsMsgHandler]
 
-type PanicRecoverNatsMiddlewareOpt = tricks.MutableOption[any]
+type PanicRecoverNatsMiddlewareOpt = PanicRecoverOpt
+
+func NatsPanicRecoverMiddleware(options ...PanicRecoverNatsMiddlewareOpt) tricks.Middleware[NatsMsgHandler] {
+	pr := newPanicRecoverer(options...)
 
-func NatsPanicRecoverMiddleware(options ...PanicRecoverAsynqMiddlewareOpt) tricks.Middleware[NatsMsgHandler] {
 	return func(next NatsMsgHandler) NatsMsgHandler {
-		return func(ctx context.Context, msg *nats.Msg) error {
+		return func(ctx context.Context, msg *nats.Msg) (err error) {
 			defer func() {
 				if r := recover(); r != nil {
-					span := trace.SpanFromContext(ctx)
-					span.AddEvent("panic recovered", trace.WithAttributes(
-						oaPanicValue.String(fmt.Sprintf("%+v", r)),
-						oaDebugStack.String(string(debug.Stack())),
-					))
+					err = pr.recovered(ctx, r)
 				}
 			}()
 
@@ -0,0 +1,120 @@
+package handywares
+
+import (
+	"errors"
+	"maps"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+)
+
+// objectStorageCodeToBricksErr maps S3 error codes to bricks errors
+var objectStorageCodeToBricksErr = map[string]error{
+	"NoSuchKey":             bricks.ErrNotFound,
+	"NoSuchBucket":          bricks.ErrNotFound,
+	"NoSuchUpload":          bricks.ErrNotFound,
+	"NoSuchVersion":         bricks.ErrNotFound,
+	"NotFound":              bricks.ErrNotFound,
+	"AccessDenied":          bricks.ErrPermissionDenied,
+	"AllAccessDisabled":     bricks.ErrPermissionDenied,
+	"InvalidAccessKeyId":    bricks.ErrUnauthenticated,
+	"ExpiredToken":          bricks.ErrUnauthenticated,
+	"SignatureDoesNotMatch": bricks.ErrUnauthenticated,
+
+	"BucketAlreadyExists":     bricks.ErrAlreadyExists,
+	"BucketAlreadyOwnedByYou": bricks.ErrAlreadyExists,
+	"BucketNotEmpty":          bricks.ErrFailedPrecondition,
+	"PreconditionFailed":      bricks.ErrFailedPrecondition,
+	"InvalidObjectState":      bricks.ErrFailedPrecondition,
+	"InvalidRange":            bricks.ErrOutOfRange,
+
+	"InvalidArgument":   bricks.ErrInvalidArgument,
+	"InvalidBucketName": bricks.ErrInvalidArgument,
+	"InvalidDigest":     bricks.ErrInvalidArgument,
+	"BadDigest":         bricks.ErrInvalidArgument,
+	"EntityTooSmall":    bricks.ErrInvalidArgument,
+	"EntityTooLarge":    bricks.ErrInvalidArgument,
+	"KeyTooLongError":   bricks.ErrInvalidArgument,
+	"MalformedXML":      bricks.ErrInvalidArgument,
+
+	"SlowDown":           bricks.ErrResourceExhausted,
+	"RequestTimeout":     bricks.ErrDeadlineExceeded,
+	"InternalError":      bricks.ErrInternal,
+	"ServiceUnavailable": bricks.ErrUnavailable,
+	"NotImplemented":     bricks.ErrUnimplemented,
+}
+
+// ObjectStorageErrorMapper maps errors of S3-style object storage clients to bricks errors by their error code. Errors
+// without a (mapped) code are mapped by their http status code if they have one.
+type ObjectStorageErrorMapper struct {
+	codes      map[string]error
+	extractors []func(err error) (string, bool)
+}
+
+type ObjectStorageErrorMapperOpt = tricks.Option[ObjectStorageErrorMapper]
+
+// ObjectStorageCodeToBricksError maps the error code to berr. It overrides the default mapping of the code if there is
+// one.
+func ObjectStorageCodeToBricksError(code string, berr error) ObjectStorageErrorMapperOpt {
+	return tricks.ImmutableOption[ObjectStorageErrorMapper](func(m ObjectStorageErrorMapper) ObjectStorageErrorMapper {
+		m.codes[code] = berr
+
+		return m
+	})
+}
+
+// ObjectStorageCodeExtractor adds an extractor of error code from client errors, e.g. using minio.ToErrorResponse.
+// Errors implementing `ErrorCode() string` (e.g. aws sdk smithy.APIError) are supported by default.
+func ObjectStorageCodeExtractor(extractor func(err error) (string, bool)) ObjectStorageErrorMapperOpt {
+	return tricks.ImmutableOption[ObjectStorageErrorMapper](func(m ObjectStorageErrorMapper) ObjectStorageErrorMapper {
+		m.extractors = append(m.extractors, extractor)
+
+		return m
+	})
+}
+
+func NewObjectStorageErrorMapper(options ...ObjectStorageErrorMapperOpt) *ObjectStorageErrorMapper {
+	m := &ObjectStorageErrorMapper{
+		codes:      maps.Clone(objectStorageCodeToBricksErr),
+		extractors: []func(err error) (string, bool){objectStorageCodeOf},
+	}
+
+	return tricks.ApplyOptions(m, options...)
+}
+
+func (m ObjectStorageErrorMapper) Map(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	for _, extract := range m.extractors {
+		if code, ok := extract(err); ok {
+			if berr, ok := m.codes[code]; ok {
+				return errors.Join(berr, err)
+			}
+		}
+	}
+
+	var herr interface{ HTTPStatusCode() int }
+	if errors.As(err, &herr) {
+		return HttpStatusToBricksError(herr.HTTPStatusCode(), err)
+	}
+
+	return bricks.ParseError(err, bricks.ErrUnknown)
+}
+
+func objectStorageCodeOf(err error) (string, bool) {
+	var cerr interface{ ErrorCode() string }
+	if errors.As(err, &cerr) {
+		return cerr.ErrorCode(), true
+	}
+
+	return "", false
+}
+
+var defaultObjectStorageErrorMapper = NewObjectStorageErrorMapper()
+
+// ObjectStorageToBricksError maps err using the default ObjectStorageErrorMapper
+func ObjectStorageToBricksError(err error) error {
+	return defaultObjectStorageErrorMapper.Map(err)
+}
@@ -0,0 +1,47 @@
+package handywares_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+type objectStorageError struct {
+	code   string
+	status int
+}
+
+func (e objectStorageError) Error() string {
+	return "object storage error " + e.code
+}
+
+func (e objectStorageError) ErrorCode() string {
+	return e.code
+}
+
+func (e objectStorageError) HTTPStatusCode() int {
+	return e.status
+}
+
+func TestObjectStorageToBricksError(t *testing.T) {
+	assert.NoError(t, handywares.ObjectStorageToBricksError(nil))
+
+	err := handywares.ObjectStorageToBricksError(objectStorageError{"NoSuchKey", http.StatusNotFound})
+	assert.ErrorIs(t, err, bricks.ErrNotFound)
+
+	err = handywares.ObjectStorageToBricksError(objectStorageError{"SlowDown", http.StatusServiceUnavailable})
+	assert.ErrorIs(t, err, bricks.ErrResourceExhausted)
+	assert.ErrorIs(t, err, bricks.ErrRetryable)
+
+	err = handywares.ObjectStorageToBricksError(objectStorageError{"Vendor", http.StatusForbidden})
+	assert.ErrorIs(t, err, bricks.ErrPermissionDenied)
+
+	mapper := handywares.NewObjectStorageErrorMapper(
+		handywares.ObjectStorageCodeToBricksError("Vendor", bricks.ErrFailedPrecondition),
+	)
+	assert.ErrorIs(t, mapper.Map(objectStorageError{"Vendor", http.StatusForbidden}), bricks.ErrFailedPrecondition)
+}
@@ -2,6 +2,9 @@ package handywares
 
 import "go.opentelemetry.io/otel/attribute"
 
+// instrumentationName is the name of meters (and tracers) which handywares creates itself
+const instrumentationName = "github.com/janstoon/toolbox/handywares"
+
 const (
 	oaPrefix = attribute.Key("jst")
 
@@ -10,7 +13,18 @@ const (
 
 	oaPanicValue = oaPrefix + ".panic.value"
 
+	oaRequestId = oaPrefix + ".request.id"
+
 	oaHttp         = oaPrefix + ".http"
 	oaHttpRequest  = oaHttp + ".request"
 	oaHttpResponse = oaHttp + ".response"
+
+	oaAsynq           = oaPrefix + ".asynq"
+	oaAsynqRetryCount = oaAsynq + ".retry.count"
+	oaAsynqRetryMax   = oaAsynq + ".retry.max"
+
+	oaCircuitBreaker          = oaPrefix + ".circuit_breaker"
+	oaCircuitBreakerName      = oaCircuitBreaker + ".name"
+	oaCircuitBreakerStateFrom = oaCircuitBreaker + ".state.from"
+	oaCircuitBreakerStateTo   = oaCircuitBreaker + ".state.to"
 )
@@ -0,0 +1,110 @@
+package handywares
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PanicError is what a recovered panic gets converted to. It carries the recovered value and the stack of the
+// panicking goroutine.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (pe PanicError) Error() string {
+	return fmt.Sprintf("panic recovered: %+v", pe.Value)
+}
+
+// Unwrap returns the recovered value if it's an error
+func (pe PanicError) Unwrap() error {
+	err, _ := pe.Value.(error)
+
+	return err
+}
+
+// PanicRecoverer is the common configuration of panic recover middlewares of all stacks
+type PanicRecoverer struct {
+	retryable   bool
+	transformer func(pe PanicError) error
+	onError     func(ctx context.Context, err error)
+}
+
+type PanicRecoverOpt = tricks.Option[PanicRecoverer]
+
+// PanicRecoverRetryable decides whether the error made of a recovered panic is bricks.ErrRetryable, which is the
+// default. A non-retryable one is still coded as internal error and leads to compensation and skipping retries of
+// message handlers.
+func PanicRecoverRetryable(retryable bool) PanicRecoverOpt {
+	return tricks.ImmutableOption[PanicRecoverer](func(pr PanicRecoverer) PanicRecoverer {
+		pr.retryable = retryable
+
+		return pr
+	})
+}
+
+// PanicRecoverErrorTransformer replaces the default conversion of PanicError to the returned error
+func PanicRecoverErrorTransformer(transformer func(pe PanicError) error) PanicRecoverOpt {
+	return tricks.ImmutableOption[PanicRecoverer](func(pr PanicRecoverer) PanicRecoverer {
+		pr.transformer = transformer
+
+		return pr
+	})
+}
+
+// PanicRecoverErrorHandler sets the handler of the errors made of recovered panics, e.g. to log them. gRPC panic
+// recover middlewares log them by default, since their clients get a generic status. A nil handler disables it.
+func PanicRecoverErrorHandler(handler func(ctx context.Context, err error)) PanicRecoverOpt {
+	return tricks.ImmutableOption[PanicRecoverer](func(pr PanicRecoverer) PanicRecoverer {
+		pr.onError = handler
+
+		return pr
+	})
+}
+
+func newPanicRecoverer(options ...PanicRecoverOpt) *PanicRecoverer {
+	pr := &PanicRecoverer{
+		retryable: true,
+	}
+	pr = tricks.ApplyOptions(pr, options...)
+	if pr.transformer == nil {
+		pr.transformer = pr.defaultTransformer
+	}
+
+	return pr
+}
+
+func (pr PanicRecoverer) defaultTransformer(pe PanicError) error {
+	if pr.retryable {
+		return errors.Join(bricks.ErrInternal, pe)
+	}
+
+	return errors.Join(bricks.ErrSupplierSide, bricks.ErrorWithCode(bricks.ErrCodeInternal, pe))
+}
+
+// recovered records the recovered panic value r on the span and converts it to an error
+func (pr PanicRecoverer) recovered(ctx context.Context, r any) error {
+	pe := PanicError{
+		Value: r,
+		Stack: debug.Stack(),
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("panic recovered", trace.WithAttributes(
+		oaPanicValue.String(fmt.Sprintf("%+v", pe.Value)),
+		oaDebugStack.String(string(pe.Stack)),
+	))
+
+	err := pr.transformer(pe)
+	if pr.onError != nil {
+		pr.onError(ctx, err)
+	}
+
+	return err
+}
@@ -0,0 +1,87 @@
+package handywares_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hibiken/asynq"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+func TestMsgPanicRecoverMiddleware(t *testing.T) {
+	var mws handywares.MsgMiddlewareStack[string]
+	handler := mws.Push(handywares.MsgPanicRecoverMiddleware[string]())(func(ctx context.Context, msg string) error {
+		panic(msg)
+	})
+
+	err := handler(context.Background(), "boom")
+	require.Error(t, err)
+	require.ErrorIs(t, err, bricks.ErrInternal)
+	require.ErrorIs(t, err, bricks.ErrRetryable)
+
+	var pe handywares.PanicError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, "boom", pe.Value)
+	assert.NotEmpty(t, pe.Stack)
+}
+
+func TestNatsPanicRecoverMiddlewareNoRetry(t *testing.T) {
+	var (
+		errCause = errors.New("cause")
+
+		compensated bool
+	)
+
+	var mws handywares.NatsMiddlewareStack
+	handler := mws.
+		Push(handywares.NatsCompensatorMiddleware()).
+		Push(handywares.NatsPanicRecoverMiddleware(handywares.PanicRecoverRetryable(false)))(
+		func(ctx context.Context, msg *nats.Msg) error {
+			panic(bricks.CompensatorAsError(bricks.CompensatorFunc(func(ctx context.Context, err error) error {
+				compensated = true
+
+				return nil
+			}), errCause))
+		},
+	)
+
+	err := handler(context.Background(), nats.NewMsg("subject"))
+	require.Error(t, err)
+	require.ErrorIs(t, err, errCause)
+	require.ErrorIs(t, err, bricks.ErrSupplierSide)
+	require.NotErrorIs(t, err, bricks.ErrRetryable)
+	assert.True(t, compensated)
+
+	var coded bricks.Coded
+	require.ErrorAs(t, err, &coded)
+	assert.Equal(t, bricks.ErrCodeInternal, coded.Code())
+}
+
+func TestAsynqPanicRecoverMiddleware(t *testing.T) {
+	var mws handywares.AsynqMiddlewareStack
+	panicky := asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		panic("boom")
+	})
+
+	err := mws.Push(handywares.AsynqPanicRecoverMiddleware())(panicky).ProcessTask(
+		context.Background(), asynq.NewTask("t", nil))
+	require.ErrorIs(t, err, bricks.ErrInternal)
+	require.NotErrorIs(t, err, asynq.SkipRetry)
+
+	err = mws.Push(handywares.AsynqPanicRecoverMiddleware(handywares.PanicRecoverRetryable(false)))(panicky).
+		ProcessTask(context.Background(), asynq.NewTask("t", nil))
+	require.ErrorIs(t, err, asynq.SkipRetry)
+
+	err = mws.Push(handywares.AsynqPanicRecoverMiddleware(handywares.PanicRecoverErrorTransformer(
+		func(pe handywares.PanicError) error {
+			return bricks.ErrUnavailable
+		},
+	)))(panicky).ProcessTask(context.Background(), asynq.NewTask("t", nil))
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+}
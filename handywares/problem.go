@@ -0,0 +1,312 @@
+package handywares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"strings"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+)
+
+const HttpProblemContentType = "application/problem+json"
+
+// httpProblemRequestIdMember is the extension member carrying id of the failed request, if any
+const httpProblemRequestIdMember = "request_id"
+
+// HttpProblem is the problem details (RFC 9457) representation of an error in http responses.
+// Extensions are marshaled as top-level members alongside the standard ones.
+type HttpProblem struct {
+	Type     string
+	Title    string
+	Status   int
+	Detail   string
+	Instance string
+
+	Extensions map[string]any
+}
+
+var httpProblemMembers = []string{"type", "title", "status", "detail", "instance"}
+
+func (p HttpProblem) MarshalJSON() ([]byte, error) {
+	mm := make(map[string]any, len(p.Extensions)+len(httpProblemMembers))
+	maps.Copy(mm, p.Extensions)
+	for _, member := range httpProblemMembers {
+		delete(mm, member)
+	}
+
+	mm["type"] = tricks.Coalesce(p.Type, "about:blank")
+	mm["title"] = p.Title
+	mm["status"] = p.Status
+	if len(p.Detail) > 0 {
+		mm["detail"] = p.Detail
+	}
+	if len(p.Instance) > 0 {
+		mm["instance"] = p.Instance
+	}
+
+	return json.Marshal(mm)
+}
+
+func (p *HttpProblem) UnmarshalJSON(bb []byte) error {
+	var std struct {
+		Type     string `json:"type"`
+		Title    string `json:"title"`
+		Status   int    `json:"status"`
+		Detail   string `json:"detail"`
+		Instance string `json:"instance"`
+	}
+	if err := json.Unmarshal(bb, &std); err != nil {
+		return err
+	}
+
+	var mm map[string]json.RawMessage
+	if err := json.Unmarshal(bb, &mm); err != nil {
+		return err
+	}
+
+	*p = HttpProblem{
+		Type:     tricks.Coalesce(std.Type, "about:blank"),
+		Title:    std.Title,
+		Status:   std.Status,
+		Detail:   std.Detail,
+		Instance: std.Instance,
+	}
+	for _, member := range httpProblemMembers {
+		delete(mm, member)
+	}
+	if len(mm) > 0 {
+		p.Extensions = make(map[string]any, len(mm))
+		for k, v := range mm {
+			p.Extensions[k] = v
+		}
+	}
+
+	return nil
+}
+
+// HttpProblemExtender is implemented by errors which contribute extension members (e.g. validation violations) to
+// the problem details they get rendered to. Extensions of all extenders in the error tree are merged.
+type HttpProblemExtender interface {
+	HttpProblemExtensions() map[string]any
+}
+
+type HttpProblemWriter struct {
+	typeResolver     func(err error, status int) string
+	instanceResolver func(req *http.Request) string
+	redactor         func(err error, problem HttpProblem) HttpProblem
+}
+
+type HttpProblemWriterOpt = tricks.Option[HttpProblemWriter]
+
+// HttpProblemTypeResolver sets the resolver of problem type uri which defaults to about:blank
+func HttpProblemTypeResolver(resolver func(err error, status int) string) HttpProblemWriterOpt {
+	return tricks.ImmutableOption[HttpProblemWriter](func(w HttpProblemWriter) HttpProblemWriter {
+		w.typeResolver = resolver
+
+		return w
+	})
+}
+
+// HttpProblemInstanceResolver sets the resolver of problem instance uri which defaults to request path
+func HttpProblemInstanceResolver(resolver func(req *http.Request) string) HttpProblemWriterOpt {
+	return tricks.ImmutableOption[HttpProblemWriter](func(w HttpProblemWriter) HttpProblemWriter {
+		w.instanceResolver = resolver
+
+		return w
+	})
+}
+
+// HttpProblemRedactionPolicy sets the policy deciding what clients see of the problem. It defaults to
+// RedactSupplierSideHttpProblem.
+func HttpProblemRedactionPolicy(redactor func(err error, problem HttpProblem) HttpProblem) HttpProblemWriterOpt {
+	return tricks.ImmutableOption[HttpProblemWriter](func(w HttpProblemWriter) HttpProblemWriter {
+		w.redactor = redactor
+
+		return w
+	})
+}
+
+// RedactSupplierSideHttpProblem hides detail and extensions of bricks.ErrSupplierSide errors and all the other
+// errors resulting in server error statuses (5xx) since they reveal internals of the service rather than a hint
+// to the client. Attached bricks.ErrorDetail(s) are kept since they're deliberately provided for clients.
+func RedactSupplierSideHttpProblem(err error, problem HttpProblem) HttpProblem {
+	if errors.Is(err, bricks.ErrSupplierSide) || problem.Status >= http.StatusInternalServerError {
+		problem.Detail = ""
+
+		details, ok := problem.Extensions[httpProblemDetailsMember]
+		problem.Extensions = nil
+		if ok {
+			problem.Extensions = map[string]any{httpProblemDetailsMember: details}
+		}
+	}
+
+	return problem
+}
+
+// NewHttpProblemWriter creates a HttpProblemWriter which maps errors to status using BricksErrorToHttpStatusMapper
+func NewHttpProblemWriter(options ...HttpProblemWriterOpt) *HttpProblemWriter {
+	w := &HttpProblemWriter{
+		typeResolver: func(_ error, _ int) string {
+			return "about:blank"
+		},
+		instanceResolver: func(req *http.Request) string {
+			return req.URL.Path
+		},
+		redactor: RedactSupplierSideHttpProblem,
+	}
+
+	return tricks.ApplyOptions(w, options...)
+}
+
+// Problem renders the err to its (redacted) problem details carrying the request id (see HttpRequestIdMiddleware)
+func (w HttpProblemWriter) Problem(req *http.Request, err error) HttpProblem {
+	status := BricksErrorToHttpStatusMapper(err)
+	problem := HttpProblem{
+		Type:     w.typeResolver(err, status),
+		Title:    tricks.Coalesce(http.StatusText(status), "Unknown Error"),
+		Status:   status,
+		Detail:   httpProblemDetail(err),
+		Instance: w.instanceResolver(req),
+	}
+
+	for e := range bricks.ErrorTree(err) {
+		if extender, ok := e.(HttpProblemExtender); ok {
+			if problem.Extensions == nil {
+				problem.Extensions = make(map[string]any)
+			}
+
+			maps.Copy(problem.Extensions, extender.HttpProblemExtensions())
+		}
+	}
+
+	if dd := bricks.ErrorDetails(err); len(dd) > 0 {
+		if problem.Extensions == nil {
+			problem.Extensions = make(map[string]any)
+		}
+
+		problem.Extensions[httpProblemDetailsMember] = bricksErrorDetailsToHttpProblemExtension(dd)
+	}
+
+	problem = w.redactor(err, problem)
+	if rid, ok := RequestIdFromContext(req.Context()); ok {
+		if problem.Extensions == nil {
+			problem.Extensions = make(map[string]any)
+		}
+
+		problem.Extensions[httpProblemRequestIdMember] = rid
+	}
+
+	return problem
+}
+
+// Write responds with the problem details of err. It also sets Retry-After header if err has bricks.RetryInfo.
+// It's a no-op if err is nil.
+func (w HttpProblemWriter) Write(rw http.ResponseWriter, req *http.Request, err error) {
+	if err == nil {
+		return
+	}
+
+	problem := w.Problem(req, err)
+
+	if ri, ok := bricks.ErrorDetailOf[bricks.RetryInfo](err); ok {
+		rw.Header().Set("Retry-After", httpFormatRetryAfter(ri.RetryDelay))
+	}
+	rw.Header().Set("Content-Type", HttpProblemContentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(problem.Status)
+	_ = json.NewEncoder(rw).Encode(problem)
+}
+
+type httpProblemWriterCtxKey struct{}
+
+// HttpProblemMiddleware provides the configured HttpProblemWriter to HttpWriteError calls down the stack
+func HttpProblemMiddleware(options ...HttpProblemWriterOpt) tricks.Middleware[http.Handler] {
+	w := NewHttpProblemWriter(options...)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), httpProblemWriterCtxKey{}, w)))
+		})
+	}
+}
+
+// HttpWriteError responds with problem details of err using the HttpProblemWriter provided by HttpProblemMiddleware
+// or a default one if there is none. It's a no-op if err is nil.
+func HttpWriteError(rw http.ResponseWriter, req *http.Request, err error) {
+	if err == nil {
+		return
+	}
+
+	w, ok := req.Context().Value(httpProblemWriterCtxKey{}).(*HttpProblemWriter)
+	if !ok {
+		w = NewHttpProblemWriter()
+	}
+
+	w.Write(rw, req, err)
+}
+
+// HttpErrorHandlerFunc is a http.Handler which returns error instead of writing it itself. Returned error is
+// rendered to problem details using HttpWriteError.
+type HttpErrorHandlerFunc func(rw http.ResponseWriter, req *http.Request) error
+
+func (fn HttpErrorHandlerFunc) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if err := fn(rw, req); err != nil {
+		HttpWriteError(rw, req, err)
+	}
+}
+
+// HttpProblemDetailer is implemented by errors which provide a detail safe to be shown to clients (see HttpPublicError)
+type HttpProblemDetailer interface {
+	HttpProblemDetail() string
+}
+
+type httpPublicError struct {
+	error
+}
+
+func (pe httpPublicError) HttpProblemDetail() string {
+	return pe.Error()
+}
+
+func (pe httpPublicError) Unwrap() error {
+	return pe.error
+}
+
+// HttpPublicError marks message of err as safe to be shown to clients in detail of problems
+func HttpPublicError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return httpPublicError{error: err}
+}
+
+// httpProblemDetail joins messages of the coded errors (e.g. bricks.ErrInvalidArgument) and details of
+// HttpProblemDetailer(s) in err. Other messages (e.g. of wrapped driver errors) are left out since they may reveal
+// internals of the service.
+func httpProblemDetail(err error) string {
+	var lines []string
+	for e := range bricks.ErrorTree(err) {
+		var line string
+		switch ee := e.(type) {
+		case HttpProblemDetailer:
+			line = ee.HttpProblemDetail()
+
+		case bricks.Coded:
+			line = e.Error()
+
+		default:
+			continue
+		}
+
+		if len(strings.TrimSpace(line)) > 0 && tricks.SliceIndexOf(line, lines) < 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "; ")
+}
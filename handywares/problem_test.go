@@ -0,0 +1,119 @@
+package handywares_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+type violationsError struct {
+	error
+	violations []string
+}
+
+func (ve violationsError) HttpProblemExtensions() map[string]any {
+	return map[string]any{"violations": ve.violations}
+}
+
+func (ve violationsError) Unwrap() error {
+	return ve.error
+}
+
+func TestHttpProblemJson(t *testing.T) {
+	bb, err := json.Marshal(handywares.HttpProblem{
+		Title:  "Not Found",
+		Status: http.StatusNotFound,
+		Extensions: map[string]any{
+			"status": "ignored",
+			"hint":   "check the id",
+		},
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"about:blank","title":"Not Found","status":404,"hint":"check the id"}`, string(bb))
+
+	var p handywares.HttpProblem
+	require.NoError(t, json.Unmarshal(bb, &p))
+	assert.Equal(t, "about:blank", p.Type)
+	assert.Equal(t, http.StatusNotFound, p.Status)
+	assert.Equal(t, map[string]any{"hint": json.RawMessage(`"check the id"`)}, p.Extensions)
+}
+
+func TestHttpProblemMiddleware(t *testing.T) {
+	var mws handywares.HttpMiddlewareStack
+	mws = mws.Push(handywares.HttpProblemMiddleware(
+		handywares.HttpProblemTypeResolver(func(err error, status int) string {
+			return "https://problems.janstun.com/" + http.StatusText(status)
+		}),
+	))
+
+	handle := func(err error) (*http.Response, map[string]any) {
+		rec := httptest.NewRecorder()
+		mws(handywares.HttpErrorHandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+			return err
+		})).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/orders/1", nil))
+
+		rsp := rec.Result()
+		bb, _ := io.ReadAll(rsp.Body)
+		_ = rsp.Body.Close()
+
+		var body map[string]any
+		_ = json.Unmarshal(bb, &body)
+
+		return rsp, body
+	}
+
+	rsp, body := handle(violationsError{
+		error: errors.Join(bricks.ErrInvalidArgument, handywares.HttpPublicError(errors.New("quantity must be positive")),
+			errors.New(`pq: duplicate key value violates unique constraint "orders_pkey"`)),
+		violations: []string{"quantity"},
+	})
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	assert.Equal(t, handywares.HttpProblemContentType, rsp.Header.Get("Content-Type"))
+	assert.Equal(t, map[string]any{
+		"type":       "https://problems.janstun.com/Bad Request",
+		"title":      "Bad Request",
+		"status":     float64(http.StatusBadRequest),
+		"detail":     "invalid argument; quantity must be positive",
+		"instance":   "/orders/1",
+		"violations": []any{"quantity"},
+	}, body)
+
+	rsp, body = handle(violationsError{
+		error:      errors.Join(bricks.ErrUnavailable, errors.New("db at 10.0.0.1 is down")),
+		violations: []string{"secret"},
+	})
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	assert.NotContains(t, body, "detail")
+	assert.NotContains(t, body, "violations")
+
+	rsp, body = handle(errors.New("unknown failure"))
+	assert.Equal(t, http.StatusInternalServerError, rsp.StatusCode)
+	assert.NotContains(t, body, "detail")
+
+	rsp, body = handle(fmt.Errorf("loading /var/lib/orders: %w", bricks.ErrNotFound))
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+	assert.Equal(t, "requested entity was not found", body["detail"])
+
+	rec := httptest.NewRecorder()
+	mws(handywares.HttpErrorHandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+		rw.WriteHeader(http.StatusNoContent)
+
+		return nil
+	})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handywares.HttpWriteError(rec, httptest.NewRequest(http.MethodGet, "/", nil), nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Zero(t, rec.Body.Len())
+}
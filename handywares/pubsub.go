@@ -0,0 +1,410 @@
+package handywares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+// Message is the broker-agnostic message published by Publisher and handled by handlers of Subscriber. Handling it
+// by MsgHandler[Message] makes a single MsgMiddlewareStack[Message] apply to all the brokers.
+type Message struct {
+	Id      string
+	Topic   string
+	Payload []byte
+	Headers map[string]string
+	Retried int // Number of previous failed deliveries, if known by the broker
+}
+
+// MessageSubject is the subject exporter of Message for MsgOpenTelemetryMiddleware
+func MessageSubject(msg Message) string {
+	return msg.Topic
+}
+
+// MessageDeadLetter is the extractor of Message for MsgDeadLetterMiddleware
+func MessageDeadLetter(msg Message) DeadLetter {
+	return DeadLetter{
+		Source:  msg.Topic,
+		Payload: msg.Payload,
+		Headers: deadLetterHeaders(msg.Headers),
+		Retried: msg.Retried,
+	}
+}
+
+// Publisher puts messages on the topic of them
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+type PublisherFunc func(ctx context.Context, msg Message) error
+
+func (fn PublisherFunc) Publish(ctx context.Context, msg Message) error {
+	return fn(ctx, msg)
+}
+
+type PublisherMiddlewareStack = tricks.MiddlewareStack[Publisher]
+
+// Subscriber runs the handler for messages of the topic until ctx is canceled. Messages failed by retryable errors
+// are redelivered as far as the broker supports it and the others are dropped, so push MsgDeadLetterMiddleware to
+// keep them.
+type Subscriber interface {
+	Subscribe(ctx context.Context, topic string, handler MsgHandler[Message], options ...SubscriptionOpt) error
+}
+
+type SubscriberFunc func(
+	ctx context.Context, topic string, handler MsgHandler[Message], options ...SubscriptionOpt,
+) error
+
+func (fn SubscriberFunc) Subscribe(
+	ctx context.Context, topic string, handler MsgHandler[Message], options ...SubscriptionOpt,
+) error {
+	return fn(ctx, topic, handler, options...)
+}
+
+// SubscriptionPolicy is the configuration of a single subscription, common to the Subscriber adapters of all brokers
+type SubscriptionPolicy struct {
+	group string
+}
+
+type SubscriptionOpt = tricks.Option[SubscriptionPolicy]
+
+// SubscriptionGroup sets the group the subscription shares messages of the topic in, i.e. queue group of nats and
+// consumer group of redis streams. The subscription gets all the messages if it's empty, which is the default except
+// for redis streams requiring it.
+func SubscriptionGroup(group string) SubscriptionOpt {
+	return tricks.ImmutableOption[SubscriptionPolicy](func(sp SubscriptionPolicy) SubscriptionPolicy {
+		sp.group = group
+
+		return sp
+	})
+}
+
+// NewSubscriptionPolicy applies the options on the default SubscriptionPolicy. It's meant for Subscriber adapters.
+func NewSubscriptionPolicy(options ...SubscriptionOpt) SubscriptionPolicy {
+	return *tricks.ApplyOptions(&SubscriptionPolicy{}, options...)
+}
+
+func (sp SubscriptionPolicy) Group() string {
+	return sp.group
+}
+
+// PubSubPolicy is the common configuration of the Publisher/Subscriber adapters of all brokers
+type PubSubPolicy struct {
+	block      time.Duration
+	maxRetries int
+	onError    func(err error)
+}
+
+type PubSubOpt = tricks.Option[PubSubPolicy]
+
+// PubSubBlock sets how long the in-memory broker delays redeliveries. It defaults to a second.
+func PubSubBlock(block time.Duration) PubSubOpt {
+	return tricks.ImmutableOption[PubSubPolicy](func(psp PubSubPolicy) PubSubPolicy {
+		psp.block = block
+
+		return psp
+	})
+}
+
+// PubSubMaxRetries sets how many times the in-memory broker redelivers messages failed by retryable errors. It
+// defaults to 3.
+func PubSubMaxRetries(retries int) PubSubOpt {
+	return tricks.ImmutableOption[PubSubPolicy](func(psp PubSubPolicy) PubSubPolicy {
+		psp.maxRetries = retries
+
+		return psp
+	})
+}
+
+// PubSubErrorHandler sets the handler of errors returned by message handlers and the broker. It defaults to logging
+// them.
+func PubSubErrorHandler(fn func(err error)) PubSubOpt {
+	return tricks.ImmutableOption[PubSubPolicy](func(psp PubSubPolicy) PubSubPolicy {
+		psp.onError = fn
+
+		return psp
+	})
+}
+
+func newPubSubPolicy(options ...PubSubOpt) *PubSubPolicy {
+	psp := &PubSubPolicy{
+		block:      time.Second,
+		maxRetries: 3,
+		onError: func(err error) {
+			log.Printf("PUBSUB|%s\n", err)
+		},
+	}
+
+	return tricks.ApplyOptions(psp, options...)
+}
+
+// NatsPubSub is the Publisher/Subscriber adapter of core nats. Message ids are carried by Nats-Msg-Id header and
+// failed messages aren't redelivered.
+type NatsPubSub struct {
+	PubSubPolicy
+
+	nc *nats.Conn
+}
+
+func NewNatsPubSub(nc *nats.Conn, options ...PubSubOpt) *NatsPubSub {
+	if nc == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty nats connection")))
+	}
+
+	return &NatsPubSub{
+		PubSubPolicy: *newPubSubPolicy(options...),
+		nc:           nc,
+	}
+}
+
+func (nps *NatsPubSub) Publish(ctx context.Context, msg Message) error {
+	nm := nats.NewMsg(msg.Topic)
+	nm.Data = msg.Payload
+	for k, v := range msg.Headers {
+		nm.Header.Set(k, v)
+	}
+	if len(msg.Id) > 0 {
+		nm.Header.Set(nats.MsgIdHdr, msg.Id)
+	}
+
+	if err := nps.nc.PublishMsg(nm); err != nil {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	return nil
+}
+
+func (nps *NatsPubSub) Subscribe(
+	ctx context.Context, topic string, handler MsgHandler[Message], options ...SubscriptionOpt,
+) error {
+	cb := func(nm *nats.Msg) {
+		msg := Message{
+			Id:      nm.Header.Get(nats.MsgIdHdr),
+			Topic:   nm.Subject,
+			Payload: nm.Data,
+			Headers: make(map[string]string, len(nm.Header)),
+		}
+		for k := range nm.Header {
+			msg.Headers[k] = nm.Header.Get(k)
+		}
+
+		if err := handler(ctx, msg); err != nil {
+			nps.onError(fmt.Errorf("%s: %w", nm.Subject, err))
+		}
+	}
+
+	sub, err := nps.nc.QueueSubscribe(topic, NewSubscriptionPolicy(options...).Group(), cb)
+	if err != nil {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	<-ctx.Done()
+
+	return sub.Drain()
+}
+
+// Fields of messages published by RedisStreamPubSub
+const (
+	redisStreamFieldId      = "id"
+	redisStreamFieldPayload = "payload"
+	redisStreamFieldHeaders = "headers"
+)
+
+// RedisStreamConsumeFunc consumes stream as a member of the consumer group until ctx is done, feeding handler by
+// the messages and the number of times they have been delivered, e.g. the one returned by kareless
+// std.RedisStreamConsume. It reclaims, retries and dead-letters the messages by outcome of the handler.
+type RedisStreamConsumeFunc func(
+	ctx context.Context, stream, group string,
+	handler func(ctx context.Context, xm redis.XMessage, deliveries int64) error,
+) error
+
+// RedisStreamPubSub is the Publisher/Subscriber adapter of redis streams. Each subscription consumes stream of the
+// topic in its group (see SubscriptionGroup) by consume. Retried of the messages is their previous deliveries.
+type RedisStreamPubSub struct {
+	client  redis.Cmdable
+	consume RedisStreamConsumeFunc
+}
+
+func NewRedisStreamPubSub(client redis.Cmdable, consume RedisStreamConsumeFunc) *RedisStreamPubSub {
+	if client == nil || consume == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty redis client or consume func")))
+	}
+
+	return &RedisStreamPubSub{
+		client:  client,
+		consume: consume,
+	}
+}
+
+func (rsps *RedisStreamPubSub) Publish(ctx context.Context, msg Message) error {
+	values := map[string]any{
+		redisStreamFieldId:      msg.Id,
+		redisStreamFieldPayload: msg.Payload,
+	}
+	if len(msg.Headers) > 0 {
+		bb, err := json.Marshal(msg.Headers)
+		if err != nil {
+			return errors.Join(bricks.ErrInvalidArgument, err)
+		}
+
+		values[redisStreamFieldHeaders] = bb
+	}
+
+	if err := rsps.client.XAdd(ctx, &redis.XAddArgs{Stream: msg.Topic, Values: values}).Err(); err != nil {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	return nil
+}
+
+// Subscribe consumes stream of the topic in the group until ctx is canceled. The group is required.
+func (rsps *RedisStreamPubSub) Subscribe(
+	ctx context.Context, topic string, handler MsgHandler[Message], options ...SubscriptionOpt,
+) error {
+	group := NewSubscriptionPolicy(options...).Group()
+	if len(group) == 0 {
+		return errors.Join(bricks.ErrInvalidArgument, errors.New("empty redis stream consumer group"))
+	}
+
+	return rsps.consume(ctx, topic, group, func(ctx context.Context, xm redis.XMessage, deliveries int64) error {
+		msg := Message{
+			Topic:   topic,
+			Retried: int(deliveries - 1),
+		}
+		if v, ok := xm.Values[redisStreamFieldId].(string); ok {
+			msg.Id = v
+		}
+		if v, ok := xm.Values[redisStreamFieldPayload].(string); ok {
+			msg.Payload = []byte(v)
+		}
+		if v, ok := xm.Values[redisStreamFieldHeaders].(string); ok {
+			if err := json.Unmarshal([]byte(v), &msg.Headers); err != nil {
+				return errors.Join(bricks.ErrDataLoss, fmt.Errorf("headers: %w", err))
+			}
+		}
+
+		return handler(ctx, msg)
+	})
+}
+
+// MemoryPubSub is an in-process Publisher/Subscriber for tests and single-process deployments. Messages are
+// delivered to all the subscribers of their topic, or one of each group of them, and those failed by retryable
+// errors are redelivered up to the max retries.
+type MemoryPubSub struct {
+	PubSubPolicy
+
+	l    sync.Mutex
+	seq  int
+	subs map[string]map[string][]*memorySubscription // topic -> group -> subscriptions
+	next map[string]int                              // topic/group -> round-robin counter
+}
+
+type memorySubscription struct {
+	ch   chan Message
+	done chan struct{}
+}
+
+func NewMemoryPubSub(options ...PubSubOpt) *MemoryPubSub {
+	return &MemoryPubSub{
+		PubSubPolicy: *newPubSubPolicy(options...),
+		subs:         make(map[string]map[string][]*memorySubscription),
+		next:         make(map[string]int),
+	}
+}
+
+func (mps *MemoryPubSub) Publish(ctx context.Context, msg Message) error {
+	mps.l.Lock()
+	var targets []*memorySubscription
+	for group, subs := range mps.subs[msg.Topic] {
+		key := msg.Topic + "/" + group
+		targets = append(targets, subs[mps.next[key]%len(subs)])
+		mps.next[key]++
+	}
+	mps.l.Unlock()
+
+	for _, sub := range targets {
+		select {
+		case sub.ch <- msg:
+		case <-sub.done:
+		case <-ctx.Done():
+			return errors.Join(bricks.ErrCanceled, ctx.Err())
+		}
+	}
+
+	return nil
+}
+
+func (mps *MemoryPubSub) Subscribe(
+	ctx context.Context, topic string, handler MsgHandler[Message], options ...SubscriptionOpt,
+) error {
+	sub := &memorySubscription{
+		ch:   make(chan Message, 64),
+		done: make(chan struct{}),
+	}
+
+	group := NewSubscriptionPolicy(options...).Group()
+
+	mps.l.Lock()
+	if len(group) == 0 {
+		mps.seq++
+		group = fmt.Sprintf("\x00%d", mps.seq) // Ungrouped subscribers are groups of their own
+	}
+	if mps.subs[topic] == nil {
+		mps.subs[topic] = make(map[string][]*memorySubscription)
+	}
+	mps.subs[topic][group] = append(mps.subs[topic][group], sub)
+	mps.l.Unlock()
+
+	defer func() {
+		mps.l.Lock()
+		defer mps.l.Unlock()
+
+		close(sub.done)
+		subs := mps.subs[topic][group]
+		for k := range subs {
+			if subs[k] == sub {
+				subs = append(subs[:k], subs[k+1:]...)
+
+				break
+			}
+		}
+		if len(subs) > 0 {
+			mps.subs[topic][group] = subs
+		} else {
+			delete(mps.subs[topic], group)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case msg := <-sub.ch:
+			err := handler(ctx, msg)
+			if err == nil {
+				continue
+			}
+
+			mps.onError(fmt.Errorf("%s: %w", topic, err))
+			if errors.Is(err, bricks.ErrRetryable) && msg.Retried < mps.maxRetries {
+				msg.Retried++
+				time.AfterFunc(mps.block, func() {
+					select {
+					case sub.ch <- msg:
+					case <-sub.done:
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package handywares_test
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+type pubSubProbe struct {
+	sync.Mutex
+
+	handled  []handywares.Message
+	failures map[string]int
+}
+
+// handler fails `retry` messages once by a retryable error, panics on `panic` messages and handles the others. All
+// the brokers share the same middleware stack.
+func (p *pubSubProbe) handler() handywares.MsgHandler[handywares.Message] {
+	var mws handywares.MsgMiddlewareStack[handywares.Message]
+
+	return mws.
+		Push(handywares.MsgPanicRecoverMiddleware[handywares.Message](handywares.PanicRecoverRetryable(false))).
+		Push(handywares.MsgCompensatorMiddleware[handywares.Message]())(
+		func(ctx context.Context, msg handywares.Message) error {
+			p.Lock()
+			defer p.Unlock()
+
+			switch string(msg.Payload) {
+			case "panic":
+				panic("boom")
+
+			case "retry":
+				if p.failures == nil {
+					p.failures = make(map[string]int)
+				}
+
+				p.failures[msg.Id]++
+				if p.failures[msg.Id] == 1 {
+					return bricks.ErrUnavailable
+				}
+			}
+
+			p.handled = append(p.handled, msg)
+
+			return nil
+		},
+	)
+}
+
+// wait waits for the message with the id to be handled and returns the handled messages except warmups
+func (p *pubSubProbe) wait(t *testing.T, id string) []handywares.Message {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		p.Lock()
+		defer p.Unlock()
+
+		return slices.ContainsFunc(p.handled, func(msg handywares.Message) bool {
+			return msg.Id == id
+		})
+	}, 5*time.Second, 10*time.Millisecond)
+
+	p.Lock()
+	defer p.Unlock()
+
+	return slices.DeleteFunc(slices.Clone(p.handled), func(msg handywares.Message) bool {
+		return msg.Id == "warmup"
+	})
+}
+
+// runNats runs an embedded nats server for the test and connects to it
+func runNats(t *testing.T) *nats.Conn {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	require.NoError(t, err)
+	ns.Start()
+	t.Cleanup(ns.Shutdown)
+	require.True(t, ns.ReadyForConnections(5*time.Second))
+
+	nc, err := nats.Connect(ns.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	return nc
+}
+
+func subscribe(
+	t *testing.T, sub handywares.Subscriber, topic string, handler handywares.MsgHandler[handywares.Message],
+	options ...handywares.SubscriptionOpt,
+) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- sub.Subscribe(ctx, topic, handler, options...)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-stopped)
+	})
+}
+
+func TestMemoryPubSub(t *testing.T) {
+	ctx := context.Background()
+	ps := handywares.NewMemoryPubSub(handywares.PubSubBlock(10*time.Millisecond), handywares.PubSubErrorHandler(
+		func(err error) {},
+	))
+
+	var p1, p2 pubSubProbe
+	subscribe(t, ps, "orders", p1.handler())
+	subscribe(t, ps, "orders", p2.handler())
+	require.Eventually(t, func() bool {
+		// Wait for both of the subscribers to get in
+		require.NoError(t, ps.Publish(ctx, handywares.Message{Id: "warmup", Topic: "orders"}))
+		p1.Lock()
+		defer p1.Unlock()
+		p2.Lock()
+		defer p2.Unlock()
+
+		return len(p1.handled) > 0 && len(p2.handled) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, ps.Publish(ctx, handywares.Message{Id: "m1", Topic: "orders", Payload: []byte("panic")}))
+	require.NoError(t, ps.Publish(ctx, handywares.Message{Id: "m2", Topic: "orders", Payload: []byte("retry")}))
+	require.NoError(t, ps.Publish(ctx, handywares.Message{Id: "m3", Topic: "orders", Payload: []byte("ok")}))
+
+	for _, p := range []*pubSubProbe{&p1, &p2} {
+		handled := p.wait(t, "m2")
+		require.Len(t, handled, 2)
+		assert.Equal(t, "m3", handled[0].Id)
+		assert.Equal(t, "m2", handled[1].Id)
+		assert.Equal(t, 1, handled[1].Retried)
+	}
+}
+
+func TestNatsPubSub(t *testing.T) {
+	nc := runNats(t)
+
+	var errs []error
+	ps := handywares.NewNatsPubSub(nc, handywares.PubSubErrorHandler(
+		func(err error) {
+			errs = append(errs, err)
+		},
+	))
+
+	var p pubSubProbe
+	subscribe(t, ps, "orders.*", p.handler(), handywares.SubscriptionGroup("workers"))
+	require.NoError(t, nc.Flush())
+
+	ctx := context.Background()
+	require.NoError(t, ps.Publish(ctx, handywares.Message{Id: "m1", Topic: "orders.created", Payload: []byte("panic")}))
+	require.NoError(t, ps.Publish(ctx, handywares.Message{
+		Id: "m2", Topic: "orders.created", Payload: []byte("ok"), Headers: map[string]string{"X-Request-ID": "r2"},
+	}))
+
+	handled := p.wait(t, "m2")
+	assert.Equal(t, "m2", handled[0].Id)
+	assert.Equal(t, "orders.created", handled[0].Topic)
+	assert.Equal(t, "r2", handled[0].Headers["X-Request-ID"])
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[0], bricks.ErrSupplierSide)
+}
+
+func TestMemoryPubSubGroups(t *testing.T) {
+	ctx := context.Background()
+	ps := handywares.NewMemoryPubSub()
+
+	var w1, w2, audit pubSubProbe
+	subscribe(t, ps, "orders", w1.handler(), handywares.SubscriptionGroup("workers"))
+	subscribe(t, ps, "orders", w2.handler(), handywares.SubscriptionGroup("workers"))
+	subscribe(t, ps, "orders", audit.handler())
+	require.Eventually(t, func() bool {
+		// Wait for all of the subscribers to get in
+		require.NoError(t, ps.Publish(ctx, handywares.Message{Id: "warmup", Topic: "orders"}))
+		w1.Lock()
+		defer w1.Unlock()
+		w2.Lock()
+		defer w2.Unlock()
+
+		return len(w1.handled) > 0 && len(w2.handled) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, ps.Publish(ctx, handywares.Message{Id: "m1", Topic: "orders"}))
+	require.NoError(t, ps.Publish(ctx, handywares.Message{Id: "m2", Topic: "orders"}))
+
+	handled := audit.wait(t, "m2")
+	require.Len(t, handled, 2)
+
+	// Each of the messages is handled by one of the workers only
+	require.Eventually(t, func() bool {
+		return len(slices.Concat(w1.wait(t, "warmup"), w2.wait(t, "warmup"))) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	handled = slices.Concat(w1.wait(t, "warmup"), w2.wait(t, "warmup"))
+	assert.ElementsMatch(t, []string{"m1", "m2"}, []string{handled[0].Id, handled[1].Id})
+	assert.Len(t, handled, 2)
+}
+
+// consumeRedisStream is a minimal handywares.RedisStreamConsumeFunc which redelivers failed messages once
+func consumeRedisStream(client redis.Cmdable) handywares.RedisStreamConsumeFunc {
+	return func(
+		ctx context.Context, stream, group string,
+		handler func(ctx context.Context, xm redis.XMessage, deliveries int64) error,
+	) error {
+		if err := client.XGroupCreateMkStream(ctx, stream, group, "0").Err(); err != nil {
+			return err
+		}
+
+		for ctx.Err() == nil {
+			streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group: group, Consumer: "c", Streams: []string{stream, ">"}, Block: 10 * time.Millisecond,
+			}).Result()
+			if err != nil {
+				continue
+			}
+
+			for _, xm := range streams[0].Messages {
+				if handler(ctx, xm, 1) != nil {
+					_ = handler(ctx, xm, 2)
+				}
+
+				client.XAck(ctx, stream, group, xm.ID)
+			}
+		}
+
+		return nil
+	}
+}
+
+func TestRedisStreamPubSub(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	ps := handywares.NewRedisStreamPubSub(client, consumeRedisStream(client))
+
+	ctx := context.Background()
+	require.NoError(t, ps.Publish(ctx, handywares.Message{Id: "m1", Topic: "orders", Payload: []byte("retry")}))
+	require.NoError(t, ps.Publish(ctx, handywares.Message{
+		Id: "m2", Topic: "orders", Payload: []byte("ok"), Headers: map[string]string{"X-Request-ID": "r2"},
+	}))
+
+	require.ErrorIs(t, ps.Subscribe(ctx, "orders", nil), bricks.ErrInvalidArgument)
+
+	var p pubSubProbe
+	subscribe(t, ps, "orders", p.handler(), handywares.SubscriptionGroup("workers"))
+
+	handled := p.wait(t, "m2")
+	require.Len(t, handled, 2)
+	assert.Equal(t, "m1", handled[0].Id)
+	assert.Equal(t, 1, handled[0].Retried)
+	assert.Equal(t, "orders", handled[1].Topic)
+	assert.Equal(t, []byte("ok"), handled[1].Payload)
+	assert.Equal(t, "r2", handled[1].Headers["X-Request-ID"])
+}
@@ -0,0 +1,268 @@
+package handywares
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/hibiken/asynq"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIdHeader carries the request (correlation) id in http and nats headers, grpc metadata (lower-cased) and
+// asynq task headers.
+const RequestIdHeader = "X-Request-ID"
+
+const requestIdMaxLength = 128
+
+type requestIdCtxKey struct{}
+
+// ContextWithRequestId puts the request id in ctx and links it to the active span
+func ContextWithRequestId(ctx context.Context, id string) context.Context {
+	trace.SpanFromContext(ctx).SetAttributes(oaRequestId.String(id))
+
+	return context.WithValue(ctx, requestIdCtxKey{}, id)
+}
+
+// RequestIdFromContext returns the request id put in ctx by request id middlewares
+func RequestIdFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIdCtxKey{}).(string)
+
+	return id, ok
+}
+
+// NewRequestId generates a random 128-bit request id in hex
+func NewRequestId() string {
+	bb := make([]byte, 16)
+	_, _ = rand.Read(bb)
+
+	return hex.EncodeToString(bb)
+}
+
+// RequestIdPolicy is the common configuration of request id middlewares of all stacks
+type RequestIdPolicy struct {
+	generator func() string
+	trusted   bool
+}
+
+type RequestIdOpt = tricks.Option[RequestIdPolicy]
+
+// RequestIdGenerator sets the generator of ids of requests coming without one. It defaults to NewRequestId.
+func RequestIdGenerator(generator func() string) RequestIdOpt {
+	return tricks.ImmutableOption[RequestIdPolicy](func(rip RequestIdPolicy) RequestIdPolicy {
+		rip.generator = generator
+
+		return rip
+	})
+}
+
+// RequestIdTrustIncoming tells whether to adopt ids of incoming requests or always generate new ones, e.g. on edges
+// facing untrusted clients. It defaults to true.
+func RequestIdTrustIncoming(trusted bool) RequestIdOpt {
+	return tricks.ImmutableOption[RequestIdPolicy](func(rip RequestIdPolicy) RequestIdPolicy {
+		rip.trusted = trusted
+
+		return rip
+	})
+}
+
+func newRequestIdPolicy(options ...RequestIdOpt) *RequestIdPolicy {
+	rip := &RequestIdPolicy{
+		generator: NewRequestId,
+		trusted:   true,
+	}
+
+	return tricks.ApplyOptions(rip, options...)
+}
+
+// resolve adopts the incoming id if it's trusted and sane or generates a new one
+func (rip RequestIdPolicy) resolve(incoming string) string {
+	if rip.trusted && len(incoming) > 0 && len(incoming) <= requestIdMaxLength &&
+		!strings.ContainsFunc(incoming, func(r rune) bool {
+			return r <= ' ' || r > '~'
+		}) {
+		return incoming
+	}
+
+	return rip.generator()
+}
+
+// HttpRequestIdMiddleware adopts X-Request-ID header of requests or generates one, puts it in context and echoes it
+// in the response header. Push it before (outer than) loggers and after (inner than) HttpOpenTelemetryMiddleware to
+// have it on the server span.
+func HttpRequestIdMiddleware(options ...RequestIdOpt) tricks.Middleware[http.Handler] {
+	rip := newRequestIdPolicy(options...)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			id := rip.resolve(req.Header.Get(RequestIdHeader))
+			rw.Header().Set(RequestIdHeader, id)
+
+			next.ServeHTTP(rw, req.WithContext(ContextWithRequestId(req.Context(), id)))
+		})
+	}
+}
+
+// HttpRequestIdTripperware forwards request id of the context in X-Request-ID header of outgoing requests
+func HttpRequestIdTripperware() tricks.Middleware[http.RoundTripper] {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return HttpRoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if id, ok := RequestIdFromContext(req.Context()); ok && len(req.Header.Get(RequestIdHeader)) == 0 {
+				req = req.Clone(req.Context())
+				req.Header.Set(RequestIdHeader, id)
+			}
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+var grpcRequestIdKey = strings.ToLower(RequestIdHeader)
+
+func grpcRequestId(ctx context.Context, rip *RequestIdPolicy) context.Context {
+	var incoming string
+	if vv := metadata.ValueFromIncomingContext(ctx, grpcRequestIdKey); len(vv) > 0 {
+		incoming = vv[0]
+	}
+
+	id := rip.resolve(incoming)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(grpcRequestIdKey, id))
+
+	return ContextWithRequestId(ctx, id)
+}
+
+// GrpcRequestIdMiddleware adopts x-request-id metadata of calls or generates one, puts it in context and echoes it in
+// the response header metadata.
+func GrpcRequestIdMiddleware(options ...RequestIdOpt) tricks.Middleware[grpc.UnaryServerInterceptor] {
+	rip := newRequestIdPolicy(options...)
+
+	return func(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			return next(grpcRequestId(ctx, rip), req, info, handler)
+		}
+	}
+}
+
+// GrpcStreamRequestIdMiddleware is the stream counterpart of GrpcRequestIdMiddleware
+func GrpcStreamRequestIdMiddleware(options ...RequestIdOpt) tricks.Middleware[grpc.StreamServerInterceptor] {
+	rip := newRequestIdPolicy(options...)
+
+	return func(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+		return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return next(srv, GrpcServerStreamWithContext(grpcRequestId(ss.Context(), rip), ss), info, handler)
+		}
+	}
+}
+
+func grpcOutgoingRequestId(ctx context.Context) context.Context {
+	id, ok := RequestIdFromContext(ctx)
+	if !ok {
+		return ctx
+	}
+
+	if md, _ := metadata.FromOutgoingContext(ctx); len(md.Get(grpcRequestIdKey)) > 0 {
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, grpcRequestIdKey, id)
+}
+
+// GrpcUnaryClientRequestIdMiddleware forwards request id of the context in x-request-id metadata of outgoing calls
+func GrpcUnaryClientRequestIdMiddleware() tricks.Middleware[grpc.UnaryClientInterceptor] {
+	return func(next grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+		return func(
+			ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption,
+		) error {
+			return next(grpcOutgoingRequestId(ctx), method, req, reply, cc, invoker, opts...)
+		}
+	}
+}
+
+// GrpcStreamClientRequestIdMiddleware is the stream counterpart of GrpcUnaryClientRequestIdMiddleware
+func GrpcStreamClientRequestIdMiddleware() tricks.Middleware[grpc.StreamClientInterceptor] {
+	return func(next grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+		return func(
+			ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer,
+			opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			return next(grpcOutgoingRequestId(ctx), desc, cc, method, streamer, opts...)
+		}
+	}
+}
+
+// NatsRequestIdMiddleware adopts X-Request-ID header of messages or generates one and puts it in context
+func NatsRequestIdMiddleware(options ...RequestIdOpt) tricks.Middleware[NatsMsgHandler] {
+	rip := newRequestIdPolicy(options...)
+
+	return func(next NatsMsgHandler) NatsMsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			return next(ContextWithRequestId(ctx, rip.resolve(msg.Header.Get(RequestIdHeader))), msg)
+		}
+	}
+}
+
+// NatsPropagateRequestId forwards request id of the context in X-Request-ID header of msg
+func NatsPropagateRequestId(ctx context.Context, msg *nats.Msg) {
+	id, ok := RequestIdFromContext(ctx)
+	if !ok {
+		return
+	}
+
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(RequestIdHeader, id)
+}
+
+// MsgRequestIdMiddleware is the generic counterpart of NatsRequestIdMiddleware. The extractor returns the request id
+// carried by the message, if any.
+func MsgRequestIdMiddleware[M any](
+	extractor func(msg M) string, options ...RequestIdOpt,
+) tricks.Middleware[MsgHandler[M]] {
+	if extractor == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty request id extractor")))
+	}
+
+	rip := newRequestIdPolicy(options...)
+
+	return func(next MsgHandler[M]) MsgHandler[M] {
+		return func(ctx context.Context, msg M) error {
+			return next(ContextWithRequestId(ctx, rip.resolve(extractor(msg))), msg)
+		}
+	}
+}
+
+// AsynqRequestIdMiddleware adopts X-Request-ID task header put by AsynqRequestIdHeaders or generates one
+// and puts it in context. The task is passed on intact and its payload without headers is shared with the other
+// middlewares and the handler through the context (see AsynqTaskPayload).
+func AsynqRequestIdMiddleware(options ...RequestIdOpt) tricks.Middleware[asynq.Handler] {
+	rip := newRequestIdPolicy(options...)
+
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+			ctx, headers := withAsynqHeaders(ctx, task)
+
+			return next.ProcessTask(ContextWithRequestId(ctx, rip.resolve(headers[RequestIdHeader])), task)
+		})
+	}
+}
+
+// AsynqRequestIdHeaders returns request id of the context as X-Request-ID header of tasks to be created by
+// NewAsynqTask, if there is any
+func AsynqRequestIdHeaders(ctx context.Context) map[string]string {
+	id, ok := RequestIdFromContext(ctx)
+	if !ok {
+		return map[string]string{}
+	}
+
+	return map[string]string{RequestIdHeader: id}
+}
@@ -0,0 +1,156 @@
+package handywares_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hibiken/asynq"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+func TestHttpRequestIdMiddleware(t *testing.T) {
+	var mws handywares.HttpMiddlewareStack
+	handler := mws.Push(handywares.HttpRequestIdMiddleware())(
+		handywares.HttpErrorHandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+			id, ok := handywares.RequestIdFromContext(req.Context())
+			require.True(t, ok)
+			assert.Equal(t, rw.Header().Get(handywares.RequestIdHeader), id)
+
+			return bricks.ErrNotFound
+		}),
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(handywares.RequestIdHeader, "req-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "req-1", rec.Header().Get(handywares.RequestIdHeader))
+
+	var problem handywares.HttpProblem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.JSONEq(t, `"req-1"`, string(problem.Extensions["request_id"].(json.RawMessage)))
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(handywares.RequestIdHeader, "bad\nid")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Len(t, rec.Header().Get(handywares.RequestIdHeader), 32)
+}
+
+func TestHttpRequestIdTripperware(t *testing.T) {
+	var forwarded string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Get(handywares.RequestIdHeader)
+	}))
+	defer server.Close()
+
+	var tws handywares.HttpTripperwareStack
+	client := &http.Client{Transport: tws.Push(handywares.HttpRequestIdTripperware())(http.DefaultTransport)}
+
+	ctx := handywares.ContextWithRequestId(context.Background(), "req-1")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	rsp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = rsp.Body.Close()
+
+	assert.Equal(t, "req-1", forwarded)
+}
+
+func TestGrpcRequestIdMiddleware(t *testing.T) {
+	var mws handywares.GrpcUnaryServerMiddlewareStack
+	interceptor := mws.Push(handywares.GrpcRequestIdMiddleware())(handywares.GrpcUnaryServerInvokeHandlerInterceptor)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "req-1"))
+	rsp, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Method"},
+		func(ctx context.Context, req any) (any, error) {
+			id, _ := handywares.RequestIdFromContext(ctx)
+
+			return id, nil
+		},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "req-1", rsp)
+
+	var cmws handywares.GrpcUnaryClientMiddlewareStack
+	client := cmws.Push(handywares.GrpcUnaryClientRequestIdMiddleware())(handywares.GrpcUnaryClientInvokerInterceptor)
+
+	err = client(handywares.ContextWithRequestId(context.Background(), "req-2"), "/svc/Method", nil, nil, nil,
+		func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			assert.Equal(t, []string{"req-2"}, md.Get("x-request-id"))
+
+			return nil
+		},
+	)
+	require.NoError(t, err)
+}
+
+func TestNatsRequestIdMiddleware(t *testing.T) {
+	var mws handywares.NatsMiddlewareStack
+	handler := mws.Push(handywares.NatsRequestIdMiddleware())(func(ctx context.Context, msg *nats.Msg) error {
+		id, _ := handywares.RequestIdFromContext(ctx)
+		assert.Equal(t, "req-1", id)
+
+		return nil
+	})
+
+	msg := nats.NewMsg("orders.created")
+	handywares.NatsPropagateRequestId(handywares.ContextWithRequestId(context.Background(), "req-1"), msg)
+	require.NoError(t, handler(context.Background(), msg))
+}
+
+func TestAsynqRequestIdMiddleware(t *testing.T) {
+	enqueued := handywares.NewAsynqTask("email:send", []byte("payload"),
+		handywares.AsynqRequestIdHeaders(handywares.ContextWithRequestId(context.Background(), "req-1")))
+
+	var mws handywares.AsynqMiddlewareStack
+	handler := mws.Push(handywares.AsynqRequestIdMiddleware())(asynq.HandlerFunc(
+		func(ctx context.Context, task *asynq.Task) error {
+			id, _ := handywares.RequestIdFromContext(ctx)
+			assert.Equal(t, "req-1", id)
+			assert.Same(t, enqueued, task)
+			assert.Equal(t, "payload", string(handywares.AsynqTaskPayload(ctx, task)))
+
+			return nil
+		},
+	))
+	require.NoError(t, handler.ProcessTask(context.Background(), enqueued))
+}
+
+func TestHttpBlindLoggerMiddlewareRequestId(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	serve := func(options ...handywares.BlindLoggerHttpMiddlewareOpt) string {
+		buf.Reset()
+		var mws handywares.HttpMiddlewareStack
+		handler := mws.
+			Push(handywares.HttpRequestIdMiddleware(handywares.RequestIdGenerator(func() string { return "req-1" }))).
+			Push(handywares.HttpBlindLoggerMiddleware(nil, options...))(
+			http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders", nil))
+
+		return buf.String()
+	}
+
+	assert.NotContains(t, serve(), "req-1", "request id is opt-in")
+	assert.Contains(t, serve(handywares.BlindLoggerRequestId()), "HTTP|req-1|")
+}
@@ -0,0 +1,198 @@
+package handywares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/hibiken/asynq"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/redis/go-redis/v9"
+)
+
+// AsynqSagaTaskType is type of asynq tasks driving instances of the saga named name
+func AsynqSagaTaskType(name string) string {
+	return "saga:" + name
+}
+
+// AsynqSagaEnqueue begins a new instance of the saga and enqueues a task of AsynqSagaTaskType running it. The saga is
+// left to be resumed if enqueuing fails.
+func AsynqSagaEnqueue[T any](
+	ctx context.Context, enqueuer AsynqEnqueuer, saga *bricks.Saga[T], id string, state T, opts ...asynq.Option,
+) error {
+	if err := saga.Begin(ctx, id, state); err != nil {
+		return err
+	}
+
+	_, err := enqueuer.EnqueueContext(ctx, asynq.NewTask(AsynqSagaTaskType(saga.Name()), []byte(id)), opts...)
+
+	return err
+}
+
+// AsynqSagaHandler runs instances of the saga identified by payload of the tasks. Retryable failures are retried by
+// asynq, which resumes the saga from its last saved step, while the others skip retry. Tasks of the compensated
+// instances succeed, since the saga has ended as it's designed to.
+func AsynqSagaHandler[T any](saga *bricks.Saga[T]) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		_, err := saga.Run(ctx, string(AsynqTaskPayload(ctx, task)))
+		if errors.Is(err, bricks.ErrSagaCompensated) {
+			return nil
+		}
+
+		if err != nil && !errors.Is(err, bricks.ErrRetryable) {
+			return errors.Join(asynq.SkipRetry, err)
+		}
+
+		return err
+	})
+}
+
+type redisSagaStore struct {
+	client redis.Cmdable
+	tag    string
+}
+
+// NewRedisSagaStore creates a bricks.SagaStore keeping records in redis under the prefixed keys. Ids of unfinished
+// instances of each saga are kept in a set to be resumed. Records are written along with the set by lua scripts, so
+// they're atomic and checked against the expected version. The prefix is the hash tag of the keys (e.g. {saga:}), so
+// the scripts work on redis cluster and all the keys of the store live in the same slot.
+func NewRedisSagaStore(client redis.Cmdable, prefix string) bricks.SagaStore {
+	if client == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty redis client")))
+	}
+
+	if len(prefix) == 0 {
+		prefix = "saga:"
+	}
+
+	return redisSagaStore{
+		client: client,
+		tag:    "{" + prefix + "}",
+	}
+}
+
+func (rss redisSagaStore) recordKey(id string) string {
+	return rss.tag + id
+}
+
+func (rss redisSagaStore) unfinishedKey(saga string) string {
+	return fmt.Sprintf("%sunfinished:%s", rss.tag, saga)
+}
+
+// Records are kept in hashes of their version and json
+var (
+	// KEYS: record, unfinished set. ARGV: version, record, id.
+	redisSagaCreateScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'version', ARGV[1], 'record', ARGV[2])
+redis.call('SADD', KEYS[2], ARGV[3])
+return 1
+`)
+
+	// KEYS: record, unfinished set. ARGV: expected version, version, record, id, finished (1 or 0).
+	redisSagaSaveScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'version') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'version', ARGV[2], 'record', ARGV[3])
+if ARGV[5] == '1' then
+	redis.call('SREM', KEYS[2], ARGV[4])
+else
+	redis.call('SADD', KEYS[2], ARGV[4])
+end
+return 1
+`)
+)
+
+func (rss redisSagaStore) Create(ctx context.Context, rec bricks.SagaRecord) error {
+	bb, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Join(bricks.ErrInternal, err)
+	}
+
+	created, err := redisSagaCreateScript.Run(ctx, rss.client,
+		[]string{rss.recordKey(rec.Id), rss.unfinishedKey(rec.Saga)},
+		rec.Version, bb, rec.Id,
+	).Bool()
+	if err != nil {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	if !created {
+		return errors.Join(bricks.ErrAlreadyExists, fmt.Errorf("saga %s exists", rec.Id))
+	}
+
+	return nil
+}
+
+func (rss redisSagaStore) Save(ctx context.Context, rec bricks.SagaRecord, expectedVersion int) error {
+	bb, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Join(bricks.ErrInternal, err)
+	}
+
+	finished := 0
+	if rec.Status.Finished() {
+		finished = 1
+	}
+
+	saved, err := redisSagaSaveScript.Run(ctx, rss.client,
+		[]string{rss.recordKey(rec.Id), rss.unfinishedKey(rec.Saga)},
+		expectedVersion, rec.Version, bb, rec.Id, finished,
+	).Bool()
+	if err != nil {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	if !saved {
+		return errors.Join(bricks.ErrSagaConflict,
+			fmt.Errorf("saga %s isn't of version %d", rec.Id, expectedVersion))
+	}
+
+	return nil
+}
+
+func (rss redisSagaStore) Load(ctx context.Context, id string) (bricks.SagaRecord, error) {
+	raw, err := rss.client.HGet(ctx, rss.recordKey(id), "record").Bytes()
+	if errors.Is(err, redis.Nil) {
+		return bricks.SagaRecord{}, bricks.ErrNotFound
+	} else if err != nil {
+		return bricks.SagaRecord{}, errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	var rec bricks.SagaRecord
+	if err = json.Unmarshal(raw, &rec); err != nil {
+		return bricks.SagaRecord{}, errors.Join(bricks.ErrDataLoss, err)
+	}
+
+	return rec, nil
+}
+
+func (rss redisSagaStore) Unfinished(ctx context.Context, saga string) ([]bricks.SagaRecord, error) {
+	ids, err := rss.client.SMembers(ctx, rss.unfinishedKey(saga)).Result()
+	if err != nil {
+		return nil, errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	records := make([]bricks.SagaRecord, 0, len(ids))
+	for _, id := range ids {
+		rec, err := rss.Load(ctx, id)
+		if errors.Is(err, bricks.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		records = append(records, rec)
+	}
+
+	slices.SortFunc(records, func(a, b bricks.SagaRecord) int {
+		return a.UpdatedAt.Compare(b.UpdatedAt)
+	})
+
+	return records, nil
+}
@@ -0,0 +1,119 @@
+package handywares_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+func TestAsynqSagaHandler(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() {
+		_ = client.Close()
+	}()
+
+	store := handywares.NewRedisSagaStore(client, "saga:")
+
+	var (
+		attempts int
+		released bool
+	)
+	saga := bricks.NewSaga("payout", store,
+		bricks.SagaStep[[]string]{
+			Name: "hold",
+			Action: func(ctx context.Context, state *[]string) error {
+				*state = append(*state, "held")
+
+				return nil
+			},
+			Compensation: func(ctx context.Context, state *[]string, cause error) error {
+				released = true
+
+				return nil
+			},
+		},
+		bricks.SagaStep[[]string]{
+			Name: "transfer",
+			Action: func(ctx context.Context, state *[]string) error {
+				attempts++
+				switch attempts {
+				case 1:
+					return bricks.ErrUnavailable
+
+				case 2:
+					*state = append(*state, "transferred")
+
+					return nil
+
+				default:
+					return bricks.ErrPermissionDenied
+				}
+			},
+		},
+	)
+
+	var enqueued []*asynq.Task
+	enqueuer := handywares.AsynqEnqueuerFunc(
+		func(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+			enqueued = append(enqueued, task)
+
+			return &asynq.TaskInfo{}, nil
+		},
+	)
+	handler := handywares.AsynqSagaHandler(saga)
+
+	require.NoError(t, handywares.AsynqSagaEnqueue(ctx, enqueuer, saga, "p1", []string{}))
+	require.ErrorIs(t, handywares.AsynqSagaEnqueue(ctx, enqueuer, saga, "p1", []string{}), bricks.ErrAlreadyExists)
+	require.Len(t, enqueued, 1)
+	assert.Equal(t, "saga:payout", enqueued[0].Type())
+	// Keys touched by the same script share the hash tag
+	assert.True(t, mr.Exists("{saga:}p1"))
+	assert.True(t, mr.Exists("{saga:}unfinished:payout"))
+
+	err := handler.ProcessTask(ctx, enqueued[0])
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	require.False(t, errors.Is(err, asynq.SkipRetry))
+
+	unfinished, err := store.Unfinished(ctx, "payout")
+	require.NoError(t, err)
+	require.Len(t, unfinished, 1)
+	assert.Equal(t, 1, unfinished[0].Step)
+
+	require.NoError(t, handler.ProcessTask(ctx, enqueued[0]))
+	rec, err := store.Load(ctx, "p1")
+	require.NoError(t, err)
+	assert.Equal(t, bricks.SagaCompleted, rec.Status)
+	assert.JSONEq(t, `["held","transferred"]`, string(rec.State))
+
+	require.NoError(t, handywares.AsynqSagaEnqueue(ctx, enqueuer, saga, "p2", []string{}))
+	require.NoError(t, handler.ProcessTask(ctx, enqueued[1]))
+	assert.True(t, released)
+	rec, err = store.Load(ctx, "p2")
+	require.NoError(t, err)
+	assert.Equal(t, bricks.SagaCompensated, rec.Status)
+
+	unfinished, err = store.Unfinished(ctx, "payout")
+	require.NoError(t, err)
+	assert.Empty(t, unfinished)
+
+	stale := rec
+	stale.Status = bricks.SagaRunning
+	stale.Version++
+	require.ErrorIs(t, store.Save(ctx, stale, rec.Version-1), bricks.ErrSagaConflict)
+	require.NoError(t, store.Save(ctx, stale, rec.Version))
+
+	unfinished, err = store.Unfinished(ctx, "payout")
+	require.NoError(t, err)
+	assert.Len(t, unfinished, 1)
+}
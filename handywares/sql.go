@@ -0,0 +1,137 @@
+package handywares
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"maps"
+	"net"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+)
+
+// errTxRollback is what transactions rolled back by the database (e.g. serialization failures and deadlocks) are
+// mapped to. The rolled back transaction is safe to be retried from the beginning.
+var errTxRollback = errors.Join(bricks.ErrRetryable, bricks.ErrAborted)
+
+var sqlErrToBricksErr = []struct {
+	target error
+	berr   error
+}{
+	{sql.ErrNoRows, bricks.ErrNotFound},
+	{sql.ErrConnDone, bricks.ErrUnavailable},
+	{driver.ErrBadConn, bricks.ErrUnavailable},
+}
+
+// sqlStateToBricksErr maps SQLSTATE codes and classes (first two characters of codes) to bricks errors
+var sqlStateToBricksErr = map[string]error{
+	"08": bricks.ErrUnavailable,        // connection exception
+	"22": bricks.ErrInvalidArgument,    // data exception
+	"23": bricks.ErrFailedPrecondition, // integrity constraint violation
+	"40": errTxRollback,                // transaction rollback
+	"53": bricks.ErrResourceExhausted,  // insufficient resources
+	"57": bricks.ErrUnavailable,        // operator intervention
+	"XX": bricks.ErrInternal,           // internal error
+
+	"23502": bricks.ErrInvalidArgument,    // not_null_violation
+	"23503": bricks.ErrFailedPrecondition, // foreign_key_violation
+	"23505": bricks.ErrAlreadyExists,      // unique_violation
+	"23514": bricks.ErrInvalidArgument,    // check_violation
+	"23P01": bricks.ErrAlreadyExists,      // exclusion_violation
+	"40001": errTxRollback,                // serialization_failure
+	"40P01": errTxRollback,                // deadlock_detected
+	"55P03": errTxRollback,                // lock_not_available
+	"57014": bricks.ErrCanceled,           // query_canceled
+}
+
+// SqlErrorMapper maps errors of database/sql and sql drivers to bricks errors. Driver errors are mapped by their
+// SQLSTATE code, or its class if the code itself isn't mapped.
+type SqlErrorMapper struct {
+	states     map[string]error
+	extractors []func(err error) (string, bool)
+}
+
+type SqlErrorMapperOpt = tricks.Option[SqlErrorMapper]
+
+// SqlStateToBricksError maps the SQLSTATE code (5 characters) or class (2 characters) to berr. It overrides the
+// default mapping of the code or class if there is one.
+func SqlStateToBricksError(state string, berr error) SqlErrorMapperOpt {
+	return tricks.ImmutableOption[SqlErrorMapper](func(m SqlErrorMapper) SqlErrorMapper {
+		m.states[state] = berr
+
+		return m
+	})
+}
+
+// SqlStateExtractor adds an extractor of SQLSTATE code from driver errors. Errors implementing `SQLState() string`
+// (e.g. pgx and lib/pq errors) are supported by default. Extractors of go-sql-driver/mysql and modernc.org/sqlite
+// errors are provided by mysqlerr and sqliteerr subpackages, so the drivers are linked (and registered) only if they
+// are used. The extractor of a driver reporting vague codes (e.g. mysql reports 23000 for all integrity constraint
+// violations) can translate its native error numbers to precise codes.
+func SqlStateExtractor(extractor func(err error) (string, bool)) SqlErrorMapperOpt {
+	return tricks.ImmutableOption[SqlErrorMapper](func(m SqlErrorMapper) SqlErrorMapper {
+		m.extractors = append(m.extractors, extractor)
+
+		return m
+	})
+}
+
+func NewSqlErrorMapper(options ...SqlErrorMapperOpt) *SqlErrorMapper {
+	m := &SqlErrorMapper{
+		states:     maps.Clone(sqlStateToBricksErr),
+		extractors: []func(err error) (string, bool){sqlStateOf},
+	}
+
+	return tricks.ApplyOptions(m, options...)
+}
+
+func (m SqlErrorMapper) Map(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	for _, se := range sqlErrToBricksErr {
+		if errors.Is(err, se.target) {
+			return errors.Join(se.berr, err)
+		}
+	}
+
+	for _, extract := range m.extractors {
+		state, ok := extract(err)
+		if !ok || len(state) != 5 {
+			continue
+		}
+
+		if berr, ok := m.states[state]; ok {
+			return errors.Join(berr, err)
+		}
+
+		if berr, ok := m.states[state[:2]]; ok {
+			return errors.Join(berr, err)
+		}
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && !nerr.Timeout() {
+		return errors.Join(bricks.ErrUnavailable, err)
+	}
+
+	return bricks.ParseError(err, bricks.ErrUnknown)
+}
+
+func sqlStateOf(err error) (string, bool) {
+	var serr interface{ SQLState() string }
+	if errors.As(err, &serr) {
+		return serr.SQLState(), true
+	}
+
+	return "", false
+}
+
+var defaultSqlErrorMapper = NewSqlErrorMapper()
+
+// SqlToBricksError maps err using the default SqlErrorMapper
+func SqlToBricksError(err error) error {
+	return defaultSqlErrorMapper.Map(err)
+}
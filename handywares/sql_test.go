@@ -0,0 +1,77 @@
+package handywares_test
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string {
+	return "sql error " + string(e)
+}
+
+func (e sqlStateError) SQLState() string {
+	return string(e)
+}
+
+type customDriverError struct {
+	Number uint16
+}
+
+func (e *customDriverError) Error() string {
+	return "custom driver error"
+}
+
+func TestSqlToBricksError(t *testing.T) {
+	assert.NoError(t, handywares.SqlToBricksError(nil))
+
+	for _, tc := range []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"no rows", sql.ErrNoRows, bricks.ErrNotFound},
+		{"unique violation", sqlStateError("23505"), bricks.ErrAlreadyExists},
+		{"foreign key violation", sqlStateError("23503"), bricks.ErrFailedPrecondition},
+		{"integrity class", sqlStateError("23000"), bricks.ErrFailedPrecondition},
+		{"serialization failure", sqlStateError("40001"), bricks.ErrAborted},
+		{"connection exception", sqlStateError("08006"), bricks.ErrUnavailable},
+		{"unmapped", sqlStateError("42P01"), bricks.ErrUnknown},
+		{"connection refused", &net.OpError{Op: "dial", Err: errors.New("refused")}, bricks.ErrUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := handywares.SqlToBricksError(tc.err)
+			assert.ErrorIs(t, err, tc.expected)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+
+	assert.ErrorIs(t, handywares.SqlToBricksError(sqlStateError("40P01")), bricks.ErrRetryable)
+	assert.NotErrorIs(t, handywares.SqlToBricksError(sqlStateError("23505")), bricks.ErrRetryable)
+}
+
+func TestSqlErrorMapperOptions(t *testing.T) {
+	mapper := handywares.NewSqlErrorMapper(
+		handywares.SqlStateExtractor(func(err error) (string, bool) {
+			var merr *customDriverError
+			if errors.As(err, &merr) && merr.Number == 1062 {
+				return "23505", true
+			}
+
+			return "", false
+		}),
+		handywares.SqlStateToBricksError("42P01", bricks.ErrUnimplemented),
+	)
+
+	assert.ErrorIs(t, mapper.Map(&customDriverError{Number: 1062}), bricks.ErrAlreadyExists)
+	assert.ErrorIs(t, mapper.Map(sqlStateError("42P01")), bricks.ErrUnimplemented)
+	assert.ErrorIs(t, handywares.SqlToBricksError(sqlStateError("42P01")), bricks.ErrUnknown)
+}
@@ -0,0 +1,46 @@
+// Package sqliteerr extracts SQLSTATE codes of modernc.org/sqlite errors for handywares.SqlErrorMapper
+package sqliteerr
+
+import (
+	"errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+// codeToSqlState translates sqlite (extended) result codes to SQLSTATE codes
+var codeToSqlState = map[int]string{
+	sqlite3.SQLITE_BUSY:                  "55P03",
+	sqlite3.SQLITE_LOCKED:                "55P03",
+	sqlite3.SQLITE_FULL:                  "53100",
+	sqlite3.SQLITE_CONSTRAINT:            "23000",
+	sqlite3.SQLITE_CONSTRAINT_CHECK:      "23514",
+	sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY: "23503",
+	sqlite3.SQLITE_CONSTRAINT_NOTNULL:    "23502",
+	sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY: "23505",
+	sqlite3.SQLITE_CONSTRAINT_UNIQUE:     "23505",
+}
+
+// SqlStateOf returns SQLSTATE code of the sqlite error in the err tree translated from its result code
+func SqlStateOf(err error) (string, bool) {
+	var serr *sqlite.Error
+	if !errors.As(err, &serr) || serr == nil {
+		return "", false
+	}
+
+	if state, ok := codeToSqlState[serr.Code()]; ok {
+		return state, true
+	}
+
+	// Primary result code of extended ones
+	state, ok := codeToSqlState[serr.Code()&0xff]
+
+	return state, ok
+}
+
+// SqlStateExtractor makes the mapper extract SQLSTATE codes of sqlite errors by SqlStateOf
+func SqlStateExtractor() handywares.SqlErrorMapperOpt {
+	return handywares.SqlStateExtractor(SqlStateOf)
+}
@@ -0,0 +1,39 @@
+package sqliteerr_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+
+	"github.com/janstoon/toolbox/handywares"
+	"github.com/janstoon/toolbox/handywares/sqliteerr"
+)
+
+func TestSqlStateExtractor(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "mapper.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	_, err = db.Exec(`CREATE TABLE orders (id INTEGER PRIMARY KEY, code TEXT UNIQUE, title TEXT NOT NULL)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO orders (id, code, title) VALUES (1, 'a', 'book')`)
+	require.NoError(t, err)
+
+	mapper := handywares.NewSqlErrorMapper(sqliteerr.SqlStateExtractor())
+
+	_, err = db.Exec(`INSERT INTO orders (id, code, title) VALUES (1, 'b', 'book')`)
+	assert.ErrorIs(t, mapper.Map(err), bricks.ErrAlreadyExists)
+
+	_, err = db.Exec(`INSERT INTO orders (id, code, title) VALUES (2, 'a', 'book')`)
+	assert.ErrorIs(t, mapper.Map(err), bricks.ErrAlreadyExists)
+
+	_, err = db.Exec(`INSERT INTO orders (id, code) VALUES (3, 'c')`)
+	assert.ErrorIs(t, mapper.Map(err), bricks.ErrInvalidArgument)
+}
@@ -0,0 +1,300 @@
+package handywares
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+)
+
+// RequestTimeoutHeader carries the remaining time of the caller deadline across http and nats hops, in seconds with
+// up to millisecond precision. gRPC propagates deadlines natively by grpc-timeout metadata.
+const RequestTimeoutHeader = "Request-Timeout"
+
+// TimeoutPolicy tells timeout middlewares how long each operation may take. Deadlines propagated by callers are
+// honored if they're sooner.
+type TimeoutPolicy struct {
+	Default    time.Duration      // Timeout of operations not matching any rule. Zero means no timeout.
+	Operations []OperationTimeout // The first matching rule applies
+}
+
+// OperationTimeout is the timeout of operations matching the glob (see path.Match) of operation ids, grpc full
+// methods or nats subjects.
+type OperationTimeout struct {
+	Operation string
+	Timeout   time.Duration
+}
+
+// LoadTimeoutPolicy reads the policy under key of the settings storage, e.g. *kareless.Settings. Durations are
+// strings of time.ParseDuration. An example in yaml:
+//
+//	default: 5s
+//	operations:
+//	  - operation: exportReport
+//	    timeout: 1m
+//	  - operation: /reports.v1.Reports/*
+//	    timeout: 30s
+func LoadTimeoutPolicy(ss SettingsUnmarshaler, key string) (TimeoutPolicy, error) {
+	var raw struct {
+		Default    string `json:"default"`
+		Operations []struct {
+			Operation string `json:"operation"`
+			Timeout   string `json:"timeout"`
+		} `json:"operations"`
+	}
+	if err := ss.UnmarshalJson(key, &raw); err != nil {
+		return TimeoutPolicy{}, errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	var (
+		tp  TimeoutPolicy
+		err error
+	)
+	if len(raw.Default) > 0 {
+		if tp.Default, err = time.ParseDuration(raw.Default); err != nil {
+			return TimeoutPolicy{}, errors.Join(bricks.ErrInvalidArgument, err)
+		}
+	}
+
+	tp.Operations = make([]OperationTimeout, len(raw.Operations))
+	for k, op := range raw.Operations {
+		tp.Operations[k].Operation = op.Operation
+		if tp.Operations[k].Timeout, err = time.ParseDuration(op.Timeout); err != nil {
+			return TimeoutPolicy{}, errors.Join(bricks.ErrInvalidArgument,
+				fmt.Errorf("operation `%s`: %w", op.Operation, err))
+		}
+	}
+
+	return tp, nil
+}
+
+// For returns timeout of the operation
+func (tp TimeoutPolicy) For(operation string) time.Duration {
+	for _, ot := range tp.Operations {
+		if matched, _ := path.Match(ot.Operation, operation); matched {
+			return ot.Timeout
+		}
+	}
+
+	return tp.Default
+}
+
+// context derives a context done by the sooner of the operation timeout and the timeout requested by the caller
+func (tp TimeoutPolicy) context(
+	ctx context.Context, operation string, requested time.Duration,
+) (context.Context, context.CancelFunc) {
+	timeout := tp.For(operation)
+	if requested > 0 && (timeout <= 0 || requested < timeout) {
+		timeout = requested
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// ErrCodeTimedOut is the custom error code of ErrTimedOut which is responded by 504 over http
+var ErrCodeTimedOut = bricks.MustRegisterErrorCode(bricks.ErrorCode{
+	Code:       bricks.ErrCodeTimedOut,
+	Name:       "timed_out",
+	Parent:     bricks.ErrCodeDeadlineExceeded,
+	HttpStatus: http.StatusGatewayTimeout,
+})
+
+// ErrTimedOut is what requests whose handler didn't respond in time are responded by. It matches
+// bricks.ErrDeadlineExceeded.
+var ErrTimedOut = bricks.ErrorWithCode(ErrCodeTimedOut, errors.New("handler timed out"))
+
+// timeoutError maps err of a handler whose context has expired to bricks.ErrDeadlineExceeded
+func timeoutError(ctx context.Context, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, bricks.ErrDeadlineExceeded) {
+		return err
+	}
+
+	return bricks.ParseError(errors.Join(err, ctx.Err()), bricks.ErrUnknown)
+}
+
+func parseRequestTimeout(v string) time.Duration {
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func formatRequestTimeout(timeout time.Duration) string {
+	return strconv.FormatFloat(max(timeout, time.Millisecond).Seconds(), 'f', -1, 64)
+}
+
+// remainingTimeout returns time left to the ctx deadline. It fails with bricks.ErrDeadlineExceeded if it's passed.
+func remainingTimeout(ctx context.Context) (time.Duration, bool, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false, nil
+	}
+
+	remaining := time.Until(deadline).Truncate(time.Millisecond)
+	if remaining <= 0 {
+		return 0, true, bricks.ParseError(context.DeadlineExceeded, bricks.ErrUnknown)
+	}
+
+	return remaining, true, nil
+}
+
+type httpStatusRecorder struct {
+	http.ResponseWriter
+
+	status int
+}
+
+func (r *httpStatusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *httpStatusRecorder) Write(bb []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(bb)
+}
+
+// HttpTimeoutMiddleware cancels context of requests once the timeout of their operation id (if mctx is not nil) or
+// the one requested by Request-Timeout header runs out. Handlers are expected to give up once their context is done.
+// Requests whose handler hasn't responded by then are responded by ErrTimedOut (504).
+func HttpTimeoutMiddleware(policy TimeoutPolicy, mctx *middleware.Context) tricks.Middleware[http.Handler] {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			var operation string
+			if mctx != nil {
+				if route, matched := mctx.LookupRoute(req); matched {
+					operation = route.Operation.ID
+				}
+			}
+
+			requested := parseRequestTimeout(req.Header.Get(RequestTimeoutHeader))
+			ctx, cancel := policy.context(req.Context(), operation, requested)
+			defer cancel()
+
+			recorder := &httpStatusRecorder{ResponseWriter: rw}
+			next.ServeHTTP(recorder, req.WithContext(ctx))
+
+			if recorder.status == 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				HttpWriteError(rw, req, errors.Join(ErrTimedOut, ctx.Err()))
+			}
+		})
+	}
+}
+
+// HttpDeadlinePropagationTripperware tells servers the time left to the request context deadline by Request-Timeout
+// header. Requests whose deadline is passed already fail by bricks.ErrDeadlineExceeded without being sent.
+func HttpDeadlinePropagationTripperware() tricks.Middleware[http.RoundTripper] {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return HttpRoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			remaining, ok, err := remainingTimeout(req.Context())
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				req = req.Clone(req.Context())
+				req.Header.Set(RequestTimeoutHeader, formatRequestTimeout(remaining))
+			}
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// GrpcTimeoutMiddleware cancels context of calls once the timeout of their full method or the deadline propagated by
+// the client runs out. Failures of expired calls are mapped to bricks.ErrDeadlineExceeded so push it after (inner
+// than) GrpcUnaryServerErrorMapperMiddleware.
+func GrpcTimeoutMiddleware(policy TimeoutPolicy) tricks.Middleware[grpc.UnaryServerInterceptor] {
+	return func(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, cancel := policy.context(ctx, info.FullMethod, 0)
+			defer cancel()
+
+			rsp, err := next(ctx, req, info, handler)
+
+			return rsp, timeoutError(ctx, err)
+		}
+	}
+}
+
+// GrpcStreamTimeoutMiddleware is the stream counterpart of GrpcTimeoutMiddleware
+func GrpcStreamTimeoutMiddleware(policy TimeoutPolicy) tricks.Middleware[grpc.StreamServerInterceptor] {
+	return func(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+		return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, cancel := policy.context(ss.Context(), info.FullMethod, 0)
+			defer cancel()
+
+			return timeoutError(ctx, next(srv, GrpcServerStreamWithContext(ctx, ss), info, handler))
+		}
+	}
+}
+
+// NatsTimeoutMiddleware cancels context of message handlers once the timeout of the subject or the one requested by
+// Request-Timeout header runs out. Failures of expired handlers are mapped to bricks.ErrDeadlineExceeded.
+func NatsTimeoutMiddleware(policy TimeoutPolicy) tricks.Middleware[NatsMsgHandler] {
+	return func(next NatsMsgHandler) NatsMsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			ctx, cancel := policy.context(ctx, msg.Subject, parseRequestTimeout(msg.Header.Get(RequestTimeoutHeader)))
+			defer cancel()
+
+			return timeoutError(ctx, next(ctx, msg))
+		}
+	}
+}
+
+// NatsPropagateDeadline tells the handler of msg the time left to the ctx deadline by Request-Timeout header. It
+// fails by bricks.ErrDeadlineExceeded if the deadline is passed already.
+func NatsPropagateDeadline(ctx context.Context, msg *nats.Msg) error {
+	remaining, ok, err := remainingTimeout(ctx)
+	if err != nil || !ok {
+		return err
+	}
+
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(RequestTimeoutHeader, formatRequestTimeout(remaining))
+
+	return nil
+}
+
+// MsgTimeoutMiddleware is the generic counterpart of NatsTimeoutMiddleware. The extractor returns the operation
+// (e.g. subject) of the message along with the timeout requested by its producer, if any.
+func MsgTimeoutMiddleware[M any](
+	policy TimeoutPolicy, extractor func(msg M) (operation string, requested time.Duration),
+) tricks.Middleware[MsgHandler[M]] {
+	if extractor == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty message operation extractor")))
+	}
+
+	return func(next MsgHandler[M]) MsgHandler[M] {
+		return func(ctx context.Context, msg M) error {
+			operation, requested := extractor(msg)
+			ctx, cancel := policy.context(ctx, operation, requested)
+			defer cancel()
+
+			return timeoutError(ctx, next(ctx, msg))
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package handywares_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/janstoon/toolbox/handywares"
+)
+
+func TestLoadTimeoutPolicy(t *testing.T) {
+	tp, err := handywares.LoadTimeoutPolicy(jsonSettings{
+		"timeouts": map[string]any{
+			"default": "5s",
+			"operations": []any{
+				map[string]any{"operation": "exportReport", "timeout": "1m"},
+				map[string]any{"operation": "/reports.v1.Reports/*", "timeout": "30s"},
+			},
+		},
+	}, "timeouts")
+	require.NoError(t, err)
+
+	assert.Equal(t, time.Minute, tp.For("exportReport"))
+	assert.Equal(t, 30*time.Second, tp.For("/reports.v1.Reports/Get"))
+	assert.Equal(t, 5*time.Second, tp.For("getReport"))
+
+	_, err = handywares.LoadTimeoutPolicy(jsonSettings{"timeouts": map[string]any{"default": "soon"}}, "timeouts")
+	require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+}
+
+func TestHttpTimeoutMiddleware(t *testing.T) {
+	var mws handywares.HttpMiddlewareStack
+	handler := mws.Push(handywares.HttpTimeoutMiddleware(handywares.TimeoutPolicy{Default: time.Second}, nil))(
+		http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			deadline, ok := req.Context().Deadline()
+			require.True(t, ok)
+			assert.WithinDuration(t, time.Now().Add(20*time.Millisecond), deadline, 10*time.Millisecond)
+
+			<-req.Context().Done()
+		}),
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(handywares.RequestTimeoutHeader, "0.02")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+}
+
+func TestHttpDeadlinePropagationTripperware(t *testing.T) {
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requested = req.Header.Get(handywares.RequestTimeoutHeader)
+	}))
+	defer server.Close()
+
+	var tws handywares.HttpTripperwareStack
+	client := &http.Client{
+		Transport: tws.Push(handywares.HttpDeadlinePropagationTripperware())(http.DefaultTransport),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	rsp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = rsp.Body.Close()
+
+	timeout, err := time.ParseDuration(requested + "s")
+	require.NoError(t, err)
+	assert.InDelta(t, 2*time.Second, timeout, float64(100*time.Millisecond))
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	req, err = http.NewRequestWithContext(expired, http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	rsp, err = client.Do(req)
+	if rsp != nil {
+		_ = rsp.Body.Close()
+	}
+	require.ErrorIs(t, err, bricks.ErrDeadlineExceeded)
+}
+
+func TestGrpcTimeoutMiddleware(t *testing.T) {
+	var mws handywares.GrpcUnaryServerMiddlewareStack
+	interceptor := mws.
+		Push(handywares.GrpcUnaryServerErrorMapperMiddleware(handywares.BricksToGrpcErrorMapper)).
+		Push(handywares.GrpcTimeoutMiddleware(handywares.TimeoutPolicy{
+			Operations: []handywares.OperationTimeout{{Operation: "/svc/*", Timeout: 10 * time.Millisecond}},
+		}))(handywares.GrpcUnaryServerInvokeHandlerInterceptor)
+
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Slow"},
+		func(ctx context.Context, req any) (any, error) {
+			<-ctx.Done()
+
+			return nil, ctx.Err()
+		},
+	)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func TestNatsTimeoutMiddleware(t *testing.T) {
+	var mws handywares.NatsMiddlewareStack
+	handler := mws.Push(handywares.NatsTimeoutMiddleware(handywares.TimeoutPolicy{}))(
+		func(ctx context.Context, msg *nats.Msg) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+
+			case <-time.After(time.Second):
+				return nil
+			}
+		},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	msg := nats.NewMsg("reports.export")
+	require.NoError(t, handywares.NatsPropagateDeadline(ctx, msg))
+	assert.NotEmpty(t, msg.Header.Get(handywares.RequestTimeoutHeader))
+
+	err := handler(context.Background(), msg)
+	require.ErrorIs(t, err, bricks.ErrDeadlineExceeded)
+	require.ErrorIs(t, err, bricks.ErrRetryable)
+}
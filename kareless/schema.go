@@ -0,0 +1,202 @@
+package kareless
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/janstoon/toolbox/bricks"
+)
+
+// Envelope is a marshaled payload along with its schema, content type and headers, as it's carried on the wire
+type Envelope struct {
+	Schema
+
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Payload     []byte            `json:"payload"`
+}
+
+// envelopeMagic prefixes envelopes framed by EnvelopeBytes, telling them apart from bare payloads since it can't
+// occur in json. The layout is: magic | version | json(envelope)
+var envelopeMagic = []byte("\x00jst:envelope\x00")
+
+const envelopeFrameVersion = 1
+
+// EnvelopeBytes frames the envelope to be carried by transports which have no headers
+func EnvelopeBytes(env Envelope) []byte {
+	bb, _ := json.Marshal(env)
+
+	framed := make([]byte, 0, len(envelopeMagic)+1+len(bb))
+	framed = append(framed, envelopeMagic...)
+	framed = append(framed, envelopeFrameVersion)
+
+	return append(framed, bb...)
+}
+
+// ParseEnvelope parses an envelope framed by EnvelopeBytes. Data which isn't framed by it (e.g. of producers not
+// aware of envelopes) is taken as the bare payload of an untyped envelope.
+func ParseEnvelope(bb []byte) (Envelope, error) {
+	if !bytes.HasPrefix(bb, envelopeMagic) {
+		return Envelope{Payload: bb}, nil
+	}
+
+	rest := bb[len(envelopeMagic):]
+	if len(rest) == 0 {
+		return Envelope{}, errors.Join(bricks.ErrDataLoss, errors.New("truncated envelope frame"))
+	}
+
+	if rest[0] != envelopeFrameVersion {
+		return Envelope{}, errors.Join(bricks.ErrUnimplemented, fmt.Errorf("envelope frame v%d", rest[0]))
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(rest[1:], &env); err != nil {
+		return Envelope{}, errors.Join(bricks.ErrDataLoss, err)
+	}
+
+	return env, nil
+}
+
+// Schema identifies a message type and the version of its layout
+type Schema struct {
+	Type    string `json:"type,omitempty"`
+	Version int    `json:"version,omitempty"`
+}
+
+func (s Schema) String() string {
+	return fmt.Sprintf("%s@v%d", s.Type, s.Version)
+}
+
+// Upcaster converts the envelope of a version of a message type to the next version, e.g. by renaming fields of its
+// payload. The version of the returned envelope is set by SchemaRegistry.
+type Upcaster func(env Envelope) (Envelope, error)
+
+// SchemaRegistry maps Go types to the current schema of them and chains upcasters of older versions, so consumers
+// survive producers upgrades and vice versa.
+type SchemaRegistry struct {
+	l sync.RWMutex
+
+	schemas   map[reflect.Type]Schema
+	types     map[Schema]reflect.Type
+	upcasters map[Schema]Upcaster
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{
+		schemas:   make(map[reflect.Type]Schema),
+		types:     make(map[Schema]reflect.Type),
+		upcasters: make(map[Schema]Upcaster),
+	}
+}
+
+// RegisterSchema registers T as the current version of the message type. Messages of older versions are upcast to it
+// by the upcasters of the type (see SchemaRegistry.RegisterUpcaster).
+func RegisterSchema[T any](reg *SchemaRegistry, typ string, version int) error {
+	if len(typ) == 0 {
+		return errors.Join(bricks.ErrInvalidArgument, errors.New("empty message type"))
+	}
+
+	var (
+		rt     = reflect.TypeFor[T]()
+		schema = Schema{Type: typ, Version: version}
+	)
+
+	reg.l.Lock()
+	defer reg.l.Unlock()
+
+	if current, ok := reg.schemas[rt]; ok {
+		return errors.Join(bricks.ErrAlreadyExists, fmt.Errorf("%s is registered as %s", rt, current))
+	}
+
+	for existing := range reg.types {
+		if existing.Type == typ {
+			return errors.Join(bricks.ErrAlreadyExists, fmt.Errorf("message type %s is registered as %s", typ, existing))
+		}
+	}
+
+	reg.schemas[rt] = schema
+	reg.types[schema] = rt
+
+	return nil
+}
+
+// RegisterUpcaster registers the upcaster converting the version of the message type to the next version
+func (reg *SchemaRegistry) RegisterUpcaster(typ string, from int, upcaster Upcaster) error {
+	if upcaster == nil {
+		return errors.Join(bricks.ErrInvalidArgument, errors.New("empty upcaster"))
+	}
+
+	schema := Schema{Type: typ, Version: from}
+
+	reg.l.Lock()
+	defer reg.l.Unlock()
+
+	if _, ok := reg.upcasters[schema]; ok {
+		return errors.Join(bricks.ErrAlreadyExists, fmt.Errorf("upcaster of %s", schema))
+	}
+
+	reg.upcasters[schema] = upcaster
+
+	return nil
+}
+
+// SchemaOf returns the schema v (or the value it points to) is registered as
+func (reg *SchemaRegistry) SchemaOf(v any) (Schema, error) {
+	rt := reflect.TypeOf(v)
+
+	reg.l.RLock()
+	defer reg.l.RUnlock()
+
+	for rt != nil {
+		if schema, ok := reg.schemas[rt]; ok {
+			return schema, nil
+		}
+
+		if rt.Kind() != reflect.Pointer {
+			break
+		}
+
+		rt = rt.Elem()
+	}
+
+	return Schema{}, errors.Join(bricks.ErrNotFound, fmt.Errorf("no schema registered for %T", v))
+}
+
+// New returns a pointer to a new value of the Go type registered for the schema
+func (reg *SchemaRegistry) New(schema Schema) (any, error) {
+	reg.l.RLock()
+	defer reg.l.RUnlock()
+
+	rt, ok := reg.types[schema]
+	if !ok {
+		return nil, errors.Join(bricks.ErrNotFound, fmt.Errorf("no type registered for %s", schema))
+	}
+
+	return reflect.New(rt).Interface(), nil
+}
+
+// Upcast runs the upcasters of the envelope schema one after another until there is none for the version reached
+func (reg *SchemaRegistry) Upcast(env Envelope) (Envelope, error) {
+	for {
+		reg.l.RLock()
+		upcaster, ok := reg.upcasters[env.Schema]
+		reg.l.RUnlock()
+
+		if !ok {
+			return env, nil
+		}
+
+		from := env.Schema
+
+		var err error
+		if env, err = upcaster(env); err != nil {
+			return env, fmt.Errorf("upcasting %s: %w", from, err)
+		}
+
+		env.Schema = Schema{Type: from.Type, Version: from.Version + 1}
+	}
+}
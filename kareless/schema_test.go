@@ -0,0 +1,161 @@
+package kareless_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/kareless"
+)
+
+type orderCreatedV1 struct {
+	Id    int `json:"id"`
+	Price int `json:"price"`
+}
+
+type orderCreated struct {
+	Id     int `json:"id"`
+	Amount int `json:"amount"`
+}
+
+type headerMsg struct {
+	topic   string
+	headers map[string]string
+	data    []byte
+}
+
+// headerCapsule carries envelopes in headers rather than in-band
+type headerCapsule struct{}
+
+func (headerCapsule) Encapsulate(route kareless.Route, data []byte) headerMsg {
+	panic("not expected to be called")
+}
+
+func (headerCapsule) EncapsulateEnvelope(route kareless.Route, env kareless.Envelope) (headerMsg, error) {
+	headers := map[string]string{"type": env.Type, "content-type": env.ContentType}
+	for k, v := range env.Headers {
+		headers[k] = v
+	}
+
+	return headerMsg{topic: route.Address, headers: headers, data: env.Payload}, nil
+}
+
+func (headerCapsule) Decapsulate(msg headerMsg) ([]byte, error) {
+	panic("not expected to be called")
+}
+
+func (headerCapsule) DecapsulateEnvelope(msg headerMsg) (kareless.Envelope, error) {
+	return kareless.Envelope{
+		Schema:      kareless.Schema{Type: msg.headers["type"], Version: 2},
+		ContentType: msg.headers["content-type"],
+		Payload:     msg.data,
+	}, nil
+}
+
+func newSchemaMuldem[M any](t *testing.T) (kareless.Muldem[M], *kareless.SchemaRegistry) {
+	t.Helper()
+
+	reg := kareless.NewSchemaRegistry()
+	require.NoError(t, kareless.RegisterSchema[orderCreated](reg, "order.created", 2))
+	require.ErrorIs(t, kareless.RegisterSchema[orderCreated](reg, "order.placed", 1), bricks.ErrAlreadyExists)
+	require.NoError(t, reg.RegisterUpcaster("order.created", 1, func(env kareless.Envelope) (kareless.Envelope, error) {
+		var v1 orderCreatedV1
+		if err := json.Unmarshal(env.Payload, &v1); err != nil {
+			return env, err
+		}
+
+		env.Payload, _ = json.Marshal(orderCreated{Id: v1.Id, Amount: v1.Price})
+
+		return env, nil
+	}))
+
+	return kareless.Muldem[M]{
+		Router: kareless.RouterFunc(func(addr string) kareless.Route {
+			return kareless.Route{Address: addr}
+		}),
+		Marshaler:   kareless.MarshalerFunc(json.Marshal),
+		Unmarshaler: kareless.UnmarshalerFunc(json.Unmarshal),
+		ContentType: "application/json",
+	}.WithSchemas(reg), reg
+}
+
+func TestMuldemSchemas(t *testing.T) {
+	bytesCapsule := kareless.EncapsulatorFunc[[]byte](func(route kareless.Route, data []byte) []byte {
+		return data
+	})
+	bytesDecapsule := kareless.DecapsulatorFunc[[]byte](func(msg []byte) ([]byte, error) {
+		return msg, nil
+	})
+
+	mx, reg := newSchemaMuldem[[]byte](t)
+	mx = mx.WithEncapsulation(bytesCapsule, bytesDecapsule)
+
+	msg, err := mx.Encapsulate("orders", orderCreated{Id: 1, Amount: 10})
+	require.NoError(t, err)
+
+	env, err := kareless.ParseEnvelope(msg)
+	require.NoError(t, err)
+	assert.Equal(t, kareless.Schema{Type: "order.created", Version: 2}, env.Schema)
+	assert.Equal(t, "application/json", env.ContentType)
+
+	var oc orderCreated
+	require.NoError(t, mx.Decapsulate(msg, &oc))
+	assert.Equal(t, orderCreated{Id: 1, Amount: 10}, oc)
+
+	// A message of an older producer gets upcast
+	old := kareless.EnvelopeBytes(kareless.Envelope{
+		Schema:  kareless.Schema{Type: "order.created", Version: 1},
+		Payload: []byte(`{"id":2,"price":20}`),
+	})
+	require.NoError(t, mx.Decapsulate(old, &oc))
+	assert.Equal(t, orderCreated{Id: 2, Amount: 20}, oc)
+
+	v, err := reg.New(env.Schema)
+	require.NoError(t, err)
+	assert.IsType(t, &orderCreated{}, v)
+
+	// A message of a newer producer isn't decoded as the current version
+	newer := kareless.EnvelopeBytes(kareless.Envelope{
+		Schema:  kareless.Schema{Type: "order.created", Version: 3},
+		Payload: []byte(`{"id":3}`),
+	})
+	require.ErrorIs(t, mx.Decapsulate(newer, &oc), bricks.ErrFailedPrecondition)
+
+	// A bare payload of a producer not aware of envelopes is decoded as it is
+	oc = orderCreated{}
+	require.NoError(t, mx.Decapsulate([]byte(`{"id":7}`), &oc))
+	assert.Equal(t, orderCreated{Id: 7}, oc)
+
+	// Even if it looks like an envelope
+	oc = orderCreated{}
+	require.NoError(t, mx.Decapsulate([]byte(`{"envelope":1,"id":8}`), &oc))
+	assert.Equal(t, orderCreated{Id: 8}, oc)
+
+	require.ErrorIs(t, mx.Decapsulate([]byte("\x00jst:envelope\x00\x02{}"), &oc), bricks.ErrUnimplemented)
+
+	_, err = mx.Encapsulate("orders", orderCreatedV1{})
+	require.ErrorIs(t, err, bricks.ErrNotFound)
+}
+
+func TestMuldemEnvelopeEncapsulator(t *testing.T) {
+	mx, _ := newSchemaMuldem[headerMsg](t)
+	mx = mx.WithEncapsulation(headerCapsule{}, headerCapsule{})
+
+	env, err := mx.Envelop(&orderCreated{Id: 1, Amount: 10})
+	require.NoError(t, err)
+	env.Headers = map[string]string{"X-Request-ID": "r1"}
+
+	msg, err := mx.Seal(kareless.Route{Address: "orders"}, env)
+	require.NoError(t, err)
+	assert.Equal(t, "orders", msg.topic)
+	assert.Equal(t, "order.created", msg.headers["type"])
+	assert.Equal(t, "r1", msg.headers["X-Request-ID"])
+	assert.JSONEq(t, `{"id":1,"amount":10}`, string(msg.data))
+
+	var oc orderCreated
+	require.NoError(t, mx.Decapsulate(msg, &oc))
+	assert.Equal(t, orderCreated{Id: 1, Amount: 10}, oc)
+}
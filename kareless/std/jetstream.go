@@ -0,0 +1,300 @@
+package std
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/nats-io/nats.go"
+
+	"github.com/janstoon/toolbox/kareless"
+)
+
+// JetStreamConsumer is a kareless.Driver feeding messages of a JetStream consumer to a handler, e.g. one built by
+// handywares.NatsMiddlewareStack. It binds to an existing consumer and runs it as a pull or a push (with its deliver
+// group if any) consumer according to the consumer config. Messages are acknowledged by outcome of the handler:
+//   - Ack on success
+//   - NakWithDelay on bricks.ErrRetryable errors, delayed by the backoff of the delivery count or the
+//     bricks.RetryInfo of the error, whichever is longer
+//   - Term on other errors. Push handywares.NatsCompensatorMiddleware to the stack to compensate them beforehand.
+//
+// Panics of the handler which aren't recovered by the stack (e.g. by handywares.NatsPanicRecoverMiddleware) are
+// reported to the error handler and taken for bricks.ErrInternal, which is retryable.
+//
+// Once ctx is done it stops receiving messages and waits for the in-flight ones to be handled. Handlers aren't
+// canceled by ctx.
+type JetStreamConsumer struct {
+	JetStreamConsumerPolicy
+
+	nc       *nats.Conn
+	stream   string
+	consumer string
+	handler  func(ctx context.Context, msg *nats.Msg) error
+}
+
+// JetStreamConsumerPolicy tells JetStreamConsumer how to receive and acknowledge messages
+type JetStreamConsumerPolicy struct {
+	concurrency  int
+	batchSize    int
+	fetchTimeout time.Duration
+	nakBackoff   bricks.Backoff
+	jsOptions    []nats.JSOpt
+	onError      func(ctx context.Context, err error)
+}
+
+type JetStreamConsumerOpt = tricks.Option[JetStreamConsumerPolicy]
+
+// JetStreamConcurrency sets the maximum number of messages handled concurrently. It defaults to 1.
+func JetStreamConcurrency(concurrency int) JetStreamConsumerOpt {
+	return tricks.ImmutableOption[JetStreamConsumerPolicy](func(jcp JetStreamConsumerPolicy) JetStreamConsumerPolicy {
+		jcp.concurrency = concurrency
+
+		return jcp
+	})
+}
+
+// JetStreamBatchSize sets the maximum number of messages pulled per request by pull consumers. It defaults to the
+// concurrency.
+func JetStreamBatchSize(size int) JetStreamConsumerOpt {
+	return tricks.ImmutableOption[JetStreamConsumerPolicy](func(jcp JetStreamConsumerPolicy) JetStreamConsumerPolicy {
+		jcp.batchSize = size
+
+		return jcp
+	})
+}
+
+// JetStreamFetchTimeout sets how long pull requests wait for messages. It defaults to 5 seconds.
+func JetStreamFetchTimeout(timeout time.Duration) JetStreamConsumerOpt {
+	return tricks.ImmutableOption[JetStreamConsumerPolicy](func(jcp JetStreamConsumerPolicy) JetStreamConsumerPolicy {
+		jcp.fetchTimeout = timeout
+
+		return jcp
+	})
+}
+
+// JetStreamNakBackoff sets the redelivery delay of failed retryable messages by their delivery count. It defaults to
+// exponential backoff from a second to a minute.
+func JetStreamNakBackoff(backoff bricks.Backoff) JetStreamConsumerOpt {
+	return tricks.ImmutableOption[JetStreamConsumerPolicy](func(jcp JetStreamConsumerPolicy) JetStreamConsumerPolicy {
+		jcp.nakBackoff = backoff
+
+		return jcp
+	})
+}
+
+// JetStreamContextOptions sets options of the JetStream context, e.g. nats.Domain
+func JetStreamContextOptions(options ...nats.JSOpt) JetStreamConsumerOpt {
+	return tricks.ImmutableOption[JetStreamConsumerPolicy](func(jcp JetStreamConsumerPolicy) JetStreamConsumerPolicy {
+		jcp.jsOptions = options
+
+		return jcp
+	})
+}
+
+// JetStreamErrorHandler sets the handler of failures of receiving and acknowledging messages. Failures don't stop the
+// consumer. They're logged by default.
+func JetStreamErrorHandler(handler func(ctx context.Context, err error)) JetStreamConsumerOpt {
+	return tricks.ImmutableOption[JetStreamConsumerPolicy](func(jcp JetStreamConsumerPolicy) JetStreamConsumerPolicy {
+		jcp.onError = handler
+
+		return jcp
+	})
+}
+
+// NewJetStreamConsumer creates a JetStreamConsumer of the consumer (durable name) of the stream
+func NewJetStreamConsumer(
+	nc *nats.Conn, stream, consumer string, handler func(ctx context.Context, msg *nats.Msg) error,
+	options ...JetStreamConsumerOpt,
+) *JetStreamConsumer {
+	if nc == nil || handler == nil || len(stream) == 0 || len(consumer) == 0 {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty jetstream connection, consumer or handler")))
+	}
+
+	policy := tricks.ApplyOptions(&JetStreamConsumerPolicy{
+		concurrency:  1,
+		fetchTimeout: 5 * time.Second,
+		nakBackoff:   bricks.ExponentialBackoff(time.Second, time.Minute),
+		onError: func(_ context.Context, err error) {
+			log.Printf("JETSTREAM|%s\n", err)
+		},
+	}, options...)
+	policy.concurrency = max(policy.concurrency, 1)
+	if policy.batchSize <= 0 {
+		policy.batchSize = policy.concurrency
+	}
+
+	return &JetStreamConsumer{
+		JetStreamConsumerPolicy: *policy,
+
+		nc:       nc,
+		stream:   stream,
+		consumer: consumer,
+		handler:  handler,
+	}
+}
+
+// JetStreamDriverConstructor creates a kareless.DriverConstructor running a JetStreamConsumer. The *nats.Conn is
+// resolved from the kareless.InstrumentBank by name and the handler is built out of the applications.
+func JetStreamDriverConstructor(
+	natsInstrument, stream, consumer string,
+	handler func(apps []kareless.Application) func(ctx context.Context, msg *nats.Msg) error,
+	options ...JetStreamConsumerOpt,
+) kareless.DriverConstructor {
+	return func(_ *kareless.Settings, ib *kareless.InstrumentBank, apps []kareless.Application) kareless.Driver {
+		return NewJetStreamConsumer(
+			kareless.ResolveInstrumentByType[*nats.Conn](ib, natsInstrument), stream, consumer, handler(apps),
+			options...,
+		)
+	}
+}
+
+func (c *JetStreamConsumer) Run(ctx context.Context) error {
+	js, err := c.nc.JetStream(c.jsOptions...)
+	if err != nil {
+		return err
+	}
+
+	info, err := js.ConsumerInfo(c.stream, c.consumer, nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	d := &jetStreamDispatcher{
+		consumer: c,
+		ctx:      context.WithoutCancel(ctx),
+		slots:    make(chan struct{}, c.concurrency),
+	}
+	defer func() {
+		d.wg.Wait()
+		_ = c.nc.Flush() // acknowledgements of the last messages
+	}()
+
+	if len(info.Config.DeliverSubject) > 0 {
+		return c.push(ctx, js, info.Config.DeliverGroup, d)
+	}
+
+	return c.pull(ctx, js, d)
+}
+
+func (c *JetStreamConsumer) pull(ctx context.Context, js nats.JetStreamContext, d *jetStreamDispatcher) error {
+	sub, err := js.PullSubscribe("", c.consumer, nats.Bind(c.stream, c.consumer))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	for ctx.Err() == nil {
+		fctx, cancel := context.WithTimeout(ctx, c.fetchTimeout)
+		msgs, err := sub.Fetch(c.batchSize, nats.Context(fctx))
+		cancel()
+
+		for _, msg := range msgs {
+			d.dispatch(msg)
+		}
+
+		switch {
+		case err == nil, errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled),
+			errors.Is(err, nats.ErrTimeout):
+
+		case errors.Is(err, nats.ErrConnectionClosed), errors.Is(err, nats.ErrBadSubscription):
+			return err
+
+		default:
+			c.onError(ctx, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *JetStreamConsumer) push(
+	ctx context.Context, js nats.JetStreamContext, group string, d *jetStreamDispatcher,
+) error {
+	var (
+		sub *nats.Subscription
+		err error
+	)
+	if len(group) > 0 {
+		sub, err = js.QueueSubscribe("", group, d.dispatch, nats.Bind(c.stream, c.consumer), nats.ManualAck())
+	} else {
+		sub, err = js.Subscribe("", d.dispatch, nats.Bind(c.stream, c.consumer), nats.ManualAck())
+	}
+	if err != nil {
+		return err
+	}
+
+	closed := sub.StatusChanged(nats.SubscriptionClosed)
+	<-ctx.Done()
+
+	if err = sub.Drain(); err != nil {
+		return err
+	}
+	<-closed
+
+	return nil
+}
+
+type jetStreamDispatcher struct {
+	consumer *JetStreamConsumer
+	ctx      context.Context
+	slots    chan struct{}
+	wg       sync.WaitGroup
+}
+
+// dispatch handles msg once there is a free slot
+func (d *jetStreamDispatcher) dispatch(msg *nats.Msg) {
+	d.slots <- struct{}{}
+	d.wg.Add(1)
+
+	go func() {
+		defer func() {
+			<-d.slots
+			d.wg.Done()
+		}()
+
+		if err := d.consumer.acknowledge(msg, d.consumer.handle(d.ctx, msg)); err != nil {
+			d.consumer.onError(d.ctx, err)
+		}
+	}()
+}
+
+// handle runs the handler and converts its panic to an error of bricks.ErrInternal, so the message is still
+// acknowledged and the process survives
+func (c *JetStreamConsumer) handle(ctx context.Context, msg *nats.Msg) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Join(bricks.ErrInternal, fmt.Errorf("%s: panic recovered: %+v\n%s", msg.Subject, r, debug.Stack()))
+			c.onError(ctx, err)
+		}
+	}()
+
+	return c.handler(ctx, msg)
+}
+
+func (c *JetStreamConsumer) acknowledge(msg *nats.Msg, err error) error {
+	if err == nil {
+		return msg.Ack()
+	}
+
+	if !errors.Is(err, bricks.ErrRetryable) {
+		return msg.Term()
+	}
+
+	var delay time.Duration
+	if meta, merr := msg.Metadata(); merr == nil && c.nakBackoff != nil {
+		delay = c.nakBackoff(int(meta.NumDelivered), 0)
+	}
+	if ri, ok := bricks.ErrorDetailOf[bricks.RetryInfo](err); ok {
+		delay = max(delay, ri.RetryDelay)
+	}
+
+	return msg.NakWithDelay(delay)
+}
@@ -0,0 +1,193 @@
+package std_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/kareless/std"
+)
+
+// runNats runs an embedded nats server for the test, with jetstream if asked, and connects to it
+func runNats(t *testing.T, jetStream bool) *nats.Conn {
+	t.Helper()
+
+	opts := &server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true}
+	if jetStream {
+		opts.JetStream = true
+		opts.StoreDir = t.TempDir()
+	}
+
+	ns, err := server.NewServer(opts)
+	require.NoError(t, err)
+	ns.Start()
+	t.Cleanup(ns.Shutdown)
+	require.True(t, ns.ReadyForConnections(5*time.Second))
+
+	nc, err := nats.Connect(ns.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	return nc
+}
+
+func runJetStream(t *testing.T) (*nats.Conn, nats.JetStreamContext) {
+	t.Helper()
+
+	nc := runNats(t, true)
+
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	_, err = js.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}})
+	require.NoError(t, err)
+
+	return nc, js
+}
+
+type jetStreamProbe struct {
+	sync.Mutex
+
+	deliveries  map[string]int
+	compensated int
+	done        chan struct{}
+	pending     atomic.Int32
+}
+
+func newJetStreamProbe(pending int32) *jetStreamProbe {
+	p := &jetStreamProbe{
+		deliveries: make(map[string]int),
+		done:       make(chan struct{}),
+	}
+	p.pending.Store(pending)
+
+	return p
+}
+
+// handle succeeds on `ok`, fails by a retryable error once on `retry`, panics once on `panic` and fails by a
+// compensable error on `fatal`
+func (p *jetStreamProbe) handle(ctx context.Context, msg *nats.Msg) error {
+	p.Lock()
+	p.deliveries[string(msg.Data)]++
+	deliveries := p.deliveries[string(msg.Data)]
+	p.Unlock()
+
+	var err error
+	switch string(msg.Data) {
+	case "retry":
+		if deliveries == 1 {
+			err = errors.Join(bricks.ErrUnavailable, bricks.ErrRetryable)
+		}
+
+	case "panic":
+		if deliveries == 1 {
+			panic("boom")
+		}
+
+	case "fatal":
+		p.Lock()
+		p.compensated++
+		p.Unlock()
+		err = bricks.ErrInvalidArgument
+	}
+
+	if err == nil || !errors.Is(err, bricks.ErrRetryable) {
+		if p.pending.Add(-1) == 0 {
+			close(p.done)
+		}
+	}
+
+	return err
+}
+
+func publishOrders(t *testing.T, js nats.JetStreamContext, payloads ...string) {
+	t.Helper()
+
+	for _, payload := range payloads {
+		_, err := js.Publish("orders.created", []byte(payload))
+		require.NoError(t, err)
+	}
+}
+
+func runJetStreamConsumer(t *testing.T, consumer *std.JetStreamConsumer, probe *jetStreamProbe) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- consumer.Run(ctx)
+	}()
+
+	select {
+	case <-probe.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages not handled in time")
+	}
+
+	cancel()
+	require.NoError(t, <-stopped)
+}
+
+func TestJetStreamPullConsumer(t *testing.T) {
+	nc, js := runJetStream(t)
+	_, err := js.AddConsumer("ORDERS", &nats.ConsumerConfig{
+		Durable: "worker", AckPolicy: nats.AckExplicitPolicy, MaxDeliver: 5,
+	})
+	require.NoError(t, err)
+
+	publishOrders(t, js, "ok", "retry", "fatal", "panic", "ok")
+
+	var panics atomic.Int32
+	probe := newJetStreamProbe(5)
+	runJetStreamConsumer(t, std.NewJetStreamConsumer(nc, "ORDERS", "worker", probe.handle,
+		std.JetStreamConcurrency(2),
+		std.JetStreamFetchTimeout(100*time.Millisecond),
+		std.JetStreamNakBackoff(bricks.ConstantBackoff(10*time.Millisecond)),
+		std.JetStreamErrorHandler(func(ctx context.Context, err error) {
+			if errors.Is(err, bricks.ErrInternal) {
+				panics.Add(1)
+			}
+		}),
+	), probe)
+
+	assert.Equal(t, map[string]int{"ok": 2, "retry": 2, "fatal": 1, "panic": 2}, probe.deliveries)
+	assert.EqualValues(t, 1, panics.Load())
+
+	info, err := js.ConsumerInfo("ORDERS", "worker")
+	require.NoError(t, err)
+	assert.Zero(t, info.NumAckPending)
+	assert.Zero(t, info.NumPending)
+}
+
+func TestJetStreamPushConsumer(t *testing.T) {
+	nc, js := runJetStream(t)
+	_, err := js.AddConsumer("ORDERS", &nats.ConsumerConfig{
+		Durable: "notifier", AckPolicy: nats.AckExplicitPolicy, MaxDeliver: 5,
+		DeliverSubject: "deliver.notifier", DeliverGroup: "notifiers",
+	})
+	require.NoError(t, err)
+
+	publishOrders(t, js, "retry", "ok", "fatal")
+
+	probe := newJetStreamProbe(3)
+	runJetStreamConsumer(t, std.NewJetStreamConsumer(nc, "ORDERS", "notifier", probe.handle,
+		std.JetStreamConcurrency(3),
+		std.JetStreamNakBackoff(bricks.ConstantBackoff(10*time.Millisecond)),
+	), probe)
+
+	assert.Equal(t, map[string]int{"ok": 1, "retry": 2, "fatal": 1}, probe.deliveries)
+	assert.Equal(t, 1, probe.compensated)
+
+	info, err := js.ConsumerInfo("ORDERS", "notifier")
+	require.NoError(t, err)
+	assert.Zero(t, info.NumAckPending)
+}
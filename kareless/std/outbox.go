@@ -0,0 +1,458 @@
+package std
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/nats-io/nats.go"
+
+	"github.com/janstoon/toolbox/kareless"
+)
+
+// SqlExecer is satisfied by *sql.DB, *sql.Tx and *sql.Conn
+type SqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Outbox stores messages encoded by its kareless.Muldem in a sql table within transactions of the caller, so they get
+// published by an OutboxRelay if and only if the transaction commits. The table is expected to be like:
+//
+//	CREATE TABLE outbox (
+//	  id           VARCHAR(64) PRIMARY KEY,
+//	  medium       INTEGER NOT NULL,
+//	  address      VARCHAR(255) NOT NULL,
+//	  payload      BYTEA NOT NULL,
+//	  attempts     INTEGER NOT NULL DEFAULT 0,
+//	  created_at   TIMESTAMP NOT NULL,
+//	  leased_until TIMESTAMP
+//	);
+//	CREATE INDEX outbox_created_at ON outbox (created_at, id);
+type Outbox[M any] struct {
+	OutboxSchema
+
+	mx kareless.Muldem[M]
+}
+
+type OutboxOpt = tricks.Option[OutboxSchema]
+
+// OutboxSchema is the sql dialect and layout of the outbox table
+type OutboxSchema struct {
+	table       string
+	placeholder bricks.SqlPlaceholder
+	lockClause  string
+	idGenerator func() string
+}
+
+// OutboxTable sets name of the outbox table. It defaults to outbox.
+func OutboxTable(name string) OutboxOpt {
+	return tricks.ImmutableOption[OutboxSchema](func(schema OutboxSchema) OutboxSchema {
+		schema.table = name
+
+		return schema
+	})
+}
+
+// OutboxSqlPlaceholder sets the bind parameter style of the database. It defaults to bricks.QuestionSqlPlaceholder.
+func OutboxSqlPlaceholder(placeholder bricks.SqlPlaceholder) OutboxOpt {
+	return tricks.ImmutableOption[OutboxSchema](func(schema OutboxSchema) OutboxSchema {
+		schema.placeholder = placeholder
+
+		return schema
+	})
+}
+
+// OutboxLockClause sets the clause appended to the query picking messages to be relayed, e.g.
+// `FOR UPDATE SKIP LOCKED` to let multiple relays run concurrently on databases supporting it.
+func OutboxLockClause(clause string) OutboxOpt {
+	return tricks.ImmutableOption[OutboxSchema](func(schema OutboxSchema) OutboxSchema {
+		schema.lockClause = clause
+
+		return schema
+	})
+}
+
+// OutboxIdGenerator sets the generator of message ids. It defaults to 128-bit random hex strings.
+func OutboxIdGenerator(generator func() string) OutboxOpt {
+	return tricks.ImmutableOption[OutboxSchema](func(schema OutboxSchema) OutboxSchema {
+		schema.idGenerator = generator
+
+		return schema
+	})
+}
+
+func newOutboxId() string {
+	bb := make([]byte, 16)
+	_, _ = rand.Read(bb)
+
+	return hex.EncodeToString(bb)
+}
+
+// NewOutbox creates an Outbox encoding messages by mx. Its Router and Marshaler are used on Put and its Encapsulator
+// on relay. Envelopes are stored framed by the Muldem, so their schema survives.
+func NewOutbox[M any](mx kareless.Muldem[M], options ...OutboxOpt) *Outbox[M] {
+	if mx.Router == nil || (mx.Marshaler == nil && mx.Codecs == nil) || mx.Encapsulator == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("incomplete muldem")))
+	}
+
+	schema := tricks.ApplyOptions(&OutboxSchema{
+		table:       "outbox",
+		placeholder: bricks.QuestionSqlPlaceholder,
+		idGenerator: newOutboxId,
+	}, options...)
+
+	return &Outbox[M]{
+		OutboxSchema: *schema,
+
+		mx: mx,
+	}
+}
+
+// Put envelops the payload, resolves the route of addr and stores them by tx (usually the caller's *sql.Tx) to be
+// relayed later. It returns id of the stored message.
+func (ob *Outbox[M]) Put(ctx context.Context, tx SqlExecer, addr string, payload any) (string, error) {
+	env, err := ob.mx.Envelop(payload)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		id    = ob.idGenerator()
+		route = ob.mx.Router.Resolve(addr)
+	)
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (id, medium, address, payload, attempts, created_at) VALUES (%s, %s, %s, %s, 0, %s)",
+		ob.table, ob.placeholder(1), ob.placeholder(2), ob.placeholder(3), ob.placeholder(4), ob.placeholder(5),
+	), id, route.Medium, route.Address, ob.mx.Frame(env), time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// OutboxPublisher puts the message relayed from the outbox on the wire. The id is the same on redeliveries of the
+// message, so it can be used by brokers and consumers to deduplicate.
+type OutboxPublisher[M any] func(ctx context.Context, id string, msg M) error
+
+// OutboxRelay is a kareless.Driver publishing messages of an Outbox in the order they're put. Batches of messages are
+// leased by short transactions and published outside them, so relays don't hold locks while publishing. A message
+// which fails to be published is skipped, so the ones put after it overtake it, and is relayed again once its lease
+// expires. Messages relayed as many times as OutboxRelayMaxAttempts are left in the table for manual inspection.
+type OutboxRelay[M any] struct {
+	OutboxRelayPolicy
+
+	outbox    *Outbox[M]
+	db        *sql.DB
+	publisher OutboxPublisher[M]
+}
+
+// OutboxRelayPolicy tells OutboxRelay how often and how persistently to relay messages
+type OutboxRelayPolicy struct {
+	interval    time.Duration
+	batchSize   int
+	lease       time.Duration
+	maxAttempts int
+	retry       bricks.RetryPolicy
+	onError     func(ctx context.Context, err error)
+}
+
+type OutboxRelayOpt = tricks.Option[OutboxRelayPolicy]
+
+// OutboxRelayInterval sets the delay of polling the table when there is nothing to relay. It defaults to a second.
+func OutboxRelayInterval(interval time.Duration) OutboxRelayOpt {
+	return tricks.ImmutableOption[OutboxRelayPolicy](func(rp OutboxRelayPolicy) OutboxRelayPolicy {
+		rp.interval = interval
+
+		return rp
+	})
+}
+
+// OutboxRelayBatchSize sets the maximum number of messages leased per batch. It defaults to 100.
+func OutboxRelayBatchSize(size int) OutboxRelayOpt {
+	return tricks.ImmutableOption[OutboxRelayPolicy](func(rp OutboxRelayPolicy) OutboxRelayPolicy {
+		rp.batchSize = size
+
+		return rp
+	})
+}
+
+// OutboxRelayLease sets how long the messages of a batch are leased to the relay. It's the delay of relaying failed
+// messages again, and should outlast publishing a batch, as the messages which aren't published by then are left to
+// the next batches. It defaults to a minute.
+func OutboxRelayLease(lease time.Duration) OutboxRelayOpt {
+	return tricks.ImmutableOption[OutboxRelayPolicy](func(rp OutboxRelayPolicy) OutboxRelayPolicy {
+		rp.lease = lease
+
+		return rp
+	})
+}
+
+// OutboxRelayMaxAttempts sets the number of relays after which a failing message is given up. It defaults to 10.
+// Zero means unlimited.
+func OutboxRelayMaxAttempts(attempts int) OutboxRelayOpt {
+	return tricks.ImmutableOption[OutboxRelayPolicy](func(rp OutboxRelayPolicy) OutboxRelayPolicy {
+		rp.maxAttempts = attempts
+
+		return rp
+	})
+}
+
+// OutboxRelayRetryPolicy sets how each relay retries publishing a message before counting it as a failed attempt.
+// It defaults to 3 attempts with exponential backoff from 100ms to 2s, retrying any error.
+func OutboxRelayRetryPolicy(policy bricks.RetryPolicy) OutboxRelayOpt {
+	return tricks.ImmutableOption[OutboxRelayPolicy](func(rp OutboxRelayPolicy) OutboxRelayPolicy {
+		rp.retry = policy
+
+		return rp
+	})
+}
+
+// OutboxRelayErrorHandler sets the handler of relay failures. Failures don't stop the relay. They're logged by
+// default.
+func OutboxRelayErrorHandler(handler func(ctx context.Context, err error)) OutboxRelayOpt {
+	return tricks.ImmutableOption[OutboxRelayPolicy](func(rp OutboxRelayPolicy) OutboxRelayPolicy {
+		rp.onError = handler
+
+		return rp
+	})
+}
+
+// Relay creates an OutboxRelay picking messages of the outbox from db and publishing them by the publisher
+func (ob *Outbox[M]) Relay(db *sql.DB, publisher OutboxPublisher[M], options ...OutboxRelayOpt) *OutboxRelay[M] {
+	if db == nil || publisher == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty outbox relay database or publisher")))
+	}
+
+	policy := tricks.ApplyOptions(&OutboxRelayPolicy{
+		interval:    time.Second,
+		batchSize:   100,
+		lease:       time.Minute,
+		maxAttempts: 10,
+		retry: bricks.RetryPolicy{
+			Backoff:     bricks.ExponentialBackoff(100*time.Millisecond, 2*time.Second),
+			MaxAttempts: 3,
+			Retryable: func(err error) bool {
+				return true
+			},
+		},
+		onError: func(_ context.Context, err error) {
+			log.Printf("OUTBOX|%s\n", err)
+		},
+	}, options...)
+
+	return &OutboxRelay[M]{
+		OutboxRelayPolicy: *policy,
+
+		outbox:    ob,
+		db:        db,
+		publisher: publisher,
+	}
+}
+
+func (r *OutboxRelay[M]) Run(ctx context.Context) error {
+	for {
+		n, err := r.RelayBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.onError(ctx, err)
+		}
+
+		if err == nil && n >= r.batchSize {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+type outboxRecord struct {
+	id      string
+	route   kareless.Route
+	payload []byte
+}
+
+// RelayBatch leases a batch of the oldest messages and publishes them. It returns the number of published ones along
+// with the failures of the others.
+func (r *OutboxRelay[M]) RelayBatch(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	records, err := r.claim(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, now.Add(r.lease))
+	defer cancel()
+
+	var (
+		ob        = r.outbox
+		published int
+		errs      []error
+	)
+	for _, rec := range records {
+		if err = ctx.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("outbox lease: %w", err))
+
+			break
+		}
+
+		if err = r.publish(ctx, rec); err == nil {
+			_, err = r.db.ExecContext(ctx,
+				fmt.Sprintf("DELETE FROM %s WHERE id = %s", ob.table, ob.placeholder(1)), rec.id,
+			)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("outbox message %s: %w", rec.id, err))
+
+			continue
+		}
+
+		published++
+	}
+
+	return published, errors.Join(errs...)
+}
+
+// claim picks a batch of messages which aren't leased and leases them within a transaction, counting the attempt
+func (r *OutboxRelay[M]) claim(ctx context.Context, now time.Time) ([]outboxRecord, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Join(bricks.ErrUnavailable, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	records, err := r.pick(ctx, tx, now)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+
+	var (
+		ob           = r.outbox
+		placeholders = make([]string, len(records))
+		args         = make([]any, 0, len(records)+1)
+	)
+	args = append(args, now.Add(r.lease))
+	for k, rec := range records {
+		placeholders[k] = ob.placeholder(k + 2)
+		args = append(args, rec.id)
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET attempts = attempts + 1, leased_until = %s WHERE id IN (%s)",
+		ob.table, ob.placeholder(1), strings.Join(placeholders, ", "),
+	), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, tx.Commit()
+}
+
+func (r *OutboxRelay[M]) pick(ctx context.Context, tx *sql.Tx, now time.Time) ([]outboxRecord, error) {
+	ob := r.outbox
+	maxAttempts := r.maxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = math.MaxInt32
+	}
+
+	query := fmt.Sprintf(
+		"SELECT id, medium, address, payload FROM %s WHERE attempts < %s AND (leased_until IS NULL OR leased_until <= %s) "+
+			"ORDER BY created_at, id LIMIT %d",
+		ob.table, ob.placeholder(1), ob.placeholder(2), r.batchSize,
+	)
+	if clause := strings.TrimSpace(ob.lockClause); len(clause) > 0 {
+		query += " " + clause
+	}
+
+	rows, err := tx.QueryContext(ctx, query, maxAttempts, now)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	records := make([]outboxRecord, 0, r.batchSize)
+	for rows.Next() {
+		var rec outboxRecord
+		if err = rows.Scan(&rec.id, &rec.route.Medium, &rec.route.Address, &rec.payload); err != nil {
+			return nil, err
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, rows.Err()
+}
+
+// publish seals the message on its route and publishes it by the publisher, retrying by the retry policy
+func (r *OutboxRelay[M]) publish(ctx context.Context, rec outboxRecord) error {
+	env, err := r.outbox.mx.Unframe(rec.payload)
+	if err != nil {
+		return err
+	}
+
+	msg, err := r.outbox.mx.Seal(rec.route, env)
+	if err != nil {
+		return err
+	}
+
+	return bricks.Retry(ctx, r.retry, func(ctx context.Context) error {
+		return r.publisher(ctx, rec.id, msg)
+	})
+}
+
+// NatsOutboxPublisher publishes messages by nc and waits for the server to receive them. The outbox message id is set
+// as Nats-Msg-Id header to let JetStream streams deduplicate redeliveries.
+func NatsOutboxPublisher(nc *nats.Conn) OutboxPublisher[*nats.Msg] {
+	return func(ctx context.Context, id string, msg *nats.Msg) error {
+		if msg.Header == nil {
+			msg.Header = nats.Header{}
+		}
+		msg.Header.Set(nats.MsgIdHdr, id)
+
+		if err := nc.PublishMsg(msg); err != nil {
+			return err
+		}
+
+		if _, ok := ctx.Deadline(); !ok {
+			return nc.Flush()
+		}
+
+		return nc.FlushWithContext(ctx)
+	}
+}
+
+// NatsOutboxRelayDriverConstructor creates a kareless.DriverConstructor relaying messages of the outbox to nats. The
+// *sql.DB and *nats.Conn are resolved from the kareless.InstrumentBank by the given names.
+func NatsOutboxRelayDriverConstructor(
+	outbox *Outbox[*nats.Msg], dbInstrument, natsInstrument string, options ...OutboxRelayOpt,
+) kareless.DriverConstructor {
+	return func(_ *kareless.Settings, ib *kareless.InstrumentBank, _ []kareless.Application) kareless.Driver {
+		return outbox.Relay(
+			kareless.ResolveInstrumentByType[*sql.DB](ib, dbInstrument),
+			NatsOutboxPublisher(kareless.ResolveInstrumentByType[*nats.Conn](ib, natsInstrument)),
+			options...,
+		)
+	}
+}
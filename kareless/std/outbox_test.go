@@ -0,0 +1,191 @@
+package std_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+
+	"github.com/janstoon/toolbox/kareless"
+	"github.com/janstoon/toolbox/kareless/std"
+)
+
+func openOutboxDb(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "outbox.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE outbox (
+		id VARCHAR(64) PRIMARY KEY,
+		medium INTEGER NOT NULL,
+		address VARCHAR(255) NOT NULL,
+		payload BLOB NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL,
+		leased_until TIMESTAMP
+	)`)
+	require.NoError(t, err)
+
+	return db
+}
+
+type outboxMsg struct {
+	route kareless.Route
+	data  string
+}
+
+func TestOutboxRelay(t *testing.T) {
+	ctx := context.Background()
+	db := openOutboxDb(t)
+
+	outbox := std.NewOutbox(std.NewMuldem[outboxMsg]().WithEncapsulation(
+		kareless.EncapsulatorFunc[outboxMsg](func(route kareless.Route, data []byte) outboxMsg {
+			return outboxMsg{route: route, data: string(data)}
+		}), nil,
+	))
+
+	put := func(commit bool, addr string, payload any) {
+		tx, err := db.BeginTx(ctx, nil)
+		require.NoError(t, err)
+
+		_, err = outbox.Put(ctx, tx, addr, payload)
+		require.NoError(t, err)
+
+		if commit {
+			require.NoError(t, tx.Commit())
+		} else {
+			require.NoError(t, tx.Rollback())
+		}
+	}
+
+	put(true, "orders.created", map[string]int{"id": 1})
+	put(false, "orders.created", map[string]int{"id": 2})
+	put(true, "orders.paid", map[string]int{"id": 1})
+	put(true, "orders.shipped", map[string]int{"id": 1})
+
+	var (
+		published []outboxMsg
+		ids       []string
+		failing   = true
+	)
+	relay := outbox.Relay(db, func(ctx context.Context, id string, msg outboxMsg) error {
+		if failing && msg.route.Address == "orders.paid" {
+			return bricks.ErrUnavailable
+		}
+
+		published = append(published, msg)
+		ids = append(ids, id)
+
+		return nil
+	},
+		std.OutboxRelayRetryPolicy(bricks.RetryPolicy{MaxAttempts: 2}),
+		std.OutboxRelayMaxAttempts(2),
+		std.OutboxRelayLease(200*time.Millisecond),
+	)
+
+	// The failing message is skipped rather than stopping the batch
+	n, err := relay.RelayBatch(ctx)
+	require.ErrorIs(t, err, bricks.ErrUnavailable)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []outboxMsg{
+		{route: kareless.Route{Address: "orders.created"}, data: `{"id":1}`},
+		{route: kareless.Route{Address: "orders.shipped"}, data: `{"id":1}`},
+	}, published)
+
+	var attempts int
+	require.NoError(t, db.QueryRow("SELECT attempts FROM outbox").Scan(&attempts))
+	assert.Equal(t, 1, attempts)
+
+	// and is relayed again once its lease expires
+	failing = false
+	n, err = relay.RelayBatch(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	time.Sleep(200 * time.Millisecond)
+	n, err = relay.RelayBatch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "orders.paid", published[2].route.Address)
+	assert.NotEqual(t, ids[0], ids[2])
+
+	n, err = relay.RelayBatch(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestOutboxRelayGivesUp(t *testing.T) {
+	ctx := context.Background()
+	db := openOutboxDb(t)
+
+	outbox := std.NewOutbox(std.NewMuldem[string]())
+	_, err := outbox.Put(ctx, db, "orders.created", "payload")
+	require.NoError(t, err)
+
+	var errs []error
+	relay := outbox.Relay(db, func(ctx context.Context, id string, msg string) error {
+		return errors.New("broker down")
+	},
+		std.OutboxRelayRetryPolicy(bricks.RetryPolicy{MaxAttempts: 1}),
+		std.OutboxRelayMaxAttempts(2),
+		std.OutboxRelayInterval(time.Millisecond),
+		std.OutboxRelayLease(10*time.Millisecond),
+		std.OutboxRelayErrorHandler(func(ctx context.Context, err error) {
+			errs = append(errs, err)
+		}),
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	require.NoError(t, relay.Run(ctx))
+
+	assert.Len(t, errs, 2)
+
+	var attempts int
+	require.NoError(t, db.QueryRow("SELECT attempts FROM outbox").Scan(&attempts))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestNatsOutboxPublisher(t *testing.T) {
+	nc := runNats(t, false)
+
+	sub, err := nc.SubscribeSync("orders.>")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	db := openOutboxDb(t)
+
+	outbox := std.NewOutbox(std.NewMuldem[*nats.Msg]().WithEncapsulation(
+		kareless.EncapsulatorFunc[*nats.Msg](func(route kareless.Route, data []byte) *nats.Msg {
+			msg := nats.NewMsg(route.Address)
+			msg.Data = data
+
+			return msg
+		}), nil,
+	))
+	id, err := outbox.Put(ctx, db, "orders.created", map[string]int{"id": 1})
+	require.NoError(t, err)
+
+	n, err := outbox.Relay(db, std.NatsOutboxPublisher(nc)).RelayBatch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	msg, err := sub.NextMsg(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "orders.created", msg.Subject)
+	assert.JSONEq(t, `{"id":1}`, string(msg.Data))
+	assert.Equal(t, id, msg.Header.Get(nats.MsgIdHdr))
+}
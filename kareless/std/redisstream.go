@@ -0,0 +1,485 @@
+package std
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/janstoon/toolbox/kareless"
+)
+
+// Fields added to dead-lettered messages of redis streams along with their original fields
+const (
+	RedisStreamDeadLetterStream     = "dead_letter_stream"
+	RedisStreamDeadLetterId         = "dead_letter_id"
+	RedisStreamDeadLetterDeliveries = "dead_letter_deliveries"
+	RedisStreamDeadLetterError      = "dead_letter_error"
+)
+
+// RedisStreamMsg is a message of a redis stream fed to handlers of RedisStreamConsumer
+type RedisStreamMsg struct {
+	redis.XMessage
+
+	Stream     string
+	Deliveries int64 // Number of times the message has been delivered, including this one
+}
+
+// RedisStreamConsumer is a kareless.Driver feeding messages of a redis stream to a handler, e.g. one built by
+// handywares.MsgMiddlewareStack[RedisStreamMsg], as a member of a consumer group. Messages are acknowledged by outcome
+// of the handler:
+//   - XACK on success
+//   - Left pending on bricks.ErrRetryable errors to be reclaimed by XAUTOCLAIM once they're idle for the min idle
+//     time, by this or any other consumer of the group
+//   - Dead-lettered (if a dead-letter stream is set) and acknowledged on other errors
+//
+// Messages delivered more than max deliveries are dead-lettered and acknowledged without being handled. Messages of
+// stuck consumers are reclaimed the same way. Panics of the handler which aren't recovered by the stack are reported
+// to the error handler and taken for bricks.ErrInternal, which is retryable.
+//
+// Once ctx is done it stops reading messages and waits for the in-flight ones to be handled. Handlers aren't
+// canceled by ctx.
+type RedisStreamConsumer struct {
+	RedisStreamConsumerPolicy
+
+	client  redis.Cmdable
+	stream  string
+	group   string
+	handler func(ctx context.Context, msg RedisStreamMsg) error
+}
+
+// RedisStreamConsumerPolicy tells RedisStreamConsumer how to read, reclaim and acknowledge messages
+type RedisStreamConsumerPolicy struct {
+	consumer      string
+	startId       string
+	concurrency   int
+	batchSize     int64
+	block         time.Duration
+	minIdle       time.Duration
+	claimInterval time.Duration
+	maxDeliveries int64
+	deadLetter    string
+	onError       func(ctx context.Context, err error)
+}
+
+type RedisStreamConsumerOpt = tricks.Option[RedisStreamConsumerPolicy]
+
+// RedisStreamConsumerName sets name of the consumer in the group. It defaults to hostname-pid-n, where n tells the
+// consumers of the process apart.
+func RedisStreamConsumerName(name string) RedisStreamConsumerOpt {
+	return tricks.ImmutableOption[RedisStreamConsumerPolicy](
+		func(rcp RedisStreamConsumerPolicy) RedisStreamConsumerPolicy {
+			rcp.consumer = name
+
+			return rcp
+		},
+	)
+}
+
+// RedisStreamStartId sets the id the group starts from if it's created by the consumer. It defaults to "0", i.e. the
+// whole stream. Use "$" to consume the messages added from then on.
+func RedisStreamStartId(id string) RedisStreamConsumerOpt {
+	return tricks.ImmutableOption[RedisStreamConsumerPolicy](
+		func(rcp RedisStreamConsumerPolicy) RedisStreamConsumerPolicy {
+			rcp.startId = id
+
+			return rcp
+		},
+	)
+}
+
+// RedisStreamConcurrency sets the maximum number of messages handled concurrently. It defaults to 1.
+func RedisStreamConcurrency(concurrency int) RedisStreamConsumerOpt {
+	return tricks.ImmutableOption[RedisStreamConsumerPolicy](
+		func(rcp RedisStreamConsumerPolicy) RedisStreamConsumerPolicy {
+			rcp.concurrency = concurrency
+
+			return rcp
+		},
+	)
+}
+
+// RedisStreamBatchSize sets the maximum number of messages read or claimed at once. It defaults to the concurrency.
+func RedisStreamBatchSize(size int64) RedisStreamConsumerOpt {
+	return tricks.ImmutableOption[RedisStreamConsumerPolicy](
+		func(rcp RedisStreamConsumerPolicy) RedisStreamConsumerPolicy {
+			rcp.batchSize = size
+
+			return rcp
+		},
+	)
+}
+
+// RedisStreamBlock sets how long XREADGROUP blocks for new messages. It bounds the shutdown delay as well. It
+// defaults to 2 seconds.
+func RedisStreamBlock(block time.Duration) RedisStreamConsumerOpt {
+	return tricks.ImmutableOption[RedisStreamConsumerPolicy](
+		func(rcp RedisStreamConsumerPolicy) RedisStreamConsumerPolicy {
+			rcp.block = block
+
+			return rcp
+		},
+	)
+}
+
+// RedisStreamClaim sets how long messages stay pending before being reclaimed, which is the retry delay of failed
+// messages too, and how often they're reclaimed. They default to a minute and 10 seconds.
+func RedisStreamClaim(minIdle, interval time.Duration) RedisStreamConsumerOpt {
+	return tricks.ImmutableOption[RedisStreamConsumerPolicy](
+		func(rcp RedisStreamConsumerPolicy) RedisStreamConsumerPolicy {
+			rcp.minIdle = minIdle
+			rcp.claimInterval = interval
+
+			return rcp
+		},
+	)
+}
+
+// RedisStreamMaxDeliveries sets how many times a message is delivered before being dead-lettered. It defaults to 5.
+func RedisStreamMaxDeliveries(deliveries int64) RedisStreamConsumerOpt {
+	return tricks.ImmutableOption[RedisStreamConsumerPolicy](
+		func(rcp RedisStreamConsumerPolicy) RedisStreamConsumerPolicy {
+			rcp.maxDeliveries = deliveries
+
+			return rcp
+		},
+	)
+}
+
+// RedisStreamDeadLetter sets the stream terminally failed messages are added to. They're dropped if it's empty, which
+// is the default.
+func RedisStreamDeadLetter(stream string) RedisStreamConsumerOpt {
+	return tricks.ImmutableOption[RedisStreamConsumerPolicy](
+		func(rcp RedisStreamConsumerPolicy) RedisStreamConsumerPolicy {
+			rcp.deadLetter = stream
+
+			return rcp
+		},
+	)
+}
+
+// RedisStreamErrorHandler sets the handler of failures of reading, acknowledging and dead-lettering messages.
+// Failures don't stop the consumer. They're logged by default.
+func RedisStreamErrorHandler(handler func(ctx context.Context, err error)) RedisStreamConsumerOpt {
+	return tricks.ImmutableOption[RedisStreamConsumerPolicy](
+		func(rcp RedisStreamConsumerPolicy) RedisStreamConsumerPolicy {
+			rcp.onError = handler
+
+			return rcp
+		},
+	)
+}
+
+// redisStreamConsumers counts consumers created in the process to tell their default names apart
+var redisStreamConsumers atomic.Int64
+
+// NewRedisStreamConsumer creates a RedisStreamConsumer of the consumer group of the stream. The group is created if
+// it doesn't exist.
+func NewRedisStreamConsumer(
+	client redis.Cmdable, stream, group string, handler func(ctx context.Context, msg RedisStreamMsg) error,
+	options ...RedisStreamConsumerOpt,
+) *RedisStreamConsumer {
+	if client == nil || handler == nil || len(stream) == 0 || len(group) == 0 {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("empty redis client, stream, group or handler")))
+	}
+
+	hostname, _ := os.Hostname()
+	policy := tricks.ApplyOptions(&RedisStreamConsumerPolicy{
+		consumer:      fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), redisStreamConsumers.Add(1)),
+		startId:       "0",
+		concurrency:   1,
+		block:         2 * time.Second,
+		minIdle:       time.Minute,
+		claimInterval: 10 * time.Second,
+		maxDeliveries: 5,
+		onError: func(_ context.Context, err error) {
+			log.Printf("REDISSTREAM|%s\n", err)
+		},
+	}, options...)
+	policy.concurrency = max(policy.concurrency, 1)
+	if policy.batchSize <= 0 {
+		policy.batchSize = int64(policy.concurrency)
+	}
+
+	return &RedisStreamConsumer{
+		RedisStreamConsumerPolicy: *policy,
+
+		client:  client,
+		stream:  stream,
+		group:   group,
+		handler: handler,
+	}
+}
+
+// RedisStreamDriverConstructor creates a kareless.DriverConstructor running a RedisStreamConsumer. The
+// redis.UniversalClient is resolved from the kareless.InstrumentBank by name and the handler is built out of the
+// applications.
+func RedisStreamDriverConstructor(
+	redisInstrument, stream, group string,
+	handler func(apps []kareless.Application) func(ctx context.Context, msg RedisStreamMsg) error,
+	options ...RedisStreamConsumerOpt,
+) kareless.DriverConstructor {
+	return func(_ *kareless.Settings, ib *kareless.InstrumentBank, apps []kareless.Application) kareless.Driver {
+		return NewRedisStreamConsumer(
+			kareless.ResolveInstrumentByType[redis.UniversalClient](ib, redisInstrument), stream, group, handler(apps),
+			options...,
+		)
+	}
+}
+
+func (c *RedisStreamConsumer) Run(ctx context.Context) error {
+	err := c.client.XGroupCreateMkStream(ctx, c.stream, c.group, c.startId).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	d := &redisStreamDispatcher{
+		consumer: c,
+		ctx:      context.WithoutCancel(ctx),
+		slots:    make(chan struct{}, c.concurrency),
+	}
+	defer d.wg.Wait()
+
+	var claimed time.Time
+	for ctx.Err() == nil {
+		if time.Since(claimed) >= c.claimInterval {
+			c.claim(ctx, d)
+			claimed = time.Now()
+		}
+
+		streams, err := c.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.group,
+			Consumer: c.consumer,
+			Streams:  []string{c.stream, ">"},
+			Count:    c.batchSize,
+			Block:    min(c.block, c.claimInterval),
+		}).Result()
+		switch {
+		case err == nil:
+			for _, stream := range streams {
+				for _, xm := range stream.Messages {
+					d.dispatch(RedisStreamMsg{XMessage: xm, Stream: c.stream, Deliveries: 1})
+				}
+			}
+
+		case errors.Is(err, redis.Nil), ctx.Err() != nil:
+
+		case errors.Is(err, redis.ErrClosed):
+			return err
+
+		default:
+			c.onError(ctx, err)
+			c.wait(ctx)
+		}
+	}
+
+	return nil
+}
+
+// wait backs off for the block time after a failed read unless ctx is done meanwhile
+func (c *RedisStreamConsumer) wait(ctx context.Context) {
+	timer := time.NewTimer(c.block)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// claim takes over messages pending for longer than min idle time, i.e. failed by retryable errors or left by stuck
+// consumers, and dispatches or dead-letters them according to their deliveries.
+func (c *RedisStreamConsumer) claim(ctx context.Context, d *redisStreamDispatcher) {
+	start := "0-0"
+	for ctx.Err() == nil {
+		xms, next, err := c.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   c.stream,
+			Group:    c.group,
+			Consumer: c.consumer,
+			MinIdle:  c.minIdle,
+			Start:    start,
+			Count:    c.batchSize,
+		}).Result()
+		if err != nil {
+			c.onError(ctx, err)
+
+			return
+		}
+
+		if len(xms) > 0 {
+			deliveries, err := c.deliveries(ctx, xms)
+			if err != nil {
+				c.onError(ctx, err)
+
+				return
+			}
+
+			for _, xm := range xms {
+				count, ok := deliveries[xm.ID]
+				if !ok {
+					continue // Acknowledged meanwhile
+				}
+
+				msg := RedisStreamMsg{XMessage: xm, Stream: c.stream, Deliveries: count}
+				if msg.Deliveries > c.maxDeliveries {
+					c.terminate(d.ctx, msg, fmt.Errorf("delivered %d times", msg.Deliveries-1))
+
+					continue
+				}
+
+				d.dispatch(msg)
+			}
+		}
+
+		if next == "0-0" || len(xms) == 0 {
+			return
+		}
+
+		start = next
+	}
+}
+
+// deliveries returns delivery counts of the messages pending for the consumer by their ids. Each message is looked up
+// by its own id, since others in range of them may be in-flight.
+func (c *RedisStreamConsumer) deliveries(ctx context.Context, xms []redis.XMessage) (map[string]int64, error) {
+	cmds := make([]*redis.XPendingExtCmd, len(xms))
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for k, xm := range xms {
+			cmds[k] = pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream:   c.stream,
+				Group:    c.group,
+				Start:    xm.ID,
+				End:      xm.ID,
+				Count:    1,
+				Consumer: c.consumer,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make(map[string]int64, len(xms))
+	for _, cmd := range cmds {
+		for _, p := range cmd.Val() {
+			deliveries[p.ID] = p.RetryCount
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (c *RedisStreamConsumer) acknowledge(ctx context.Context, msg RedisStreamMsg, err error) {
+	switch {
+	case err == nil:
+		if err = c.client.XAck(ctx, c.stream, c.group, msg.ID).Err(); err != nil {
+			c.onError(ctx, err)
+		}
+
+	case !errors.Is(err, bricks.ErrRetryable), msg.Deliveries >= c.maxDeliveries:
+		c.terminate(ctx, msg, err)
+
+	default:
+		// Left pending to be reclaimed
+	}
+}
+
+// terminate dead-letters the message failed by err and acknowledges it. The message is left pending if dead-lettering
+// fails.
+func (c *RedisStreamConsumer) terminate(ctx context.Context, msg RedisStreamMsg, err error) {
+	if len(c.deadLetter) > 0 {
+		values := make(map[string]any, len(msg.Values)+4)
+		for k, v := range msg.Values {
+			values[k] = v
+		}
+		values[RedisStreamDeadLetterStream] = msg.Stream
+		values[RedisStreamDeadLetterId] = msg.ID
+		values[RedisStreamDeadLetterDeliveries] = msg.Deliveries
+		values[RedisStreamDeadLetterError] = err.Error()
+
+		_, aerr := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.XAdd(ctx, &redis.XAddArgs{Stream: c.deadLetter, Values: values})
+			pipe.XAck(ctx, c.stream, c.group, msg.ID)
+
+			return nil
+		})
+		if aerr != nil {
+			c.onError(ctx, aerr)
+		}
+
+		return
+	}
+
+	c.onError(ctx, fmt.Errorf("dropping %s/%s: %w", msg.Stream, msg.ID, err))
+	if aerr := c.client.XAck(ctx, c.stream, c.group, msg.ID).Err(); aerr != nil {
+		c.onError(ctx, aerr)
+	}
+}
+
+type redisStreamDispatcher struct {
+	consumer *RedisStreamConsumer
+	ctx      context.Context
+	slots    chan struct{}
+	wg       sync.WaitGroup
+}
+
+// dispatch handles msg once there is a free slot
+func (d *redisStreamDispatcher) dispatch(msg RedisStreamMsg) {
+	d.slots <- struct{}{}
+	d.wg.Add(1)
+
+	go func() {
+		defer func() {
+			<-d.slots
+			d.wg.Done()
+		}()
+
+		d.consumer.acknowledge(d.ctx, msg, d.consumer.handle(d.ctx, msg))
+	}()
+}
+
+// handle runs the handler and converts its panic to an error of bricks.ErrInternal, so the message is still
+// acknowledged and the process survives
+func (c *RedisStreamConsumer) handle(ctx context.Context, msg RedisStreamMsg) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Join(bricks.ErrInternal, fmt.Errorf("%s: panic recovered: %+v\n%s", msg.ID, r, debug.Stack()))
+			c.onError(ctx, err)
+		}
+	}()
+
+	return c.handler(ctx, msg)
+}
+
+// RedisStreamConsume returns a function running a RedisStreamConsumer of the consumer group of the stream, by the
+// client and the options, until ctx is done. It's for drivers and adapters which aren't aware of kareless, e.g.
+// handywares.RedisStreamPubSub, so the handler is fed by the raw message and its deliveries.
+func RedisStreamConsume(client redis.Cmdable, options ...RedisStreamConsumerOpt) func(
+	ctx context.Context, stream, group string,
+	handler func(ctx context.Context, xm redis.XMessage, deliveries int64) error,
+) error {
+	return func(
+		ctx context.Context, stream, group string,
+		handler func(ctx context.Context, xm redis.XMessage, deliveries int64) error,
+	) error {
+		if handler == nil {
+			return errors.Join(bricks.ErrInvalidArgument, errors.New("empty handler"))
+		}
+
+		return NewRedisStreamConsumer(client, stream, group, func(ctx context.Context, msg RedisStreamMsg) error {
+			return handler(ctx, msg.XMessage, msg.Deliveries)
+		}, options...).Run(ctx)
+	}
+}
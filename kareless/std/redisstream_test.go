@@ -0,0 +1,323 @@
+package std_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/kareless/std"
+)
+
+func TestRedisStreamConsumer(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() {
+		_ = client.Close()
+	}()
+
+	ctx := context.Background()
+	for _, payload := range []string{"ok", "retry", "fatal", "stuck"} {
+		require.NoError(t, client.XAdd(ctx, &redis.XAddArgs{
+			Stream: "orders", Values: map[string]any{"payload": payload},
+		}).Err())
+	}
+
+	// A stuck consumer of the group which never acknowledges what it reads
+	require.NoError(t, client.XGroupCreateMkStream(ctx, "orders", "workers", "0").Err())
+	require.NoError(t, client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "workers", Consumer: "stuck", Streams: []string{"orders", ">"}, Count: 1,
+	}).Err())
+
+	var (
+		l          sync.Mutex
+		deliveries = make(map[string][]int64)
+	)
+	consumer := std.NewRedisStreamConsumer(client, "orders", "workers",
+		func(ctx context.Context, msg std.RedisStreamMsg) error {
+			payload := msg.Values["payload"].(string)
+
+			l.Lock()
+			deliveries[payload] = append(deliveries[payload], msg.Deliveries)
+			l.Unlock()
+
+			switch payload {
+			case "retry":
+				if msg.Deliveries == 1 {
+					return errors.Join(bricks.ErrUnavailable, bricks.ErrRetryable)
+				}
+
+			case "fatal":
+				return bricks.ErrInvalidArgument
+
+			case "stuck":
+				return bricks.ErrUnavailable
+			}
+
+			return nil
+		},
+		std.RedisStreamConsumerName("worker-1"),
+		std.RedisStreamConcurrency(2),
+		std.RedisStreamBlock(20*time.Millisecond),
+		std.RedisStreamClaim(50*time.Millisecond, 20*time.Millisecond),
+		std.RedisStreamMaxDeliveries(3),
+		std.RedisStreamDeadLetter("orders.dlq"),
+		std.RedisStreamErrorHandler(func(ctx context.Context, err error) {}),
+	)
+
+	rctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan error)
+	go func() {
+		stopped <- consumer.Run(rctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		pending, err := client.XPending(ctx, "orders", "workers").Result()
+
+		return err == nil && pending.Count == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-stopped)
+
+	assert.Equal(t, map[string][]int64{
+		"ok":    {2}, // claimed from the stuck consumer
+		"retry": {1, 2},
+		"fatal": {1},
+		"stuck": {1, 2, 3},
+	}, deliveries)
+
+	letters, err := client.XRange(ctx, "orders.dlq", "-", "+").Result()
+	require.NoError(t, err)
+	require.Len(t, letters, 2)
+	assert.Equal(t, "fatal", letters[0].Values["payload"])
+	assert.Equal(t, "orders", letters[0].Values[std.RedisStreamDeadLetterStream])
+	assert.Equal(t, bricks.ErrInvalidArgument.Error(), letters[0].Values[std.RedisStreamDeadLetterError])
+	assert.Equal(t, "stuck", letters[1].Values["payload"])
+	assert.Equal(t, "3", letters[1].Values[std.RedisStreamDeadLetterDeliveries])
+}
+
+func TestRedisStreamConsumerDeliveries(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() {
+		_ = client.Close()
+	}()
+
+	ctx := context.Background()
+	for _, payload := range []string{"a", "b", "c"} {
+		require.NoError(t, client.XAdd(ctx, &redis.XAddArgs{
+			Stream: "orders", Values: map[string]any{"payload": payload},
+		}).Err())
+	}
+
+	// a and c are left by a stuck consumer while b, in range of them, is in-flight by the consumer
+	require.NoError(t, client.XGroupCreateMkStream(ctx, "orders", "workers", "0").Err())
+	now := time.Now()
+	for k, consumer := range []string{"stuck", "worker-1", "stuck"} {
+		if k == 1 {
+			mr.SetTime(now.Add(time.Minute))
+		} else {
+			mr.SetTime(now)
+		}
+
+		require.NoError(t, client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "workers", Consumer: consumer, Streams: []string{"orders", ">"}, Count: 1,
+		}).Err())
+	}
+	mr.SetTime(now.Add(time.Minute + time.Second))
+
+	var (
+		l          sync.Mutex
+		deliveries = make(map[string]int64)
+	)
+	consumer := std.NewRedisStreamConsumer(client, "orders", "workers",
+		func(ctx context.Context, msg std.RedisStreamMsg) error {
+			l.Lock()
+			defer l.Unlock()
+
+			deliveries[msg.Values["payload"].(string)] = msg.Deliveries
+
+			return nil
+		},
+		std.RedisStreamConsumerName("worker-1"),
+		std.RedisStreamBlock(20*time.Millisecond),
+		std.RedisStreamBatchSize(10),
+		std.RedisStreamClaim(time.Minute, time.Minute),
+		std.RedisStreamErrorHandler(func(ctx context.Context, err error) {}),
+	)
+
+	rctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan error)
+	go func() {
+		stopped <- consumer.Run(rctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		l.Lock()
+		defer l.Unlock()
+
+		return len(deliveries) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-stopped)
+
+	assert.Equal(t, map[string]int64{"a": 2, "c": 2}, deliveries)
+}
+
+func TestRedisStreamConsumerDefaults(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() {
+		_ = client.Close()
+	}()
+
+	ctx := context.Background()
+	publish := func(payloads ...string) {
+		for _, payload := range payloads {
+			require.NoError(t, client.XAdd(ctx, &redis.XAddArgs{
+				Stream: "orders", Values: map[string]any{"payload": payload},
+			}).Err())
+		}
+	}
+
+	var (
+		failures = make(chan error, 10)
+		held     = make(chan struct{}, 2)
+		release  = make(chan struct{})
+		stopped  = make(chan error, 2)
+	)
+	rctx, cancel := context.WithCancel(ctx)
+	run := func() {
+		consumer := std.NewRedisStreamConsumer(client, "orders", "workers",
+			func(ctx context.Context, msg std.RedisStreamMsg) error {
+				if msg.Values["payload"] == "panic" {
+					panic("boom")
+				}
+
+				held <- struct{}{}
+				<-release
+
+				return nil
+			},
+			std.RedisStreamClaim(time.Hour, 20*time.Millisecond),
+			std.RedisStreamBlock(time.Hour),
+			std.RedisStreamErrorHandler(func(ctx context.Context, err error) {
+				failures <- err
+			}),
+		)
+		go func() {
+			stopped <- consumer.Run(rctx)
+		}()
+	}
+	hold := func() {
+		t.Helper()
+
+		select {
+		case <-held:
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not handled in time")
+		}
+	}
+
+	// Consumers of a process get distinct names by default, so the second one gets a message while the first one is
+	// busy. A consumer reads one message ahead of its free slots, which leaves one of the others.
+	run()
+	publish("a", "b")
+	hold()
+	run()
+	publish("c")
+	hold()
+
+	consumers, err := client.XInfoConsumers(ctx, "orders", "workers").Result()
+	require.NoError(t, err)
+	assert.Len(t, consumers, 2)
+	close(release)
+
+	// Panics are taken for retryable errors, so the message is left pending
+	publish("panic")
+	require.ErrorIs(t, <-failures, bricks.ErrInternal)
+	require.Eventually(t, func() bool {
+		pending, err := client.XPending(ctx, "orders", "workers").Result()
+
+		return err == nil && pending.Count == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Reads fail once redis is gone and the consumers back off for the block time, but not beyond ctx
+	mr.Close()
+	require.Eventually(t, func() bool {
+		return len(failures) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	for range 2 {
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("consumer not stopped in time")
+		}
+	}
+}
+
+func TestRedisStreamConsume(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() {
+		_ = client.Close()
+	}()
+
+	consume := std.RedisStreamConsume(client,
+		std.RedisStreamBlock(20*time.Millisecond),
+		std.RedisStreamClaim(50*time.Millisecond, 20*time.Millisecond),
+		std.RedisStreamErrorHandler(func(ctx context.Context, err error) {}),
+	)
+
+	ctx := context.Background()
+	for _, v := range []string{"retry", "ok"} {
+		require.NoError(t, client.XAdd(ctx, &redis.XAddArgs{Stream: "orders", Values: []any{"v", v}}).Err())
+	}
+
+	require.ErrorIs(t, consume(ctx, "orders", "workers", nil), bricks.ErrInvalidArgument)
+
+	var (
+		l          sync.Mutex
+		deliveries = make(map[string][]int64)
+	)
+	sctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan error)
+	go func() {
+		stopped <- consume(sctx, "orders", "workers", func(ctx context.Context, xm redis.XMessage, n int64) error {
+			l.Lock()
+			defer l.Unlock()
+
+			v := xm.Values["v"].(string)
+			deliveries[v] = append(deliveries[v], n)
+			if v == "retry" && n == 1 {
+				return errors.Join(bricks.ErrUnavailable, bricks.ErrRetryable)
+			}
+
+			return nil
+		})
+	}()
+
+	require.Eventually(t, func() bool {
+		pending, err := client.XPending(ctx, "orders", "workers").Result()
+
+		l.Lock()
+		defer l.Unlock()
+
+		return err == nil && pending.Count == 0 && len(deliveries["retry"]) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-stopped)
+
+	assert.Equal(t, map[string][]int64{"retry": {1, 2}, "ok": {1}}, deliveries)
+}
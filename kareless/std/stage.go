@@ -0,0 +1,310 @@
+package std
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/janstoon/toolbox/tricks"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/janstoon/toolbox/kareless"
+)
+
+// Headers recorded in envelopes by the stages
+const (
+	ContentEncodingHeader = "Content-Encoding"
+	EncryptionHeader      = "Encryption"
+	EncryptionKeyIdHeader = "Encryption-Key-Id"
+	EncryptionAadHeader   = "Encryption-Authenticated-Headers"
+)
+
+// CompressionPolicy tells compression stages how to decompress payloads
+type CompressionPolicy struct {
+	maxSize int64
+}
+
+type CompressionOpt = tricks.Option[CompressionPolicy]
+
+// CompressionMaxSize sets the maximum size of decompressed payloads. Payloads decompressed to more than it (e.g.
+// compression bombs) are rejected. It defaults to 16MiB.
+func CompressionMaxSize(size int64) CompressionOpt {
+	return tricks.ImmutableOption[CompressionPolicy](func(cp CompressionPolicy) CompressionPolicy {
+		cp.maxSize = size
+
+		return cp
+	})
+}
+
+func newCompressionPolicy(options ...CompressionOpt) *CompressionPolicy {
+	cp := tricks.ApplyOptions(&CompressionPolicy{
+		maxSize: 16 << 20,
+	}, options...)
+	if cp.maxSize <= 0 {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("non-positive max decompressed size")))
+	}
+
+	return cp
+}
+
+type compressionStage struct {
+	encoding   string
+	compress   func(data []byte) ([]byte, error)
+	decompress func(data []byte) ([]byte, error)
+}
+
+// Pack compresses the payload and records the encoding in Content-Encoding header. Payloads encoded already (e.g. by
+// a preceding compression stage) are left as they are, so consumers can stack stages of all the encodings they accept.
+func (cs compressionStage) Pack(env kareless.Envelope) (kareless.Envelope, error) {
+	if _, ok := env.Headers[ContentEncodingHeader]; ok {
+		return env, nil
+	}
+
+	data, err := cs.compress(env.Payload)
+	if err != nil {
+		return env, errors.Join(bricks.ErrInternal, err)
+	}
+
+	env.Payload = data
+	env.Headers = withHeader(env.Headers, ContentEncodingHeader, cs.encoding)
+
+	return env, nil
+}
+
+// Unpack decompresses payload of envelopes encoded by the stage and leaves the others as they are, so producers can
+// adopt it gradually.
+func (cs compressionStage) Unpack(env kareless.Envelope) (kareless.Envelope, error) {
+	if env.Headers[ContentEncodingHeader] != cs.encoding {
+		return env, nil
+	}
+
+	data, err := cs.decompress(env.Payload)
+	if err != nil {
+		return env, errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	env.Payload = data
+	env.Headers = withoutHeader(env.Headers, ContentEncodingHeader)
+
+	return env, nil
+}
+
+// GzipStage compresses payloads by gzip at the level (e.g. gzip.DefaultCompression)
+func GzipStage(level int, options ...CompressionOpt) kareless.Stage {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, err))
+	}
+
+	policy := newCompressionPolicy(options...)
+
+	return compressionStage{
+		encoding: "gzip",
+		compress: func(data []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			zw, _ := gzip.NewWriterLevel(&buf, level)
+			if _, err := zw.Write(data); err != nil {
+				return nil, err
+			}
+
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+
+			return buf.Bytes(), nil
+		},
+		decompress: func(data []byte) ([]byte, error) {
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+
+			data, err = io.ReadAll(io.LimitReader(zr, policy.maxSize+1))
+			if err != nil {
+				return nil, err
+			}
+
+			if int64(len(data)) > policy.maxSize {
+				return nil, fmt.Errorf("decompressed payload exceeds %d bytes", policy.maxSize)
+			}
+
+			return data, nil
+		},
+	}
+}
+
+// ZstdStage compresses payloads by zstd at the level
+func ZstdStage(level zstd.EncoderLevel, options ...CompressionOpt) kareless.Stage {
+	policy := newCompressionPolicy(options...)
+
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, err))
+	}
+
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(policy.maxSize)))
+	if err != nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, err))
+	}
+
+	return compressionStage{
+		encoding: "zstd",
+		compress: func(data []byte) ([]byte, error) {
+			return enc.EncodeAll(data, nil), nil
+		},
+		decompress: func(data []byte) ([]byte, error) {
+			return dec.DecodeAll(data, nil)
+		},
+	}
+}
+
+type aesGcmStage struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// AesGcmStage encrypts payloads by AES-GCM with the current key and records its id in Encryption-Key-Id header.
+// Payloads are decrypted by the key of their id, so keys can be rotated by adding the new one as the current key and
+// dropping the old one once messages encrypted by it are consumed. Keys are 16, 24 or 32 bytes long.
+func AesGcmStage(current string, keys map[string][]byte) kareless.Stage {
+	if _, ok := keys[current]; !ok {
+		panic(errors.Join(bricks.ErrInvalidArgument, fmt.Errorf("current key `%s` is missing", current)))
+	}
+
+	stage := aesGcmStage{
+		current: current,
+		aeads:   make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			panic(errors.Join(bricks.ErrInvalidArgument, fmt.Errorf("key `%s`: %w", id, err)))
+		}
+
+		if stage.aeads[id], err = cipher.NewGCM(block); err != nil {
+			panic(errors.Join(bricks.ErrInvalidArgument, fmt.Errorf("key `%s`: %w", id, err)))
+		}
+	}
+
+	return stage
+}
+
+// Pack encrypts the payload and prepends the nonce to it. The key id, schema, content type and headers of the envelope
+// are authenticated along with the payload, and names of the headers are recorded in Encryption-Authenticated-Headers
+// header. Headers added afterwards (e.g. by transports) aren't authenticated.
+func (as aesGcmStage) Pack(env kareless.Envelope) (kareless.Envelope, error) {
+	aead := as.aeads[as.current]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(env.Payload)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return env, errors.Join(bricks.ErrInternal, err)
+	}
+
+	names := make([]string, 0, len(env.Headers))
+	for k := range env.Headers {
+		names = append(names, textproto.CanonicalMIMEHeaderKey(k))
+	}
+	slices.Sort(names)
+
+	env.Headers = withHeader(env.Headers, EncryptionHeader, "aes-gcm")
+	env.Headers[EncryptionKeyIdHeader] = as.current
+	env.Headers[EncryptionAadHeader] = strings.Join(names, ",")
+	env.Payload = aead.Seal(nonce, nonce, env.Payload, aesGcmAad(env))
+
+	return env, nil
+}
+
+// Unpack decrypts the payload. Unencrypted payloads are rejected.
+func (as aesGcmStage) Unpack(env kareless.Envelope) (kareless.Envelope, error) {
+	if env.Headers[EncryptionHeader] != "aes-gcm" {
+		return env, errors.Join(bricks.ErrInvalidArgument, errors.New("payload is not encrypted by aes-gcm"))
+	}
+
+	id := env.Headers[EncryptionKeyIdHeader]
+	aead, ok := as.aeads[id]
+	if !ok {
+		return env, errors.Join(bricks.ErrFailedPrecondition, fmt.Errorf("unknown encryption key `%s`", id))
+	}
+
+	if len(env.Payload) < aead.NonceSize() {
+		return env, errors.Join(bricks.ErrInvalidArgument, errors.New("encrypted payload is too short"))
+	}
+
+	nonce, sealed := env.Payload[:aead.NonceSize()], env.Payload[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, sealed, aesGcmAad(env))
+	if err != nil {
+		return env, errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	env.Payload = data
+	env.Headers = withoutHeader(env.Headers, EncryptionHeader, EncryptionKeyIdHeader, EncryptionAadHeader)
+
+	return env, nil
+}
+
+// aesGcmAad returns the additional data authenticated along with payload of the envelope, i.e. its key id, schema,
+// content type and the headers named in Encryption-Authenticated-Headers header. Names of headers are matched
+// case-insensitively, since transports (e.g. http) may canonicalize them.
+func aesGcmAad(env kareless.Envelope) []byte {
+	headers := make(map[string]string, len(env.Headers))
+	for k, v := range env.Headers {
+		headers[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+
+	authenticated := make(map[string]*string)
+	if names := headers[EncryptionAadHeader]; len(names) > 0 {
+		for _, name := range strings.Split(names, ",") {
+			if v, ok := headers[name]; ok {
+				authenticated[name] = &v
+			} else {
+				authenticated[name] = nil // Missing headers fail authentication unlike the empty ones
+			}
+		}
+	}
+
+	bb, _ := json.Marshal(struct {
+		KeyId       string             `json:"key_id"`
+		Schema      kareless.Schema    `json:"schema"`
+		ContentType string             `json:"content_type"`
+		Headers     map[string]*string `json:"headers"`
+	}{
+		KeyId:       headers[EncryptionKeyIdHeader],
+		Schema:      env.Schema,
+		ContentType: env.ContentType,
+		Headers:     authenticated,
+	})
+
+	return bb
+}
+
+// withHeader returns a copy of the headers with the header set, leaving the original intact
+func withHeader(headers map[string]string, key, value string) map[string]string {
+	headers = maps.Clone(headers)
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+
+	headers[key] = value
+
+	return headers
+}
+
+// withoutHeader returns a copy of the headers without the keys, leaving the original intact
+func withoutHeader(headers map[string]string, keys ...string) map[string]string {
+	headers = maps.Clone(headers)
+	for _, key := range keys {
+		delete(headers, key)
+	}
+
+	return headers
+}
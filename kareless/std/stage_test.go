@@ -0,0 +1,115 @@
+package std_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/kareless"
+	"github.com/janstoon/toolbox/kareless/std"
+)
+
+func TestMuldemStages(t *testing.T) {
+	var (
+		k1    = bytes.Repeat([]byte{1}, 32)
+		k2    = bytes.Repeat([]byte{2}, 16)
+		order = wireOrder{Id: 1, Title: string(bytes.Repeat([]byte("book "), 100))}
+	)
+
+	oldProducer := newBytesMuldem(std.JsonContentType).WithStages(
+		std.GzipStage(gzip.BestCompression), std.AesGcmStage("k1", map[string][]byte{"k1": k1}),
+	)
+	// The consumer has rotated to k2 and keeps k1 to decrypt messages of old producers
+	consumer := newBytesMuldem(std.JsonContentType).WithStages(
+		std.ZstdStage(zstd.SpeedDefault), std.GzipStage(gzip.DefaultCompression),
+		std.AesGcmStage("k2", map[string][]byte{"k1": k1, "k2": k2}),
+	)
+
+	for name, producer := range map[string]kareless.Muldem[[]byte]{"old": oldProducer, "rotated": consumer} {
+		t.Run(name, func(t *testing.T) {
+			msg, err := producer.Encapsulate("orders", order)
+			require.NoError(t, err)
+
+			env, err := kareless.ParseEnvelope(msg)
+			require.NoError(t, err)
+			assert.Less(t, len(env.Payload), len(order.Title))
+			assert.NotContains(t, string(env.Payload), "book")
+
+			var decoded wireOrder
+			require.NoError(t, consumer.Decapsulate(msg, &decoded))
+			assert.Equal(t, order, decoded)
+		})
+	}
+
+	msg, err := consumer.Encapsulate("orders", order)
+	require.NoError(t, err)
+	env, err := kareless.ParseEnvelope(msg)
+	require.NoError(t, err)
+	assert.Equal(t, "k2", env.Headers[std.EncryptionKeyIdHeader])
+	assert.Equal(t, "zstd", env.Headers[std.ContentEncodingHeader])
+
+	// Old producers don't know k2
+	var decoded wireOrder
+	require.ErrorIs(t, oldProducer.Decapsulate(msg, &decoded), bricks.ErrFailedPrecondition)
+
+	// Tampering with the key id fails authentication
+	env.Headers[std.EncryptionKeyIdHeader] = "k1"
+	require.ErrorIs(t, consumer.Decapsulate(kareless.EnvelopeBytes(env), &decoded), bricks.ErrInvalidArgument)
+
+	// So does tampering with the schema, content type or the other headers
+	for name, tamper := range map[string]func(env *kareless.Envelope){
+		"schema":       func(env *kareless.Envelope) { env.Version++ },
+		"content type": func(env *kareless.Envelope) { env.ContentType = "application/cbor" },
+		"header":       func(env *kareless.Envelope) { delete(env.Headers, std.ContentEncodingHeader) },
+		"header names": func(env *kareless.Envelope) { env.Headers[std.EncryptionAadHeader] = "" },
+	} {
+		env, err := kareless.ParseEnvelope(msg)
+		require.NoError(t, err)
+		tamper(&env)
+
+		err = consumer.Decapsulate(kareless.EnvelopeBytes(env), &decoded)
+		require.ErrorIs(t, err, bricks.ErrInvalidArgument, name)
+		require.ErrorContains(t, err, "authentication failed", name)
+	}
+
+	// Headers added afterwards (e.g. by transports) aren't authenticated
+	env, err = kareless.ParseEnvelope(msg)
+	require.NoError(t, err)
+	env.Headers["User-Agent"] = "test"
+	require.NoError(t, consumer.Decapsulate(kareless.EnvelopeBytes(env), &decoded))
+
+	// Unencrypted payloads are rejected
+	plain, err := newBytesMuldem(std.JsonContentType).Encapsulate("orders", order)
+	require.NoError(t, err)
+	require.ErrorIs(t, consumer.Decapsulate(plain, &decoded), bricks.ErrInvalidArgument)
+}
+
+func TestCompressionStageMaxSize(t *testing.T) {
+	order := wireOrder{Id: 1, Title: string(bytes.Repeat([]byte("book "), 1000))}
+
+	for name, stages := range map[string][2]kareless.Stage{
+		"gzip": {std.GzipStage(gzip.BestCompression), std.GzipStage(gzip.BestCompression, std.CompressionMaxSize(1024))},
+		"zstd": {std.ZstdStage(zstd.SpeedDefault), std.ZstdStage(zstd.SpeedDefault, std.CompressionMaxSize(1024))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			msg, err := newBytesMuldem(std.JsonContentType).WithStages(stages[0]).Encapsulate("orders", order)
+			require.NoError(t, err)
+
+			var decoded wireOrder
+			require.NoError(t, newBytesMuldem(std.JsonContentType).WithStages(stages[0]).Decapsulate(msg, &decoded))
+			assert.Equal(t, order, decoded)
+
+			limited := newBytesMuldem(std.JsonContentType).WithStages(stages[1])
+			require.ErrorIs(t, limited.Decapsulate(msg, &decoded), bricks.ErrInvalidArgument)
+		})
+	}
+
+	assert.Panics(t, func() {
+		std.GzipStage(gzip.DefaultCompression, std.CompressionMaxSize(0))
+	})
+}
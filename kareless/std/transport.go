@@ -0,0 +1,268 @@
+package std
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/hibiken/asynq"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats.go"
+
+	"github.com/janstoon/toolbox/kareless"
+)
+
+// Headers carrying envelope metadata by the transports which have headers
+const (
+	ContentTypeHeader   = "Content-Type"
+	SchemaTypeHeader    = "Schema-Type"
+	SchemaVersionHeader = "Schema-Version"
+)
+
+// PatternRoute routes logical addresses matching the Pattern (see path.Match) to the Address on the Medium.
+// Occurrences of {addr} in the Address are replaced by the logical address.
+type PatternRoute struct {
+	Pattern string
+	Medium  int
+	Address string
+}
+
+// PatternRouter resolves logical addresses by the first route matching them and by the fallback (e.g. IdentityRouter)
+// if there is none.
+func PatternRouter(fallback kareless.Router, routes ...PatternRoute) kareless.Router {
+	if fallback == nil {
+		panic(errors.Join(bricks.ErrInvalidArgument, errors.New("nil fallback router")))
+	}
+
+	for _, pr := range routes {
+		if _, err := path.Match(pr.Pattern, ""); err != nil {
+			panic(errors.Join(bricks.ErrInvalidArgument, fmt.Errorf("pattern `%s`: %w", pr.Pattern, err)))
+		}
+	}
+
+	return kareless.RouterFunc(func(addr string) kareless.Route {
+		for _, pr := range routes {
+			if ok, _ := path.Match(pr.Pattern, addr); ok {
+				return kareless.Route{
+					Medium:  pr.Medium,
+					Address: strings.ReplaceAll(pr.Address, "{addr}", addr),
+				}
+			}
+		}
+
+		return fallback.Resolve(addr)
+	})
+}
+
+// NatsCapsule encapsulates messages into nats messages published on the subject of the route address. Envelope
+// metadata and headers are carried in the message headers.
+type NatsCapsule struct{}
+
+func (nc NatsCapsule) Encapsulate(route kareless.Route, data []byte) *nats.Msg {
+	msg, _ := nc.EncapsulateEnvelope(route, kareless.Envelope{Payload: data})
+
+	return msg
+}
+
+func (NatsCapsule) EncapsulateEnvelope(route kareless.Route, env kareless.Envelope) (*nats.Msg, error) {
+	msg := nats.NewMsg(route.Address)
+	for k, v := range envelopeHeaders(env) {
+		msg.Header.Set(k, v)
+	}
+
+	msg.Data = env.Payload
+
+	return msg, nil
+}
+
+func (nc NatsCapsule) Decapsulate(msg *nats.Msg) ([]byte, error) {
+	env, err := nc.DecapsulateEnvelope(msg)
+
+	return env.Payload, err
+}
+
+func (NatsCapsule) DecapsulateEnvelope(msg *nats.Msg) (kareless.Envelope, error) {
+	return headersEnvelope(firstValues(msg.Header), msg.Data)
+}
+
+// HttpCapsule encapsulates messages into http requests. The route address is the url of the request preceded by its
+// method and a space (e.g. `PUT https://example.com/orders`). The method defaults to POST. Envelope metadata and
+// headers are carried in the request headers.
+//
+// Requests carry headers of their own (e.g. Authorization and Cookie), so only the listed Headers and the ones
+// starting with HeaderPrefix are taken into envelopes decapsulated from them, besides the ones of envelope metadata
+// and stages.
+//
+// EncapsulateEnvelope fails on malformed addresses by bricks.ErrInvalidArgument. Encapsulate, which can't fail,
+// panics on them as they're a matter of configuration (see PatternRouter).
+type HttpCapsule struct {
+	Headers      []string
+	HeaderPrefix string
+}
+
+func (hc HttpCapsule) Encapsulate(route kareless.Route, data []byte) *http.Request {
+	req, err := hc.EncapsulateEnvelope(route, kareless.Envelope{Payload: data})
+	if err != nil {
+		panic(err)
+	}
+
+	return req
+}
+
+func (HttpCapsule) EncapsulateEnvelope(route kareless.Route, env kareless.Envelope) (*http.Request, error) {
+	method, url := http.MethodPost, route.Address
+	if before, after, ok := strings.Cut(route.Address, " "); ok {
+		method, url = before, after
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(env.Payload))
+	if err != nil {
+		return nil, errors.Join(bricks.ErrInvalidArgument, fmt.Errorf("route `%s`: %w", route.Address, err))
+	}
+
+	for k, v := range envelopeHeaders(env) {
+		req.Header.Set(k, v)
+	}
+
+	return req, nil
+}
+
+func (hc HttpCapsule) Decapsulate(req *http.Request) ([]byte, error) {
+	env, err := hc.DecapsulateEnvelope(req)
+
+	return env.Payload, err
+}
+
+// DecapsulateEnvelope reads the request body and replaces it by a copy, so it can be read again
+func (hc HttpCapsule) DecapsulateEnvelope(req *http.Request) (kareless.Envelope, error) {
+	var data []byte
+	if req.Body != nil {
+		var err error
+		if data, err = io.ReadAll(req.Body); err != nil {
+			return kareless.Envelope{}, errors.Join(bricks.ErrInvalidArgument, err)
+		}
+
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(data))
+	}
+
+	headers := firstValues(req.Header)
+	for k := range headers {
+		if !hc.keeps(k) {
+			delete(headers, k)
+		}
+	}
+
+	return headersEnvelope(headers, data)
+}
+
+// keeps tells whether the request header is taken into envelopes
+func (hc HttpCapsule) keeps(key string) bool {
+	switch key {
+	case ContentTypeHeader, SchemaTypeHeader, SchemaVersionHeader,
+		ContentEncodingHeader, EncryptionHeader, EncryptionKeyIdHeader, EncryptionAadHeader:
+		return true
+	}
+
+	if len(hc.HeaderPrefix) > 0 && strings.HasPrefix(key, http.CanonicalHeaderKey(hc.HeaderPrefix)) {
+		return true
+	}
+
+	for _, h := range hc.Headers {
+		if http.CanonicalHeaderKey(h) == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AsynqCapsule encapsulates messages into asynq tasks. The route address is the task type followed by @ and the
+// queue to enqueue it in (e.g. `email:send@critical`), if it's not the default queue. Asynq tasks have no headers, so
+// envelopes are carried in-band (see kareless.EnvelopeBytes).
+type AsynqCapsule struct{}
+
+func (ac AsynqCapsule) Encapsulate(route kareless.Route, data []byte) *asynq.Task {
+	task, _ := ac.EncapsulateEnvelope(route, kareless.Envelope{Payload: data})
+
+	return task
+}
+
+func (AsynqCapsule) EncapsulateEnvelope(route kareless.Route, env kareless.Envelope) (*asynq.Task, error) {
+	typ, queue, ok := strings.Cut(route.Address, "@")
+	if !ok {
+		return asynq.NewTask(typ, kareless.EnvelopeBytes(env)), nil
+	}
+
+	return asynq.NewTask(typ, kareless.EnvelopeBytes(env), asynq.Queue(queue)), nil
+}
+
+func (ac AsynqCapsule) Decapsulate(task *asynq.Task) ([]byte, error) {
+	env, err := ac.DecapsulateEnvelope(task)
+
+	return env.Payload, err
+}
+
+func (AsynqCapsule) DecapsulateEnvelope(task *asynq.Task) (kareless.Envelope, error) {
+	return kareless.ParseEnvelope(task.Payload())
+}
+
+// envelopeHeaders returns the envelope headers along with its metadata
+func envelopeHeaders(env kareless.Envelope) map[string]string {
+	headers := make(map[string]string, len(env.Headers)+3)
+	for k, v := range env.Headers {
+		headers[k] = v
+	}
+
+	if len(env.ContentType) > 0 {
+		headers[ContentTypeHeader] = env.ContentType
+	}
+
+	if len(env.Type) > 0 {
+		headers[SchemaTypeHeader] = env.Type
+		headers[SchemaVersionHeader] = strconv.Itoa(env.Version)
+	}
+
+	return headers
+}
+
+// headersEnvelope is the counterpart of envelopeHeaders
+func headersEnvelope(headers map[string]string, payload []byte) (kareless.Envelope, error) {
+	env := kareless.Envelope{
+		Schema:      kareless.Schema{Type: headers[SchemaTypeHeader]},
+		ContentType: headers[ContentTypeHeader],
+		Payload:     payload,
+	}
+
+	if version, ok := headers[SchemaVersionHeader]; ok {
+		var err error
+		if env.Version, err = strconv.Atoi(version); err != nil {
+			return kareless.Envelope{}, errors.Join(bricks.ErrInvalidArgument, fmt.Errorf("schema version: %w", err))
+		}
+	}
+
+	delete(headers, ContentTypeHeader)
+	delete(headers, SchemaTypeHeader)
+	delete(headers, SchemaVersionHeader)
+	if len(headers) > 0 {
+		env.Headers = headers
+	}
+
+	return env, nil
+}
+
+func firstValues(header map[string][]string) map[string]string {
+	headers := make(map[string]string, len(header))
+	for k, vv := range header {
+		if len(vv) > 0 {
+			headers[k] = vv[0]
+		}
+	}
+
+	return headers
+}
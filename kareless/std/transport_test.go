@@ -0,0 +1,186 @@
+package std_test
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/janstoon/toolbox/kareless"
+	"github.com/janstoon/toolbox/kareless/std"
+)
+
+func newTransportMuldem[M any](t *testing.T, capsule interface {
+	kareless.Encapsulator[M]
+	kareless.Decapsulator[M]
+}, routes ...std.PatternRoute,
+) kareless.Muldem[M] {
+	t.Helper()
+
+	reg := kareless.NewSchemaRegistry()
+	require.NoError(t, kareless.RegisterSchema[wireOrder](reg, "order.created", 2))
+
+	return std.NewMuldem[M]().
+		WithRouter(std.PatternRouter(std.IdentityRouter(0), routes...)).
+		WithCodecs(std.NewCodecs()).
+		WithSchemas(reg).
+		WithStages(std.GzipStage(gzip.DefaultCompression)).
+		WithEncapsulation(capsule, capsule)
+}
+
+func TestPatternRouter(t *testing.T) {
+	router := std.PatternRouter(std.IdentityRouter(0),
+		std.PatternRoute{Pattern: "orders.*", Medium: 1, Address: "app.{addr}"},
+		std.PatternRoute{Pattern: "*", Medium: 2, Address: "{addr}@low"},
+	)
+
+	assert.Equal(t, kareless.Route{Medium: 1, Address: "app.orders.created"}, router.Resolve("orders.created"))
+	assert.Equal(t, kareless.Route{Medium: 2, Address: "email@low"}, router.Resolve("email"))
+	assert.Equal(t, kareless.Route{Medium: 0, Address: "a/b"}, router.Resolve("a/b"))
+
+	require.Panics(t, func() {
+		std.PatternRouter(std.IdentityRouter(0), std.PatternRoute{Pattern: "["})
+	})
+}
+
+func TestNatsCapsule(t *testing.T) {
+	order := wireOrder{Id: 1, Title: "book"}
+	mx := newTransportMuldem[*nats.Msg](t, std.NatsCapsule{},
+		std.PatternRoute{Pattern: "orders", Address: "app.{addr}"})
+
+	msg, err := mx.Encapsulate("orders", order)
+	require.NoError(t, err)
+	assert.Equal(t, "app.orders", msg.Subject)
+	assert.Equal(t, std.JsonContentType, msg.Header.Get(std.ContentTypeHeader))
+	assert.Equal(t, "order.created", msg.Header.Get(std.SchemaTypeHeader))
+	assert.Equal(t, "2", msg.Header.Get(std.SchemaVersionHeader))
+	assert.Equal(t, "gzip", msg.Header.Get(std.ContentEncodingHeader))
+
+	var decoded wireOrder
+	require.NoError(t, mx.Decapsulate(msg, &decoded))
+	assert.Equal(t, order, decoded)
+
+	msg.Header.Set(std.SchemaVersionHeader, "two")
+	require.ErrorIs(t, mx.Decapsulate(msg, &decoded), bricks.ErrInvalidArgument)
+}
+
+func TestHttpCapsule(t *testing.T) {
+	order := wireOrder{Id: 1, Title: "book"}
+
+	var (
+		received = make(chan wireOrder, 1)
+		consumer kareless.Muldem[*http.Request]
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		var decoded wireOrder
+		if err := consumer.Decapsulate(r, &decoded); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		received <- decoded
+	}))
+	t.Cleanup(srv.Close)
+
+	mx := newTransportMuldem[*http.Request](t, std.HttpCapsule{},
+		std.PatternRoute{Pattern: "orders", Address: "PUT " + srv.URL + "/{addr}"},
+		std.PatternRoute{Pattern: "*", Address: srv.URL + "/{addr}"},
+	)
+	consumer = mx
+
+	req, err := mx.Encapsulate("orders", order)
+	require.NoError(t, err)
+	assert.Equal(t, "/orders", req.URL.Path)
+	assert.Equal(t, std.JsonContentType, req.Header.Get(std.ContentTypeHeader))
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, order, <-received)
+
+	req, err = mx.Encapsulate("invoices", order)
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodPost, req.Method)
+
+	// The body is left readable for the handler
+	var decoded wireOrder
+	require.NoError(t, mx.Decapsulate(req, &decoded))
+	bb, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.NotEmpty(t, bb)
+
+	_, err = std.HttpCapsule{}.EncapsulateEnvelope(kareless.Route{Address: "GET \x7f"}, kareless.Envelope{})
+	require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+	require.Panics(t, func() {
+		std.HttpCapsule{}.Encapsulate(kareless.Route{Address: "GET \x7f"}, nil)
+	})
+}
+
+func TestHttpCapsuleHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{}`))
+	req.Header.Set(std.ContentTypeHeader, std.JsonContentType)
+	req.Header.Set(std.ContentEncodingHeader, "gzip")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Request-ID", "r1")
+	req.Header.Set("X-Meta-Tenant", "t1")
+
+	env, err := std.HttpCapsule{}.DecapsulateEnvelope(req)
+	require.NoError(t, err)
+	assert.Equal(t, std.JsonContentType, env.ContentType)
+	assert.Equal(t, map[string]string{std.ContentEncodingHeader: "gzip"}, env.Headers)
+
+	env, err = std.HttpCapsule{Headers: []string{"x-request-id"}, HeaderPrefix: "x-meta-"}.DecapsulateEnvelope(req)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		std.ContentEncodingHeader: "gzip",
+		"X-Request-Id":            "r1",
+		"X-Meta-Tenant":           "t1",
+	}, env.Headers)
+}
+
+func TestAsynqCapsule(t *testing.T) {
+	order := wireOrder{Id: 1, Title: "book"}
+	mx := newTransportMuldem[*asynq.Task](t, std.AsynqCapsule{},
+		std.PatternRoute{Pattern: "orders", Address: "order:created@critical"})
+
+	task, err := mx.Encapsulate("orders", order)
+	require.NoError(t, err)
+	assert.Equal(t, "order:created", task.Type())
+
+	env, err := kareless.ParseEnvelope(task.Payload())
+	require.NoError(t, err)
+	assert.Equal(t, kareless.Schema{Type: "order.created", Version: 2}, env.Schema)
+
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	info, err := client.Enqueue(task)
+	require.NoError(t, err)
+	assert.Equal(t, "critical", info.Queue)
+
+	var decoded wireOrder
+	require.NoError(t, mx.Decapsulate(asynq.NewTask(info.Type, info.Payload), &decoded))
+	assert.Equal(t, order, decoded)
+
+	task, err = mx.Encapsulate("invoices", order)
+	require.NoError(t, err)
+	assert.Equal(t, "invoices", task.Type())
+}
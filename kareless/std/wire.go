@@ -3,8 +3,11 @@ package std
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/janstoon/toolbox/bricks"
+	"github.com/vmihailenco/msgpack/v5"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/janstoon/toolbox/kareless"
@@ -19,23 +22,43 @@ func IdentityRouter(medium int) kareless.Router {
 	})
 }
 
-var JsonMarshaler = kareless.MarshalerFunc(func(payload any) []byte {
-	bb, _ := json.Marshal(payload)
+// Content types of the codecs of NewCodecs
+const (
+	JsonContentType     = "application/json"
+	ProtobufContentType = "application/x-protobuf"
+	MsgpackContentType  = "application/msgpack"
+	CborContentType     = "application/cbor"
+)
+
+var JsonMarshaler = kareless.MarshalerFunc(func(payload any) ([]byte, error) {
+	bb, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Join(bricks.ErrInvalidArgument, err)
+	}
 
-	return bb
+	return bb, nil
 })
 
-var JsonUnmarshaler = kareless.UnmarshalerFunc(json.Unmarshal)
+var JsonUnmarshaler = kareless.UnmarshalerFunc(func(bb []byte, v any) error {
+	if err := json.Unmarshal(bb, v); err != nil {
+		return errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	return nil
+})
 
-var ProtobufMarshaler = kareless.MarshalerFunc(func(payload any) []byte {
+var ProtobufMarshaler = kareless.MarshalerFunc(func(payload any) ([]byte, error) {
 	msg, ok := payload.(proto.Message)
 	if !ok {
-		return nil
+		return nil, errors.Join(bricks.ErrInvalidArgument, fmt.Errorf("payload is not proto.Message: %T", payload))
 	}
 
-	bb, _ := proto.Marshal(msg)
+	bb, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, errors.Join(bricks.ErrInvalidArgument, err)
+	}
 
-	return bb
+	return bb, nil
 })
 
 var ProtobufUnmarshaler = kareless.UnmarshalerFunc(func(bb []byte, v any) error {
@@ -44,9 +67,64 @@ var ProtobufUnmarshaler = kareless.UnmarshalerFunc(func(bb []byte, v any) error
 		return errors.Join(bricks.ErrInvalidArgument, errors.New("variable is not proto.Message"))
 	}
 
-	return proto.Unmarshal(bb, msg)
+	if err := proto.Unmarshal(bb, msg); err != nil {
+		return errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	return nil
 })
 
+var MsgpackMarshaler = kareless.MarshalerFunc(func(payload any) ([]byte, error) {
+	bb, err := msgpack.Marshal(payload)
+	if err != nil {
+		return nil, errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	return bb, nil
+})
+
+var MsgpackUnmarshaler = kareless.UnmarshalerFunc(func(bb []byte, v any) error {
+	if err := msgpack.Unmarshal(bb, v); err != nil {
+		return errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	return nil
+})
+
+var CborMarshaler = kareless.MarshalerFunc(func(payload any) ([]byte, error) {
+	bb, err := cbor.Marshal(payload)
+	if err != nil {
+		return nil, errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	return bb, nil
+})
+
+var CborUnmarshaler = kareless.UnmarshalerFunc(func(bb []byte, v any) error {
+	if err := cbor.Unmarshal(bb, v); err != nil {
+		return errors.Join(bricks.ErrInvalidArgument, err)
+	}
+
+	return nil
+})
+
+// NewCodecs creates kareless.Codecs of json, protobuf, msgpack and cbor by their content types
+func NewCodecs() *kareless.Codecs {
+	cc := kareless.NewCodecs()
+	for ct, codec := range map[string]kareless.Codec{
+		JsonContentType:         {Marshaler: JsonMarshaler, Unmarshaler: JsonUnmarshaler},
+		ProtobufContentType:     {Marshaler: ProtobufMarshaler, Unmarshaler: ProtobufUnmarshaler},
+		"application/protobuf":  {Marshaler: ProtobufMarshaler, Unmarshaler: ProtobufUnmarshaler},
+		MsgpackContentType:      {Marshaler: MsgpackMarshaler, Unmarshaler: MsgpackUnmarshaler},
+		"application/x-msgpack": {Marshaler: MsgpackMarshaler, Unmarshaler: MsgpackUnmarshaler},
+		CborContentType:         {Marshaler: CborMarshaler, Unmarshaler: CborUnmarshaler},
+	} {
+		_ = cc.Register(ct, codec)
+	}
+
+	return cc
+}
+
 func NoopEncapsulator[M any]() kareless.Encapsulator[M] {
 	return kareless.EncapsulatorFunc[M](func(route kareless.Route, data []byte) (m M) {
 		return m
@@ -67,6 +145,7 @@ func NewMuldem[M any]() kareless.Muldem[M] {
 
 		Marshaler:   JsonMarshaler,
 		Unmarshaler: JsonUnmarshaler,
+		ContentType: JsonContentType,
 
 		Encapsulator: NoopEncapsulator[M](),
 		Decapsulator: NoopDecapsulator[M](),
@@ -0,0 +1,73 @@
+package std_test
+
+import (
+	"testing"
+
+	"github.com/janstoon/toolbox/bricks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/janstoon/toolbox/kareless"
+	"github.com/janstoon/toolbox/kareless/std"
+)
+
+type wireOrder struct {
+	Id    int    `json:"id" msgpack:"id" cbor:"id"`
+	Title string `json:"title" msgpack:"title" cbor:"title"`
+}
+
+func newBytesMuldem(contentType string) kareless.Muldem[[]byte] {
+	return std.NewMuldem[[]byte]().
+		WithCodecs(std.NewCodecs()).
+		WithContentType(contentType).
+		WithEncapsulation(
+			kareless.EncapsulatorFunc[[]byte](func(route kareless.Route, data []byte) []byte {
+				return data
+			}),
+			kareless.DecapsulatorFunc[[]byte](func(msg []byte) ([]byte, error) {
+				return msg, nil
+			}),
+		)
+}
+
+func TestMuldemCodecs(t *testing.T) {
+	order := wireOrder{Id: 1, Title: "book"}
+	consumer := newBytesMuldem(std.JsonContentType)
+
+	for _, ct := range []string{std.JsonContentType, std.MsgpackContentType, std.CborContentType} {
+		t.Run(ct, func(t *testing.T) {
+			msg, err := newBytesMuldem(ct).Encapsulate("orders", order)
+			require.NoError(t, err)
+
+			env, err := kareless.ParseEnvelope(msg)
+			require.NoError(t, err)
+			assert.Equal(t, ct, env.ContentType)
+
+			// The consumer picks the codec by content type of the envelope, not its own
+			var decoded wireOrder
+			require.NoError(t, consumer.Decapsulate(msg, &decoded))
+			assert.Equal(t, order, decoded)
+		})
+	}
+
+	t.Run(std.ProtobufContentType, func(t *testing.T) {
+		producer := newBytesMuldem(std.ProtobufContentType + "; proto=google.protobuf.StringValue")
+		msg, err := producer.Encapsulate("orders", wrapperspb.String("book"))
+		require.NoError(t, err)
+
+		decoded := &wrapperspb.StringValue{}
+		require.NoError(t, consumer.Decapsulate(msg, decoded))
+		assert.True(t, proto.Equal(wrapperspb.String("book"), decoded))
+
+		_, err = producer.Encapsulate("orders", order)
+		require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+	})
+
+	_, err := newBytesMuldem("application/xml").Encapsulate("orders", order)
+	require.ErrorIs(t, err, bricks.ErrUnimplemented)
+
+	_, err = std.NewMuldem[[]byte]().Encapsulate("orders", func() {})
+	require.ErrorIs(t, err, bricks.ErrInvalidArgument)
+}
@@ -1,5 +1,13 @@
 package kareless
 
+import (
+	"errors"
+	"fmt"
+	"mime"
+
+	"github.com/janstoon/toolbox/bricks"
+)
+
 type Route struct {
 	Medium  int
 	Address string // Medium-specific address
@@ -16,12 +24,12 @@ func (f RouterFunc) Resolve(addr string) Route {
 }
 
 type Marshaler interface {
-	Marshal(payload any) []byte
+	Marshal(payload any) ([]byte, error)
 }
 
-type MarshalerFunc func(payload any) []byte
+type MarshalerFunc func(payload any) ([]byte, error)
 
-func (f MarshalerFunc) Marshal(payload any) []byte {
+func (f MarshalerFunc) Marshal(payload any) ([]byte, error) {
 	return f(payload)
 }
 
@@ -45,6 +53,12 @@ func (f EncapsulatorFunc[M]) Encapsulate(route Route, data []byte) M {
 	return f(route, data)
 }
 
+// EnvelopeEncapsulator is implemented by Encapsulators which carry the envelope metadata natively (e.g. in headers)
+// rather than in-band. Muldem prefers it over Encapsulate. It fails if the route isn't valid for the transport.
+type EnvelopeEncapsulator[M any] interface {
+	EncapsulateEnvelope(route Route, env Envelope) (M, error)
+}
+
 type Decapsulator[M any] interface {
 	Decapsulate(msg M) ([]byte, error)
 }
@@ -55,16 +69,35 @@ func (f DecapsulatorFunc[M]) Decapsulate(msg M) ([]byte, error) {
 	return f(msg)
 }
 
+// EnvelopeDecapsulator is the counterpart of EnvelopeEncapsulator. Muldem prefers it over Decapsulate.
+type EnvelopeDecapsulator[M any] interface {
+	DecapsulateEnvelope(msg M) (Envelope, error)
+}
+
 // Muldem is a bidirectional multiplexer and demultiplexer which is able to:
 //  1. Marshal message using the Marshaler and encapsulate it for a specific address
 //     using the Encapsulator and Router to be put on the wire.
 //  2. Decapsulate message picked from the wire from a specific address
 //     using the Decapsulator and unmarshal it using the Unmarshaler.
+//
+// Once Codecs is set, it's used instead of the Marshaler and Unmarshaler: messages are marshaled by the codec of
+// ContentType and unmarshaled by the codec of the content type carried in their envelope.
+//
+// Payloads are carried in Envelopes. Once Schemas is set, envelopes are typed and versioned by it and old versions are
+// upcast on the way in. Stages (e.g. compression and encryption) are applied in order after marshaling and in reverse
+// order before unmarshaling. Once Schemas, Codecs or Stages is set, envelopes are carried in-band (see EnvelopeBytes)
+// by Encapsulators which aren't EnvelopeEncapsulator, and data which isn't framed as an envelope is still taken as the
+// bare payload.
 type Muldem[M any] struct {
 	Router Router
 
 	Marshaler   Marshaler
 	Unmarshaler Unmarshaler
+	ContentType string
+	Codecs      *Codecs
+
+	Schemas *SchemaRegistry
+	Stages  []Stage
 
 	Encapsulator Encapsulator[M]
 	Decapsulator Decapsulator[M]
@@ -83,6 +116,30 @@ func (mx Muldem[M]) WithEncoding(m Marshaler, um Unmarshaler) Muldem[M] {
 	return mx
 }
 
+func (mx Muldem[M]) WithContentType(ct string) Muldem[M] {
+	mx.ContentType = ct
+
+	return mx
+}
+
+func (mx Muldem[M]) WithCodecs(cc *Codecs) Muldem[M] {
+	mx.Codecs = cc
+
+	return mx
+}
+
+func (mx Muldem[M]) WithSchemas(reg *SchemaRegistry) Muldem[M] {
+	mx.Schemas = reg
+
+	return mx
+}
+
+func (mx Muldem[M]) WithStages(ss ...Stage) Muldem[M] {
+	mx.Stages = ss
+
+	return mx
+}
+
 func (mx Muldem[M]) WithEncapsulation(e Encapsulator[M], de Decapsulator[M]) Muldem[M] {
 	mx.Encapsulator = e
 	mx.Decapsulator = de
@@ -92,6 +149,206 @@ func (mx Muldem[M]) WithEncapsulation(e Encapsulator[M], de Decapsulator[M]) Mul
 
 // Encapsulate marshals the payload and binds it to a specific address using Router
 // and outputs the Message(M) ready to be put on the wire.
-func (mx Muldem[M]) Encapsulate(addr string, payload any) M {
-	return mx.Encapsulator.Encapsulate(mx.Router.Resolve(addr), mx.Marshaler.Marshal(payload))
+func (mx Muldem[M]) Encapsulate(addr string, payload any) (M, error) {
+	env, err := mx.Envelop(payload)
+	if err != nil {
+		var m M
+
+		return m, err
+	}
+
+	return mx.Seal(mx.Router.Resolve(addr), env)
+}
+
+// Envelop marshals the payload into an envelope of its schema, if Schemas is set, and packs it by the Stages
+func (mx Muldem[M]) Envelop(payload any) (Envelope, error) {
+	env := Envelope{
+		ContentType: mx.ContentType,
+	}
+
+	if mx.Schemas != nil {
+		var err error
+		if env.Schema, err = mx.Schemas.SchemaOf(payload); err != nil {
+			return Envelope{}, err
+		}
+	}
+
+	marshaler := mx.Marshaler
+	if mx.Codecs != nil {
+		codec, err := mx.Codecs.Lookup(env.ContentType)
+		if err != nil {
+			return Envelope{}, err
+		}
+
+		marshaler = codec
+	}
+
+	var err error
+	if env.Payload, err = marshaler.Marshal(payload); err != nil {
+		return Envelope{}, err
+	}
+
+	for _, stage := range mx.Stages {
+		if env, err = stage.Pack(env); err != nil {
+			return Envelope{}, err
+		}
+	}
+
+	return env, nil
+}
+
+// Seal outputs the Message(M) carrying the envelope on the route
+func (mx Muldem[M]) Seal(route Route, env Envelope) (M, error) {
+	if ee, ok := mx.Encapsulator.(EnvelopeEncapsulator[M]); ok {
+		return ee.EncapsulateEnvelope(route, env)
+	}
+
+	return mx.Encapsulator.Encapsulate(route, mx.Frame(env)), nil
+}
+
+// Frame returns the data carrying the envelope by Encapsulators which aren't EnvelopeEncapsulator, i.e. the bare
+// payload unless Schemas, Codecs or Stages is set.
+func (mx Muldem[M]) Frame(env Envelope) []byte {
+	if !mx.enveloped() {
+		return env.Payload
+	}
+
+	return EnvelopeBytes(env)
+}
+
+// Unframe is the counterpart of Frame
+func (mx Muldem[M]) Unframe(data []byte) (Envelope, error) {
+	if !mx.enveloped() {
+		return Envelope{ContentType: mx.ContentType, Payload: data}, nil
+	}
+
+	return ParseEnvelope(data)
+}
+
+// enveloped tells whether metadata of envelopes matters, so they should be carried as a whole
+func (mx Muldem[M]) enveloped() bool {
+	return mx.Schemas != nil || mx.Codecs != nil || len(mx.Stages) > 0
+}
+
+// Open extracts the envelope of the Message(M) picked from the wire, unpacks it by the Stages and upcasts it to the
+// current version of its type
+func (mx Muldem[M]) Open(msg M) (Envelope, error) {
+	var (
+		env Envelope
+		err error
+	)
+	if ed, ok := mx.Decapsulator.(EnvelopeDecapsulator[M]); ok {
+		env, err = ed.DecapsulateEnvelope(msg)
+	} else {
+		var data []byte
+		if data, err = mx.Decapsulator.Decapsulate(msg); err == nil {
+			env, err = mx.Unframe(data)
+		}
+	}
+
+	for k := len(mx.Stages) - 1; k >= 0 && err == nil; k-- {
+		env, err = mx.Stages[k].Unpack(env)
+	}
+
+	if err != nil || mx.Schemas == nil {
+		return env, err
+	}
+
+	return mx.Schemas.Upcast(env)
+}
+
+// Decapsulate opens the Message(M) picked from the wire and unmarshals its payload into v. Messages of other types
+// than the one v is registered as in Schemas, or of versions not upcast to the current one, are rejected. Untyped
+// messages (e.g. of producers not aware of schemas) are unmarshaled as they are.
+func (mx Muldem[M]) Decapsulate(msg M, v any) error {
+	env, err := mx.Open(msg)
+	if err != nil {
+		return err
+	}
+
+	if mx.Schemas != nil && len(env.Type) > 0 {
+		if schema, err := mx.Schemas.SchemaOf(v); err == nil && schema != env.Schema {
+			return errors.Join(bricks.ErrFailedPrecondition, fmt.Errorf("%s can't be decoded as %s", env.Schema, schema))
+		}
+	}
+
+	unmarshaler := mx.Unmarshaler
+	if mx.Codecs != nil {
+		ct := env.ContentType
+		if len(ct) == 0 {
+			ct = mx.ContentType
+		}
+
+		codec, err := mx.Codecs.Lookup(ct)
+		if err != nil {
+			return err
+		}
+
+		unmarshaler = codec
+	}
+
+	return unmarshaler.Unmarshal(env.Payload, v)
+}
+
+// Stage transforms payload of envelopes between marshaling and encapsulation, e.g. compresses or encrypts it. Pack is
+// applied on the way out and records what it does in headers of the envelope, so Unpack can undo it on the way in.
+type Stage interface {
+	Pack(env Envelope) (Envelope, error)
+	Unpack(env Envelope) (Envelope, error)
+}
+
+// Codec marshals and unmarshals payloads of a content type
+type Codec struct {
+	Marshaler
+	Unmarshaler
+}
+
+// Codecs is a registry of codecs by content type. Content types are matched by their media type, regardless of
+// their parameters (e.g. charset).
+type Codecs struct {
+	reg *bricks.Registry[Codec]
+}
+
+func NewCodecs() *Codecs {
+	return &Codecs{
+		reg: bricks.NewRegistry[Codec](),
+	}
+}
+
+// Register registers the codec for the content type
+func (cc *Codecs) Register(contentType string, codec Codec) error {
+	if codec.Marshaler == nil || codec.Unmarshaler == nil {
+		return errors.Join(bricks.ErrInvalidArgument, errors.New("incomplete codec"))
+	}
+
+	mt, err := mediaType(contentType)
+	if err != nil {
+		return err
+	}
+
+	return cc.reg.Register(mt, codec)
+}
+
+// Lookup returns the codec of the content type. It fails by bricks.ErrUnimplemented if there is none.
+func (cc *Codecs) Lookup(contentType string) (Codec, error) {
+	mt, err := mediaType(contentType)
+	if err != nil {
+		return Codec{}, err
+	}
+
+	codec, err := cc.reg.Get(mt)
+	if err != nil {
+		return Codec{}, errors.Join(bricks.ErrUnimplemented, fmt.Errorf("no codec for content type `%s`", contentType))
+	}
+
+	return codec, nil
+}
+
+func mediaType(contentType string) (string, error) {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", errors.Join(bricks.ErrInvalidArgument, fmt.Errorf("content type `%s`: %w", contentType, err))
+	}
+
+	return mt, nil
 }